@@ -0,0 +1,351 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package backtest
+
+import (
+	"fmt"
+	"gitlab.com/crankykernel/maker/go/binanceex"
+	"gitlab.com/crankykernel/maker/go/exchange"
+	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/tradeservice"
+	"gitlab.com/crankykernel/maker/go/types"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type EntryRuleType string
+
+const (
+	// Enter once, on the first trade of the replay.
+	EntryRuleOnce EntryRuleType = "once"
+
+	// Enter every interval while no trade is open.
+	EntryRuleInterval EntryRuleType = "interval"
+
+	// Enter when the price drops a percentage below the high seen since
+	// the start or the last exit.
+	EntryRuleDip EntryRuleType = "dip"
+)
+
+type EntryRule struct {
+	Type     EntryRuleType
+	Interval time.Duration
+	Percent  float64
+}
+
+// ParseEntryRule parses an entry rule in the form "once", "interval:<duration>"
+// or "dip:<percent>".
+func ParseEntryRule(rule string) (EntryRule, error) {
+	parts := strings.SplitN(rule, ":", 2)
+	entryRule := EntryRule{Type: EntryRuleType(parts[0])}
+	switch entryRule.Type {
+	case EntryRuleOnce:
+		return entryRule, nil
+	case EntryRuleInterval:
+		if len(parts) != 2 {
+			return entryRule, fmt.Errorf("interval entry rule requires a duration")
+		}
+		interval, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return entryRule, fmt.Errorf("invalid interval: %v", err)
+		}
+		entryRule.Interval = interval
+		return entryRule, nil
+	case EntryRuleDip:
+		if len(parts) != 2 {
+			return entryRule, fmt.Errorf("dip entry rule requires a percent")
+		}
+		percent, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || percent <= 0 {
+			return entryRule, fmt.Errorf("invalid dip percent: %s", parts[1])
+		}
+		entryRule.Percent = percent
+		return entryRule, nil
+	}
+	return entryRule, fmt.Errorf("unknown entry rule: %s", rule)
+}
+
+type Options struct {
+	Symbol string
+	Entry  EntryRule
+
+	// The amount of the quote asset to spend on each entry.
+	QuoteAmount float64
+
+	StopLossEnabled bool
+	StopLossPercent float64
+
+	TrailingProfitEnabled   bool
+	TrailingProfitPercent   float64
+	TrailingProfitDeviation float64
+
+	LimitSellEnabled bool
+	LimitSellPercent float64
+}
+
+type TradeResult struct {
+	TradeID       string
+	Status        types.TradeStatus
+	OpenTime      time.Time
+	CloseTime     *time.Time
+	BuyPrice      float64
+	SellPrice     float64
+	Quantity      float64
+	Profit        float64
+	ProfitPercent float64
+	ExitReason    string
+}
+
+type Result struct {
+	Trades         []TradeResult
+	TotalProfit    float64
+	Wins           int
+	Losses         int
+	AveragePercent float64
+}
+
+type openRecord struct {
+	trade     *types.Trade
+	openTime  time.Time
+	closeTime *time.Time
+}
+
+type runner struct {
+	options      Options
+	symbolInfo   exchange.SymbolInfo
+	market       *replayMarket
+	paper        *exchange.PaperExchange
+	tradeService *tradeservice.TradeService
+	records      []*openRecord
+
+	lastEntryTime time.Time
+	highPrice     float64
+}
+
+// Run replays the trades through a trade service backed by a paper exchange,
+// so the same stop loss, trailing profit and limit sell logic used live is
+// exercised. The database must already be open, and should be a scratch
+// database as trades are written to it.
+func Run(options Options, symbolInfo exchange.SymbolInfo, trades []binanceex.AggTrade) (*Result, error) {
+	if len(trades) == 0 {
+		return nil, fmt.Errorf("no trades to replay")
+	}
+	if options.QuoteAmount <= 0 {
+		return nil, fmt.Errorf("quote amount must be greater than 0")
+	}
+
+	r := &runner{
+		options:    options,
+		symbolInfo: symbolInfo,
+		market:     newReplayMarket(symbolInfo),
+	}
+	r.paper = exchange.NewSteppedPaperExchange(r.market)
+	r.tradeService = tradeservice.NewTradeService(r.paper)
+
+	for i := range trades {
+		trade := &trades[i]
+		streamTrade := &exchange.MarketTrade{
+			Symbol:     trade.Symbol,
+			TradeID:    trade.ID,
+			Price:      trade.Price,
+			Quantity:   trade.Quantity,
+			Time:       trade.Time,
+			BuyerMaker: trade.BuyerMaker,
+		}
+		r.market.setPrice(trade.Price)
+
+		r.paper.OnTrade(streamTrade)
+		r.drain()
+
+		if r.shouldEnter(trade) {
+			r.enter(trade)
+			r.drain()
+		}
+
+		r.tradeService.OnLastTrade(streamTrade)
+		r.drain()
+
+		r.updateCloseTimes(trade.Time)
+	}
+
+	return r.result(trades[len(trades)-1].Price), nil
+}
+
+// Deliver any pending execution reports to the trade service. Handling a
+// report may place new orders, so repeat until nothing is left.
+func (r *runner) drain() {
+	for {
+		events := r.paper.PendingEvents()
+		if len(events) == 0 {
+			return
+		}
+		for _, event := range events {
+			r.tradeService.OnExecutionReport(event)
+		}
+	}
+}
+
+func (r *runner) hasOpenTrade() bool {
+	for _, record := range r.records {
+		if !record.trade.IsDone() {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *runner) shouldEnter(trade *binanceex.AggTrade) bool {
+	if trade.Price > r.highPrice {
+		r.highPrice = trade.Price
+	}
+	if r.hasOpenTrade() {
+		return false
+	}
+	switch r.options.Entry.Type {
+	case EntryRuleOnce:
+		return len(r.records) == 0
+	case EntryRuleInterval:
+		return r.lastEntryTime.IsZero() ||
+			trade.Time.Sub(r.lastEntryTime) >= r.options.Entry.Interval
+	case EntryRuleDip:
+		dip := (r.highPrice - trade.Price) / r.highPrice * 100
+		return dip >= r.options.Entry.Percent
+	}
+	return false
+}
+
+func (r *runner) enter(aggTrade *binanceex.AggTrade) {
+	price := aggTrade.Price
+	quantity := r.tradeService.FixQuantityToStepSize(
+		r.options.QuoteAmount/price, r.symbolInfo.StepSize)
+	if quantity*price < r.symbolInfo.MinNotional || quantity <= 0 {
+		log.WithFields(log.Fields{
+			"symbol":      r.options.Symbol,
+			"price":       price,
+			"quantity":    quantity,
+			"minNotional": r.symbolInfo.MinNotional,
+		}).Warnf("Backtest: quote amount too small for an entry")
+		return
+	}
+
+	clientOrderId, err := r.tradeService.MakeOrderID()
+	if err != nil {
+		log.WithError(err).Errorf("Backtest: failed to create order ID")
+		return
+	}
+
+	trade := types.NewTrade()
+	trade.State.Symbol = r.options.Symbol
+	trade.AddClientOrderID(clientOrderId)
+	if r.options.StopLossEnabled {
+		trade.SetStopLoss(true, r.options.StopLossPercent)
+	}
+	if r.options.TrailingProfitEnabled {
+		trade.SetTrailingProfit(true, r.options.TrailingProfitPercent,
+			r.options.TrailingProfitDeviation)
+	}
+	if r.options.LimitSellEnabled {
+		trade.SetLimitSellByPercent(r.options.LimitSellPercent)
+	}
+	r.tradeService.AddNewTrade(trade)
+
+	r.records = append(r.records, &openRecord{
+		trade:    trade,
+		openTime: aggTrade.Time,
+	})
+	r.lastEntryTime = aggTrade.Time
+
+	_, err = r.paper.PostOrder(exchange.OrderParameters{
+		Symbol:        r.options.Symbol,
+		Side:          exchange.OrderSideBuy,
+		Type:          exchange.OrderTypeLimit,
+		TimeInForce:   exchange.TimeInForceGTC,
+		Quantity:      quantity,
+		Price:         price,
+		ClientOrderID: clientOrderId,
+	})
+	if err != nil {
+		log.WithError(err).Errorf("Backtest: failed to post buy order")
+		r.tradeService.FailTrade(trade)
+	}
+}
+
+func (r *runner) updateCloseTimes(now time.Time) {
+	for _, record := range r.records {
+		if record.closeTime == nil && record.trade.IsDone() {
+			closeTime := now
+			record.closeTime = &closeTime
+			r.highPrice = 0
+		}
+	}
+}
+
+func (r *runner) result(lastPrice float64) *Result {
+	result := &Result{}
+	totalPercent := float64(0)
+	for _, record := range r.records {
+		state := &record.trade.State
+		tradeResult := TradeResult{
+			TradeID:   state.TradeID,
+			Status:    state.Status,
+			OpenTime:  record.openTime,
+			CloseTime: record.closeTime,
+			BuyPrice:  state.AverageBuyPrice,
+			SellPrice: state.AverageSellPrice,
+			Quantity:  state.BuyFillQuantity,
+		}
+
+		switch {
+		case state.Status == types.TradeStatusDone:
+			tradeResult.Profit = state.Profit
+			tradeResult.ProfitPercent = state.ProfitPercent
+			switch {
+			case state.StopLoss.Triggered:
+				tradeResult.ExitReason = "stop loss"
+			case state.TrailingProfit.Triggered:
+				tradeResult.ExitReason = "trailing profit"
+			default:
+				tradeResult.ExitReason = "limit sell"
+			}
+		case record.trade.IsDone():
+			tradeResult.ExitReason = strings.ToLower(string(state.Status))
+			result.Trades = append(result.Trades, tradeResult)
+			continue
+		default:
+			// Still open at the end of the replay, value it at the last
+			// price.
+			tradeResult.SellPrice = lastPrice
+			tradeResult.ProfitPercent = r.tradeService.CalculateProfit(
+				record.trade, lastPrice)
+			tradeResult.Profit = state.BuyCost * tradeResult.ProfitPercent / 100
+			tradeResult.ExitReason = "open"
+		}
+
+		result.TotalProfit += tradeResult.Profit
+		totalPercent += tradeResult.ProfitPercent
+		if tradeResult.Profit > 0 {
+			result.Wins++
+		} else {
+			result.Losses++
+		}
+		result.Trades = append(result.Trades, tradeResult)
+	}
+	if count := result.Wins + result.Losses; count > 0 {
+		result.AveragePercent = totalPercent / float64(count)
+	}
+	return result
+}
@@ -0,0 +1,138 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package backtest
+
+import (
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/crankykernel/maker/go/binanceex"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/exchange"
+	"gitlab.com/crankykernel/maker/go/types"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func newTestSeries(prices ...float64) []binanceex.AggTrade {
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	trades := []binanceex.AggTrade{}
+	for i, price := range prices {
+		trades = append(trades, binanceex.AggTrade{
+			Symbol:   "ETHBTC",
+			ID:       int64(i + 1),
+			Price:    price,
+			Quantity: 100,
+			Time:     start.Add(time.Duration(i) * time.Minute),
+		})
+	}
+	return trades
+}
+
+func TestRun(t *testing.T) {
+	directory, err := ioutil.TempDir("", "maker-backtest")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+	db.DbOpenFile(path.Join(directory, "maker.db"))
+	defer db.DbClose()
+
+	symbolInfo := exchange.SymbolInfo{
+		TickSize:    0.000001,
+		StepSize:    0.001,
+		MinNotional: 0.001,
+	}
+
+	t.Run("limit sell", func(t *testing.T) {
+		result, err := Run(Options{
+			Symbol:           "ETHBTC",
+			Entry:            EntryRule{Type: EntryRuleOnce},
+			QuoteAmount:      0.3,
+			LimitSellEnabled: true,
+			LimitSellPercent: 1,
+		}, symbolInfo, newTestSeries(0.03, 0.03, 0.0302, 0.031))
+		assert.Nil(t, err)
+		assert.Len(t, result.Trades, 1)
+		trade := result.Trades[0]
+		assert.Equal(t, types.TradeStatusDone, trade.Status)
+		assert.Equal(t, "limit sell", trade.ExitReason)
+		// Bought 10 less the commission.
+		assert.Equal(t, 9.99, trade.Quantity)
+		assert.True(t, trade.SellPrice > trade.BuyPrice)
+		assert.NotNil(t, trade.CloseTime)
+		assert.Equal(t, 1, result.Wins)
+		assert.True(t, result.TotalProfit > 0)
+	})
+
+	t.Run("stop loss", func(t *testing.T) {
+		result, err := Run(Options{
+			Symbol:          "ETHBTC",
+			Entry:           EntryRule{Type: EntryRuleOnce},
+			QuoteAmount:     0.3,
+			StopLossEnabled: true,
+			StopLossPercent: 2,
+		}, symbolInfo, newTestSeries(0.03, 0.03, 0.0295, 0.029))
+		assert.Nil(t, err)
+		assert.Len(t, result.Trades, 1)
+		trade := result.Trades[0]
+		assert.Equal(t, types.TradeStatusDone, trade.Status)
+		assert.Equal(t, "stop loss", trade.ExitReason)
+		assert.Equal(t, 0.029, trade.SellPrice)
+		assert.Equal(t, 1, result.Losses)
+	})
+
+	t.Run("open at end", func(t *testing.T) {
+		// Re-entering on an interval only once the first trade is done.
+		result, err := Run(Options{
+			Symbol:      "ETHBTC",
+			Entry:       EntryRule{Type: EntryRuleInterval, Interval: time.Minute},
+			QuoteAmount: 0.3,
+		}, symbolInfo, newTestSeries(0.03, 0.03, 0.033))
+		assert.Nil(t, err)
+		assert.Len(t, result.Trades, 1)
+		assert.Equal(t, "open", result.Trades[0].ExitReason)
+		assert.Equal(t, 0.033, result.Trades[0].SellPrice)
+		assert.True(t, result.Trades[0].ProfitPercent > 0)
+	})
+
+	_, err = Run(Options{Symbol: "ETHBTC", QuoteAmount: 0.3}, symbolInfo, nil)
+	assert.NotNil(t, err)
+}
+
+func TestParseEntryRule(t *testing.T) {
+	rule, err := ParseEntryRule("dip:1.5")
+	assert.Nil(t, err)
+	assert.Equal(t, EntryRule{Type: EntryRuleDip, Percent: 1.5}, rule)
+	rule, err = ParseEntryRule("interval:1h")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Hour, rule.Interval)
+	_, err = ParseEntryRule("interval")
+	assert.NotNil(t, err)
+	_, err = ParseEntryRule("bogus")
+	assert.NotNil(t, err)
+}
+
+func TestReplayMarket(t *testing.T) {
+	market := newReplayMarket(exchange.SymbolInfo{})
+	_, err := market.GetPrice("ETHBTC", types.PriceSourceLast)
+	assert.NotNil(t, err)
+	market.setPrice(0.03)
+	price, err := market.GetPrice("ETHBTC", types.PriceSourceBestBid)
+	assert.Nil(t, err)
+	assert.Equal(t, 0.03, price)
+	_, err = market.PostOrder(exchange.OrderParameters{})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,124 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package backtest
+
+import (
+	"fmt"
+	"gitlab.com/crankykernel/maker/go/exchange"
+	"gitlab.com/crankykernel/maker/go/types"
+	"sync"
+)
+
+// replayMarket is the market data side of a backtest. Prices come from the
+// trade currently being replayed and order handling is left to the paper
+// exchange wrapping it.
+type replayMarket struct {
+	lock       sync.RWMutex
+	symbolInfo exchange.SymbolInfo
+	price      float64
+}
+
+func newReplayMarket(symbolInfo exchange.SymbolInfo) *replayMarket {
+	return &replayMarket{
+		symbolInfo: symbolInfo,
+	}
+}
+
+func (m *replayMarket) setPrice(price float64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.price = price
+}
+
+func (m *replayMarket) Name() string {
+	return "replay"
+}
+
+func (m *replayMarket) PostOrder(order exchange.OrderParameters) (*exchange.Order, error) {
+	return nil, fmt.Errorf("orders not supported by replay market")
+}
+
+func (m *replayMarket) PostStopOrder(order exchange.StopOrderParameters) (*exchange.Order, error) {
+	return nil, fmt.Errorf("orders not supported by replay market")
+}
+
+func (m *replayMarket) PostOcoOrder(order exchange.OcoOrderParameters) (*exchange.OrderList, error) {
+	return nil, fmt.Errorf("orders not supported by replay market")
+}
+
+func (m *replayMarket) CancelOrder(symbol string, orderId int64) error {
+	return fmt.Errorf("orders not supported by replay market")
+}
+
+func (m *replayMarket) GetOrderByClientId(symbol string, clientOrderId string) (*exchange.Order, error) {
+	return nil, fmt.Errorf("orders not supported by replay market")
+}
+
+func (m *replayMarket) GetOrderByOrderId(symbol string, orderId int64) (*exchange.Order, error) {
+	return nil, fmt.Errorf("orders not supported by replay market")
+}
+
+func (m *replayMarket) GetOpenOrders(symbol string) ([]exchange.Order, error) {
+	return nil, fmt.Errorf("orders not supported by replay market")
+}
+
+func (m *replayMarket) GetBalance(asset string) (float64, error) {
+	return 0, fmt.Errorf("balances not supported by replay market")
+}
+
+func (m *replayMarket) GetFreeBalance(asset string) (float64, error) {
+	return 0, fmt.Errorf("balances not supported by replay market")
+}
+
+func (m *replayMarket) GetOrderFills(symbol string, orderId int64) ([]exchange.Fill, error) {
+	return []exchange.Fill{}, nil
+}
+
+// GetPrice returns the price of the trade being replayed for all price
+// sources.
+func (m *replayMarket) GetPrice(symbol string, priceSource types.PriceSource) (float64, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.price == 0 {
+		return 0, fmt.Errorf("no price for %s yet", symbol)
+	}
+	return m.price, nil
+}
+
+func (m *replayMarket) GetSymbolInfo(symbol string) (exchange.SymbolInfo, error) {
+	return m.symbolInfo, nil
+}
+
+func (m *replayMarket) AddSymbol(symbol string) {
+}
+
+func (m *replayMarket) RemoveSymbol(symbol string) {
+}
+
+// The replay is driven directly, so nothing is ever sent on these channels.
+func (m *replayMarket) SubscribeTrades() exchange.TradeChannel {
+	return make(exchange.TradeChannel)
+}
+
+func (m *replayMarket) UnsubscribeTrades(channel exchange.TradeChannel) {
+}
+
+func (m *replayMarket) SubscribeUserStream() chan *exchange.UserStreamEvent {
+	return make(chan *exchange.UserStreamEvent)
+}
+
+func (m *replayMarket) UnsubscribeUserStream(channel chan *exchange.UserStreamEvent) {
+}
@@ -0,0 +1,142 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package binanceex
+
+import (
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Binance only allows an hour between startTime and endTime when fetching
+// aggregate trades, and returns at most this many per request.
+const aggTradesLimit = 1000
+
+// AggTrade is an aggregate trade as returned by the historical aggTrades
+// REST endpoint.
+type AggTrade struct {
+	Symbol     string
+	ID         int64
+	Price      float64
+	Quantity   float64
+	Time       time.Time
+	BuyerMaker bool
+}
+
+type restAggTrade struct {
+	ID         int64  `json:"a"`
+	Price      string `json:"p"`
+	Quantity   string `json:"q"`
+	Time       int64  `json:"T"`
+	BuyerMaker bool   `json:"m"`
+}
+
+// GetAggTrades fetches the historical aggregate trades for a symbol between
+// startTime and endTime from the public REST API. Requests are paged by
+// trade ID so ranges longer than an hour are supported.
+func GetAggTrades(symbol string, startTime time.Time, endTime time.Time) ([]AggTrade, error) {
+	trades := []AggTrade{}
+
+	params := url.Values{}
+	params.Set("symbol", symbol)
+	params.Set("limit", strconv.Itoa(aggTradesLimit))
+	params.Set("startTime", strconv.FormatInt(toMillis(startTime), 10))
+	windowEnd := startTime.Add(time.Hour)
+	if windowEnd.After(endTime) {
+		windowEnd = endTime
+	}
+	params.Set("endTime", strconv.FormatInt(toMillis(windowEnd), 10))
+
+	for {
+		page, err := getAggTradesPage(symbol, params)
+		if err != nil {
+			return nil, err
+		}
+		for _, trade := range page {
+			if trade.Time.After(endTime) {
+				return trades, nil
+			}
+			trades = append(trades, trade)
+		}
+
+		if len(page) == 0 {
+			// Paging by trade ID only comes up empty once there are no
+			// more trades at all.
+			if params.Get("fromId") != "" {
+				return trades, nil
+			}
+
+			// Nothing in this window, move to the next one.
+			if !windowEnd.Before(endTime) {
+				return trades, nil
+			}
+			startTime = windowEnd
+			windowEnd = startTime.Add(time.Hour)
+			if windowEnd.After(endTime) {
+				windowEnd = endTime
+			}
+			params.Set("startTime", strconv.FormatInt(toMillis(startTime), 10))
+			params.Set("endTime", strconv.FormatInt(toMillis(windowEnd), 10))
+			continue
+		}
+
+		// Page forward from the last trade ID.
+		params.Del("startTime")
+		params.Del("endTime")
+		params.Set("fromId", strconv.FormatInt(page[len(page)-1].ID+1, 10))
+
+		// Stay well clear of the request weight limit.
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func getAggTradesPage(symbol string, params url.Values) ([]AggTrade, error) {
+	body, err := restRequest("GET", "/api/v1/aggTrades", params.Encode(), "")
+	if err != nil {
+		return nil, err
+	}
+
+	var restTrades []restAggTrade
+	if err := json.Unmarshal(body, &restTrades); err != nil {
+		return nil, err
+	}
+
+	trades := []AggTrade{}
+	for _, restTrade := range restTrades {
+		price, err := strconv.ParseFloat(restTrade.Price, 64)
+		if err != nil {
+			return nil, err
+		}
+		quantity, err := strconv.ParseFloat(restTrade.Quantity, 64)
+		if err != nil {
+			return nil, err
+		}
+		trades = append(trades, AggTrade{
+			Symbol:     symbol,
+			ID:         restTrade.ID,
+			Price:      price,
+			Quantity:   quantity,
+			Time:       time.Unix(0, restTrade.Time*int64(time.Millisecond)),
+			BuyerMaker: restTrade.BuyerMaker,
+		})
+	}
+	return trades, nil
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,53 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package binanceex
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestGetAggTradesPaging(t *testing.T) {
+	requests := []url.Values{}
+	binance := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		requests = append(requests, params)
+		if params.Get("fromId") == "" {
+			w.Write([]byte(`[{"a":1,"p":"0.03","q":"1","T":1000,"m":false},{"a":2,"p":"0.031","q":"2","T":2000,"m":true}]`))
+			return
+		}
+		w.Write([]byte(`[]`))
+	}))
+	defer binance.Close()
+	assert.Nil(t, SetBaseUrl(binance.URL, ""))
+	defer SetBaseUrl(DefaultRestBaseUrl, DefaultStreamBaseUrl)
+
+	trades, err := GetAggTrades("ETHBTC", time.Unix(0, 0), time.Unix(3*3600, 0))
+	assert.Nil(t, err)
+	assert.Len(t, trades, 2)
+
+	// Paging stops at the first empty page by trade ID, rather than going
+	// on with fromId mixed with a time window.
+	assert.Len(t, requests, 2)
+	assert.Equal(t, "3", requests[1].Get("fromId"))
+	for _, params := range requests {
+		assert.False(t, params.Get("fromId") != "" && params.Get("startTime") != "")
+	}
+}
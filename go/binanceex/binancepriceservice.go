@@ -17,62 +17,34 @@ package binanceex
 
 import (
 	"fmt"
-	"github.com/crankykernel/binanceapi-go"
-	"gitlab.com/crankykernel/maker/go/log"
 	"gitlab.com/crankykernel/maker/go/types"
-	"gitlab.com/crankykernel/maker/go/util"
 )
 
 type BinancePriceService struct {
-	exchangeInfoService *ExchangeInfoService
-	client              *binanceapi.RestClient
 }
 
-func NewBinancePriceService(exchangeInfoService *ExchangeInfoService) *BinancePriceService {
-	return &BinancePriceService{
-		exchangeInfoService: exchangeInfoService,
-		client:              binanceapi.NewRestClient(),
-	}
+func NewBinancePriceService() *BinancePriceService {
+	return &BinancePriceService{}
 }
 
 // GetLastPrice gets the most current close price from Binance using the REST
 // API.
 func (s *BinancePriceService) GetLastPrice(symbol string) (float64, error) {
-	ticker, err := s.client.GetPriceTicker(symbol)
-	if err != nil {
-		return 0, err
-	}
-	return ticker.Price, nil
+	return GetLastPrice(symbol)
 }
 
 // GetBestBidPrice gets the most current best bid price from Binance using
 // the REST API.
 func (s *BinancePriceService) GetBestBidPrice(symbol string) (float64, error) {
-	ticker, err := s.client.GetBookTicker(symbol)
-	if err != nil {
-		return 0, err
-	}
-	return ticker.BidPrice, nil
+	bid, _, err := GetBookTicker(symbol)
+	return bid, err
 }
 
 // GetBestBidPrice gets the most current best bid price from Binance using
 // the REST API.
 func (s *BinancePriceService) GetBestAskPrice(symbol string) (float64, error) {
-	ticker, err := s.client.GetBookTicker(symbol)
-	if err != nil {
-		return 0, err
-	}
-	return ticker.AskPrice, nil
-}
-
-func (s *BinancePriceService) AdjustPriceByTicks(symbol string, price float64, ticks int64) float64 {
-	tickSize, err := s.exchangeInfoService.GetTickSize(symbol)
-	if err != nil {
-		log.WithError(err).WithFields(log.Fields{
-			"symbol": symbol,
-		}).Errorf("Failed to lookup tick size")
-	}
-	return util.Round8(price + (tickSize * float64(ticks)))
+	_, ask, err := GetBookTicker(symbol)
+	return ask, err
 }
 
 func (s *BinancePriceService) GetPrice(symbol string, priceSource types.PriceSource) (float64, error) {
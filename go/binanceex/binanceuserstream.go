@@ -32,8 +32,32 @@ type StreamEventType string
 const (
 	EventTypeExecutionReport     StreamEventType = "executionReport"
 	EventTypeOutboundAccountInfo StreamEventType = "outboundAccountInfo"
+	EventTypeListStatus          StreamEventType = "listStatus"
 )
 
+// StreamListStatus is the status of an order list, such as an OCO, sent on
+// the user stream when the list is placed and when it is done. The orders
+// of the list have their own execution reports.
+type StreamListStatus struct {
+	EventType         string                  `json:"e"`
+	EventTimeMillis   int64                   `json:"E"`
+	Symbol            string                  `json:"s"`
+	OrderListID       int64                   `json:"g"`
+	ContingencyType   string                  `json:"c"`
+	ListStatusType    string                  `json:"l"`
+	ListOrderStatus   string                  `json:"L"`
+	ListRejectReason  string                  `json:"r"`
+	ListClientOrderID string                  `json:"C"`
+	TransactionTime   int64                   `json:"T"`
+	Orders            []StreamListStatusOrder `json:"O"`
+}
+
+type StreamListStatusOrder struct {
+	Symbol        string `json:"s"`
+	OrderID       int64  `json:"i"`
+	ClientOrderID string `json:"c"`
+}
+
 type ListenKeyWrapper struct {
 	lock      sync.Mutex
 	listenKey string
@@ -60,6 +84,7 @@ type UserStreamEvent struct {
 	EventTime           time.Time
 	OutboundAccountInfo binanceapi.StreamOutboundAccountInfo
 	ExecutionReport     binanceapi.StreamExecutionReport
+	ListStatus          StreamListStatus
 	Raw                 []byte
 }
 
@@ -104,8 +129,7 @@ func (b *BinanceUserDataStream) ListenKeyRefreshLoop() {
 			log.Debugf("No Binance user stream key set, will not refresh")
 		} else {
 			log.Debugf("Refreshing Binance user stream listen key")
-			client := GetBinanceRestClient()
-			if err := client.PutUserStreamKeepAlive(listenKey); err != nil {
+			if err := KeepAliveListenKey(listenKey); err != nil {
 				log.WithError(err).Errorf("Failed to send Binance user stream keep alive.")
 			}
 		}
@@ -143,7 +167,7 @@ Start:
 	}
 
 	// First we have to get the user stream listen key.
-	listenKey, err := GetBinanceRestClient().GetUserDataStream()
+	listenKey, err := CreateListenKey()
 	if err != nil {
 		log.WithError(err).Error("Failed to get Binance user stream key. Retyring.")
 		goto Fail
@@ -152,7 +176,7 @@ Start:
 		}).Debugf("Acquired Binance user stream listen key")
 	}
 
-	userStream, err := binanceapi.OpenSingleStream(listenKey)
+	userStream, err := OpenSingleStream(listenKey)
 	if err != nil {
 		log.WithError(err).Errorf("Failed to open Binance user stream")
 		goto Fail
@@ -204,6 +228,13 @@ Start:
 			}
 			streamEvent.EventType = StreamEventType(streamEvent.OutboundAccountInfo.EventType)
 			streamEvent.EventTime = time.Unix(0, streamEvent.OutboundAccountInfo.EventTimeMillis*int64(time.Millisecond))
+		case strings.HasPrefix(string(message), `{"e":"listStatus",`):
+			if err := json.Unmarshal(message, &streamEvent.ListStatus); err != nil {
+				log.WithError(err).Error("Failed to decode user stream listStatus message.")
+				continue
+			}
+			streamEvent.EventType = StreamEventType(streamEvent.ListStatus.EventType)
+			streamEvent.EventTime = time.Unix(0, streamEvent.ListStatus.EventTimeMillis*int64(time.Millisecond))
 		}
 
 		for channel := range b.Subscribers {
@@ -0,0 +1,72 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package binanceex
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultRestBaseUrl   = "https://api.binance.com"
+	DefaultStreamBaseUrl = "wss://stream.binance.com:9443"
+)
+
+var baseUrlLock sync.RWMutex
+var restBaseUrl = DefaultRestBaseUrl
+var streamBaseUrl = DefaultStreamBaseUrl
+
+func RestBaseUrl() string {
+	baseUrlLock.RLock()
+	defer baseUrlLock.RUnlock()
+	return restBaseUrl
+}
+
+func StreamBaseUrl() string {
+	baseUrlLock.RLock()
+	defer baseUrlLock.RUnlock()
+	return streamBaseUrl
+}
+
+// SetBaseUrl points all REST requests and streams at a Binance compatible
+// API other than Binance, such as the fake Binance server. If streamUrl is
+// empty it is derived from restUrl.
+func SetBaseUrl(restUrl string, streamUrl string) error {
+	restUrl = strings.TrimRight(restUrl, "/")
+	target, err := url.Parse(restUrl)
+	if err != nil {
+		return err
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return fmt.Errorf("invalid REST URL: %s", restUrl)
+	}
+
+	if streamUrl == "" {
+		streamUrl = "ws" + strings.TrimPrefix(restUrl, "http")
+	}
+	streamUrl = strings.TrimRight(streamUrl, "/")
+	if !strings.HasPrefix(streamUrl, "ws://") && !strings.HasPrefix(streamUrl, "wss://") {
+		return fmt.Errorf("invalid stream URL: %s", streamUrl)
+	}
+
+	baseUrlLock.Lock()
+	defer baseUrlLock.Unlock()
+	restBaseUrl = restUrl
+	streamBaseUrl = streamUrl
+	return nil
+}
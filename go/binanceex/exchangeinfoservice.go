@@ -25,16 +25,39 @@
 package binanceex
 
 import (
+	"encoding/json"
 	"fmt"
-	"github.com/crankykernel/binanceapi-go"
 	"gitlab.com/crankykernel/maker/go/log"
+	"strconv"
 	"sync"
 )
 
+// SymbolStatusTrading is the status of a symbol that can be traded.
+const SymbolStatusTrading = "TRADING"
+
 type SymbolInfo struct {
+	BaseAsset   string
+	QuoteAsset  string
 	TickSize    float64
 	StepSize    float64
 	MinNotional float64
+
+	// The rest of the symbol filters. Anything not set by the exchange is
+	// left zero and not checked.
+	Status           string
+	OrderTypes       []string
+	MinPrice         float64
+	MaxPrice         float64
+	MinQty           float64
+	MaxQty           float64
+	MarketMinQty     float64
+	MarketMaxQty     float64
+	MarketStepSize   float64
+	MultiplierUp     float64
+	MultiplierDown   float64
+	ApplyToMarket    bool
+	MaxNumOrders     int64
+	MaxNumAlgoOrders int64
 }
 
 type ExchangeInfoService struct {
@@ -48,26 +71,121 @@ func NewExchangeInfoService() *ExchangeInfoService {
 	}
 }
 
+// The exchange info is decoded here as the binanceapi client only keeps
+// some of the filters.
+type restExchangeInfoFilter struct {
+	FilterType       string `json:"filterType"`
+	MinPrice         string `json:"minPrice"`
+	MaxPrice         string `json:"maxPrice"`
+	TickSize         string `json:"tickSize"`
+	MultiplierUp     string `json:"multiplierUp"`
+	MultiplierDown   string `json:"multiplierDown"`
+	MinQty           string `json:"minQty"`
+	MaxQty           string `json:"maxQty"`
+	StepSize         string `json:"stepSize"`
+	MinNotional      string `json:"minNotional"`
+	ApplyToMarket    bool   `json:"applyToMarket"`
+	MaxNumOrders     int64  `json:"maxNumOrders"`
+	MaxNumAlgoOrders int64  `json:"maxNumAlgoOrders"`
+}
+
+type restRateLimit struct {
+	RateLimitType string `json:"rateLimitType"`
+	Interval      string `json:"interval"`
+	IntervalNum   int64  `json:"intervalNum"`
+	Limit         int64  `json:"limit"`
+}
+
+type restExchangeInfo struct {
+	RateLimits []restRateLimit `json:"rateLimits"`
+	Symbols    []struct {
+		Symbol     string                   `json:"symbol"`
+		Status     string                   `json:"status"`
+		BaseAsset  string                   `json:"baseAsset"`
+		QuoteAsset string                   `json:"quoteAsset"`
+		OrderTypes []string                 `json:"orderTypes"`
+		Filters    []restExchangeInfoFilter `json:"filters"`
+	} `json:"symbols"`
+}
+
+func getExchangeInfo() (*restExchangeInfo, error) {
+	body, err := restRequest("GET", "/api/v1/exchangeInfo", "", "")
+	if err != nil {
+		return nil, err
+	}
+	var exchangeInfo restExchangeInfo
+	if err := json.Unmarshal(body, &exchangeInfo); err != nil {
+		return nil, err
+	}
+	return &exchangeInfo, nil
+}
+
+// Applies a filter to the symbol info. Values are decimal strings that are
+// left out of the filters they don't apply to.
+func (f *restExchangeInfoFilter) apply(symbolInfo *SymbolInfo) (err error) {
+	parse := func(value string) float64 {
+		if value == "" || err != nil {
+			return 0
+		}
+		var parsed float64
+		parsed, err = strconv.ParseFloat(value, 64)
+		return parsed
+	}
+	switch f.FilterType {
+	case "PRICE_FILTER":
+		symbolInfo.TickSize = parse(f.TickSize)
+		symbolInfo.MinPrice = parse(f.MinPrice)
+		symbolInfo.MaxPrice = parse(f.MaxPrice)
+	case "PERCENT_PRICE":
+		symbolInfo.MultiplierUp = parse(f.MultiplierUp)
+		symbolInfo.MultiplierDown = parse(f.MultiplierDown)
+	case "LOT_SIZE":
+		symbolInfo.StepSize = parse(f.StepSize)
+		symbolInfo.MinQty = parse(f.MinQty)
+		symbolInfo.MaxQty = parse(f.MaxQty)
+	case "MARKET_LOT_SIZE":
+		symbolInfo.MarketStepSize = parse(f.StepSize)
+		symbolInfo.MarketMinQty = parse(f.MinQty)
+		symbolInfo.MarketMaxQty = parse(f.MaxQty)
+	case "MIN_NOTIONAL":
+		symbolInfo.MinNotional = parse(f.MinNotional)
+		symbolInfo.ApplyToMarket = f.ApplyToMarket
+	case "MAX_NUM_ORDERS":
+		symbolInfo.MaxNumOrders = f.MaxNumOrders
+	case "MAX_NUM_ALGO_ORDERS":
+		symbolInfo.MaxNumAlgoOrders = f.MaxNumAlgoOrders
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s filter: %v", f.FilterType, err)
+	}
+	return nil
+}
+
 func (s *ExchangeInfoService) Update() error {
-	exchangeInfo, err := binanceapi.NewRestClient().GetExchangeInfo()
+	exchangeInfo, err := getExchangeInfo()
 	if err != nil {
 		return err
 	}
-	s.lock.Lock()
-	defer s.lock.Unlock()
+	symbols := map[string]SymbolInfo{}
 	for _, symbol := range exchangeInfo.Symbols {
-		symbolInfo := SymbolInfo{}
+		symbolInfo := SymbolInfo{
+			BaseAsset:  symbol.BaseAsset,
+			QuoteAsset: symbol.QuoteAsset,
+			Status:     symbol.Status,
+			OrderTypes: symbol.OrderTypes,
+		}
 		for _, filter := range symbol.Filters {
-			switch filter.FilterType {
-			case "PRICE_FILTER":
-				symbolInfo.TickSize = filter.TickSize
-			case "MIN_NOTIONAL":
-				symbolInfo.MinNotional = filter.MinNotional
-			case "LOT_SIZE":
-				symbolInfo.StepSize = filter.StepSize
+			if err := filter.apply(&symbolInfo); err != nil {
+				return fmt.Errorf("%s: %v", symbol.Symbol, err)
 			}
 		}
-		s.Symbols[symbol.Symbol] = symbolInfo
+		symbols[symbol.Symbol] = symbolInfo
+	}
+	rateLimiter.setLimits(exchangeInfo.RateLimits)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for symbol, symbolInfo := range symbols {
+		s.Symbols[symbol] = symbolInfo
 	}
 	log.WithFields(log.Fields{
 		"symbols": len(s.Symbols),
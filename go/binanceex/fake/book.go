@@ -0,0 +1,740 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package fake
+
+import (
+	"fmt"
+	"gitlab.com/crankykernel/maker/go/types"
+	"gitlab.com/crankykernel/maker/go/util"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Streams published by the order book. Symbol streams are prefixed with the
+// lower case symbol, eg. "ethbtc@aggTrade".
+const (
+	streamAggTrade   = "aggTrade"
+	streamBookTicker = "bookTicker"
+	streamUser       = "user"
+)
+
+// Binance error codes returned by the fake.
+const (
+	errorCodeUnknown      = -1000
+	errorCodeBadSymbol    = -1121
+	errorCodeBadParameter = -1102
+	errorCodeUnknownOrder = -2011
+	errorCodeNoSuchOrder  = -2013
+	errorCodeInvalidOrder = -1013
+	errorCodeNotSupported = -1116
+)
+
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"msg"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d: %s", e.Code, e.Message)
+}
+
+func newError(code int, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+type SymbolConfig struct {
+	Symbol      string
+	BaseAsset   string
+	QuoteAsset  string
+	TickSize    float64
+	StepSize    float64
+	MinNotional float64
+}
+
+type market struct {
+	config      SymbolConfig
+	lastPrice   float64
+	bidPrice    float64
+	bidQuantity float64
+	askPrice    float64
+	askQuantity float64
+	updateId    int64
+	aggTrades   []aggTradeMessage
+}
+
+type order struct {
+	symbol             string
+	orderId            int64
+	clientOrderId      string
+	side               string
+	orderType          string
+	timeInForce        string
+	price              float64
+	quantity           float64
+	executedQuantity   float64
+	cumulativeQuoteQty float64
+	status             string
+	time               int64
+	updateTime         int64
+}
+
+func (o *order) isOpen() bool {
+	return o.status == "NEW" || o.status == "PARTIALLY_FILLED"
+}
+
+func (o *order) remaining() float64 {
+	return util.Round8(o.quantity - o.executedQuantity)
+}
+
+type fill struct {
+	id              int64
+	symbol          string
+	orderId         int64
+	price           float64
+	quantity        float64
+	commission      float64
+	commissionAsset string
+	time            int64
+	isBuyer         bool
+	isMaker         bool
+}
+
+// OrderBook is the matching engine behind the fake Binance server. The
+// market is driven by script: SetBook sets the best bid and ask, Trade prints
+// an aggregate trade. Orders are matched against these, not each other.
+//
+// Market orders, and limit orders that cross the book, fill at the best bid
+// or ask. Resting limit orders fill at their price when a trade prints at or
+// through it.
+type OrderBook struct {
+	lock        sync.Mutex
+	markets     map[string]*market
+	orders      map[int64]*order
+	fills       []*fill
+	balances    map[string]float64
+	nextOrderId int64
+	nextFillId  int64
+	nextAggId   int64
+
+	// Called with every stream message, with the lock held so messages are
+	// published in order. Must not block.
+	publish func(stream string, message interface{})
+}
+
+func NewOrderBook() *OrderBook {
+	return &OrderBook{
+		markets:     make(map[string]*market),
+		orders:      make(map[int64]*order),
+		balances:    make(map[string]float64),
+		nextOrderId: 1,
+		nextFillId:  1,
+		nextAggId:   1,
+		publish:     func(string, interface{}) {},
+	}
+}
+
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+func symbolStream(symbol string, stream string) string {
+	return fmt.Sprintf("%s@%s", strings.ToLower(symbol), stream)
+}
+
+// AddSymbol adds, or replaces the configuration of, a tradable symbol with
+// its book one tick either side of price.
+func (b *OrderBook) AddSymbol(config SymbolConfig, price float64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	config.Symbol = strings.ToUpper(config.Symbol)
+	m := b.markets[config.Symbol]
+	if m == nil {
+		m = &market{}
+		b.markets[config.Symbol] = m
+	}
+	m.config = config
+	m.lastPrice = price
+	m.bidPrice = util.Round8(price - config.TickSize)
+	m.askPrice = util.Round8(price + config.TickSize)
+	m.bidQuantity = 100
+	m.askQuantity = 100
+}
+
+func (b *OrderBook) getMarket(symbol string) (*market, error) {
+	m := b.markets[strings.ToUpper(symbol)]
+	if m == nil {
+		return nil, newError(errorCodeBadSymbol, "Invalid symbol.")
+	}
+	return m, nil
+}
+
+func (b *OrderBook) SetBalance(asset string, amount float64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.balances[strings.ToUpper(asset)] = amount
+}
+
+// SetBook sets the best bid and ask of a symbol, filling any orders that
+// now cross the book.
+func (b *OrderBook) SetBook(symbol string, bid float64, ask float64) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	m, err := b.getMarket(symbol)
+	if err != nil {
+		return err
+	}
+	if bid <= 0 || ask < bid {
+		return fmt.Errorf("invalid book: bid=%f; ask=%f", bid, ask)
+	}
+	m.bidPrice = bid
+	m.askPrice = ask
+	b.publishBookTicker(m)
+	for _, o := range b.openOrders(m.config.Symbol) {
+		b.matchTaker(m, o)
+	}
+	return nil
+}
+
+// Trade prints an aggregate trade. The book is moved so its mid price is
+// the trade price, keeping the spread, and resting limit orders at or
+// through the price are filled up to the trade quantity.
+func (b *OrderBook) Trade(symbol string, price float64, quantity float64) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	m, err := b.getMarket(symbol)
+	if err != nil {
+		return err
+	}
+	if price <= 0 || quantity <= 0 {
+		return fmt.Errorf("invalid trade: price=%f; quantity=%f", price, quantity)
+	}
+	price = roundToTick(price, m.config.TickSize)
+
+	now := nowMillis()
+	message := aggTradeMessage{
+		EventType:    "aggTrade",
+		EventTime:    now,
+		Symbol:       m.config.Symbol,
+		AggTradeId:   b.nextAggId,
+		Price:        formatFloat(price),
+		Quantity:     formatFloat(quantity),
+		FirstTradeId: b.nextAggId,
+		LastTradeId:  b.nextAggId,
+		TradeTime:    now,
+		BuyerMaker:   price <= m.lastPrice,
+		BestMatch:    true,
+	}
+	b.nextAggId++
+	m.aggTrades = append(m.aggTrades, message)
+	if len(m.aggTrades) > maxAggTradeHistory {
+		m.aggTrades = m.aggTrades[len(m.aggTrades)-maxAggTradeHistory:]
+	}
+	m.lastPrice = price
+	b.publish(symbolStream(m.config.Symbol, streamAggTrade), message)
+
+	halfSpread := (m.askPrice - m.bidPrice) / 2
+	m.bidPrice = roundToTick(price-halfSpread, m.config.TickSize)
+	m.askPrice = roundToTick(price+halfSpread, m.config.TickSize)
+	b.publishBookTicker(m)
+
+	available := quantity
+	for _, o := range b.openOrders(m.config.Symbol) {
+		if available <= 0 {
+			break
+		}
+		if o.orderType != "LIMIT" {
+			continue
+		}
+		if o.side == "BUY" && price > o.price {
+			continue
+		}
+		if o.side == "SELL" && price < o.price {
+			continue
+		}
+		fillQuantity := math.Min(o.remaining(), available)
+		available = util.Round8(available - fillQuantity)
+		b.fill(m, o, o.price, fillQuantity, true)
+	}
+	return nil
+}
+
+// openOrders returns the open orders of a symbol, oldest first.
+func (b *OrderBook) openOrders(symbol string) []*order {
+	orders := []*order{}
+	for _, o := range b.orders {
+		if o.symbol == symbol && o.isOpen() {
+			orders = append(orders, o)
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool {
+		return orders[i].orderId < orders[j].orderId
+	})
+	return orders
+}
+
+type OrderRequest struct {
+	Symbol        string
+	Side          string
+	Type          string
+	TimeInForce   string
+	Quantity      float64
+	Price         float64
+	ClientOrderId string
+}
+
+// PlaceOrder validates and accepts an order, filling it immediately if it
+// is a market order or crosses the book.
+func (b *OrderBook) PlaceOrder(request OrderRequest) (*order, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	m, err := b.getMarket(request.Symbol)
+	if err != nil {
+		return nil, err
+	}
+	if request.Side != "BUY" && request.Side != "SELL" {
+		return nil, newError(errorCodeBadParameter, "Invalid side.")
+	}
+	switch request.Type {
+	case "MARKET":
+	case "LIMIT":
+		if request.Price <= 0 {
+			return nil, newError(errorCodeInvalidOrder, "Invalid price.")
+		}
+		if request.TimeInForce == "" {
+			return nil, newError(errorCodeBadParameter,
+				"Mandatory parameter 'timeInForce' was not sent, was empty/null, or malformed.")
+		}
+	default:
+		return nil, newError(errorCodeNotSupported, "Invalid orderType.")
+	}
+	if request.Quantity <= 0 {
+		return nil, newError(errorCodeInvalidOrder, "Invalid quantity.")
+	}
+	if !isMultiple(request.Quantity, m.config.StepSize) {
+		return nil, newError(errorCodeInvalidOrder, "Filter failure: LOT_SIZE")
+	}
+	if request.Type == "LIMIT" && !isMultiple(request.Price, m.config.TickSize) {
+		return nil, newError(errorCodeInvalidOrder, "Filter failure: PRICE_FILTER")
+	}
+	notionalPrice := request.Price
+	if request.Type == "MARKET" {
+		notionalPrice = m.lastPrice
+	}
+	if notionalPrice*request.Quantity < m.config.MinNotional {
+		return nil, newError(errorCodeInvalidOrder, "Filter failure: MIN_NOTIONAL")
+	}
+
+	now := nowMillis()
+	o := &order{
+		symbol:        m.config.Symbol,
+		orderId:       b.nextOrderId,
+		clientOrderId: request.ClientOrderId,
+		side:          request.Side,
+		orderType:     request.Type,
+		timeInForce:   request.TimeInForce,
+		price:         request.Price,
+		quantity:      request.Quantity,
+		status:        "NEW",
+		time:          now,
+		updateTime:    now,
+	}
+	if o.clientOrderId == "" {
+		o.clientOrderId = fmt.Sprintf("fake-%d", o.orderId)
+	}
+	b.nextOrderId++
+	b.orders[o.orderId] = o
+
+	b.publishExecutionReport(o, "NEW", o.clientOrderId, "", nil)
+	b.matchTaker(m, o)
+	return o, nil
+}
+
+// matchTaker fills an order against the best bid or ask if it is a market
+// order or its price crosses the book.
+func (b *OrderBook) matchTaker(m *market, o *order) {
+	if o.side == "BUY" {
+		if o.orderType == "MARKET" || o.price >= m.askPrice {
+			b.fill(m, o, m.askPrice, o.remaining(), false)
+		}
+	} else {
+		if o.orderType == "MARKET" || o.price <= m.bidPrice {
+			b.fill(m, o, m.bidPrice, o.remaining(), false)
+		}
+	}
+}
+
+// Must be called with the lock held.
+func (b *OrderBook) fill(m *market, o *order, price float64, quantity float64, maker bool) {
+	now := nowMillis()
+	o.executedQuantity = util.Round8(o.executedQuantity + quantity)
+	o.cumulativeQuoteQty = util.Round8(o.cumulativeQuoteQty + price*quantity)
+	o.updateTime = now
+	if o.remaining() <= 0 {
+		o.status = "FILLED"
+	} else {
+		o.status = "PARTIALLY_FILLED"
+	}
+
+	f := &fill{
+		id:       b.nextFillId,
+		symbol:   o.symbol,
+		orderId:  o.orderId,
+		price:    price,
+		quantity: quantity,
+		time:     now,
+		isBuyer:  o.side == "BUY",
+		isMaker:  maker,
+	}
+	b.nextFillId++
+
+	base := m.config.BaseAsset
+	quote := m.config.QuoteAsset
+	if o.side == "BUY" {
+		f.commissionAsset = base
+		f.commission = util.Round8(quantity * types.DEFAULT_FEE)
+		b.balances[base] = util.Round8(b.balances[base] + quantity - f.commission)
+		b.balances[quote] = util.Round8(b.balances[quote] - price*quantity)
+	} else {
+		f.commissionAsset = quote
+		f.commission = util.Round8(price * quantity * types.DEFAULT_FEE)
+		b.balances[base] = util.Round8(b.balances[base] - quantity)
+		b.balances[quote] = util.Round8(b.balances[quote] + price*quantity - f.commission)
+	}
+	b.fills = append(b.fills, f)
+
+	b.publishExecutionReport(o, "TRADE", o.clientOrderId, "", f)
+	b.publishAccountInfo()
+}
+
+// CancelOrder cancels an open order by order ID, or client order ID if the
+// order ID is 0.
+func (b *OrderBook) CancelOrder(symbol string, orderId int64, origClientOrderId string) (*order, string, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	o, err := b.findOrder(symbol, orderId, origClientOrderId)
+	if err != nil {
+		return nil, "", newError(errorCodeUnknownOrder, "Unknown order sent.")
+	}
+	if !o.isOpen() {
+		return nil, "", newError(errorCodeUnknownOrder, "Unknown order sent.")
+	}
+	o.status = "CANCELED"
+	o.updateTime = nowMillis()
+	cancelClientOrderId := fmt.Sprintf("cancel-%d", o.orderId)
+	b.publishExecutionReport(o, "CANCELED", cancelClientOrderId, o.clientOrderId, nil)
+	return o, cancelClientOrderId, nil
+}
+
+func (b *OrderBook) GetOrder(symbol string, orderId int64, origClientOrderId string) (*order, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	o, err := b.findOrder(symbol, orderId, origClientOrderId)
+	if err != nil {
+		return nil, err
+	}
+	result := *o
+	return &result, nil
+}
+
+// OpenOrders returns copies of the open orders of a symbol, oldest first.
+func (b *OrderBook) OpenOrders(symbol string) []*order {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	orders := []*order{}
+	for _, o := range b.openOrders(strings.ToUpper(symbol)) {
+		result := *o
+		orders = append(orders, &result)
+	}
+	return orders
+}
+
+// Must be called with the lock held.
+func (b *OrderBook) findOrder(symbol string, orderId int64, origClientOrderId string) (*order, error) {
+	symbol = strings.ToUpper(symbol)
+	if orderId != 0 {
+		if o := b.orders[orderId]; o != nil && o.symbol == symbol {
+			return o, nil
+		}
+	} else if origClientOrderId != "" {
+		for _, o := range b.orders {
+			if o.symbol == symbol && o.clientOrderId == origClientOrderId {
+				return o, nil
+			}
+		}
+	}
+	return nil, newError(errorCodeNoSuchOrder, "Order does not exist.")
+}
+
+// Fills returns the fills of a symbol starting at fromId, up to limit, only
+// those of the order if orderId is not 0.
+func (b *OrderBook) Fills(symbol string, orderId int64, fromId int64, limit int) []fill {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	fills := []fill{}
+	for _, f := range b.fills {
+		if f.symbol != strings.ToUpper(symbol) || f.id < fromId {
+			continue
+		}
+		if orderId != 0 && f.orderId != orderId {
+			continue
+		}
+		fills = append(fills, *f)
+	}
+	if limit > 0 && len(fills) > limit {
+		// Without fromId Binance returns the most recent trades.
+		if fromId == 0 {
+			fills = fills[len(fills)-limit:]
+		} else {
+			fills = fills[:limit]
+		}
+	}
+	return fills
+}
+
+// Must be called with the lock held.
+func (b *OrderBook) publishBookTicker(m *market) {
+	m.updateId++
+	b.publish(symbolStream(m.config.Symbol, streamBookTicker), bookTickerMessage{
+		UpdateId:    m.updateId,
+		Symbol:      m.config.Symbol,
+		BidPrice:    formatFloat(m.bidPrice),
+		BidQuantity: formatFloat(m.bidQuantity),
+		AskPrice:    formatFloat(m.askPrice),
+		AskQuantity: formatFloat(m.askQuantity),
+	})
+}
+
+// Must be called with the lock held.
+func (b *OrderBook) publishExecutionReport(o *order, executionType string,
+	clientOrderId string, origClientOrderId string, f *fill) {
+	message := executionReportMessage{
+		EventType:                "executionReport",
+		EventTime:                nowMillis(),
+		Symbol:                   o.symbol,
+		ClientOrderId:            clientOrderId,
+		Side:                     o.side,
+		OrderType:                o.orderType,
+		TimeInForce:              o.timeInForce,
+		Quantity:                 formatFloat(o.quantity),
+		Price:                    formatFloat(o.price),
+		StopPrice:                formatFloat(0),
+		IcebergQuantity:          formatFloat(0),
+		OrderListId:              -1,
+		OriginalClientOrderId:    origClientOrderId,
+		ExecutionType:            executionType,
+		OrderStatus:              o.status,
+		RejectReason:             "NONE",
+		OrderId:                  o.orderId,
+		LastExecutedQuantity:     formatFloat(0),
+		CumulativeFilledQuantity: formatFloat(o.executedQuantity),
+		LastExecutedPrice:        formatFloat(0),
+		CommissionAmount:         formatFloat(0),
+		TransactionTime:          o.updateTime,
+		TradeId:                  -1,
+		Ignore:                   8641984,
+		IsWorking:                o.isOpen(),
+		OrderCreationTime:        o.time,
+		CumulativeQuoteQuantity:  formatFloat(o.cumulativeQuoteQty),
+		LastQuoteQuantity:        formatFloat(0),
+	}
+	if f != nil {
+		message.LastExecutedQuantity = formatFloat(f.quantity)
+		message.LastExecutedPrice = formatFloat(f.price)
+		message.CommissionAmount = formatFloat(f.commission)
+		message.CommissionAsset = f.commissionAsset
+		message.TradeId = f.id
+		message.IsMaker = f.isMaker
+		message.LastQuoteQuantity = formatFloat(f.price * f.quantity)
+	}
+	b.publish(streamUser, message)
+}
+
+// Must be called with the lock held.
+func (b *OrderBook) publishAccountInfo() {
+	now := nowMillis()
+	b.publish(streamUser, accountInfoMessage{
+		EventType:       "outboundAccountInfo",
+		EventTime:       now,
+		MakerCommission: 10,
+		TakerCommission: 10,
+		CanTrade:        true,
+		CanWithdraw:     true,
+		CanDeposit:      true,
+		LastUpdateTime:  now,
+		Balances:        b.streamBalances(),
+	})
+}
+
+// Must be called with the lock held.
+func (b *OrderBook) streamBalances() []streamBalance {
+	balances := []streamBalance{}
+	for _, asset := range b.sortedAssets() {
+		balances = append(balances, streamBalance{
+			Asset:  asset,
+			Free:   formatFloat(b.balances[asset]),
+			Locked: formatFloat(0),
+		})
+	}
+	return balances
+}
+
+// Must be called with the lock held.
+func (b *OrderBook) sortedAssets() []string {
+	assets := []string{}
+	for asset := range b.balances {
+		assets = append(assets, asset)
+	}
+	sort.Strings(assets)
+	return assets
+}
+
+func isMultiple(value float64, size float64) bool {
+	if size <= 0 {
+		return true
+	}
+	steps := value / size
+	return math.Abs(steps-math.Round(steps)) < 1e-6
+}
+
+func roundToTick(price float64, tickSize float64) float64 {
+	if tickSize <= 0 {
+		return util.Round8(price)
+	}
+	return util.Round8(math.Round(price/tickSize) * tickSize)
+}
+
+func (b *OrderBook) exchangeInfo() exchangeInfoResponse {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	applyToMarket := true
+	averagePriceMins := 5
+	response := exchangeInfoResponse{
+		Timezone:   "UTC",
+		ServerTime: nowMillis(),
+		RateLimits: []interface{}{},
+		Symbols:    []exchangeInfoSymbol{},
+	}
+	for _, m := range b.markets {
+		response.Symbols = append(response.Symbols, exchangeInfoSymbol{
+			Symbol:             m.config.Symbol,
+			Status:             "TRADING",
+			BaseAsset:          m.config.BaseAsset,
+			BaseAssetPrecision: 8,
+			QuoteAsset:         m.config.QuoteAsset,
+			QuotePrecision:     8,
+			OrderTypes:         []string{"LIMIT", "MARKET"},
+			IcebergAllowed:     false,
+			Filters: []exchangeInfoFilter{
+				{
+					FilterType: "PRICE_FILTER",
+					MinPrice:   formatFloat(m.config.TickSize),
+					MaxPrice:   formatFloat(100000),
+					TickSize:   formatFloat(m.config.TickSize),
+				},
+				{
+					FilterType: "LOT_SIZE",
+					MinQty:     formatFloat(m.config.StepSize),
+					MaxQty:     formatFloat(90000000),
+					StepSize:   formatFloat(m.config.StepSize),
+				},
+				{
+					FilterType:       "MIN_NOTIONAL",
+					MinNotional:      formatFloat(m.config.MinNotional),
+					ApplyToMarket:    &applyToMarket,
+					AveragePriceMins: &averagePriceMins,
+				},
+			},
+		})
+	}
+	sort.Slice(response.Symbols, func(i, j int) bool {
+		return response.Symbols[i].Symbol < response.Symbols[j].Symbol
+	})
+	return response
+}
+
+// prices returns the last price, best bid and best ask of a symbol.
+func (b *OrderBook) prices(symbol string) (last float64, bid float64, ask float64, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	m, err := b.getMarket(symbol)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return m.lastPrice, m.bidPrice, m.askPrice, nil
+}
+
+func (b *OrderBook) account() accountResponse {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	response := accountResponse{
+		MakerCommission: 10,
+		TakerCommission: 10,
+		CanTrade:        true,
+		CanWithdraw:     true,
+		CanDeposit:      true,
+		UpdateTime:      nowMillis(),
+		Balances:        []accountBalance{},
+	}
+	for _, asset := range b.sortedAssets() {
+		response.Balances = append(response.Balances, accountBalance{
+			Asset:  asset,
+			Free:   formatFloat(b.balances[asset]),
+			Locked: formatFloat(0),
+		})
+	}
+	return response
+}
+
+// aggTrades returns the recorded aggregate trades of a symbol from fromId,
+// or between startTime and endTime (in milliseconds), up to limit.
+func (b *OrderBook) aggTrades(symbol string, fromId int64, startTime int64, endTime int64, limit int) ([]restAggTrade, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	m, err := b.getMarket(symbol)
+	if err != nil {
+		return nil, err
+	}
+	trades := []restAggTrade{}
+	for _, trade := range m.aggTrades {
+		if trade.AggTradeId < fromId {
+			continue
+		}
+		if startTime > 0 && trade.TradeTime < startTime {
+			continue
+		}
+		if endTime > 0 && trade.TradeTime > endTime {
+			continue
+		}
+		trades = append(trades, restAggTrade{
+			AggTradeId:   trade.AggTradeId,
+			Price:        trade.Price,
+			Quantity:     trade.Quantity,
+			FirstTradeId: trade.FirstTradeId,
+			LastTradeId:  trade.LastTradeId,
+			TradeTime:    trade.TradeTime,
+			BuyerMaker:   trade.BuyerMaker,
+			BestMatch:    trade.BestMatch,
+		})
+		if limit > 0 && len(trades) >= limit {
+			break
+		}
+	}
+	return trades, nil
+}
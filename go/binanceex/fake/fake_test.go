@@ -0,0 +1,196 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/crankykernel/binanceapi-go"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/crankykernel/maker/go/binanceex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func newTestServer(t *testing.T) *httptest.Server {
+	book := NewOrderBook()
+	assert.Nil(t, RunScript(book, strings.NewReader(DefaultScript)))
+	ts := httptest.NewServer(NewServer(book))
+	assert.Nil(t, binanceex.SetBaseUrl(ts.URL, ""))
+	return ts
+}
+
+func closeTestServer(ts *httptest.Server) {
+	binanceex.SetBaseUrl(binanceex.DefaultRestBaseUrl, binanceex.DefaultStreamBaseUrl)
+	ts.Close()
+}
+
+func decodeResponse(t *testing.T, response *http.Response, err error, v interface{}) {
+	assert.Nil(t, err)
+	defer response.Body.Close()
+	assert.Nil(t, json.NewDecoder(response.Body).Decode(v))
+}
+
+func TestLimitOrderFillsOnTrade(t *testing.T) {
+	ts := newTestServer(t)
+	defer closeTestServer(ts)
+
+	// Streams are opened on the fake through the configured base URL.
+	var listenKey map[string]string
+	response, err := http.Post(ts.URL+"/api/v1/userDataStream", "", nil)
+	decodeResponse(t, response, err, &listenKey)
+	stream, err := binanceex.OpenSingleStream(listenKey["listenKey"])
+	assert.Nil(t, err)
+	defer stream.Close()
+
+	var order orderResponse
+	response, err = http.PostForm(ts.URL+"/api/v3/order", url.Values{
+		"symbol":           {"ETHBTC"},
+		"side":             {"BUY"},
+		"type":             {"LIMIT"},
+		"timeInForce":      {"GTC"},
+		"quantity":         {"1"},
+		"price":            {"0.030"},
+		"newClientOrderId": {"test-buy"},
+	})
+	decodeResponse(t, response, err, &order)
+	assert.Equal(t, "NEW", order.Status)
+
+	var openOrders []orderResponse
+	response, err = http.Get(ts.URL + "/api/v3/openOrders?symbol=ETHBTC")
+	decodeResponse(t, response, err, &openOrders)
+	assert.Equal(t, 1, len(openOrders))
+	assert.Equal(t, "test-buy", openOrders[0].ClientOrderId)
+
+	payload, err := stream.Next()
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(payload), `{"e":"executionReport",`))
+
+	request, _ := http.NewRequest("POST", ts.URL+"/fake/script",
+		strings.NewReader("trade ETHBTC 0.0305 0.4\ntrade ETHBTC 0.030\n"))
+	response, err = http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	var report executionReportMessage
+	statuses := []string{}
+	for len(statuses) < 1 || report.OrderStatus != "FILLED" {
+		payload, err := stream.Next()
+		assert.Nil(t, err)
+		if strings.HasPrefix(string(payload), `{"e":"executionReport",`) {
+			assert.Nil(t, json.Unmarshal(payload, &report))
+			statuses = append(statuses, report.OrderStatus)
+		}
+	}
+	assert.Equal(t, []string{"FILLED"}, statuses)
+	assert.Equal(t, "test-buy", report.ClientOrderId)
+	assert.Equal(t, "0.03000000", report.LastExecutedPrice)
+
+	response, err = http.Get(ts.URL + "/api/v3/order?symbol=ETHBTC&origClientOrderId=test-buy")
+	decodeResponse(t, response, err, &order)
+	assert.Equal(t, "FILLED", order.Status)
+
+	var trades []myTradesEntry
+	response, err = http.Get(ts.URL + "/api/v3/myTrades?symbol=ETHBTC")
+	decodeResponse(t, response, err, &trades)
+	assert.Equal(t, 1, len(trades))
+	assert.Equal(t, "1.00000000", trades[0].Qty)
+	assert.Equal(t, "ETH", trades[0].CommissionAsset)
+
+	response, err = http.Get(fmt.Sprintf("%s/api/v3/myTrades?symbol=ETHBTC&orderId=%d",
+		ts.URL, trades[0].OrderId+1))
+	decodeResponse(t, response, err, &trades)
+	assert.Equal(t, 0, len(trades))
+}
+
+func TestMarketOrderAndErrors(t *testing.T) {
+	book := NewOrderBook()
+	assert.Nil(t, RunScript(book, strings.NewReader(DefaultScript)))
+	assert.Nil(t, book.SetBook("ETHBTC", 0.0309, 0.0311))
+
+	order, err := book.PlaceOrder(OrderRequest{
+		Symbol:   "ETHBTC",
+		Side:     "SELL",
+		Type:     "MARKET",
+		Quantity: 1,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "FILLED", order.status)
+	assert.Equal(t, 0.0309, order.cumulativeQuoteQty)
+
+	_, err = book.PlaceOrder(OrderRequest{
+		Symbol:      "ETHBTC",
+		Side:        "BUY",
+		Type:        "LIMIT",
+		TimeInForce: "GTC",
+		Quantity:    0.0001,
+		Price:       0.03,
+	})
+	assert.Equal(t, "Filter failure: LOT_SIZE", err.(*Error).Message)
+
+	_, _, err = book.CancelOrder("ETHBTC", order.orderId, "")
+	assert.Equal(t, errorCodeUnknownOrder, err.(*Error).Code)
+}
+
+// The binanceex REST functions against the fake.
+func TestRestRequests(t *testing.T) {
+	ts := newTestServer(t)
+	defer closeTestServer(ts)
+	viper.Set("binance.api.key", "key")
+	viper.Set("binance.api.secret", "secret")
+	defer viper.Set("binance.api.key", "")
+	defer viper.Set("binance.api.secret", "")
+
+	serverTime, err := binanceex.GetServerTime()
+	assert.Nil(t, err)
+	assert.True(t, serverTime > 0)
+	_, err = binanceex.GetLastPrice("ETHBTC")
+	assert.Nil(t, err)
+	bid, ask, err := binanceex.GetBookTicker("ETHBTC")
+	assert.Nil(t, err)
+	assert.True(t, bid > 0 && ask > bid)
+
+	posted, err := binanceex.PostOrder(binanceapi.OrderParameters{
+		Symbol:           "ETHBTC",
+		Side:             binanceapi.OrderSideBuy,
+		Type:             binanceapi.OrderTypeLimit,
+		TimeInForce:      binanceapi.TimeInForceGTC,
+		Quantity:         1,
+		Price:            bid,
+		NewClientOrderId: "rest-buy",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, binanceapi.OrderStatusNew, posted.Status)
+	assert.True(t, posted.TimeMillis > 0)
+
+	order, err := binanceex.GetOrderByClientId("ETHBTC", "rest-buy")
+	assert.Nil(t, err)
+	assert.Equal(t, posted.OrderID, order.OrderID)
+	assert.Nil(t, binanceex.CancelOrder("ETHBTC", order.OrderID))
+
+	_, err = binanceex.GetOrderByClientId("ETHBTC", "bogus")
+	requestError, ok := err.(*binanceex.RequestError)
+	assert.True(t, ok)
+	assert.Contains(t, string(requestError.Body), "-2013")
+
+	listenKey, err := binanceex.CreateListenKey()
+	assert.Nil(t, err)
+	assert.Nil(t, binanceex.KeepAliveListenKey(listenKey))
+}
@@ -0,0 +1,218 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package fake
+
+import (
+	"strconv"
+)
+
+// Messages are encoded as Binance does, with quantities and prices as
+// strings and the event type first.
+
+// The number of aggregate trades kept per symbol for the aggTrades endpoint.
+const maxAggTradeHistory = 10000
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', 8, 64)
+}
+
+type aggTradeMessage struct {
+	EventType    string `json:"e"`
+	EventTime    int64  `json:"E"`
+	Symbol       string `json:"s"`
+	AggTradeId   int64  `json:"a"`
+	Price        string `json:"p"`
+	Quantity     string `json:"q"`
+	FirstTradeId int64  `json:"f"`
+	LastTradeId  int64  `json:"l"`
+	TradeTime    int64  `json:"T"`
+	BuyerMaker   bool   `json:"m"`
+	BestMatch    bool   `json:"M"`
+}
+
+// The REST form of an aggregate trade omits the event fields.
+type restAggTrade struct {
+	AggTradeId   int64  `json:"a"`
+	Price        string `json:"p"`
+	Quantity     string `json:"q"`
+	FirstTradeId int64  `json:"f"`
+	LastTradeId  int64  `json:"l"`
+	TradeTime    int64  `json:"T"`
+	BuyerMaker   bool   `json:"m"`
+	BestMatch    bool   `json:"M"`
+}
+
+type bookTickerMessage struct {
+	UpdateId    int64  `json:"u"`
+	Symbol      string `json:"s"`
+	BidPrice    string `json:"b"`
+	BidQuantity string `json:"B"`
+	AskPrice    string `json:"a"`
+	AskQuantity string `json:"A"`
+}
+
+type executionReportMessage struct {
+	EventType                string `json:"e"`
+	EventTime                int64  `json:"E"`
+	Symbol                   string `json:"s"`
+	ClientOrderId            string `json:"c"`
+	Side                     string `json:"S"`
+	OrderType                string `json:"o"`
+	TimeInForce              string `json:"f"`
+	Quantity                 string `json:"q"`
+	Price                    string `json:"p"`
+	StopPrice                string `json:"P"`
+	IcebergQuantity          string `json:"F"`
+	OrderListId              int64  `json:"g"`
+	OriginalClientOrderId    string `json:"C"`
+	ExecutionType            string `json:"x"`
+	OrderStatus              string `json:"X"`
+	RejectReason             string `json:"r"`
+	OrderId                  int64  `json:"i"`
+	LastExecutedQuantity     string `json:"l"`
+	CumulativeFilledQuantity string `json:"z"`
+	LastExecutedPrice        string `json:"L"`
+	CommissionAmount         string `json:"n"`
+	CommissionAsset          string `json:"N"`
+	TransactionTime          int64  `json:"T"`
+	TradeId                  int64  `json:"t"`
+	Ignore                   int64  `json:"I"`
+	IsWorking                bool   `json:"w"`
+	IsMaker                  bool   `json:"m"`
+	OrderCreationTime        int64  `json:"O"`
+	CumulativeQuoteQuantity  string `json:"Z"`
+	LastQuoteQuantity        string `json:"Y"`
+}
+
+type streamBalance struct {
+	Asset  string `json:"a"`
+	Free   string `json:"f"`
+	Locked string `json:"l"`
+}
+
+type accountInfoMessage struct {
+	EventType       string          `json:"e"`
+	EventTime       int64           `json:"E"`
+	MakerCommission int64           `json:"m"`
+	TakerCommission int64           `json:"t"`
+	CanTrade        bool            `json:"T"`
+	CanWithdraw     bool            `json:"W"`
+	CanDeposit      bool            `json:"D"`
+	LastUpdateTime  int64           `json:"u"`
+	Balances        []streamBalance `json:"B"`
+}
+
+type orderResponse struct {
+	Symbol              string `json:"symbol"`
+	OrderId             int64  `json:"orderId"`
+	ClientOrderId       string `json:"clientOrderId"`
+	TransactTime        int64  `json:"transactTime,omitempty"`
+	Price               string `json:"price"`
+	OrigQty             string `json:"origQty"`
+	ExecutedQty         string `json:"executedQty"`
+	CummulativeQuoteQty string `json:"cummulativeQuoteQty"`
+	Status              string `json:"status"`
+	TimeInForce         string `json:"timeInForce"`
+	Type                string `json:"type"`
+	Side                string `json:"side"`
+	StopPrice           string `json:"stopPrice,omitempty"`
+	IcebergQty          string `json:"icebergQty,omitempty"`
+	Time                int64  `json:"time,omitempty"`
+	UpdateTime          int64  `json:"updateTime,omitempty"`
+	IsWorking           *bool  `json:"isWorking,omitempty"`
+	OrigClientOrderId   string `json:"origClientOrderId,omitempty"`
+}
+
+func newOrderResponse(o *order) orderResponse {
+	return orderResponse{
+		Symbol:              o.symbol,
+		OrderId:             o.orderId,
+		ClientOrderId:       o.clientOrderId,
+		Price:               formatFloat(o.price),
+		OrigQty:             formatFloat(o.quantity),
+		ExecutedQty:         formatFloat(o.executedQuantity),
+		CummulativeQuoteQty: formatFloat(o.cumulativeQuoteQty),
+		Status:              o.status,
+		TimeInForce:         o.timeInForce,
+		Type:                o.orderType,
+		Side:                o.side,
+	}
+}
+
+type myTradesEntry struct {
+	Symbol          string `json:"symbol"`
+	Id              int64  `json:"id"`
+	OrderId         int64  `json:"orderId"`
+	Price           string `json:"price"`
+	Qty             string `json:"qty"`
+	QuoteQty        string `json:"quoteQty"`
+	Commission      string `json:"commission"`
+	CommissionAsset string `json:"commissionAsset"`
+	Time            int64  `json:"time"`
+	IsBuyer         bool   `json:"isBuyer"`
+	IsMaker         bool   `json:"isMaker"`
+	IsBestMatch     bool   `json:"isBestMatch"`
+}
+
+type exchangeInfoFilter struct {
+	FilterType       string `json:"filterType"`
+	MinPrice         string `json:"minPrice,omitempty"`
+	MaxPrice         string `json:"maxPrice,omitempty"`
+	TickSize         string `json:"tickSize,omitempty"`
+	MinQty           string `json:"minQty,omitempty"`
+	MaxQty           string `json:"maxQty,omitempty"`
+	StepSize         string `json:"stepSize,omitempty"`
+	MinNotional      string `json:"minNotional,omitempty"`
+	ApplyToMarket    *bool  `json:"applyToMarket,omitempty"`
+	AveragePriceMins *int   `json:"avgPriceMins,omitempty"`
+}
+
+type exchangeInfoSymbol struct {
+	Symbol             string               `json:"symbol"`
+	Status             string               `json:"status"`
+	BaseAsset          string               `json:"baseAsset"`
+	BaseAssetPrecision int                  `json:"baseAssetPrecision"`
+	QuoteAsset         string               `json:"quoteAsset"`
+	QuotePrecision     int                  `json:"quotePrecision"`
+	OrderTypes         []string             `json:"orderTypes"`
+	IcebergAllowed     bool                 `json:"icebergAllowed"`
+	Filters            []exchangeInfoFilter `json:"filters"`
+}
+
+type exchangeInfoResponse struct {
+	Timezone   string               `json:"timezone"`
+	ServerTime int64                `json:"serverTime"`
+	RateLimits []interface{}        `json:"rateLimits"`
+	Symbols    []exchangeInfoSymbol `json:"symbols"`
+}
+
+type accountBalance struct {
+	Asset  string `json:"asset"`
+	Free   string `json:"free"`
+	Locked string `json:"locked"`
+}
+
+type accountResponse struct {
+	MakerCommission  int64            `json:"makerCommission"`
+	TakerCommission  int64            `json:"takerCommission"`
+	BuyerCommission  int64            `json:"buyerCommission"`
+	SellerCommission int64            `json:"sellerCommission"`
+	CanTrade         bool             `json:"canTrade"`
+	CanWithdraw      bool             `json:"canWithdraw"`
+	CanDeposit       bool             `json:"canDeposit"`
+	UpdateTime       int64            `json:"updateTime"`
+	Balances         []accountBalance `json:"balances"`
+}
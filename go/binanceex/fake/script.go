@@ -0,0 +1,189 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package fake
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultScript sets up a few symbols and a funded account.
+const DefaultScript = `
+symbol ETHBTC ETH BTC 0.031 0.000001 0.001 0.001
+symbol BNBBTC BNB BTC 0.0037 0.0000001 0.01 0.001
+symbol BTCUSDT BTC USDT 4000 0.01 0.000001 10
+symbol ETHUSDT ETH USDT 130 0.01 0.00001 10
+balance BTC 1
+balance USDT 10000
+`
+
+// The quantity of a trade when not given. Large enough to fill any
+// resting order it crosses.
+const defaultTradeQuantity = 1000000
+
+// RunScript executes script commands, one per line, against the order book.
+// Blank lines and lines starting with # are ignored.
+//
+//	symbol SYMBOL BASE QUOTE PRICE [TICK_SIZE [STEP_SIZE [MIN_NOTIONAL]]]
+//	balance ASSET AMOUNT
+//	book SYMBOL BID ASK
+//	trade SYMBOL PRICE [QUANTITY]
+//	ramp SYMBOL FROM_PRICE TO_PRICE STEPS INTERVAL [QUANTITY]
+//	sleep DURATION
+//
+// ramp prints STEPS trades moving linearly from FROM_PRICE to TO_PRICE,
+// INTERVAL apart. Durations are Go durations, eg. 500ms.
+func RunScript(book *OrderBook, reader io.Reader) error {
+	scanner := bufio.NewScanner(reader)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := runCommand(book, strings.Fields(line)); err != nil {
+			return fmt.Errorf("line %d: %s: %v", lineNumber, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func runCommand(book *OrderBook, args []string) error {
+	command := args[0]
+	args = args[1:]
+	switch command {
+	case "symbol":
+		if len(args) < 4 {
+			return fmt.Errorf("usage: symbol SYMBOL BASE QUOTE PRICE [TICK_SIZE [STEP_SIZE [MIN_NOTIONAL]]]")
+		}
+		values, err := parseFloats(args[3:])
+		if err != nil {
+			return err
+		}
+		config := SymbolConfig{
+			Symbol:      args[0],
+			BaseAsset:   strings.ToUpper(args[1]),
+			QuoteAsset:  strings.ToUpper(args[2]),
+			TickSize:    0.00000001,
+			StepSize:    0.001,
+			MinNotional: 0,
+		}
+		if len(values) > 1 {
+			config.TickSize = values[1]
+		}
+		if len(values) > 2 {
+			config.StepSize = values[2]
+		}
+		if len(values) > 3 {
+			config.MinNotional = values[3]
+		}
+		book.AddSymbol(config, values[0])
+	case "balance":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: balance ASSET AMOUNT")
+		}
+		values, err := parseFloats(args[1:])
+		if err != nil {
+			return err
+		}
+		book.SetBalance(args[0], values[0])
+	case "book":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: book SYMBOL BID ASK")
+		}
+		values, err := parseFloats(args[1:])
+		if err != nil {
+			return err
+		}
+		return book.SetBook(args[0], values[0], values[1])
+	case "trade":
+		if len(args) < 2 || len(args) > 3 {
+			return fmt.Errorf("usage: trade SYMBOL PRICE [QUANTITY]")
+		}
+		values, err := parseFloats(args[1:])
+		if err != nil {
+			return err
+		}
+		quantity := float64(defaultTradeQuantity)
+		if len(values) > 1 {
+			quantity = values[1]
+		}
+		return book.Trade(args[0], values[0], quantity)
+	case "ramp":
+		if len(args) < 5 || len(args) > 6 {
+			return fmt.Errorf("usage: ramp SYMBOL FROM_PRICE TO_PRICE STEPS INTERVAL [QUANTITY]")
+		}
+		values, err := parseFloats(args[1:3])
+		if err != nil {
+			return err
+		}
+		steps, err := strconv.Atoi(args[3])
+		if err != nil || steps < 1 {
+			return fmt.Errorf("invalid steps: %s", args[3])
+		}
+		interval, err := time.ParseDuration(args[4])
+		if err != nil {
+			return err
+		}
+		quantity := float64(defaultTradeQuantity)
+		if len(args) > 5 {
+			quantities, err := parseFloats(args[5:])
+			if err != nil {
+				return err
+			}
+			quantity = quantities[0]
+		}
+		from, to := values[0], values[1]
+		for i := 1; i <= steps; i++ {
+			price := from + (to-from)*float64(i)/float64(steps)
+			if err := book.Trade(args[0], price, quantity); err != nil {
+				return err
+			}
+			if i < steps {
+				time.Sleep(interval)
+			}
+		}
+	case "sleep":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: sleep DURATION")
+		}
+		duration, err := time.ParseDuration(args[0])
+		if err != nil {
+			return err
+		}
+		time.Sleep(duration)
+	default:
+		return fmt.Errorf("unknown command: %s", command)
+	}
+	return nil
+}
+
+func parseFloats(args []string) ([]float64, error) {
+	values := []float64{}
+	for _, arg := range args {
+		value, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number: %s", arg)
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
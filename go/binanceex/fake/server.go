@@ -0,0 +1,464 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package fake
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"gitlab.com/crankykernel/maker/go/log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Server implements the subset of the Binance REST API and websocket streams
+// used by Maker on top of an OrderBook. Request signatures are not checked.
+//
+// The order book can be scripted at runtime by posting a script to
+// /fake/script.
+type Server struct {
+	book *OrderBook
+
+	lock        sync.Mutex
+	subscribers map[string]map[chan []byte]bool
+	listenKeys  map[string]bool
+
+	router *mux.Router
+}
+
+func NewServer(book *OrderBook) *Server {
+	s := &Server{
+		book:        book,
+		subscribers: make(map[string]map[chan []byte]bool),
+		listenKeys:  make(map[string]bool),
+		router:      mux.NewRouter(),
+	}
+	book.lock.Lock()
+	book.publish = s.publish
+	book.lock.Unlock()
+
+	// Binance has moved endpoints between API versions, serve them all
+	// under both.
+	for _, version := range []string{"v1", "v3"} {
+		prefix := fmt.Sprintf("/api/%s", version)
+		s.router.HandleFunc(prefix+"/ping", s.pingHandler).Methods("GET")
+		s.router.HandleFunc(prefix+"/time", s.timeHandler).Methods("GET")
+		s.router.HandleFunc(prefix+"/exchangeInfo", s.exchangeInfoHandler).Methods("GET")
+		s.router.HandleFunc(prefix+"/ticker/price", s.priceTickerHandler).Methods("GET")
+		s.router.HandleFunc(prefix+"/ticker/bookTicker", s.bookTickerHandler).Methods("GET")
+		s.router.HandleFunc(prefix+"/aggTrades", s.aggTradesHandler).Methods("GET")
+		s.router.HandleFunc(prefix+"/order", s.postOrderHandler).Methods("POST")
+		s.router.HandleFunc(prefix+"/order", s.cancelOrderHandler).Methods("DELETE")
+		s.router.HandleFunc(prefix+"/order", s.getOrderHandler).Methods("GET")
+		s.router.HandleFunc(prefix+"/openOrders", s.openOrdersHandler).Methods("GET")
+		s.router.HandleFunc(prefix+"/myTrades", s.myTradesHandler).Methods("GET")
+		s.router.HandleFunc(prefix+"/account", s.accountHandler).Methods("GET")
+		s.router.HandleFunc(prefix+"/userDataStream", s.createListenKeyHandler).Methods("POST")
+		s.router.HandleFunc(prefix+"/userDataStream", s.keepAliveListenKeyHandler).Methods("PUT")
+		s.router.HandleFunc(prefix+"/userDataStream", s.deleteListenKeyHandler).Methods("DELETE")
+	}
+	s.router.HandleFunc("/ws/{stream}", s.streamHandler)
+	s.router.HandleFunc("/fake/script", s.scriptHandler).Methods("POST")
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.WithFields(log.Fields{
+		"method": r.Method,
+		"path":   r.URL.Path,
+	}).Debugf("Fake Binance request")
+	s.router.ServeHTTP(w, r)
+}
+
+// publish sends a message to all subscribers of a stream. Slow subscribers
+// miss messages rather than blocking the order book.
+func (s *Server) publish(stream string, message interface{}) {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		log.WithError(err).Errorf("Fake Binance: failed to encode stream message")
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for channel := range s.subscribers[stream] {
+		select {
+		case channel <- payload:
+		default:
+			log.WithField("stream", stream).
+				Warnf("Fake Binance: dropped message for slow subscriber")
+		}
+	}
+}
+
+func (s *Server) subscribe(stream string) chan []byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	channel := make(chan []byte, 1024)
+	if s.subscribers[stream] == nil {
+		s.subscribers[stream] = make(map[chan []byte]bool)
+	}
+	s.subscribers[stream][channel] = true
+	return channel
+}
+
+func (s *Server) unsubscribe(stream string, channel chan []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.subscribers[stream], channel)
+}
+
+func writeJson(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	encoder := json.NewEncoder(w)
+	encoder.Encode(body)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	apiError, ok := err.(*Error)
+	if !ok {
+		apiError = newError(errorCodeUnknown, "%s", err.Error())
+	}
+	writeJson(w, http.StatusBadRequest, apiError)
+}
+
+func formFloat(r *http.Request, name string) (float64, error) {
+	value := r.Form.Get(name)
+	if value == "" {
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, newError(errorCodeBadParameter, "Illegal characters found in parameter '%s'.", name)
+	}
+	return f, nil
+}
+
+func formInt64(r *http.Request, name string) (int64, error) {
+	value := r.Form.Get(name)
+	if value == "" {
+		return 0, nil
+	}
+	i, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, newError(errorCodeBadParameter, "Illegal characters found in parameter '%s'.", name)
+	}
+	return i, nil
+}
+
+func (s *Server) pingHandler(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, map[string]interface{}{})
+}
+
+func (s *Server) timeHandler(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"serverTime": nowMillis(),
+	})
+}
+
+func (s *Server) exchangeInfoHandler(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, s.book.exchangeInfo())
+}
+
+func (s *Server) priceTickerHandler(w http.ResponseWriter, r *http.Request) {
+	symbol := strings.ToUpper(r.FormValue("symbol"))
+	last, _, _, err := s.book.prices(symbol)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"symbol": symbol,
+		"price":  formatFloat(last),
+	})
+}
+
+func (s *Server) bookTickerHandler(w http.ResponseWriter, r *http.Request) {
+	symbol := strings.ToUpper(r.FormValue("symbol"))
+	_, bid, ask, err := s.book.prices(symbol)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"symbol":   symbol,
+		"bidPrice": formatFloat(bid),
+		"bidQty":   formatFloat(100),
+		"askPrice": formatFloat(ask),
+		"askQty":   formatFloat(100),
+	})
+}
+
+func (s *Server) aggTradesHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	fromId, err := formInt64(r, "fromId")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	startTime, err := formInt64(r, "startTime")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	endTime, err := formInt64(r, "endTime")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	limit, err := formInt64(r, "limit")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if limit == 0 {
+		limit = 500
+	}
+	trades, err := s.book.aggTrades(r.Form.Get("symbol"), fromId, startTime, endTime, int(limit))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJson(w, http.StatusOK, trades)
+}
+
+func (s *Server) postOrderHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	quantity, err := formFloat(r, "quantity")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	price, err := formFloat(r, "price")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	order, err := s.book.PlaceOrder(OrderRequest{
+		Symbol:        r.Form.Get("symbol"),
+		Side:          r.Form.Get("side"),
+		Type:          r.Form.Get("type"),
+		TimeInForce:   r.Form.Get("timeInForce"),
+		Quantity:      quantity,
+		Price:         price,
+		ClientOrderId: r.Form.Get("newClientOrderId"),
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	response := newOrderResponse(order)
+	response.TransactTime = order.time
+	writeJson(w, http.StatusOK, response)
+}
+
+func (s *Server) cancelOrderHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	orderId, err := formInt64(r, "orderId")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	order, cancelClientOrderId, err := s.book.CancelOrder(r.Form.Get("symbol"),
+		orderId, r.Form.Get("origClientOrderId"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	response := newOrderResponse(order)
+	response.OrigClientOrderId = order.clientOrderId
+	response.ClientOrderId = cancelClientOrderId
+	writeJson(w, http.StatusOK, response)
+}
+
+func (s *Server) getOrderHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	orderId, err := formInt64(r, "orderId")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	order, err := s.book.GetOrder(r.Form.Get("symbol"), orderId, r.Form.Get("origClientOrderId"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	response := newOrderResponse(order)
+	isWorking := order.isOpen()
+	response.StopPrice = formatFloat(0)
+	response.IcebergQty = formatFloat(0)
+	response.Time = order.time
+	response.UpdateTime = order.updateTime
+	response.IsWorking = &isWorking
+	writeJson(w, http.StatusOK, response)
+}
+
+func (s *Server) openOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	responses := []orderResponse{}
+	for _, order := range s.book.OpenOrders(r.Form.Get("symbol")) {
+		response := newOrderResponse(order)
+		isWorking := true
+		response.StopPrice = formatFloat(0)
+		response.IcebergQty = formatFloat(0)
+		response.Time = order.time
+		response.UpdateTime = order.updateTime
+		response.IsWorking = &isWorking
+		responses = append(responses, response)
+	}
+	writeJson(w, http.StatusOK, responses)
+}
+
+func (s *Server) myTradesHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	orderId, err := formInt64(r, "orderId")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	fromId, err := formInt64(r, "fromId")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	limit, err := formInt64(r, "limit")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if limit <= 0 {
+		limit = 500
+	}
+	trades := []myTradesEntry{}
+	for _, fill := range s.book.Fills(r.Form.Get("symbol"), orderId, fromId, int(limit)) {
+		trades = append(trades, myTradesEntry{
+			Symbol:          fill.symbol,
+			Id:              fill.id,
+			OrderId:         fill.orderId,
+			Price:           formatFloat(fill.price),
+			Qty:             formatFloat(fill.quantity),
+			QuoteQty:        formatFloat(fill.price * fill.quantity),
+			Commission:      formatFloat(fill.commission),
+			CommissionAsset: fill.commissionAsset,
+			Time:            fill.time,
+			IsBuyer:         fill.isBuyer,
+			IsMaker:         fill.isMaker,
+			IsBestMatch:     true,
+		})
+	}
+	writeJson(w, http.StatusOK, trades)
+}
+
+func (s *Server) accountHandler(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, s.book.account())
+}
+
+func (s *Server) createListenKeyHandler(w http.ResponseWriter, r *http.Request) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		writeError(w, err)
+		return
+	}
+	listenKey := hex.EncodeToString(buf)
+	s.lock.Lock()
+	s.listenKeys[listenKey] = true
+	s.lock.Unlock()
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"listenKey": listenKey,
+	})
+}
+
+func (s *Server) keepAliveListenKeyHandler(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, map[string]interface{}{})
+}
+
+func (s *Server) deleteListenKeyHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	s.lock.Lock()
+	delete(s.listenKeys, r.Form.Get("listenKey"))
+	s.lock.Unlock()
+	writeJson(w, http.StatusOK, map[string]interface{}{})
+}
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+func (s *Server) streamHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["stream"]
+
+	var stream string
+	if parts := strings.SplitN(name, "@", 2); len(parts) == 2 {
+		stream = symbolStream(parts[0], parts[1])
+	} else {
+		s.lock.Lock()
+		valid := s.listenKeys[name]
+		s.lock.Unlock()
+		if !valid {
+			http.Error(w, "invalid listen key", http.StatusNotFound)
+			return
+		}
+		stream = streamUser
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.WithError(err).Errorf("Fake Binance: failed to upgrade websocket")
+		return
+	}
+	defer conn.Close()
+
+	channel := s.subscribe(stream)
+	defer s.unsubscribe(stream, channel)
+
+	// Reading handles pings and notices the client going away.
+	done := make(chan bool)
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				close(done)
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case payload := <-channel:
+			if err := conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (s *Server) scriptHandler(w http.ResponseWriter, r *http.Request) {
+	if err := RunScript(s.book, r.Body); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]interface{}{})
+}
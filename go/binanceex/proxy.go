@@ -0,0 +1,115 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package binanceex
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"gitlab.com/crankykernel/maker/go/config"
+	"gitlab.com/crankykernel/maker/go/log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+)
+
+// The endpoints the web UI uses through the proxy, by method and path, and
+// whether they are signed. Anything else is refused, so the proxy can't be
+// used to sign requests the UI doesn't make, such as withdrawals.
+var proxyEndpoints = map[string]bool{
+	"GET /api/v3/account":      true,
+	"GET /api/v1/exchangeInfo": false,
+	"GET /api/v1/ticker/24hr":  false,
+}
+
+// Sign returns the hex encoded HMAC SHA256 signature Binance expects for
+// the given parameters.
+func Sign(secret string, params string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(params))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewProxyHandler returns a handler that proxies the requests the web UI
+// makes to the Binance REST API, adding the API key, timestamp and signature
+// to those that are signed. This keeps the API secret on the server.
+//
+// Any API key, timestamp or signature sent by the client is replaced. A
+// request that can't be signed is refused rather than forwarded.
+func NewProxyHandler() http.Handler {
+	proxy := &httputil.ReverseProxy{
+		Transport: restClient.Transport,
+		Director: func(request *http.Request) {
+			// Don't forward the browser session to Binance.
+			request.Header.Del("Cookie")
+			request.Header.Del("Authorization")
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+		logFields := log.Fields{
+			"method": request.Method,
+			"path":   request.URL.Path,
+		}
+		signed, ok := proxyEndpoints[request.Method+" "+request.URL.Path]
+		if !ok {
+			log.WithFields(logFields).Warnf("Refusing Binance proxy request to an endpoint not used by the UI")
+			http.Error(w, "endpoint not allowed", http.StatusForbidden)
+			return
+		}
+		target, err := url.Parse(RestBaseUrl())
+		if err != nil {
+			log.WithError(err).Errorf("Invalid Binance REST URL")
+			http.Error(w, "invalid Binance REST URL", http.StatusInternalServerError)
+			return
+		}
+		request.Header.Del("X-MBX-APIKEY")
+		if signed {
+			if err := signProxyRequest(request); err != nil {
+				log.WithError(err).WithFields(logFields).
+					Errorf("Failed to sign Binance proxy request")
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		request.URL.Scheme = target.Scheme
+		request.URL.Host = target.Host
+		request.URL.Path = target.Path + request.URL.Path
+		request.Host = target.Host
+
+		// The UI comes after the trades when close to the rate limits.
+		proxy.ServeHTTP(w, request.WithContext(context.WithValue(request.Context(),
+			proxiedRequestKey{}, true)))
+	})
+}
+
+func signProxyRequest(request *http.Request) error {
+	apiKey := config.GetString("binance.api.key")
+	apiSecret := config.GetString("binance.api.secret")
+	if apiKey == "" || apiSecret == "" {
+		return fmt.Errorf("binance api key not configured")
+	}
+	request.Header.Set("X-MBX-APIKEY", apiKey)
+
+	params := request.URL.Query()
+	params.Del("signature")
+	params.Set("timestamp", fmt.Sprintf("%d", time.Now().UnixNano()/int64(time.Millisecond)))
+	query := params.Encode()
+	request.URL.RawQuery = fmt.Sprintf("%s&signature=%s", query, Sign(apiSecret, query))
+	return nil
+}
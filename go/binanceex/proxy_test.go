@@ -0,0 +1,128 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package binanceex
+
+import (
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// The example from the Binance API documentation.
+func TestSign(t *testing.T) {
+	secret := "NhqPtmdSJYdKjVHjA7PZj4Mge3R5YNiP1e3UZjInClVN65XAbvqqM6A7H5fATj0j"
+	params := "symbol=LTCBTC&side=BUY&type=LIMIT&timeInForce=GTC&quantity=1&price=0.1&recvWindow=5000&timestamp=1499827319559"
+	assert.Equal(t, "c8db56825ae71d6d79447849e617115f4a920fa2acdcab2b053c4b2838bd6b71",
+		Sign(secret, params))
+}
+
+func TestProxySignsRequests(t *testing.T) {
+	var received *http.Request
+	binance := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+	}))
+	defer binance.Close()
+	assert.Nil(t, SetBaseUrl(binance.URL, ""))
+	defer SetBaseUrl(DefaultRestBaseUrl, DefaultStreamBaseUrl)
+
+	viper.Set("binance.api.key", "key")
+	viper.Set("binance.api.secret", "secret")
+	defer viper.Set("binance.api.key", "")
+	defer viper.Set("binance.api.secret", "")
+
+	proxy := httptest.NewServer(NewProxyHandler())
+	defer proxy.Close()
+
+	// A signed endpoint with a bogus client signature.
+	response, err := http.Get(proxy.URL + "/api/v3/account?recvWindow=5000&signature=bogus")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "key", received.Header.Get("X-MBX-APIKEY"))
+	query := received.URL.RawQuery
+	signatureIndex := strings.LastIndex(query, "&signature=")
+	assert.True(t, signatureIndex > 0)
+	assert.Equal(t, Sign("secret", query[:signatureIndex]), query[signatureIndex+len("&signature="):])
+	params, _ := url.ParseQuery(query)
+	assert.Equal(t, "5000", params.Get("recvWindow"))
+	assert.Equal(t, []string{params.Get("signature")}, params["signature"])
+	assert.NotEmpty(t, params.Get("timestamp"))
+
+	// Public endpoints are not signed.
+	received = nil
+	request, _ := http.NewRequest("GET", proxy.URL+"/api/v1/exchangeInfo", nil)
+	request.Header.Set("X-MBX-APIKEY", "client")
+	_, err = http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	assert.Equal(t, "", received.URL.RawQuery)
+	assert.Equal(t, "", received.Header.Get("X-MBX-APIKEY"))
+}
+
+func TestProxyRefusesRequests(t *testing.T) {
+	forwarded := false
+	binance := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = true
+	}))
+	defer binance.Close()
+	assert.Nil(t, SetBaseUrl(binance.URL, ""))
+	defer SetBaseUrl(DefaultRestBaseUrl, DefaultStreamBaseUrl)
+
+	viper.Set("binance.api.key", "key")
+	viper.Set("binance.api.secret", "secret")
+	defer viper.Set("binance.api.key", "")
+	defer viper.Set("binance.api.secret", "")
+
+	proxy := httptest.NewServer(NewProxyHandler())
+	defer proxy.Close()
+
+	// Endpoints the UI doesn't use, including signed ones.
+	for _, request := range []struct {
+		method string
+		path   string
+	}{
+		{"POST", "/sapi/v1/capital/withdraw/apply?coin=BTC&amount=1"},
+		{"POST", "/wapi/v3/withdraw.html?asset=BTC&amount=1"},
+		{"POST", "/api/v3/order?symbol=ETHBTC&side=SELL"},
+		{"DELETE", "/api/v3/account"},
+		{"GET", "/api/v3/account/../../sapi/v1/account"},
+	} {
+		r, _ := http.NewRequest(request.method, proxy.URL+request.path, nil)
+		response, err := http.DefaultClient.Do(r)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusForbidden, response.StatusCode, request.path)
+	}
+	assert.False(t, forwarded)
+
+	// A signed endpoint without the secret to sign it.
+	viper.Set("binance.api.secret", "")
+	response, err := http.Get(proxy.URL + "/api/v3/account")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusInternalServerError, response.StatusCode)
+	assert.False(t, forwarded)
+
+	// An invalid Binance URL.
+	viper.Set("binance.api.secret", "secret")
+	baseUrlLock.Lock()
+	restBaseUrl = "http://[::1"
+	baseUrlLock.Unlock()
+	response, err = http.Get(proxy.URL + "/api/v1/exchangeInfo")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusInternalServerError, response.StatusCode)
+	assert.False(t, forwarded)
+}
@@ -0,0 +1,417 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package binanceex
+
+import (
+	"bytes"
+	"fmt"
+	"gitlab.com/crankykernel/maker/go/log"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RequestPriority decides how close to the Binance limits a request can be
+// sent.
+type RequestPriority int
+
+const (
+	// Bulk history and UI requests, held back first.
+	PriorityLow RequestPriority = iota
+	PriorityNormal
+	// Market sells and cancels, the exits of trades. These are never held
+	// back and have headroom reserved for them.
+	PriorityHigh
+)
+
+func (p RequestPriority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityHigh:
+		return "high"
+	default:
+		return "normal"
+	}
+}
+
+// Context key marking requests proxied for the UI, which are sent at low
+// priority.
+type proxiedRequestKey struct{}
+
+func isProxiedRequest(request *http.Request) bool {
+	proxied, _ := request.Context().Value(proxiedRequestKey{}).(bool)
+	return proxied
+}
+
+// Endpoints that are always low priority.
+var lowPriorityEndpoints = []string{
+	"/api/v3/myTrades",
+	"/api/v3/allOrders",
+	"/api/v3/allOrderList",
+	"/api/v1/aggTrades",
+	"/api/v1/klines",
+	"/api/v1/exchangeInfo",
+}
+
+// Request weights of the endpoints that weigh more than 1, and their weight
+// when no symbol is given.
+var endpointWeights = map[string][2]int64{
+	"/api/v3/account":           {5, 5},
+	"/api/v3/myTrades":          {5, 5},
+	"/api/v3/allOrders":         {5, 5},
+	"/api/v3/allOrderList":      {5, 5},
+	"/api/v3/openOrders":        {1, 40},
+	"/api/v1/ticker/24hr":       {1, 40},
+	"/api/v3/ticker/price":      {1, 2},
+	"/api/v3/ticker/bookTicker": {1, 2},
+}
+
+// RateLimiter keeps the REST requests to Binance under the request weight
+// and order rate limits. The used weight and order count are estimated from
+// the requests sent, and corrected from the X-MBX-USED-WEIGHT and
+// X-MBX-ORDER-COUNT headers of the responses.
+//
+// Low and normal priority requests that would take the weight, or order
+// count, into the headroom above their threshold are rejected, unless the
+// limit resets within MaxWait. Proxied requests from the UI never wait. High
+// priority requests are always sent, unless Binance has banned the IP with
+// a 418.
+type RateLimiter struct {
+	// Request weight per minute and orders per 10 seconds.
+	WeightLimit int64
+	OrderLimit  int64
+
+	// Part of the limits only high priority requests can use, and the
+	// part above that low priority requests can't use.
+	HighReserve float64
+	LowReserve  float64
+
+	// How long a request may wait for the limits to reset. 0 by default,
+	// as the trade service makes its requests holding its execution lock
+	// and a wait there would hold up every trade.
+	MaxWait time.Duration
+
+	lock         sync.Mutex
+	weightWindow time.Time
+	usedWeight   int64
+	orderWindow  time.Time
+	orderCount   int64
+
+	// Set when Binance responds with 429, nothing but high priority
+	// requests is sent until then.
+	retryAfter time.Time
+
+	// Set when Binance responds with 418 as the IP is banned, nothing is
+	// sent until then.
+	bannedUntil time.Time
+
+	now func() time.Time
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		WeightLimit: 1200,
+		OrderLimit:  100,
+		HighReserve: 0.1,
+		LowReserve:  0.3,
+		now:         time.Now,
+	}
+}
+
+// The limiter used for all Binance REST requests once enabled.
+var rateLimiter = NewRateLimiter()
+
+// EnableRateLimiter puts the REST requests of the Binance client, and the
+// proxy, through the rate limiter. Must be called before the proxy handler
+// is created.
+func EnableRateLimiter() {
+	restClient.Transport = &rateLimitTransport{
+		limiter: rateLimiter,
+		next:    http.DefaultTransport,
+	}
+}
+
+// RateLimitError is returned for a request that was not sent as it would
+// have gone over the rate limits.
+type RateLimitError struct {
+	Priority RequestPriority
+	Path     string
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s priority request to %s held back by rate limit", e.Priority, e.Path)
+}
+
+// Used returns the request weight used in the current minute and the
+// orders placed in the current 10 seconds.
+func (l *RateLimiter) Used() (weight int64, orders int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.rollWindows(l.now())
+	return l.usedWeight, l.orderCount
+}
+
+// Starts new windows when the minute or 10 seconds are up. Must be called
+// with the lock held.
+func (l *RateLimiter) rollWindows(now time.Time) {
+	if window := now.Truncate(time.Minute); window != l.weightWindow {
+		l.weightWindow = window
+		l.usedWeight = 0
+	}
+	if window := now.Truncate(10 * time.Second); window != l.orderWindow {
+		l.orderWindow = window
+		l.orderCount = 0
+	}
+}
+
+// The share of a limit a request of the priority can use.
+func (l *RateLimiter) threshold(limit int64, priority RequestPriority) int64 {
+	switch priority {
+	case PriorityLow:
+		return int64(float64(limit) * (1 - l.HighReserve - l.LowReserve))
+	case PriorityNormal:
+		return int64(float64(limit) * (1 - l.HighReserve))
+	default:
+		return limit
+	}
+}
+
+// Takes weight, and an order if isOrder, for a request of the priority.
+// Returns when it was taken, or the time to try again if not.
+func (l *RateLimiter) take(priority RequestPriority, weight int64, isOrder bool) (bool, time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.now()
+	l.rollWindows(now)
+	if now.Before(l.bannedUntil) {
+		return false, l.bannedUntil
+	}
+	if priority != PriorityHigh {
+		if now.Before(l.retryAfter) {
+			return false, l.retryAfter
+		}
+		if l.usedWeight+weight > l.threshold(l.WeightLimit, priority) {
+			return false, l.weightWindow.Add(time.Minute)
+		}
+		if isOrder && l.orderCount+1 > l.threshold(l.OrderLimit, priority) {
+			return false, l.orderWindow.Add(10 * time.Second)
+		}
+	}
+	l.usedWeight += weight
+	if isOrder {
+		l.orderCount++
+	}
+	return true, now
+}
+
+// Wait blocks until a request of the priority and weight can be sent, or
+// returns an error if that would be longer than maxWait.
+func (l *RateLimiter) Wait(priority RequestPriority, path string, weight int64, isOrder bool,
+	maxWait time.Duration) error {
+	deadline := l.now().Add(maxWait)
+	for {
+		ok, retry := l.take(priority, weight, isOrder)
+		if ok {
+			return nil
+		}
+		if retry.After(deadline) {
+			return &RateLimitError{Priority: priority, Path: path}
+		}
+		log.WithFields(log.Fields{
+			"path":     path,
+			"priority": priority,
+			"retry":    retry,
+		}).Warnf("Binance request held back by rate limit.")
+		time.Sleep(retry.Sub(l.now()))
+	}
+}
+
+// Update corrects the used weight and order count from the headers of a
+// Binance response, and backs off on a 429 or 418.
+func (l *RateLimiter) Update(response *http.Response) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.now()
+	l.rollWindows(now)
+	for _, header := range []string{"X-Mbx-Used-Weight-1m", "X-Mbx-Used-Weight"} {
+		if value, err := strconv.ParseInt(response.Header.Get(header), 10, 64); err == nil {
+			l.usedWeight = value
+			break
+		}
+	}
+	if value, err := strconv.ParseInt(response.Header.Get("X-Mbx-Order-Count-10s"), 10, 64); err == nil {
+		l.orderCount = value
+	}
+	if response.StatusCode == http.StatusTooManyRequests || response.StatusCode == 418 {
+		retryAfter := l.weightWindow.Add(time.Minute)
+		if seconds, err := strconv.ParseInt(response.Header.Get("Retry-After"), 10, 64); err == nil {
+			retryAfter = now.Add(time.Duration(seconds) * time.Second)
+		}
+		if response.StatusCode == 418 {
+			if retryAfter.After(l.bannedUntil) {
+				l.bannedUntil = retryAfter
+			}
+		} else if retryAfter.After(l.retryAfter) {
+			l.retryAfter = retryAfter
+		}
+		log.WithFields(log.Fields{
+			"status":     response.StatusCode,
+			"retryAfter": retryAfter,
+		}).Errorf("Binance rate limit exceeded, backing off.")
+	}
+}
+
+// Sets the limits from the rate limits of the exchange info.
+func (l *RateLimiter) setLimits(rateLimits []restRateLimit) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, rateLimit := range rateLimits {
+		switch {
+		case rateLimit.RateLimitType == "REQUEST_WEIGHT" && rateLimit.Interval == "MINUTE" &&
+			rateLimit.IntervalNum <= 1:
+			l.WeightLimit = rateLimit.Limit
+		case rateLimit.RateLimitType == "ORDERS" && rateLimit.Interval == "SECOND":
+			// Older exchange info has the limit per second.
+			intervalNum := rateLimit.IntervalNum
+			if intervalNum < 1 {
+				intervalNum = 1
+			}
+			l.OrderLimit = rateLimit.Limit * 10 / intervalNum
+		}
+	}
+}
+
+// Returns the query and form body parameters of a request, leaving the
+// body readable.
+func requestParams(request *http.Request) url.Values {
+	params := request.URL.Query()
+	if request.Body == nil || !strings.HasPrefix(request.Header.Get("Content-Type"),
+		"application/x-www-form-urlencoded") {
+		return params
+	}
+	body, err := ioutil.ReadAll(request.Body)
+	request.Body.Close()
+	request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return params
+	}
+	if bodyParams, err := url.ParseQuery(string(body)); err == nil {
+		for key, values := range bodyParams {
+			params[key] = append(params[key], values...)
+		}
+	}
+	return params
+}
+
+// Returns the priority, weight and if a request places an order.
+func classifyRequest(request *http.Request) (RequestPriority, int64, bool) {
+	path := request.URL.Path
+	params := requestParams(request)
+
+	weight := int64(1)
+	if weights, ok := endpointWeights[path]; ok {
+		weight = weights[0]
+		if params.Get("symbol") == "" {
+			weight = weights[1]
+		}
+	}
+
+	isOrder := request.Method == http.MethodPost &&
+		(path == "/api/v3/order" || path == "/api/v3/order/oco")
+
+	if isProxiedRequest(request) {
+		return PriorityLow, weight, isOrder
+	}
+	if path == "/api/v3/order" {
+		if request.Method == http.MethodDelete {
+			return PriorityHigh, weight, isOrder
+		}
+		if isOrder && params.Get("side") == "SELL" && params.Get("type") == "MARKET" {
+			return PriorityHigh, weight, isOrder
+		}
+	}
+	for _, endpoint := range lowPriorityEndpoints {
+		if path == endpoint {
+			return PriorityLow, weight, isOrder
+		}
+	}
+	return PriorityNormal, weight, isOrder
+}
+
+// True for requests to the Binance REST API, or the API configured in its
+// place.
+func isBinanceRestRequest(request *http.Request) bool {
+	if request.URL.Host == "api.binance.com" {
+		return true
+	}
+	if target, err := url.Parse(RestBaseUrl()); err == nil && request.URL.Host == target.Host {
+		return true
+	}
+	return false
+}
+
+// rateLimitTransport holds back Binance REST requests with the rate limiter
+// and updates it from the responses. Requests that are not sent get a 429
+// response like Binance would send.
+type rateLimitTransport struct {
+	limiter *RateLimiter
+	next    http.RoundTripper
+}
+
+func (t *rateLimitTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if !isBinanceRestRequest(request) {
+		return t.next.RoundTrip(request)
+	}
+
+	// A copy as the body may be replaced when classifying.
+	limited := new(http.Request)
+	*limited = *request
+	priority, weight, isOrder := classifyRequest(limited)
+	maxWait := t.limiter.MaxWait
+	if isProxiedRequest(limited) {
+		maxWait = 0
+	}
+
+	if err := t.limiter.Wait(priority, limited.URL.Path, weight, isOrder, maxWait); err != nil {
+		if limited.Body != nil {
+			limited.Body.Close()
+		}
+		body := fmt.Sprintf(`{"code":-1003,"msg":%q}`, err.Error())
+		return &http.Response{
+			Status:        "429 Too Many Requests",
+			StatusCode:    http.StatusTooManyRequests,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": []string{"application/json"}},
+			Body:          ioutil.NopCloser(strings.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       request,
+		}, nil
+	}
+
+	response, err := t.next.RoundTrip(limited)
+	if err != nil {
+		return nil, err
+	}
+	t.limiter.Update(response)
+	return response, nil
+}
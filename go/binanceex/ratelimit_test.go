@@ -0,0 +1,164 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package binanceex
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type roundTripFunc func(request *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(request *http.Request) (*http.Response, error) {
+	return f(request)
+}
+
+func TestRateLimiter(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)
+	limiter := NewRateLimiter()
+	limiter.WeightLimit = 100
+	limiter.OrderLimit = 10
+	limiter.now = func() time.Time {
+		return now
+	}
+
+	// Low priority requests stop at 60%, normal at 90%.
+	assert.Nil(limiter.Wait(PriorityLow, "/api/v3/myTrades", 60, false, 0))
+	assert.NotNil(limiter.Wait(PriorityLow, "/api/v3/myTrades", 1, false, 0))
+	assert.Nil(limiter.Wait(PriorityNormal, "/api/v3/order", 30, false, 0))
+	assert.NotNil(limiter.Wait(PriorityNormal, "/api/v3/order", 1, false, 0))
+
+	// High priority requests are always sent.
+	assert.Nil(limiter.Wait(PriorityHigh, "/api/v3/order", 20, true, 0))
+	weight, orders := limiter.Used()
+	assert.Equal(int64(110), weight)
+	assert.Equal(int64(1), orders)
+
+	// The weight is reset on the next minute.
+	now = now.Add(time.Minute)
+	assert.Nil(limiter.Wait(PriorityLow, "/api/v3/myTrades", 5, false, 0))
+
+	// The used weight header from Binance replaces the estimate.
+	limiter.Update(&http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"X-Mbx-Used-Weight-1m": []string{"95"}},
+	})
+	weight, _ = limiter.Used()
+	assert.Equal(int64(95), weight)
+
+	// A 429 holds back everything but high priority requests.
+	now = now.Add(time.Minute)
+	limiter.Update(&http.Response{
+		StatusCode: http.StatusTooManyRequests,
+		Header:     http.Header{"Retry-After": []string{"30"}},
+	})
+	assert.NotNil(limiter.Wait(PriorityNormal, "/api/v3/order", 1, false, 0))
+	assert.Nil(limiter.Wait(PriorityHigh, "/api/v3/order", 1, true, 0))
+	now = now.Add(31 * time.Second)
+	assert.Nil(limiter.Wait(PriorityNormal, "/api/v3/order", 1, false, 0))
+
+	// A 418 holds back high priority requests too.
+	limiter.Update(&http.Response{
+		StatusCode: 418,
+		Header:     http.Header{"Retry-After": []string{"120"}},
+	})
+	assert.NotNil(limiter.Wait(PriorityHigh, "/api/v3/order", 1, true, 0))
+	assert.NotNil(limiter.Wait(PriorityNormal, "/api/v3/order", 1, false, 0))
+	now = now.Add(121 * time.Second)
+	assert.Nil(limiter.Wait(PriorityHigh, "/api/v3/order", 1, true, 0))
+	assert.Nil(limiter.Wait(PriorityNormal, "/api/v3/order", 1, false, 0))
+}
+
+func TestRateLimitTransport(t *testing.T) {
+	assert := assert.New(t)
+	limiter := NewRateLimiter()
+	sent := 0
+	transport := &rateLimitTransport{
+		limiter: limiter,
+		next: roundTripFunc(func(request *http.Request) (*http.Response, error) {
+			sent++
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"X-Mbx-Used-Weight-1m": []string{"1100"}},
+				Body:       ioutil.NopCloser(strings.NewReader("{}")),
+			}, nil
+		}),
+	}
+
+	request, _ := http.NewRequest("GET", "https://api.binance.com/api/v3/account", nil)
+	priority, weight, isOrder := classifyRequest(request)
+	assert.Equal(PriorityNormal, priority)
+	assert.Equal(int64(5), weight)
+	assert.False(isOrder)
+	response, err := transport.RoundTrip(request)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, response.StatusCode)
+
+	// Close to the limit the UI gets a 429 without the request being sent.
+	request, _ = http.NewRequest("GET", "https://api.binance.com/api/v3/openOrders", nil)
+	request = request.WithContext(context.WithValue(request.Context(), proxiedRequestKey{}, true))
+	response, err = transport.RoundTrip(request)
+	assert.Nil(err)
+	assert.Equal(http.StatusTooManyRequests, response.StatusCode)
+	assert.Equal(1, sent)
+
+	// So do the requests of the trade service, rather than wait for the
+	// limit to reset holding the execution lock.
+	request, _ = http.NewRequest("GET", "https://api.binance.com/api/v3/order?symbol=ETHBTC&orderId=1", nil)
+	started := time.Now()
+	response, err = transport.RoundTrip(request)
+	assert.Nil(err)
+	assert.Equal(http.StatusTooManyRequests, response.StatusCode)
+	assert.True(time.Since(started) < time.Second)
+	assert.Equal(1, sent)
+
+	// A market sell still goes out.
+	request, _ = http.NewRequest("POST", "https://api.binance.com/api/v3/order",
+		strings.NewReader("symbol=ETHBTC&side=SELL&type=MARKET&quantity=1"))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	priority, _, isOrder = classifyRequest(request)
+	assert.Equal(PriorityHigh, priority)
+	assert.True(isOrder)
+	body, _ := ioutil.ReadAll(request.Body)
+	assert.Equal("symbol=ETHBTC&side=SELL&type=MARKET&quantity=1", string(body))
+	request.Body = ioutil.NopCloser(strings.NewReader(string(body)))
+	response, err = transport.RoundTrip(request)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, response.StatusCode)
+	assert.Equal(2, sent)
+}
+
+func TestEnableRateLimiter(t *testing.T) {
+	assert := assert.New(t)
+	defaultTransport := http.DefaultTransport
+	defer func() {
+		restClient.Transport = nil
+	}()
+
+	// Only the Binance client goes through the limiter.
+	EnableRateLimiter()
+	assert.Equal(defaultTransport, http.DefaultTransport)
+	transport, ok := restClient.Transport.(*rateLimitTransport)
+	assert.True(ok)
+	assert.Equal(rateLimiter, transport.limiter)
+	assert.Equal(defaultTransport, transport.next)
+}
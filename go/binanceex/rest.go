@@ -0,0 +1,136 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package binanceex
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// restClient is the HTTP client for all requests to the Binance REST API,
+// which are made to the configured base URL. The timeout bounds how long a
+// request in flight can leave the outcome of an order unknown.
+var restClient = &http.Client{
+	Timeout: 30 * time.Second,
+}
+
+// restRequest makes a request to the Binance REST API and returns the
+// response body. The API key header is only sent if apiKey is set.
+func restRequest(method string, path string, query string, apiKey string) ([]byte, error) {
+	requestUrl := fmt.Sprintf("%s%s", RestBaseUrl(), path)
+	if query != "" {
+		requestUrl = fmt.Sprintf("%s?%s", requestUrl, query)
+	}
+	request, err := http.NewRequest(method, requestUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	if apiKey != "" {
+		request.Header.Set("X-MBX-APIKEY", apiKey)
+	}
+
+	response, err := restClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, &RequestError{
+			Path:       path,
+			StatusCode: response.StatusCode,
+			Body:       body,
+		}
+	}
+	return body, nil
+}
+
+// RequestError is returned when Binance responds to a request with an error
+// status.
+type RequestError struct {
+	Path       string
+	StatusCode int
+	Body       []byte
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("%s request failed: status=%d; body=%s",
+		e.Path, e.StatusCode, string(e.Body))
+}
+
+// GetServerTime returns the Binance server time in milliseconds.
+func GetServerTime() (int64, error) {
+	body, err := restRequest("GET", "/api/v1/time", "", "")
+	if err != nil {
+		return 0, err
+	}
+	var response struct {
+		ServerTime int64 `json:"serverTime"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return 0, err
+	}
+	return response.ServerTime, nil
+}
+
+// GetLastPrice returns the last trade price of a symbol.
+func GetLastPrice(symbol string) (float64, error) {
+	params := url.Values{}
+	params.Set("symbol", symbol)
+	body, err := restRequest("GET", "/api/v3/ticker/price", params.Encode(), "")
+	if err != nil {
+		return 0, err
+	}
+	var ticker struct {
+		Price string `json:"price"`
+	}
+	if err := json.Unmarshal(body, &ticker); err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(ticker.Price, 64)
+}
+
+// GetBookTicker returns the best bid and ask price of a symbol.
+func GetBookTicker(symbol string) (bid float64, ask float64, err error) {
+	params := url.Values{}
+	params.Set("symbol", symbol)
+	body, err := restRequest("GET", "/api/v3/ticker/bookTicker", params.Encode(), "")
+	if err != nil {
+		return 0, 0, err
+	}
+	var ticker struct {
+		BidPrice string `json:"bidPrice"`
+		AskPrice string `json:"askPrice"`
+	}
+	if err := json.Unmarshal(body, &ticker); err != nil {
+		return 0, 0, err
+	}
+	if bid, err = strconv.ParseFloat(ticker.BidPrice, 64); err != nil {
+		return 0, 0, err
+	}
+	if ask, err = strconv.ParseFloat(ticker.AskPrice, 64); err != nil {
+		return 0, 0, err
+	}
+	return bid, ask, nil
+}
@@ -0,0 +1,419 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package binanceex
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/crankykernel/binanceapi-go"
+	"gitlab.com/crankykernel/maker/go/config"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// SignedRequest makes a request to a signed endpoint of the Binance REST API
+// with the configured API key and secret, and returns the response body. The
+// parameters are sent in the query string.
+func SignedRequest(method string, path string, params url.Values) ([]byte, error) {
+	apiKey := config.GetString("binance.api.key")
+	apiSecret := config.GetString("binance.api.secret")
+	if apiKey == "" || apiSecret == "" {
+		return nil, fmt.Errorf("binance api key or secret not configured")
+	}
+	return signedRequest(apiKey, apiSecret, method, path, params)
+}
+
+func signedRequest(apiKey string, apiSecret string, method string, path string,
+	params url.Values) ([]byte, error) {
+	if params == nil {
+		params = url.Values{}
+	}
+	params.Set("timestamp", strconv.FormatInt(toMillis(time.Now()), 10))
+	query := params.Encode()
+	query = fmt.Sprintf("%s&signature=%s", query, Sign(apiSecret, query))
+	return restRequest(method, path, query, apiKey)
+}
+
+// apiKeyRequest makes a request to an endpoint of the Binance REST API that
+// takes the API key but no signature, such as the user data stream.
+func apiKeyRequest(method string, path string, params url.Values) ([]byte, error) {
+	apiKey := config.GetString("binance.api.key")
+	if apiKey == "" {
+		return nil, fmt.Errorf("binance api key not configured")
+	}
+	return restRequest(method, path, params.Encode(), apiKey)
+}
+
+// CheckCredentials checks an API key and secret by fetching the account
+// they belong to.
+func CheckCredentials(apiKey string, apiSecret string) error {
+	_, err := signedRequest(apiKey, apiSecret, "GET", "/api/v3/account", nil)
+	return err
+}
+
+// RestOrder is an order as returned by the order and open orders endpoints.
+type RestOrder struct {
+	Symbol           string
+	OrderID          int64
+	ClientOrderID    string
+	Side             binanceapi.OrderSide
+	Status           binanceapi.OrderStatus
+	Price            float64
+	Quantity         float64
+	ExecutedQuantity float64
+	TimeMillis       int64
+}
+
+type restOrder struct {
+	Symbol        string                 `json:"symbol"`
+	OrderID       int64                  `json:"orderId"`
+	ClientOrderID string                 `json:"clientOrderId"`
+	Side          binanceapi.OrderSide   `json:"side"`
+	Status        binanceapi.OrderStatus `json:"status"`
+	Price         string                 `json:"price"`
+	OrigQty       string                 `json:"origQty"`
+	ExecutedQty   string                 `json:"executedQty"`
+	Time          int64                  `json:"time"`
+	TransactTime  int64                  `json:"transactTime"`
+}
+
+// GetOpenOrders returns the open orders for a symbol.
+func GetOpenOrders(symbol string) ([]RestOrder, error) {
+	params := url.Values{}
+	params.Set("symbol", symbol)
+	body, err := SignedRequest("GET", "/api/v3/openOrders", params)
+	if err != nil {
+		return nil, err
+	}
+
+	var restOrders []restOrder
+	if err := json.Unmarshal(body, &restOrders); err != nil {
+		return nil, err
+	}
+
+	orders := []RestOrder{}
+	for _, restOrder := range restOrders {
+		order, err := restOrder.toRestOrder()
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, *order)
+	}
+	return orders, nil
+}
+
+// PostStopLossLimitOrder places a stop loss limit sell order.
+func PostStopLossLimitOrder(symbol string, quantity float64, stopPrice float64,
+	price float64, clientOrderId string) (*RestOrder, error) {
+	params := url.Values{}
+	params.Set("symbol", symbol)
+	params.Set("side", string(binanceapi.OrderSideSell))
+	params.Set("type", "STOP_LOSS_LIMIT")
+	params.Set("timeInForce", "GTC")
+	params.Set("quantity", strconv.FormatFloat(quantity, 'f', -1, 64))
+	params.Set("stopPrice", strconv.FormatFloat(stopPrice, 'f', -1, 64))
+	params.Set("price", strconv.FormatFloat(price, 'f', -1, 64))
+	params.Set("newClientOrderId", clientOrderId)
+	params.Set("newOrderRespType", "RESULT")
+	body, err := SignedRequest("POST", "/api/v3/order", params)
+	if err != nil {
+		return nil, err
+	}
+
+	var order restOrder
+	if err := json.Unmarshal(body, &order); err != nil {
+		return nil, err
+	}
+	return order.toRestOrder()
+}
+
+// RestOrderList is an order list as returned when placing an OCO order.
+type RestOrderList struct {
+	OrderListID       int64  `json:"orderListId"`
+	ContingencyType   string `json:"contingencyType"`
+	ListStatusType    string `json:"listStatusType"`
+	ListOrderStatus   string `json:"listOrderStatus"`
+	ListClientOrderID string `json:"listClientOrderId"`
+	Symbol            string `json:"symbol"`
+	Orders            []struct {
+		Symbol        string `json:"symbol"`
+		OrderID       int64  `json:"orderId"`
+		ClientOrderID string `json:"clientOrderId"`
+	} `json:"orders"`
+}
+
+// PostOcoSellOrder places a one-cancels-the-other sell of a limit maker order
+// at price and a stop loss limit order at stopLimitPrice triggered at
+// stopPrice.
+func PostOcoSellOrder(symbol string, quantity float64, price float64,
+	stopPrice float64, stopLimitPrice float64, listClientOrderId string,
+	limitClientOrderId string, stopClientOrderId string) (*RestOrderList, error) {
+	params := url.Values{}
+	params.Set("symbol", symbol)
+	params.Set("side", string(binanceapi.OrderSideSell))
+	params.Set("quantity", strconv.FormatFloat(quantity, 'f', -1, 64))
+	params.Set("price", strconv.FormatFloat(price, 'f', -1, 64))
+	params.Set("stopPrice", strconv.FormatFloat(stopPrice, 'f', -1, 64))
+	params.Set("stopLimitPrice", strconv.FormatFloat(stopLimitPrice, 'f', -1, 64))
+	params.Set("stopLimitTimeInForce", "GTC")
+	params.Set("listClientOrderId", listClientOrderId)
+	params.Set("limitClientOrderId", limitClientOrderId)
+	params.Set("stopClientOrderId", stopClientOrderId)
+	body, err := SignedRequest("POST", "/api/v3/order/oco", params)
+	if err != nil {
+		return nil, err
+	}
+
+	var orderList RestOrderList
+	if err := json.Unmarshal(body, &orderList); err != nil {
+		return nil, err
+	}
+	return &orderList, nil
+}
+
+// GetOrder returns an order by its exchange order ID.
+func GetOrder(symbol string, orderId int64) (*RestOrder, error) {
+	params := url.Values{}
+	params.Set("symbol", symbol)
+	params.Set("orderId", strconv.FormatInt(orderId, 10))
+	body, err := SignedRequest("GET", "/api/v3/order", params)
+	if err != nil {
+		return nil, err
+	}
+
+	var order restOrder
+	if err := json.Unmarshal(body, &order); err != nil {
+		return nil, err
+	}
+	return order.toRestOrder()
+}
+
+// PostOrder places an order.
+func PostOrder(order binanceapi.OrderParameters) (*RestOrder, error) {
+	params := url.Values{}
+	params.Set("symbol", order.Symbol)
+	params.Set("side", string(order.Side))
+	params.Set("type", string(order.Type))
+	if order.TimeInForce != "" {
+		params.Set("timeInForce", string(order.TimeInForce))
+	}
+	params.Set("quantity", strconv.FormatFloat(order.Quantity, 'f', -1, 64))
+	if order.Price > 0 {
+		params.Set("price", strconv.FormatFloat(order.Price, 'f', -1, 64))
+	}
+	if order.StopPrice > 0 {
+		params.Set("stopPrice", strconv.FormatFloat(order.StopPrice, 'f', -1, 64))
+	}
+	if order.NewClientOrderId != "" {
+		params.Set("newClientOrderId", order.NewClientOrderId)
+	}
+	params.Set("newOrderRespType", "RESULT")
+	body, err := SignedRequest("POST", "/api/v3/order", params)
+	if err != nil {
+		return nil, err
+	}
+
+	var restOrder restOrder
+	if err := json.Unmarshal(body, &restOrder); err != nil {
+		return nil, err
+	}
+	return restOrder.toRestOrder()
+}
+
+// CancelOrder cancels an order by its exchange order ID.
+func CancelOrder(symbol string, orderId int64) error {
+	params := url.Values{}
+	params.Set("symbol", symbol)
+	params.Set("orderId", strconv.FormatInt(orderId, 10))
+	_, err := SignedRequest("DELETE", "/api/v3/order", params)
+	return err
+}
+
+// GetOrderByClientId returns an order by its client order ID.
+func GetOrderByClientId(symbol string, clientOrderId string) (*RestOrder, error) {
+	params := url.Values{}
+	params.Set("symbol", symbol)
+	params.Set("origClientOrderId", clientOrderId)
+	body, err := SignedRequest("GET", "/api/v3/order", params)
+	if err != nil {
+		return nil, err
+	}
+
+	var order restOrder
+	if err := json.Unmarshal(body, &order); err != nil {
+		return nil, err
+	}
+	return order.toRestOrder()
+}
+
+// RestTrade is a trade of the account as returned by the myTrades endpoint.
+type RestTrade struct {
+	ID              int64
+	OrderID         int64
+	Price           float64
+	Quantity        float64
+	Commission      float64
+	CommissionAsset string
+	TimeMillis      int64
+}
+
+// GetMyTrades returns the trades of the account for a symbol, only those of
+// the order if orderId is not 0. Without an order ID only the most recent
+// trades are returned.
+func GetMyTrades(symbol string, orderId int64) ([]RestTrade, error) {
+	params := url.Values{}
+	params.Set("symbol", symbol)
+	if orderId != 0 {
+		params.Set("orderId", strconv.FormatInt(orderId, 10))
+	}
+	body, err := SignedRequest("GET", "/api/v3/myTrades", params)
+	if err != nil {
+		return nil, err
+	}
+
+	var restTrades []struct {
+		ID              int64  `json:"id"`
+		OrderID         int64  `json:"orderId"`
+		Price           string `json:"price"`
+		Qty             string `json:"qty"`
+		Commission      string `json:"commission"`
+		CommissionAsset string `json:"commissionAsset"`
+		Time            int64  `json:"time"`
+	}
+	if err := json.Unmarshal(body, &restTrades); err != nil {
+		return nil, err
+	}
+
+	trades := []RestTrade{}
+	for _, restTrade := range restTrades {
+		trade := RestTrade{
+			ID:              restTrade.ID,
+			OrderID:         restTrade.OrderID,
+			CommissionAsset: restTrade.CommissionAsset,
+			TimeMillis:      restTrade.Time,
+		}
+		var err error
+		if trade.Price, err = strconv.ParseFloat(restTrade.Price, 64); err != nil {
+			return nil, err
+		}
+		if trade.Quantity, err = strconv.ParseFloat(restTrade.Qty, 64); err != nil {
+			return nil, err
+		}
+		if trade.Commission, err = strconv.ParseFloat(restTrade.Commission, 64); err != nil {
+			return nil, err
+		}
+		trades = append(trades, trade)
+	}
+	return trades, nil
+}
+
+// CreateListenKey creates a listen key for the user data stream.
+func CreateListenKey() (string, error) {
+	body, err := apiKeyRequest("POST", "/api/v1/userDataStream", nil)
+	if err != nil {
+		return "", err
+	}
+	var response struct {
+		ListenKey string `json:"listenKey"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return "", err
+	}
+	return response.ListenKey, nil
+}
+
+// KeepAliveListenKey extends the validity of a user data stream listen key.
+func KeepAliveListenKey(listenKey string) error {
+	params := url.Values{}
+	params.Set("listenKey", listenKey)
+	_, err := apiKeyRequest("PUT", "/api/v1/userDataStream", params)
+	return err
+}
+
+func (o restOrder) toRestOrder() (*RestOrder, error) {
+	order := &RestOrder{
+		Symbol:        o.Symbol,
+		OrderID:       o.OrderID,
+		ClientOrderID: o.ClientOrderID,
+		Side:          o.Side,
+		Status:        o.Status,
+		TimeMillis:    o.Time,
+	}
+	if order.TimeMillis == 0 {
+		// Orders just placed have a transact time instead.
+		order.TimeMillis = o.TransactTime
+	}
+	var err error
+	if order.Price, err = strconv.ParseFloat(o.Price, 64); err != nil {
+		return nil, err
+	}
+	if order.Quantity, err = strconv.ParseFloat(o.OrigQty, 64); err != nil {
+		return nil, err
+	}
+	if order.ExecutedQuantity, err = strconv.ParseFloat(o.ExecutedQty, 64); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+type restAccount struct {
+	Balances []struct {
+		Asset  string `json:"asset"`
+		Free   string `json:"free"`
+		Locked string `json:"locked"`
+	} `json:"balances"`
+}
+
+// GetBalances returns the total, free plus locked, balance of each asset in
+// the account.
+func GetBalances() (map[string]float64, error) {
+	return getBalances(true)
+}
+
+// GetFreeBalances returns the balance of each asset in the account that is
+// not locked in open orders.
+func GetFreeBalances() (map[string]float64, error) {
+	return getBalances(false)
+}
+
+func getBalances(withLocked bool) (map[string]float64, error) {
+	body, err := SignedRequest("GET", "/api/v3/account", nil)
+	if err != nil {
+		return nil, err
+	}
+	var account restAccount
+	if err := json.Unmarshal(body, &account); err != nil {
+		return nil, err
+	}
+	balances := map[string]float64{}
+	for _, balance := range account.Balances {
+		free, err := strconv.ParseFloat(balance.Free, 64)
+		if err != nil {
+			return nil, err
+		}
+		balances[balance.Asset] = free
+		if !withLocked {
+			continue
+		}
+		locked, err := strconv.ParseFloat(balance.Locked, 64)
+		if err != nil {
+			return nil, err
+		}
+		balances[balance.Asset] += locked
+	}
+	return balances, nil
+}
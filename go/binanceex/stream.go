@@ -1,4 +1,4 @@
-// Copyright (C) 2018 Cranky Kernel
+// Copyright (C) 2019 Cranky Kernel
 //
 // This program is free software: you can redistribute it and/or modify
 // it under the terms of the GNU Affero General Public License as published by
@@ -16,14 +16,31 @@
 package binanceex
 
 import (
-	"github.com/crankykernel/binanceapi-go"
-	"gitlab.com/crankykernel/maker/go/config"
+	"fmt"
+	"github.com/gorilla/websocket"
 )
 
-func GetBinanceRestClient() *binanceapi.RestClient {
-	client := binanceapi.NewRestClient().WithAuth(
-		config.GetString("binance.api.key"),
-		config.GetString("binance.api.secret"))
+// Stream is a websocket stream from the configured stream base URL.
+type Stream struct {
+	Conn *websocket.Conn
+}
+
+// OpenSingleStream opens a raw stream, such as "ethbtc@aggTrade" or a user
+// data stream listen key.
+func OpenSingleStream(name string) (*Stream, error) {
+	url := fmt.Sprintf("%s/ws/%s", StreamBaseUrl(), name)
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Stream{Conn: conn}, nil
+}
+
+func (s *Stream) Next() ([]byte, error) {
+	_, payload, err := s.Conn.ReadMessage()
+	return payload, err
+}
 
-	return client
+func (s *Stream) Close() {
+	s.Conn.Close()
 }
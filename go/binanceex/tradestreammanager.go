@@ -27,17 +27,23 @@ import (
 
 type TradeStreamChannel chan *binanceapi.StreamAggTrade
 
+// TradeRecorder receives the raw payload of every trade stream message.
+type TradeRecorder interface {
+	RecordAggTrade(symbol string, payload []byte)
+}
+
 type TradeStreamManager struct {
 	mutex         sync.RWMutex
 	subscriptions map[TradeStreamChannel]bool
-	streams       map[string]*binanceapi.Stream
+	streams       map[string]*Stream
 	streamCount   map[string]int
+	recorder      TradeRecorder
 }
 
 func NewXTradeStreamManager() *TradeStreamManager {
 	return &TradeStreamManager{
 		subscriptions: make(map[TradeStreamChannel]bool),
-		streams:       make(map[string]*binanceapi.Stream),
+		streams:       make(map[string]*Stream),
 		streamCount:   make(map[string]int),
 	}
 }
@@ -60,6 +66,12 @@ func (m *TradeStreamManager) Unsubscribe(channel TradeStreamChannel) {
 	delete(m.subscriptions, channel)
 }
 
+func (m *TradeStreamManager) SetRecorder(recorder TradeRecorder) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.recorder = recorder
+}
+
 func (m *TradeStreamManager) AddSymbol(symbol string) {
 	symbol = strings.ToLower(symbol)
 	m.mutex.Lock()
@@ -104,7 +116,7 @@ Retry:
 		return
 	}
 	streamName := fmt.Sprintf("%s@aggTrade", strings.ToLower(name))
-	stream, err := binanceapi.OpenSingleStream(streamName)
+	stream, err := OpenSingleStream(streamName)
 	if err != nil {
 		log.WithError(err).
 			WithField("stream", streamName).
@@ -145,6 +157,9 @@ Retry:
 		}
 
 		m.mutex.RLock()
+		if m.recorder != nil {
+			m.recorder.RecordAggTrade(name, payload)
+		}
 		for channel := range m.subscriptions {
 			channel <- &trade
 		}
@@ -0,0 +1,181 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"gitlab.com/crankykernel/maker/go/backtest"
+	"gitlab.com/crankykernel/maker/go/binanceex"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/exchange"
+	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/recorder"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const backtestTimeFormat = "2006-01-02 15:04"
+
+var backtestFlags struct {
+	Symbol                  string
+	Start                   string
+	End                     string
+	Entry                   string
+	QuoteAmount             float64
+	StopLossPercent         float64
+	TrailingProfitPercent   float64
+	TrailingProfitDeviation float64
+	LimitSellPercent        float64
+	Verbose                 bool
+	Recorded                bool
+}
+
+var backtestCmd = &cobra.Command{
+	Use:   "backtest",
+	Short: "Replay historical trades through the trade exit rules.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := backtestMain(); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	flags := backtestCmd.Flags()
+	flags.StringVar(&backtestFlags.Symbol, "symbol", "", "Symbol to backtest (eg. ETHBTC)")
+	flags.StringVar(&backtestFlags.Start, "start", "", "Start time in UTC (YYYY-MM-DD HH:MM)")
+	flags.StringVar(&backtestFlags.End, "end", "", "End time in UTC (YYYY-MM-DD HH:MM), defaults to now")
+	flags.StringVar(&backtestFlags.Entry, "entry", "once", "Entry rule: once, interval:<duration> or dip:<percent>")
+	flags.Float64Var(&backtestFlags.QuoteAmount, "quote-amount", 0, "Amount of quote asset to spend per entry")
+	flags.Float64Var(&backtestFlags.StopLossPercent, "stop-loss", 0, "Stop loss percent, 0 to disable")
+	flags.Float64Var(&backtestFlags.TrailingProfitPercent, "trailing-profit", 0, "Trailing profit percent, 0 to disable")
+	flags.Float64Var(&backtestFlags.TrailingProfitDeviation, "trailing-deviation", 0, "Trailing profit deviation percent")
+	flags.Float64Var(&backtestFlags.LimitSellPercent, "limit-sell", 0, "Limit sell percent, 0 to disable")
+	flags.BoolVar(&backtestFlags.Recorded, "recorded", false, "Use trades recorded by the server instead of downloading them")
+	flags.BoolVar(&backtestFlags.Verbose, "verbose", false, "Show trade service logging")
+	rootCmd.AddCommand(backtestCmd)
+}
+
+func backtestMain() error {
+	if !backtestFlags.Verbose {
+		log.SetLevel(log.LogLevelWarn)
+	}
+
+	if backtestFlags.Symbol == "" {
+		return fmt.Errorf("--symbol is required")
+	}
+	symbol := strings.ToUpper(backtestFlags.Symbol)
+
+	startTime, err := time.Parse(backtestTimeFormat, backtestFlags.Start)
+	if err != nil {
+		return fmt.Errorf("invalid start time: %v", err)
+	}
+	endTime := time.Now()
+	if backtestFlags.End != "" {
+		endTime, err = time.Parse(backtestTimeFormat, backtestFlags.End)
+		if err != nil {
+			return fmt.Errorf("invalid end time: %v", err)
+		}
+	}
+	if !endTime.After(startTime) {
+		return fmt.Errorf("end time must be after start time")
+	}
+
+	entryRule, err := backtest.ParseEntryRule(backtestFlags.Entry)
+	if err != nil {
+		return err
+	}
+
+	options := backtest.Options{
+		Symbol:                  symbol,
+		Entry:                   entryRule,
+		QuoteAmount:             backtestFlags.QuoteAmount,
+		StopLossEnabled:         backtestFlags.StopLossPercent > 0,
+		StopLossPercent:         backtestFlags.StopLossPercent,
+		TrailingProfitEnabled:   backtestFlags.TrailingProfitPercent > 0,
+		TrailingProfitPercent:   backtestFlags.TrailingProfitPercent,
+		TrailingProfitDeviation: backtestFlags.TrailingProfitDeviation,
+		LimitSellEnabled:        backtestFlags.LimitSellPercent > 0,
+		LimitSellPercent:        backtestFlags.LimitSellPercent,
+	}
+
+	exchangeInfoService := binanceex.NewExchangeInfoService()
+	if err := exchangeInfoService.Update(); err != nil {
+		return fmt.Errorf("failed to get exchange info: %v", err)
+	}
+	symbolInfo, err := exchangeInfoService.GetSymbol(symbol)
+	if err != nil {
+		return fmt.Errorf("%s: %v", symbol, err)
+	}
+
+	fmt.Printf("Loading %s trades from %s to %s...\n", symbol,
+		startTime.Format(backtestTimeFormat), endTime.Format(backtestTimeFormat))
+	var trades []binanceex.AggTrade
+	if backtestFlags.Recorded {
+		trades, err = recorder.ReadTrades(path.Join(DefaultDataDirectory, "marketdata"),
+			symbol, startTime, endTime)
+	} else {
+		trades, err = binanceex.GetAggTrades(symbol, startTime, endTime)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load trades: %v", err)
+	}
+	fmt.Printf("Replaying %d trades.\n\n", len(trades))
+
+	// Trades are written to a scratch database that is thrown away.
+	tmpDir, err := ioutil.TempDir("", "maker-backtest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	db.DbOpenFile(path.Join(tmpDir, "backtest.db"))
+	defer db.DbClose()
+
+	result, err := backtest.Run(options, exchange.FromBinanceSymbolInfo(symbolInfo), trades)
+	if err != nil {
+		return err
+	}
+
+	printBacktestResult(result)
+	return nil
+}
+
+func printBacktestResult(result *backtest.Result) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "OPEN\tCLOSE\tBUY\tSELL\tQUANTITY\tPROFIT\tPERCENT\tEXIT")
+	for _, trade := range result.Trades {
+		closeTime := "-"
+		if trade.CloseTime != nil {
+			closeTime = trade.CloseTime.UTC().Format(backtestTimeFormat)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%.8f\t%.8f\t%.8f\t%.8f\t%.2f%%\t%s\n",
+			trade.OpenTime.UTC().Format(backtestTimeFormat), closeTime,
+			trade.BuyPrice, trade.SellPrice, trade.Quantity,
+			trade.Profit, trade.ProfitPercent, trade.ExitReason)
+	}
+	w.Flush()
+
+	fmt.Printf("\nTrades: %d; Wins: %d; Losses: %d\n",
+		result.Wins+result.Losses, result.Wins, result.Losses)
+	fmt.Printf("Total profit: %.8f; Average: %.2f%%\n",
+		result.TotalProfit, result.AveragePercent)
+}
@@ -0,0 +1,245 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"gitlab.com/crankykernel/maker/go/binanceex"
+	"gitlab.com/crankykernel/maker/go/config"
+	"gitlab.com/crankykernel/maker/go/credentials"
+	"os"
+	"path"
+)
+
+var credentialsFlags struct {
+	KeyFile    string
+	NewKeyFile string
+	ApiKey     string
+}
+
+var credentialsCmd = &cobra.Command{
+	Use:   "credentials",
+	Short: "Manage the encrypted Binance API credential store.",
+}
+
+var credentialsSetCmd = &cobra.Command{
+	Use:   "set",
+	Short: "Set the Binance API key and secret, creating the store if needed.",
+	Run: func(cmd *cobra.Command, args []string) {
+		exitOnError(credentialsSet())
+	},
+}
+
+var credentialsImportCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Move plain text credentials from maker.yaml into the store.",
+	Run: func(cmd *cobra.Command, args []string) {
+		exitOnError(credentialsImport())
+	},
+}
+
+var credentialsRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Change the passphrase of the store.",
+	Run: func(cmd *cobra.Command, args []string) {
+		exitOnError(credentialsRotate())
+	},
+}
+
+var credentialsVerifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Unlock the store and test the credentials against Binance.",
+	Run: func(cmd *cobra.Command, args []string) {
+		exitOnError(credentialsVerify())
+	},
+}
+
+func init() {
+	credentialsCmd.PersistentFlags().StringVar(&credentialsFlags.KeyFile, "key-file", "",
+		"File containing the store passphrase")
+	credentialsSetCmd.Flags().StringVar(&credentialsFlags.ApiKey, "api-key", "",
+		"Binance API key, prompted for if not set")
+	credentialsRotateCmd.Flags().StringVar(&credentialsFlags.NewKeyFile, "new-key-file", "",
+		"File containing the new passphrase, prompted for if not set")
+	credentialsCmd.AddCommand(credentialsSetCmd)
+	credentialsCmd.AddCommand(credentialsImportCmd)
+	credentialsCmd.AddCommand(credentialsRotateCmd)
+	credentialsCmd.AddCommand(credentialsVerifyCmd)
+	rootCmd.AddCommand(credentialsCmd)
+}
+
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func credentialStore() *credentials.Store {
+	return credentials.NewStore(path.Join(DefaultDataDirectory, "credentials.json"))
+}
+
+// unlockOrCreate unlocks an existing store, or creates a new empty store
+// with a new passphrase.
+func unlockOrCreate(store *credentials.Store) error {
+	if store.Exists() {
+		passphrase, err := credentials.ReadPassphrase(credentialsFlags.KeyFile)
+		if err != nil {
+			return err
+		}
+		_, err = store.Unlock(passphrase)
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Creating credential store %s.\n", store.Filename())
+	passphrase, err := newPassphrase(credentialsFlags.KeyFile, true)
+	if err != nil {
+		return err
+	}
+	return store.Create(passphrase, &credentials.Credentials{})
+}
+
+// newPassphrase reads a new passphrase from the key file, the environment
+// if allowed, or prompts for it.
+func newPassphrase(keyFile string, fromEnv bool) (string, error) {
+	if keyFile != "" {
+		return credentials.ReadKeyFile(keyFile)
+	}
+	if fromEnv {
+		if passphrase := os.Getenv(credentials.PassphraseEnv); passphrase != "" {
+			return passphrase, nil
+		}
+		if keyFile := os.Getenv(credentials.KeyFileEnv); keyFile != "" {
+			return credentials.ReadKeyFile(keyFile)
+		}
+	}
+	return credentials.PromptNew()
+}
+
+// clearPlainTextCredentials removes the credentials from maker.yaml once
+// they are in the store.
+func clearPlainTextCredentials() {
+	if config.GetString("binance.api.key") == "" && config.GetString("binance.api.secret") == "" {
+		return
+	}
+	config.Set("binance.api.key", "")
+	config.Set("binance.api.secret", "")
+	config.WriteConfig(path.Join(DefaultDataDirectory, "maker.yaml"))
+	fmt.Fprintf(os.Stderr, "Removed plain text credentials from maker.yaml.\n")
+}
+
+func credentialsSet() error {
+	store := credentialStore()
+	if err := unlockOrCreate(store); err != nil {
+		return err
+	}
+
+	apiKey := credentialsFlags.ApiKey
+	if apiKey == "" {
+		var err error
+		apiKey, err = credentials.PromptLine("Binance API key: ")
+		if err != nil {
+			return err
+		}
+	}
+	apiSecret, err := credentials.Prompt("Binance API secret: ")
+	if err != nil {
+		return err
+	}
+	if apiKey == "" || apiSecret == "" {
+		return fmt.Errorf("API key and secret are required")
+	}
+
+	if err := store.Save(&credentials.Credentials{
+		BinanceApiKey:    apiKey,
+		BinanceApiSecret: apiSecret,
+	}); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Credentials saved.\n")
+	clearPlainTextCredentials()
+	return nil
+}
+
+func credentialsImport() error {
+	apiKey := config.GetString("binance.api.key")
+	apiSecret := config.GetString("binance.api.secret")
+	if apiKey == "" || apiSecret == "" {
+		return fmt.Errorf("no plain text credentials found in maker.yaml")
+	}
+
+	store := credentialStore()
+	if err := unlockOrCreate(store); err != nil {
+		return err
+	}
+	if err := store.Save(&credentials.Credentials{
+		BinanceApiKey:    apiKey,
+		BinanceApiSecret: apiSecret,
+	}); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Credentials imported.\n")
+	clearPlainTextCredentials()
+	return nil
+}
+
+func credentialsRotate() error {
+	store := credentialStore()
+	if !store.Exists() {
+		return fmt.Errorf("credential store %s does not exist", store.Filename())
+	}
+	passphrase, err := credentials.ReadPassphrase(credentialsFlags.KeyFile)
+	if err != nil {
+		return err
+	}
+	if _, err := store.Unlock(passphrase); err != nil {
+		return err
+	}
+	passphrase, err = newPassphrase(credentialsFlags.NewKeyFile, false)
+	if err != nil {
+		return err
+	}
+	if err := store.Rotate(passphrase); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Passphrase changed.\n")
+	return nil
+}
+
+func credentialsVerify() error {
+	store := credentialStore()
+	if !store.Exists() {
+		return fmt.Errorf("credential store %s does not exist", store.Filename())
+	}
+	passphrase, err := credentials.ReadPassphrase(credentialsFlags.KeyFile)
+	if err != nil {
+		return err
+	}
+	creds, err := store.Unlock(passphrase)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Credential store unlocked.\n")
+	if creds.BinanceApiKey == "" || creds.BinanceApiSecret == "" {
+		return fmt.Errorf("no credentials set")
+	}
+
+	if err := binanceex.CheckCredentials(creds.BinanceApiKey, creds.BinanceApiSecret); err != nil {
+		return fmt.Errorf("Binance authentication failed: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Binance authentication OK.\n")
+	return nil
+}
@@ -0,0 +1,76 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"gitlab.com/crankykernel/maker/go/binanceex/fake"
+	"gitlab.com/crankykernel/maker/go/log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var fakeBinanceFlags struct {
+	Host   string
+	Port   int16
+	Script string
+}
+
+var fakeBinanceCmd = &cobra.Command{
+	Use:   "fake-binance",
+	Short: "Run a local fake Binance API for testing.",
+	Run: func(cmd *cobra.Command, args []string) {
+		fakeBinanceMain()
+	},
+}
+
+func init() {
+	flags := fakeBinanceCmd.Flags()
+	flags.StringVar(&fakeBinanceFlags.Host, "host", "127.0.0.1", "Host to bind to")
+	flags.Int16VarP(&fakeBinanceFlags.Port, "port", "p", 6046, "Port")
+	flags.StringVar(&fakeBinanceFlags.Script, "script", "", "Script to run against the order book once started")
+	rootCmd.AddCommand(fakeBinanceCmd)
+}
+
+func fakeBinanceMain() {
+	book := fake.NewOrderBook()
+	if err := fake.RunScript(book, strings.NewReader(fake.DefaultScript)); err != nil {
+		log.Fatalf("Failed to run default script: %v", err)
+	}
+	server := fake.NewServer(book)
+
+	if fakeBinanceFlags.Script != "" {
+		file, err := os.Open(fakeBinanceFlags.Script)
+		if err != nil {
+			log.Fatalf("Failed to open script: %v", err)
+		}
+		go func() {
+			defer file.Close()
+			if err := fake.RunScript(book, file); err != nil {
+				log.WithError(err).Errorf("Script failed")
+				return
+			}
+			log.Infof("Script complete")
+		}()
+	}
+
+	listenAddr := fmt.Sprintf("%s:%d", fakeBinanceFlags.Host, fakeBinanceFlags.Port)
+	log.Infof("Fake Binance listening on http://%s", listenAddr)
+	log.Infof("Run Maker against it with: maker server --binance-url http://%s", listenAddr)
+	log.Fatal(http.ListenAndServe(listenAddr, server))
+}
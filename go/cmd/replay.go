@@ -0,0 +1,149 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"gitlab.com/crankykernel/maker/go/binanceex"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/replay"
+	"gitlab.com/crankykernel/maker/go/types"
+	"os"
+	"path"
+	"text/tabwriter"
+)
+
+var replayFlags struct {
+	All    bool
+	Paper  bool
+	Repair bool
+}
+
+var replayCmd = &cobra.Command{
+	Use:   "replay [trade-id...]",
+	Short: "Rebuild trades from their execution reports and show differences.",
+	Long: `Rebuild trades from the execution reports saved by the server and the
+user actions in their history, and show any differences from the stored
+trade state.
+
+With --repair the rebuilt state is saved over the stored state. The server
+should not be running when repairing, use the API instead.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		exitOnError(replayMain(args))
+	},
+}
+
+func init() {
+	flags := replayCmd.Flags()
+	flags.BoolVar(&replayFlags.All, "all", false, "Replay all trades")
+	flags.BoolVar(&replayFlags.Paper, "paper", false, "Use the paper trading database")
+	flags.BoolVar(&replayFlags.Repair, "repair", false, "Save the rebuilt state of trades with differences")
+	rootCmd.AddCommand(replayCmd)
+}
+
+func replayMain(tradeIds []string) error {
+	if len(tradeIds) == 0 && !replayFlags.All {
+		return fmt.Errorf("no trade IDs given, use --all to replay all trades")
+	}
+
+	log.SetLevel(log.LogLevelWarn)
+
+	if replayFlags.Paper {
+		db.DbOpenFile(path.Join(DefaultDataDirectory, "maker-paper.db"))
+	} else {
+		db.DbOpen(DefaultDataDirectory)
+	}
+	defer db.DbClose()
+
+	tradeStates := []types.TradeState{}
+	if replayFlags.All {
+		var err error
+		tradeStates, err = db.DbQueryTrades(db.TradeQueryOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to load trades: %v", err)
+		}
+	}
+	for _, tradeId := range tradeIds {
+		tradeState, err := db.DbGetTradeByID(tradeId)
+		if err != nil {
+			return fmt.Errorf("failed to load trade %s: %v", tradeId, err)
+		}
+		tradeStates = append(tradeStates, *tradeState)
+	}
+
+	// The step size is only needed for trades that didn't pay fees in BNB, so
+	// carry on without it if Binance can't be reached.
+	exchangeInfoService := binanceex.NewExchangeInfoService()
+	if err := exchangeInfoService.Update(); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: failed to get exchange info, sellable quantities will not be replayed: %v\n", err)
+		exchangeInfoService = nil
+	}
+
+	withDifferences := 0
+	for _, tradeState := range tradeStates {
+		stepSize := float64(0)
+		if exchangeInfoService != nil {
+			if symbolInfo, err := exchangeInfoService.GetSymbol(tradeState.Symbol); err == nil {
+				stepSize = symbolInfo.StepSize
+			}
+		}
+
+		result, err := replay.ReplayTrade(tradeState, stepSize)
+		if err != nil {
+			return fmt.Errorf("failed to replay trade %s: %v", tradeState.TradeID, err)
+		}
+
+		fmt.Printf("Trade %s (%s %s): %d execution reports, %d differences\n",
+			result.TradeID, tradeState.Symbol, tradeState.Status,
+			result.Reports, len(result.Differences))
+		if len(result.Differences) == 0 {
+			continue
+		}
+		withDifferences++
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "  FIELD\tSTORED\tREPLAYED")
+		for _, difference := range result.Differences {
+			fmt.Fprintf(w, "  %s\t%v\t%v\n", difference.Field,
+				formatReplayValue(difference.Stored),
+				formatReplayValue(difference.Replayed))
+		}
+		w.Flush()
+
+		if replayFlags.Repair {
+			if err := db.DbUpdateTrade(&types.Trade{State: result.Repaired()}); err != nil {
+				return fmt.Errorf("failed to save trade %s: %v", result.TradeID, err)
+			}
+			fmt.Printf("  Repaired.\n")
+		}
+	}
+
+	fmt.Printf("\nTrades: %d; With differences: %d\n", len(tradeStates), withDifferences)
+	return nil
+}
+
+func formatReplayValue(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "-"
+	case float64:
+		return fmt.Sprintf("%.8f", value)
+	default:
+		return fmt.Sprintf("%v", value)
+	}
+}
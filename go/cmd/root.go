@@ -21,11 +21,17 @@ import (
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"gitlab.com/crankykernel/maker/go/binanceex"
 	"gitlab.com/crankykernel/maker/go/log"
 )
 
 var DefaultDataDirectory string = "."
 
+var binanceFlags struct {
+	RestUrl   string
+	StreamUrl string
+}
+
 var rootCmd = &cobra.Command{
 	Use: "maker",
 }
@@ -40,6 +46,8 @@ func Execute() {
 func InitCobra() {
 	cobra.OnInitialize(initConfig)
 	rootCmd.PersistentFlags().StringVarP(&DefaultDataDirectory, "data", "D", DefaultDataDirectory, "Data directory")
+	rootCmd.PersistentFlags().StringVar(&binanceFlags.RestUrl, "binance-url", "", "Binance REST API URL, eg. of a fake Binance server")
+	rootCmd.PersistentFlags().StringVar(&binanceFlags.StreamUrl, "binance-stream-url", "", "Binance websocket stream URL, derived from --binance-url if not set")
 }
 
 func initConfig() {
@@ -48,6 +56,16 @@ func initConfig() {
 
 	viper.AutomaticEnv()
 
+	if binanceFlags.RestUrl != "" {
+		if err := binanceex.SetBaseUrl(binanceFlags.RestUrl, binanceFlags.StreamUrl); err != nil {
+			log.Fatalf("Invalid Binance URL: %v", err)
+		}
+		log.WithFields(log.Fields{
+			"rest":   binanceex.RestBaseUrl(),
+			"stream": binanceex.StreamBaseUrl(),
+		}).Infof("Using alternate Binance API")
+	}
+
 	if err := viper.ReadInConfig(); err == nil {
 		log.Println("Using config file:", viper.ConfigFileUsed())
 	} else {
@@ -19,6 +19,7 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"gitlab.com/crankykernel/maker/go/server"
+	"time"
 )
 
 var ServerCmd = &cobra.Command{
@@ -38,6 +39,14 @@ func init() {
 	flags.BoolVar(&server.ServerFlags.TLS, "tls", false, "Enable TLS")
 	flags.BoolVar(&server.ServerFlags.ItsAllMyFault, "its-all-my-fault", false, "Its all my fault")
 	flags.BoolVar(&server.ServerFlags.EnableAuth, "auth", false, "Enable authentication")
+	flags.BoolVar(&server.ServerFlags.Paper, "paper", false, "Paper trading mode, orders are simulated")
+	flags.StringSliceVar(&server.ServerFlags.PaperBalances, "paper-balance", nil, "Simulated balance for paper trading as ASSET=AMOUNT (comma separated)")
+	flags.StringVar(&server.ServerFlags.CredentialsKeyFile, "credentials-key-file", "", "File containing the credential store passphrase")
+	flags.StringSliceVar(&server.ServerFlags.Record, "record", nil, "Record market data for symbols (comma separated)")
+	flags.BoolVar(&server.ServerFlags.RecordBookTicker, "record-book-ticker", false, "Also record the book ticker stream")
+	flags.DurationVar(&server.ServerFlags.RecordMaxAge, "record-max-age", 7*24*time.Hour, "Remove recorded market data older than this")
+	flags.Int64Var(&server.ServerFlags.RecordMaxSize, "record-max-size", 1024, "Maximum size of recorded market data in MB")
+	flags.DurationVar(&server.ServerFlags.ReconcileInterval, "reconcile-interval", 2*time.Minute, "Interval to reconcile open trades with the exchange, 0 to disable")
 
 	flags.MarkHidden("its-all-my-fault")
 
@@ -24,8 +24,13 @@ import (
 var subscribers map[chan bool]bool
 var lock sync.RWMutex
 
+// Values held in memory only, such as credentials from the encrypted
+// credential store. They are never written to the configuration file.
+var secrets map[string]string
+
 func init() {
 	subscribers = make(map[chan bool]bool)
+	secrets = make(map[string]string)
 }
 
 func Subscribe() chan bool {
@@ -62,6 +67,20 @@ func Set(key string, val string) {
 	viper.Set(key, val)
 }
 
+// SetSecret sets an in memory only value that takes precedence over the
+// configuration file.
+func SetSecret(key string, val string) {
+	lock.Lock()
+	defer lock.Unlock()
+	secrets[key] = val
+}
+
 func GetString(key string) string {
+	lock.RLock()
+	val, ok := secrets[key]
+	lock.RUnlock()
+	if ok {
+		return val
+	}
 	return viper.GetString(key)
 }
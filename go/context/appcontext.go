@@ -17,11 +17,13 @@ package context
 
 import (
 	"gitlab.com/crankykernel/maker/go/binanceex"
+	"gitlab.com/crankykernel/maker/go/exchange"
 	"gitlab.com/crankykernel/maker/go/tradeservice"
 )
 
 type ApplicationContext struct {
 	TradeService              *tradeservice.TradeService
+	Exchange                  exchange.Exchange
 	BinanceTradeStreamManager *binanceex.TradeStreamManager
 	BinanceUserDataStream     *binanceex.BinanceUserDataStream
 	OpenBrowser               bool
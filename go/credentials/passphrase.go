@@ -0,0 +1,106 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package credentials
+
+import (
+	"bufio"
+	"fmt"
+	"golang.org/x/crypto/ssh/terminal"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Environment variables the passphrase can be read from when not prompting.
+const (
+	PassphraseEnv = "MAKER_CREDENTIALS_PASSPHRASE"
+	KeyFileEnv    = "MAKER_CREDENTIALS_KEY_FILE"
+)
+
+// ReadPassphrase returns the master passphrase from the first of: the key
+// file if given, the passphrase environment variable, the key file
+// environment variable, or a prompt on the terminal.
+func ReadPassphrase(keyFile string) (string, error) {
+	if keyFile != "" {
+		return ReadKeyFile(keyFile)
+	}
+	if passphrase := os.Getenv(PassphraseEnv); passphrase != "" {
+		return passphrase, nil
+	}
+	if keyFile := os.Getenv(KeyFileEnv); keyFile != "" {
+		return ReadKeyFile(keyFile)
+	}
+	return Prompt("Credential store passphrase: ")
+}
+
+// ReadKeyFile reads a passphrase from a file, ignoring trailing whitespace.
+func ReadKeyFile(filename string) (string, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	passphrase := strings.TrimRight(string(buf), "\r\n\t ")
+	if passphrase == "" {
+		return "", fmt.Errorf("key file %s is empty", filename)
+	}
+	return passphrase, nil
+}
+
+// Prompt reads a line from the terminal without echo.
+func Prompt(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return "", fmt.Errorf("no terminal to prompt for passphrase, set %s or %s",
+			PassphraseEnv, KeyFileEnv)
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	buf, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// PromptNew prompts for a new passphrase twice, requiring them to match.
+func PromptNew() (string, error) {
+	passphrase, err := Prompt("New passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if passphrase == "" {
+		return "", fmt.Errorf("empty passphrase")
+	}
+	confirm, err := Prompt("Confirm new passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if passphrase != confirm {
+		return "", fmt.Errorf("passphrases do not match")
+	}
+	return passphrase, nil
+}
+
+// PromptLine reads a line from standard input with echo, for non secret
+// values.
+func PromptLine(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
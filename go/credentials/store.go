@@ -0,0 +1,269 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package credentials
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const storeVersion = 1
+
+const kdfArgon2id = "argon2id"
+
+// Key derivation parameters for new stores. They are saved with the store so
+// they can be changed without breaking existing stores.
+const (
+	defaultTime    = 1
+	defaultMemory  = 64 * 1024
+	defaultThreads = 4
+	keySize        = 32
+	saltSize       = 16
+)
+
+var ErrBadPassphrase = fmt.Errorf("incorrect passphrase or corrupt credential store")
+
+var ErrLocked = fmt.Errorf("credential store is locked")
+
+type Credentials struct {
+	BinanceApiKey    string `json:"binance.api.key"`
+	BinanceApiSecret string `json:"binance.api.secret"`
+}
+
+// The on disk format. The credentials are encrypted with AES-256-GCM using a
+// key derived from the passphrase with argon2id.
+type storeFile struct {
+	Version    int    `json:"version"`
+	Kdf        string `json:"kdf"`
+	Salt       string `json:"salt"`
+	Time       uint32 `json:"time"`
+	Memory     uint32 `json:"memory"`
+	Threads    uint8  `json:"threads"`
+	Nonce      string `json:"nonce"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+// Store is an encrypted credential file. Once unlocked the passphrase is kept
+// in memory so updated credentials can be saved.
+type Store struct {
+	lock       sync.Mutex
+	filename   string
+	passphrase string
+	unlocked   bool
+}
+
+func NewStore(filename string) *Store {
+	return &Store{
+		filename: filename,
+	}
+}
+
+func (s *Store) Filename() string {
+	return s.filename
+}
+
+func (s *Store) Exists() bool {
+	_, err := os.Stat(s.filename)
+	return err == nil
+}
+
+func (s *Store) IsUnlocked() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.unlocked
+}
+
+// Unlock decrypts the store with the passphrase, keeping the passphrase for
+// later saves.
+func (s *Store) Unlock(passphrase string) (*Credentials, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	credentials, err := load(s.filename, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	s.passphrase = passphrase
+	s.unlocked = true
+	return credentials, nil
+}
+
+// Create writes a new store, replacing any existing one, and leaves it
+// unlocked with the passphrase.
+func (s *Store) Create(passphrase string, credentials *Credentials) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if passphrase == "" {
+		return fmt.Errorf("empty passphrase")
+	}
+	if err := save(s.filename, passphrase, credentials); err != nil {
+		return err
+	}
+	s.passphrase = passphrase
+	s.unlocked = true
+	return nil
+}
+
+// Save encrypts the credentials with the passphrase the store was unlocked
+// with.
+func (s *Store) Save(credentials *Credentials) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.unlocked {
+		return ErrLocked
+	}
+	return save(s.filename, s.passphrase, credentials)
+}
+
+// Rotate re-encrypts the store under a new passphrase.
+func (s *Store) Rotate(newPassphrase string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.unlocked {
+		return ErrLocked
+	}
+	if newPassphrase == "" {
+		return fmt.Errorf("empty passphrase")
+	}
+	credentials, err := load(s.filename, s.passphrase)
+	if err != nil {
+		return err
+	}
+	if err := save(s.filename, newPassphrase, credentials); err != nil {
+		return err
+	}
+	s.passphrase = newPassphrase
+	return nil
+}
+
+func deriveKey(passphrase string, salt []byte, time uint32, memory uint32, threads uint8) []byte {
+	return argon2.IDKey([]byte(passphrase), salt, time, memory, threads, keySize)
+}
+
+func load(filename string, passphrase string) (*Credentials, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var file storeFile
+	if err := json.Unmarshal(buf, &file); err != nil {
+		return nil, fmt.Errorf("failed to decode credential store: %v", err)
+	}
+	if file.Version != storeVersion || file.Kdf != kdfArgon2id {
+		return nil, fmt.Errorf("unsupported credential store: version=%d; kdf=%s",
+			file.Version, file.Kdf)
+	}
+	salt, err := hex.DecodeString(file.Salt)
+	if err != nil {
+		return nil, ErrBadPassphrase
+	}
+	nonce, err := hex.DecodeString(file.Nonce)
+	if err != nil {
+		return nil, ErrBadPassphrase
+	}
+	ciphertext, err := hex.DecodeString(file.Ciphertext)
+	if err != nil {
+		return nil, ErrBadPassphrase
+	}
+
+	gcm, err := newGCM(deriveKey(passphrase, salt, file.Time, file.Memory, file.Threads))
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, ErrBadPassphrase
+	}
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, ErrBadPassphrase
+	}
+
+	var credentials Credentials
+	if err := json.Unmarshal(plaintext, &credentials); err != nil {
+		return nil, ErrBadPassphrase
+	}
+	return &credentials, nil
+}
+
+func save(filename string, passphrase string, credentials *Credentials) error {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	gcm, err := newGCM(deriveKey(passphrase, salt, defaultTime, defaultMemory, defaultThreads))
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	plaintext, err := json.Marshal(credentials)
+	if err != nil {
+		return err
+	}
+	file := storeFile{
+		Version:    storeVersion,
+		Kdf:        kdfArgon2id,
+		Salt:       hex.EncodeToString(salt),
+		Time:       defaultTime,
+		Memory:     defaultMemory,
+		Threads:    defaultThreads,
+		Nonce:      hex.EncodeToString(nonce),
+		Ciphertext: hex.EncodeToString(gcm.Seal(nil, nonce, plaintext, nil)),
+	}
+	buf, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a failed write never loses the
+	// existing store.
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), ".credentials")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
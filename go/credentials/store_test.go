@@ -0,0 +1,64 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package credentials
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	directory, err := ioutil.TempDir("", "maker-credentials")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+	filename := path.Join(directory, "credentials.json")
+
+	store := NewStore(filename)
+	assert.False(t, store.Exists())
+	assert.Equal(t, ErrLocked, store.Save(&Credentials{}))
+	assert.Nil(t, store.Create("passphrase", &Credentials{
+		BinanceApiKey:    "key",
+		BinanceApiSecret: "secret",
+	}))
+
+	// Nothing is stored in plain text.
+	buf, err := ioutil.ReadFile(filename)
+	assert.Nil(t, err)
+	assert.False(t, strings.Contains(string(buf), "secret"))
+	info, err := os.Stat(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	store = NewStore(filename)
+	_, err = store.Unlock("wrong")
+	assert.Equal(t, ErrBadPassphrase, err)
+	assert.False(t, store.IsUnlocked())
+
+	credentials, err := store.Unlock("passphrase")
+	assert.Nil(t, err)
+	assert.Equal(t, "secret", credentials.BinanceApiSecret)
+
+	assert.Nil(t, store.Rotate("new passphrase"))
+	_, err = NewStore(filename).Unlock("passphrase")
+	assert.Equal(t, ErrBadPassphrase, err)
+	credentials, err = NewStore(filename).Unlock("new passphrase")
+	assert.Nil(t, err)
+	assert.Equal(t, "key", credentials.BinanceApiKey)
+}
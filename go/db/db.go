@@ -19,6 +19,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	_ "github.com/mattn/go-sqlite3"
 	"gitlab.com/crankykernel/maker/go/log"
 	"gitlab.com/crankykernel/maker/go/types"
 	"path"
@@ -112,7 +113,7 @@ func initDb(db *sql.DB) error {
 			}
 
 			tradeState := types.TradeStateV0ToTradeStateV1(tradeState0)
-			TxDbUpdateTradeState(tx, &tradeState)
+			txUpdateTradeData(tx, &tradeState)
 			count += 1
 		}
 		log.Printf("Migrated %d trades from v0 to v1.", count)
@@ -122,13 +123,51 @@ func initDb(db *sql.DB) error {
 		}
 	}
 
+	if version < 4 {
+		if err := migrateV4(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to migrate to version 4: %v", err)
+		}
+		if err := incrementVersion(tx, 4); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if version < 5 {
+		if err := migrateV5(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to migrate to version 5: %v", err)
+		}
+		if err := incrementVersion(tx, 5); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if version < 6 {
+		if err := migrateV6(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to migrate to version 6: %v", err)
+		}
+		if err := incrementVersion(tx, 6); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
 	tx.Commit()
 	return nil
 }
 
 func DbOpen(dataDirectory string) {
+	DbOpenFile(path.Join(dataDirectory, "maker.db"))
+}
+
+// DbOpenFile opens, and initializes if needed, the database at the given
+// filename.
+func DbOpenFile(filename string) {
 	var err error
-	filename := path.Join(dataDirectory, "maker.db")
 	log.Infof("Opening database %s", filename)
 	db, err = sql.Open("sqlite3", filename)
 	if err != nil {
@@ -139,13 +178,23 @@ func DbOpen(dataDirectory string) {
 	}
 }
 
+func DbClose() error {
+	return db.Close()
+}
+
 func DbSaveBinanceRawExecutionReport(timestamp time.Time, event []byte) error {
+	clientOrderId, originalClientOrderId, err := rawReportClientOrderIds(event)
+	if err != nil {
+		return err
+	}
 	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
-	_, err = tx.Exec(`insert into binance_raw_execution_report (timestamp, report) values (?, ?)`,
-		formatTimestamp(timestamp), event)
+	_, err = tx.Exec(`insert into binance_raw_execution_report
+		(timestamp, report, client_order_id, original_client_order_id)
+		values (?, ?, ?, ?)`,
+		formatTimestamp(timestamp), event, clientOrderId, originalClientOrderId)
 	if err != nil {
 		tx.Rollback()
 		return err
@@ -154,6 +203,42 @@ func DbSaveBinanceRawExecutionReport(timestamp time.Time, event []byte) error {
 	return nil
 }
 
+// DbGetRawExecutionReports returns the raw execution reports for the given
+// client order IDs, matching either the client order ID or the original
+// client order ID of a cancel, in the order they were received.
+func DbGetRawExecutionReports(clientOrderIds []string) ([][]byte, error) {
+	if len(clientOrderIds) == 0 {
+		return [][]byte{}, nil
+	}
+
+	placeholders := make([]string, len(clientOrderIds))
+	args := make([]interface{}, 0, len(clientOrderIds)*2)
+	for i, id := range clientOrderIds {
+		placeholders[i] = "?"
+		args = append(args, id)
+	}
+	args = append(args, args...)
+	in := strings.Join(placeholders, ", ")
+
+	rows, err := db.Query(fmt.Sprintf(`select report from binance_raw_execution_report
+		where client_order_id in (%s) or original_client_order_id in (%s)
+		order by rowid`, in, in), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := [][]byte{}
+	for rows.Next() {
+		var report []byte
+		if err := rows.Scan(&report); err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, rows.Err()
+}
+
 func DbSaveTrade(trade *types.Trade) error {
 	tx, err := db.Begin()
 	if err != nil {
@@ -161,15 +246,25 @@ func DbSaveTrade(trade *types.Trade) error {
 	}
 	data, err := formatJson(trade.State)
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
 	_, err = tx.Exec(`insert into binance_trade (id, data) values (?, ?)`,
 		trade.State.TradeID, data)
-	tx.Commit()
-	return err
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := txSyncTradeTables(tx, &trade.State); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
 }
 
-func TxDbUpdateTradeState(tx *sql.Tx, trade *types.TradeState) error {
+// txUpdateTradeData updates only the JSON trade state, for migrations that
+// run before the typed tables exist.
+func txUpdateTradeData(tx *sql.Tx, trade *types.TradeState) error {
 	data, err := formatJson(trade)
 	if err != nil {
 		return err
@@ -179,6 +274,13 @@ func TxDbUpdateTradeState(tx *sql.Tx, trade *types.TradeState) error {
 	return err
 }
 
+func TxDbUpdateTradeState(tx *sql.Tx, trade *types.TradeState) error {
+	if err := txUpdateTradeData(tx, trade); err != nil {
+		return err
+	}
+	return txSyncTradeTables(tx, trade)
+}
+
 func DbUpdateTrade(trade *types.Trade) error {
 	tx, err := db.Begin()
 	if err != nil {
@@ -264,22 +366,30 @@ func DbGetTradeByID(tradeId string) (*types.TradeState, error) {
 
 type TradeQueryOptions struct {
 	IsClosed bool
+	Symbol   string
 }
 
 func DbQueryTrades(options TradeQueryOptions) ([]types.TradeState, error) {
 
 	where := []string{}
+	args := []interface{}{}
 
 	if options.IsClosed {
-		where = append(where, fmt.Sprintf("json_extract(binance_trade.data, '$.CloseTime') != ''"))
+		where = append(where, "close_time is not null")
+	}
+
+	if options.Symbol != "" {
+		where = append(where, "symbol = ?")
+		args = append(args, options.Symbol)
 	}
 
 	sql := "select id, data from binance_trade"
 	if len(where) > 0 {
-		sql = fmt.Sprintf("%s WHERE %s", sql, strings.Join(where, "AND "))
+		sql = fmt.Sprintf("%s WHERE %s", sql, strings.Join(where, " AND "))
 	}
+	sql = fmt.Sprintf("%s ORDER BY open_time", sql)
 
-	rows, err := db.Query(sql)
+	rows, err := db.Query(sql, args...)
 	if err != nil {
 		return nil, err
 	}
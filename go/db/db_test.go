@@ -0,0 +1,231 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"database/sql"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/crankykernel/maker/go/types"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func newTestTrade(id string, closed bool) *types.Trade {
+	trade := types.NewTrade()
+	trade.State.TradeID = id
+	trade.State.Symbol = "ETHBTC"
+	trade.State.Status = types.TradeStatusWatching
+	trade.State.BuyOrderId = 1
+	trade.State.BuyOrder.Quantity = 1
+	trade.State.BuyOrder.Price = 0.03
+	trade.AddHistoryEntry(types.HistoryTypeCreated, nil)
+	trade.DoAddBuyFill(types.OrderFill{
+		Price:            0.03,
+		Quantity:         1,
+		CommissionAsset:  "ETH",
+		CommissionAmount: 0.001,
+	})
+	if closed {
+		closeTime := time.Now()
+		trade.State.CloseTime = &closeTime
+		trade.State.Status = types.TradeStatusDone
+		trade.State.Profit = 0.001
+	}
+	return trade
+}
+
+// A version 3 database, with trades stored only as JSON, is migrated to the
+// typed tables, and its raw execution reports are indexed by client order ID.
+func TestMigrateV4(t *testing.T) {
+	directory, err := ioutil.TempDir("", "maker-db")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+	filename := path.Join(directory, "maker.db")
+
+	old, err := sql.Open("sqlite3", filename)
+	assert.Nil(t, err)
+	for _, statement := range []string{
+		`create table schema (version integer not null primary key, timestamp timestamp)`,
+		`insert into schema values (0, 'now'), (1, 'now'), (2, 'now'), (3, 'now')`,
+		`create table binance_raw_execution_report (timestamp timestamp, report json)`,
+		`create table binance_trade (id string primary key unique, archived bool default false, data json)`,
+	} {
+		_, err := old.Exec(statement)
+		assert.Nil(t, err)
+	}
+	for _, trade := range []*types.Trade{newTestTrade("open", false), newTestTrade("closed", true)} {
+		data, err := formatJson(trade.State)
+		assert.Nil(t, err)
+		_, err = old.Exec(`insert into binance_trade (id, data) values (?, ?)`, trade.State.TradeID, data)
+		assert.Nil(t, err)
+	}
+	_, err = old.Exec(`insert into binance_raw_execution_report (timestamp, report) values (?, ?)`,
+		formatTimestamp(time.Now()), `{"e":"executionReport","c":"cancel","C":"buy"}`)
+	assert.Nil(t, err)
+	old.Close()
+
+	DbOpenFile(filename)
+	defer DbClose()
+
+	var status string
+	var profit float64
+	row := db.QueryRow(`select status, profit from binance_trade where id = 'closed'`)
+	assert.Nil(t, row.Scan(&status, &profit))
+	assert.Equal(t, "DONE", status)
+	assert.Equal(t, 0.001, profit)
+
+	var count int
+	assert.Nil(t, db.QueryRow(`select count(*) from trade_fill`).Scan(&count))
+	assert.Equal(t, 2, count)
+	assert.Nil(t, db.QueryRow(`select count(*) from trade_order where side = 'BUY'`).Scan(&count))
+	assert.Equal(t, 2, count)
+	assert.Nil(t, db.QueryRow(`select count(*) from trade_history`).Scan(&count))
+	assert.Equal(t, 2, count)
+
+	trades, err := DbQueryTrades(TradeQueryOptions{IsClosed: true})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(trades))
+	assert.Equal(t, "closed", trades[0].TradeID)
+
+	reports, err := DbGetRawExecutionReports([]string{"buy"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(reports))
+}
+
+func TestSaveAndUpdateTrade(t *testing.T) {
+	directory, err := ioutil.TempDir("", "maker-db")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+	DbOpen(directory)
+	defer DbClose()
+
+	trade := newTestTrade("trade", false)
+	assert.Nil(t, DbSaveTrade(trade))
+
+	trade.State.SellOrderId = 2
+	trade.State.SellOrder.Type = "LIMIT"
+	trade.State.SellOrder.Status = "FILLED"
+	trade.AddHistoryEntry(types.HistoryTypeSellOrder, nil)
+	trade.DoAddSellFill(types.OrderFill{Price: 0.031, Quantity: 0.999, CommissionAsset: "BTC"})
+	assert.Nil(t, DbUpdateTrade(trade))
+
+	var count int
+	assert.Nil(t, db.QueryRow(`select count(*) from trade_history where trade_id = 'trade'`).Scan(&count))
+	assert.Equal(t, 2, count)
+	var orderType string
+	assert.Nil(t, db.QueryRow(`select type from trade_order where side = 'SELL' and order_id = 2`).Scan(&orderType))
+	assert.Equal(t, "LIMIT", orderType)
+	var price float64
+	assert.Nil(t, db.QueryRow(`select price from trade_fill where side = 'SELL'`).Scan(&price))
+	assert.Equal(t, 0.031, price)
+}
+
+// Every order of a trade is in trade_order, not only the current buy and
+// sell.
+func TestSaveTradeOrders(t *testing.T) {
+	directory, err := ioutil.TempDir("", "maker-db")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+	DbOpen(directory)
+	defer DbClose()
+
+	trade := newTestTrade("trade", false)
+
+	// A chased buy: the first order part filled before being replaced.
+	trade.State.BuySideFills[0].OrderID = 1
+	trade.DoAddBuyFill(types.OrderFill{Price: 0.0301, Quantity: 1, OrderID: 3})
+	trade.State.BuyOrderId = 3
+
+	trade.State.TakeProfit = []types.TakeProfitTarget{
+		{QuantityPercent: 50, ProfitPercent: 1, OrderID: 4, Quantity: 1, Price: 0.0304},
+		{QuantityPercent: 50, ProfitPercent: 2},
+	}
+	trade.State.StopLoss.Orders = []types.StopOrder{
+		{ClientOrderID: "stop-1", OrderID: 5, Quantity: 1, StopPrice: 0.029, Price: 0.0289},
+	}
+	trade.DoAddSellFill(types.OrderFill{Price: 0.0304, Quantity: 1, OrderID: 4})
+	assert.Nil(t, DbSaveTrade(trade))
+
+	orders := map[int64]string{}
+	rows, err := db.Query(`select order_id, side from trade_order where trade_id = 'trade'`)
+	assert.Nil(t, err)
+	for rows.Next() {
+		var orderId int64
+		var side string
+		assert.Nil(t, rows.Scan(&orderId, &side))
+		orders[orderId] = side
+	}
+	rows.Close()
+	assert.Equal(t, map[int64]string{1: "BUY", 3: "BUY", 4: "SELL", 5: "SELL"}, orders)
+
+	var orderType string
+	assert.Nil(t, db.QueryRow(`select type from trade_order where order_id = 5`).Scan(&orderType))
+	assert.Equal(t, "STOP_LOSS_LIMIT", orderType)
+}
+
+func TestGetRawExecutionReports(t *testing.T) {
+	directory, err := ioutil.TempDir("", "maker-db")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+	DbOpen(directory)
+	defer DbClose()
+
+	reports := []string{
+		`{"e":"executionReport","c":"buy","C":""}`,
+		`{"e":"executionReport","c":"other","C":""}`,
+		`{"e":"executionReport","c":"cancel","C":"buy"}`,
+		`{"e":"executionReport","c":"buyer","C":""}`,
+	}
+	for _, report := range reports {
+		assert.Nil(t, DbSaveBinanceRawExecutionReport(time.Now(), []byte(report)))
+	}
+
+	found, err := DbGetRawExecutionReports([]string{"buy"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(found))
+	assert.Equal(t, reports[0], string(found[0]))
+	assert.Equal(t, reports[2], string(found[1]))
+}
+
+// A client order ID is only journalled again once its intent has failed.
+func TestSaveOrderIntent(t *testing.T) {
+	directory, err := ioutil.TempDir("", "maker-db")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+	DbOpen(directory)
+	defer DbClose()
+
+	intent := OrderIntent{ClientOrderID: "sell", Symbol: "ETHBTC", Kind: "OCO"}
+	assert.Nil(t, DbSaveOrderIntent(intent))
+	intent.Kind = "ORDER"
+	assert.NotNil(t, DbSaveOrderIntent(intent))
+	assert.Nil(t, DbConfirmOrderIntent("sell", 1))
+	assert.NotNil(t, DbSaveOrderIntent(intent))
+
+	var kind string
+	assert.Nil(t, db.QueryRow(`select kind from order_intent where client_order_id = 'sell'`).Scan(&kind))
+	assert.Equal(t, "OCO", kind)
+
+	assert.Nil(t, DbFailOrderIntent("sell", "rejected"))
+	assert.Nil(t, DbSaveOrderIntent(intent))
+	pending, err := DbGetPendingOrderIntents()
+	assert.Nil(t, err)
+	assert.Len(t, pending, 1)
+	assert.Equal(t, "ORDER", pending[0].Kind)
+}
@@ -0,0 +1,145 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Every order is journalled as an intent before it is sent to the exchange,
+// and the intent is marked confirmed or failed once the outcome is known. An
+// intent still pending after a crash or lost response is resolved against
+// the exchange by its client order ID.
+
+const (
+	OrderIntentPending   = "PENDING"
+	OrderIntentConfirmed = "CONFIRMED"
+	OrderIntentFailed    = "FAILED"
+)
+
+var schemaV5 = []string{
+	`create table order_intent (
+		client_order_id text not null primary key,
+		symbol text not null,
+		kind text not null,
+		params json,
+		status text not null,
+		order_id integer,
+		error text,
+		created timestamp not null,
+		updated timestamp not null)`,
+	`create index order_intent_status_index on order_intent(status)`,
+}
+
+func migrateV5(tx *sql.Tx) error {
+	for _, statement := range schemaV5 {
+		if _, err := tx.Exec(statement); err != nil {
+			return fmt.Errorf("failed to execute %q: %v", statement, err)
+		}
+	}
+	return nil
+}
+
+// OrderIntent is a journalled order. Kind is the type of order submission,
+// and Params the parameters it was submitted with.
+type OrderIntent struct {
+	ClientOrderID string
+	Symbol        string
+	Kind          string
+	Params        interface{}
+	Status        string
+	OrderID       int64
+	Error         string
+	Created       time.Time
+}
+
+// DbSaveOrderIntent journals a new pending intent. A client order ID may
+// only be used again once its intent has failed, so an order that may be on
+// the exchange is never overwritten.
+func DbSaveOrderIntent(intent OrderIntent) error {
+	params, err := formatJson(intent.Params)
+	if err != nil {
+		return err
+	}
+	now := formatTimestamp(time.Now())
+	result, err := db.Exec(`insert into order_intent
+		(client_order_id, symbol, kind, params, status, created, updated)
+		values (?, ?, ?, ?, ?, ?, ?)
+		on conflict (client_order_id) do update set
+			symbol = excluded.symbol, kind = excluded.kind, params = excluded.params,
+			status = excluded.status, order_id = null, error = null,
+			created = excluded.created, updated = excluded.updated
+		where status = ?`,
+		intent.ClientOrderID, intent.Symbol, intent.Kind, params,
+		OrderIntentPending, now, now, OrderIntentFailed)
+	if err != nil {
+		return err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("client order ID %s is already journalled", intent.ClientOrderID)
+	}
+	return nil
+}
+
+// DbConfirmOrderIntent marks an intent as confirmed by the exchange.
+func DbConfirmOrderIntent(clientOrderId string, orderId int64) error {
+	_, err := db.Exec(`update order_intent set status = ?, order_id = ?, error = null, updated = ?
+		where client_order_id = ?`,
+		OrderIntentConfirmed, orderId, formatTimestamp(time.Now()), clientOrderId)
+	return err
+}
+
+// DbFailOrderIntent marks an intent as failed, the order having never been
+// placed.
+func DbFailOrderIntent(clientOrderId string, reason string) error {
+	_, err := db.Exec(`update order_intent set status = ?, error = ?, updated = ?
+		where client_order_id = ?`,
+		OrderIntentFailed, reason, formatTimestamp(time.Now()), clientOrderId)
+	return err
+}
+
+// DbGetPendingOrderIntents returns the intents whose outcome is not known,
+// oldest first. Params are returned as the raw JSON they were stored as.
+func DbGetPendingOrderIntents() ([]OrderIntent, error) {
+	rows, err := db.Query(`select client_order_id, symbol, kind, params, created
+		from order_intent where status = ? order by created`, OrderIntentPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	intents := []OrderIntent{}
+	for rows.Next() {
+		var intent OrderIntent
+		var params string
+		var created time.Time
+		if err := rows.Scan(&intent.ClientOrderID, &intent.Symbol, &intent.Kind,
+			&params, &created); err != nil {
+			return nil, err
+		}
+		intent.Params = json.RawMessage(params)
+		intent.Status = OrderIntentPending
+		intent.Created = created
+		intents = append(intents, intent)
+	}
+	return intents, rows.Err()
+}
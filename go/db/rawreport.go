@@ -0,0 +1,99 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"gitlab.com/crankykernel/maker/go/log"
+)
+
+// The client order IDs of raw execution reports are stored in their own
+// indexed columns so the reports for a trade can be found without scanning
+// every report.
+
+var schemaV6 = []string{
+	`alter table binance_raw_execution_report add column client_order_id text`,
+	`alter table binance_raw_execution_report add column original_client_order_id text`,
+	`create index binance_raw_execution_report_client_order_id_index
+		on binance_raw_execution_report(client_order_id)`,
+	`create index binance_raw_execution_report_original_client_order_id_index
+		on binance_raw_execution_report(original_client_order_id)`,
+}
+
+// migrateV6 adds the client order ID columns and populates them from the
+// existing reports.
+func migrateV6(tx *sql.Tx) error {
+	for _, statement := range schemaV6 {
+		if _, err := tx.Exec(statement); err != nil {
+			return fmt.Errorf("failed to execute %q: %v", statement, err)
+		}
+	}
+
+	type rawReportIds struct {
+		rowid                 int64
+		clientOrderId         string
+		originalClientOrderId string
+	}
+
+	rows, err := tx.Query(`select rowid, report from binance_raw_execution_report`)
+	if err != nil {
+		return fmt.Errorf("failed to load raw execution reports: %v", err)
+	}
+	reports := []rawReportIds{}
+	for rows.Next() {
+		var ids rawReportIds
+		var report []byte
+		if err := rows.Scan(&ids.rowid, &report); err != nil {
+			rows.Close()
+			return err
+		}
+		ids.clientOrderId, ids.originalClientOrderId, err = rawReportClientOrderIds(report)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"rowid": ids.rowid,
+			}).Warn("Failed to decode raw execution report.")
+			continue
+		}
+		reports = append(reports, ids)
+	}
+	rows.Close()
+
+	for _, ids := range reports {
+		_, err := tx.Exec(`update binance_raw_execution_report
+			set client_order_id = ?, original_client_order_id = ? where rowid = ?`,
+			ids.clientOrderId, ids.originalClientOrderId, ids.rowid)
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("Indexed %d raw execution reports by client order ID.", len(reports))
+	return nil
+}
+
+// rawReportClientOrderIds returns the client order ID, and the original
+// client order ID of a cancel, from a raw execution report.
+func rawReportClientOrderIds(report []byte) (string, string, error) {
+	var orderIds struct {
+		ClientOrderID         string `json:"c"`
+		OriginalClientOrderID string `json:"C"`
+	}
+	if err := json.Unmarshal(report, &orderIds); err != nil {
+		return "", "", err
+	}
+	return orderIds.ClientOrderID, orderIds.OriginalClientOrderID, nil
+}
@@ -0,0 +1,252 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/crankykernel/binanceapi-go"
+	"gitlab.com/crankykernel/maker/go/types"
+)
+
+// The trade state is stored whole as JSON in binance_trade.data, which is
+// what trades are restored from. The columns of binance_trade and the
+// trade_order, trade_fill and trade_history tables are a typed copy of the
+// state, kept in sync on every write, for querying and reporting.
+
+var schemaV4 = []string{
+	`alter table binance_trade add column symbol text`,
+	`alter table binance_trade add column status text`,
+	`alter table binance_trade add column open_time timestamp`,
+	`alter table binance_trade add column close_time timestamp`,
+	`alter table binance_trade add column profit real`,
+	`alter table binance_trade add column profit_percent real`,
+	`create index binance_trade_symbol_index on binance_trade(symbol)`,
+	`create index binance_trade_status_index on binance_trade(status)`,
+	`create index binance_trade_open_time_index on binance_trade(open_time)`,
+	`create index binance_trade_close_time_index on binance_trade(close_time)`,
+	`create index binance_trade_profit_index on binance_trade(profit)`,
+	`create table trade_order (
+		trade_id text not null references binance_trade(id),
+		side text not null,
+		order_id integer not null,
+		type text,
+		quantity real,
+		price real,
+		status text,
+		primary key (trade_id, side, order_id))`,
+	`create index trade_order_order_id_index on trade_order(order_id)`,
+	`create table trade_fill (
+		trade_id text not null references binance_trade(id),
+		side text not null,
+		seq integer not null,
+		price real not null,
+		quantity real not null,
+		commission_asset text,
+		commission_amount real,
+		primary key (trade_id, side, seq))`,
+	`create table trade_history (
+		trade_id text not null references binance_trade(id),
+		seq integer not null,
+		timestamp timestamp not null,
+		type text not null,
+		fields json,
+		primary key (trade_id, seq))`,
+	`create index trade_history_timestamp_index on trade_history(timestamp)`,
+	`create index trade_history_type_index on trade_history(type)`,
+}
+
+// migrateV4 creates the typed tables and populates them from the existing
+// trade JSON.
+func migrateV4(tx *sql.Tx) error {
+	for _, statement := range schemaV4 {
+		if _, err := tx.Exec(statement); err != nil {
+			return fmt.Errorf("failed to execute %q: %v", statement, err)
+		}
+	}
+
+	rows, err := tx.Query(`select id, data from binance_trade`)
+	if err != nil {
+		return fmt.Errorf("failed to load trades: %v", err)
+	}
+	states := []types.TradeState{}
+	for rows.Next() {
+		var localId string
+		var data string
+		if err := rows.Scan(&localId, &data); err != nil {
+			rows.Close()
+			return err
+		}
+		var state types.TradeState
+		if err := json.Unmarshal([]byte(data), &state); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to decode trade %s: %v", localId, err)
+		}
+		states = append(states, state)
+	}
+	rows.Close()
+
+	for i := range states {
+		if err := txSyncTradeTables(tx, &states[i]); err != nil {
+			return fmt.Errorf("failed to migrate trade %s: %v", states[i].TradeID, err)
+		}
+	}
+	return nil
+}
+
+// txSyncTradeTables updates the typed columns and tables from the trade
+// state.
+func txSyncTradeTables(tx *sql.Tx, state *types.TradeState) error {
+	var closeTime interface{}
+	if state.CloseTime != nil {
+		closeTime = formatTimestamp(*state.CloseTime)
+	}
+	_, err := tx.Exec(`update binance_trade
+		set symbol = ?, status = ?, open_time = ?, close_time = ?, profit = ?, profit_percent = ?
+		where id = ?`,
+		state.Symbol, string(state.Status), formatTimestamp(state.OpenTime), closeTime,
+		state.Profit, state.ProfitPercent, state.TradeID)
+	if err != nil {
+		return err
+	}
+
+	if err := txSaveTradeOrders(tx, state); err != nil {
+		return err
+	}
+
+	if err := txSaveTradeFills(tx, state.TradeID, "BUY", state.BuySideFills); err != nil {
+		return err
+	}
+	if err := txSaveTradeFills(tx, state.TradeID, "SELL", state.SellSideFills); err != nil {
+		return err
+	}
+
+	return txSaveTradeHistory(tx, state.TradeID, state.History)
+}
+
+// txSaveTradeOrders saves every order of a trade: the current buy and sell
+// orders, take profit and stop orders, and any order with fills, such as a
+// buy replaced by chasing.
+func txSaveTradeOrders(tx *sql.Tx, state *types.TradeState) error {
+	for _, target := range state.TakeProfit {
+		if target.OrderID == 0 {
+			continue
+		}
+		if err := txSaveTradeOrder(tx, state.TradeID, "SELL", target.OrderID,
+			string(binanceapi.OrderTypeLimit), target.Quantity, target.Price,
+			string(target.Status)); err != nil {
+			return err
+		}
+	}
+	for _, order := range state.StopLoss.Orders {
+		if order.OrderID == 0 {
+			continue
+		}
+		if err := txSaveTradeOrder(tx, state.TradeID, "SELL", order.OrderID,
+			"STOP_LOSS_LIMIT", order.Quantity, order.Price, string(order.Status)); err != nil {
+			return err
+		}
+	}
+
+	if state.BuyOrderId != 0 {
+		if err := txSaveTradeOrder(tx, state.TradeID, "BUY", state.BuyOrderId, "",
+			state.BuyOrder.Quantity, state.BuyOrder.Price, string(state.LastBuyStatus)); err != nil {
+			return err
+		}
+	}
+	if state.SellOrderId != 0 {
+		if err := txSaveTradeOrder(tx, state.TradeID, "SELL", state.SellOrderId,
+			state.SellOrder.Type, state.SellOrder.Quantity, state.SellOrder.Price,
+			string(state.SellOrder.Status)); err != nil {
+			return err
+		}
+	}
+
+	// Orders no longer current were saved in full while they were, only
+	// make sure they are there.
+	for side, fills := range map[string][]types.OrderFill{
+		"BUY":  state.BuySideFills,
+		"SELL": state.SellSideFills,
+	} {
+		for _, fill := range fills {
+			if fill.OrderID == 0 {
+				continue
+			}
+			_, err := tx.Exec(`insert or ignore into trade_order (trade_id, side, order_id)
+				values (?, ?, ?)`, state.TradeID, side, fill.OrderID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func txSaveTradeOrder(tx *sql.Tx, tradeId string, side string, orderId int64,
+	orderType string, quantity float64, price float64, status string) error {
+	_, err := tx.Exec(`insert or replace into trade_order
+		(trade_id, side, order_id, type, quantity, price, status)
+		values (?, ?, ?, ?, ?, ?, ?)`,
+		tradeId, side, orderId, orderType, quantity, price, status)
+	return err
+}
+
+func txSaveTradeFills(tx *sql.Tx, tradeId string, side string, fills []types.OrderFill) error {
+	for i, fill := range fills {
+		_, err := tx.Exec(`insert or replace into trade_fill
+			(trade_id, side, seq, price, quantity, commission_asset, commission_amount)
+			values (?, ?, ?, ?, ?, ?, ?)`,
+			tradeId, side, i, fill.Price, fill.Quantity, fill.CommissionAsset,
+			fill.CommissionAmount)
+		if err != nil {
+			return err
+		}
+	}
+	// Fills may be rebuilt from the exchange on restore.
+	_, err := tx.Exec(`delete from trade_fill where trade_id = ? and side = ? and seq >= ?`,
+		tradeId, side, len(fills))
+	return err
+}
+
+// History is append only, so only entries not already stored are inserted.
+func txSaveTradeHistory(tx *sql.Tx, tradeId string, history []types.HistoryEntry) error {
+	var count int
+	row := tx.QueryRow(`select count(*) from trade_history where trade_id = ?`, tradeId)
+	if err := row.Scan(&count); err != nil {
+		return err
+	}
+	if count > len(history) {
+		if _, err := tx.Exec(`delete from trade_history where trade_id = ?`, tradeId); err != nil {
+			return err
+		}
+		count = 0
+	}
+	for i := count; i < len(history); i++ {
+		entry := history[i]
+		fields, err := formatJson(entry.Fields)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`insert into trade_history (trade_id, seq, timestamp, type, fields)
+			values (?, ?, ?, ?, ?)`,
+			tradeId, i, formatTimestamp(entry.Timestamp), string(entry.Type), fields)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
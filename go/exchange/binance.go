@@ -0,0 +1,540 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package exchange
+
+import (
+	"encoding/json"
+	"github.com/crankykernel/binanceapi-go"
+	"gitlab.com/crankykernel/maker/go/binanceex"
+	"gitlab.com/crankykernel/maker/go/types"
+	"sync"
+	"time"
+)
+
+// BinanceExchange implements Exchange on top of the Binance REST API and
+// websocket streams.
+type BinanceExchange struct {
+	exchangeInfoService *binanceex.ExchangeInfoService
+	priceService        *binanceex.BinancePriceService
+	tradeStreamManager  *binanceex.TradeStreamManager
+	userDataStream      *binanceex.BinanceUserDataStream
+
+	lock                  sync.Mutex
+	tradeSubscriptions    map[TradeChannel]*binanceTradeSubscription
+	userStreamSubscribers map[chan *UserStreamEvent]*binanceUserStreamSubscription
+}
+
+// A subscription to a binanceex stream, converted and forwarded to the
+// subscriber by a goroutine. The binanceex streams block sending to their
+// subscribers, so the source is read until it is unsubscribed.
+type binanceTradeSubscription struct {
+	source binanceex.TradeStreamChannel
+	done   chan bool
+}
+
+type binanceUserStreamSubscription struct {
+	source chan *binanceex.UserStreamEvent
+	done   chan bool
+}
+
+func NewBinanceExchange(exchangeInfoService *binanceex.ExchangeInfoService,
+	priceService *binanceex.BinancePriceService,
+	tradeStreamManager *binanceex.TradeStreamManager,
+	userDataStream *binanceex.BinanceUserDataStream) *BinanceExchange {
+	return &BinanceExchange{
+		exchangeInfoService: exchangeInfoService,
+		priceService:        priceService,
+		tradeStreamManager:  tradeStreamManager,
+		userDataStream:      userDataStream,
+
+		tradeSubscriptions:    make(map[TradeChannel]*binanceTradeSubscription),
+		userStreamSubscribers: make(map[chan *UserStreamEvent]*binanceUserStreamSubscription),
+	}
+}
+
+// Binance error codes we act on.
+const (
+	binanceErrorUnknown            = -1000
+	binanceErrorDisconnected       = -1001
+	binanceErrorUnexpectedResponse = -1006
+	binanceErrorTimeout            = -1007
+	binanceErrorFilterFailure      = -1013
+	binanceErrorNewOrderRejected   = -2010
+	binanceErrorNoSuchOrder        = -2013
+)
+
+// binanceErrorCode returns the code of a Binance error response body, or 0
+// if it is not one.
+func binanceErrorCode(body []byte) int {
+	var response struct {
+		Code int `json:"code"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return 0
+	}
+	return response.Code
+}
+
+// fromBinanceError returns a request the Binance API failed as an ApiError.
+func fromBinanceError(err error) error {
+	if requestError, ok := err.(*binanceex.RequestError); ok {
+		return &ApiError{
+			StatusCode: requestError.StatusCode,
+			Body:       requestError.Body,
+		}
+	}
+	return err
+}
+
+func (e *BinanceExchange) Name() string {
+	return "binance"
+}
+
+func (e *BinanceExchange) PostOrder(order OrderParameters) (*Order, error) {
+	restOrder, err := binanceex.PostOrder(binanceapi.OrderParameters{
+		Symbol:           order.Symbol,
+		Side:             binanceapi.OrderSide(order.Side),
+		Type:             binanceapi.OrderType(order.Type),
+		TimeInForce:      binanceapi.TimeInForce(order.TimeInForce),
+		Quantity:         order.Quantity,
+		Price:            order.Price,
+		StopPrice:        order.StopPrice,
+		NewClientOrderId: order.ClientOrderID,
+	})
+	if err != nil {
+		return nil, fromBinanceError(err)
+	}
+	return fromRestOrder(restOrder), nil
+}
+
+func (e *BinanceExchange) PostStopOrder(order StopOrderParameters) (*Order, error) {
+	restOrder, err := binanceex.PostStopLossLimitOrder(order.Symbol, order.Quantity,
+		order.StopPrice, order.Price, order.ClientOrderID)
+	if err != nil {
+		return nil, fromBinanceError(err)
+	}
+	return fromRestOrder(restOrder), nil
+}
+
+func (e *BinanceExchange) PostOcoOrder(order OcoOrderParameters) (*OrderList, error) {
+	restOrderList, err := binanceex.PostOcoSellOrder(order.Symbol, order.Quantity,
+		order.Price, order.StopPrice, order.StopLimitPrice, order.ListClientOrderID,
+		order.LimitClientOrderID, order.StopClientOrderID)
+	if err != nil {
+		return nil, fromBinanceError(err)
+	}
+	orderList := &OrderList{
+		OrderListID:       restOrderList.OrderListID,
+		ListClientOrderID: restOrderList.ListClientOrderID,
+		ListStatusType:    restOrderList.ListStatusType,
+		ListOrderStatus:   restOrderList.ListOrderStatus,
+	}
+	for _, order := range restOrderList.Orders {
+		orderList.Orders = append(orderList.Orders, Order{
+			Symbol:        order.Symbol,
+			OrderID:       order.OrderID,
+			ClientOrderID: order.ClientOrderID,
+		})
+	}
+	return orderList, nil
+}
+
+func (e *BinanceExchange) CancelOrder(symbol string, orderId int64) error {
+	return fromBinanceError(binanceex.CancelOrder(symbol, orderId))
+}
+
+func (e *BinanceExchange) GetOrderByClientId(symbol string, clientOrderId string) (*Order, error) {
+	order, err := binanceex.GetOrderByClientId(symbol, clientOrderId)
+	if err != nil {
+		if requestError, ok := err.(*binanceex.RequestError); ok &&
+			binanceErrorCode(requestError.Body) == binanceErrorNoSuchOrder {
+			return nil, ErrOrderNotFound
+		}
+		return nil, err
+	}
+	return fromRestOrder(order), nil
+}
+
+func (e *BinanceExchange) GetOrderByOrderId(symbol string, orderId int64) (*Order, error) {
+	order, err := binanceex.GetOrder(symbol, orderId)
+	if err != nil {
+		if requestError, ok := err.(*binanceex.RequestError); ok &&
+			binanceErrorCode(requestError.Body) == binanceErrorNoSuchOrder {
+			return nil, ErrOrderNotFound
+		}
+		return nil, err
+	}
+	return fromRestOrder(order), nil
+}
+
+func fromRestOrder(order *binanceex.RestOrder) *Order {
+	return &Order{
+		Symbol:           order.Symbol,
+		OrderID:          order.OrderID,
+		ClientOrderID:    order.ClientOrderID,
+		Status:           OrderStatus(order.Status),
+		TimeMillis:       order.TimeMillis,
+		ExecutedQuantity: order.ExecutedQuantity,
+		Side:             OrderSide(order.Side),
+		Price:            order.Price,
+		Quantity:         order.Quantity,
+	}
+}
+
+func (e *BinanceExchange) GetOpenOrders(symbol string) ([]Order, error) {
+	openOrders, err := binanceex.GetOpenOrders(symbol)
+	if err != nil {
+		return nil, err
+	}
+	orders := []Order{}
+	for i := range openOrders {
+		orders = append(orders, *fromRestOrder(&openOrders[i]))
+	}
+	return orders, nil
+}
+
+func (e *BinanceExchange) GetBalance(asset string) (float64, error) {
+	balances, err := binanceex.GetBalances()
+	if err != nil {
+		return 0, err
+	}
+	return balances[asset], nil
+}
+
+func (e *BinanceExchange) GetFreeBalance(asset string) (float64, error) {
+	balances, err := binanceex.GetFreeBalances()
+	if err != nil {
+		return 0, err
+	}
+	return balances[asset], nil
+}
+
+func (e *BinanceExchange) GetOrderFills(symbol string, orderId int64) ([]Fill, error) {
+	trades, err := binanceex.GetMyTrades(symbol, orderId)
+	if err != nil {
+		return nil, err
+	}
+	fills := []Fill{}
+	for _, trade := range trades {
+		fills = append(fills, Fill{
+			OrderID:         trade.OrderID,
+			Price:           trade.Price,
+			Quantity:        trade.Quantity,
+			Commission:      trade.Commission,
+			CommissionAsset: trade.CommissionAsset,
+		})
+	}
+	return fills, nil
+}
+
+func (e *BinanceExchange) GetPrice(symbol string, priceSource types.PriceSource) (float64, error) {
+	return e.priceService.GetPrice(symbol, priceSource)
+}
+
+func (e *BinanceExchange) GetSymbolInfo(symbol string) (SymbolInfo, error) {
+	info, err := e.exchangeInfoService.GetSymbol(symbol)
+	if err != nil {
+		return SymbolInfo{}, err
+	}
+	return FromBinanceSymbolInfo(info), nil
+}
+
+// FromBinanceSymbolInfo converts the symbol information of the Binance
+// exchange info service.
+func FromBinanceSymbolInfo(info binanceex.SymbolInfo) SymbolInfo {
+	return SymbolInfo{
+		BaseAsset:        info.BaseAsset,
+		QuoteAsset:       info.QuoteAsset,
+		TickSize:         info.TickSize,
+		StepSize:         info.StepSize,
+		MinNotional:      info.MinNotional,
+		Status:           info.Status,
+		OrderTypes:       info.OrderTypes,
+		MinPrice:         info.MinPrice,
+		MaxPrice:         info.MaxPrice,
+		MinQty:           info.MinQty,
+		MaxQty:           info.MaxQty,
+		MarketMinQty:     info.MarketMinQty,
+		MarketMaxQty:     info.MarketMaxQty,
+		MarketStepSize:   info.MarketStepSize,
+		MultiplierUp:     info.MultiplierUp,
+		MultiplierDown:   info.MultiplierDown,
+		ApplyToMarket:    info.ApplyToMarket,
+		MaxNumOrders:     info.MaxNumOrders,
+		MaxNumAlgoOrders: info.MaxNumAlgoOrders,
+	}
+}
+
+func (e *BinanceExchange) AddSymbol(symbol string) {
+	e.tradeStreamManager.AddSymbol(symbol)
+}
+
+func (e *BinanceExchange) RemoveSymbol(symbol string) {
+	e.tradeStreamManager.RemoveSymbol(symbol)
+}
+
+func (e *BinanceExchange) SubscribeTrades() TradeChannel {
+	subscription := &binanceTradeSubscription{
+		source: e.tradeStreamManager.Subscribe(),
+		done:   make(chan bool),
+	}
+	channel := make(TradeChannel)
+	e.lock.Lock()
+	e.tradeSubscriptions[channel] = subscription
+	e.lock.Unlock()
+	go func() {
+		for {
+			select {
+			case trade := <-subscription.source:
+				select {
+				case channel <- FromBinanceAggTrade(trade):
+				case <-subscription.done:
+					return
+				}
+			case <-subscription.done:
+				return
+			}
+		}
+	}()
+	return channel
+}
+
+func (e *BinanceExchange) UnsubscribeTrades(channel TradeChannel) {
+	e.lock.Lock()
+	subscription := e.tradeSubscriptions[channel]
+	delete(e.tradeSubscriptions, channel)
+	e.lock.Unlock()
+	if subscription == nil {
+		return
+	}
+	close(subscription.done)
+	unsubscribed := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-subscription.source:
+			case <-unsubscribed:
+				return
+			}
+		}
+	}()
+	e.tradeStreamManager.Unsubscribe(subscription.source)
+	close(unsubscribed)
+}
+
+func (e *BinanceExchange) SubscribeUserStream() chan *UserStreamEvent {
+	subscription := &binanceUserStreamSubscription{
+		source: e.userDataStream.Subscribe(),
+		done:   make(chan bool),
+	}
+	channel := make(chan *UserStreamEvent)
+	e.lock.Lock()
+	e.userStreamSubscribers[channel] = subscription
+	e.lock.Unlock()
+	go func() {
+		for {
+			select {
+			case event := <-subscription.source:
+				converted := FromBinanceUserStreamEvent(event)
+				if converted == nil {
+					continue
+				}
+				select {
+				case channel <- converted:
+				case <-subscription.done:
+					return
+				}
+			case <-subscription.done:
+				return
+			}
+		}
+	}()
+	return channel
+}
+
+func (e *BinanceExchange) UnsubscribeUserStream(channel chan *UserStreamEvent) {
+	e.lock.Lock()
+	subscription := e.userStreamSubscribers[channel]
+	delete(e.userStreamSubscribers, channel)
+	e.lock.Unlock()
+	if subscription == nil {
+		return
+	}
+	close(subscription.done)
+	unsubscribed := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-subscription.source:
+			case <-unsubscribed:
+				return
+			}
+		}
+	}()
+	e.userDataStream.Unsubscribe(subscription.source)
+	close(unsubscribed)
+}
+
+// FromBinanceAggTrade converts a trade from the Binance aggregate trade
+// stream.
+func FromBinanceAggTrade(trade *binanceapi.StreamAggTrade) *MarketTrade {
+	return &MarketTrade{
+		Symbol:     trade.Symbol,
+		TradeID:    trade.TradeID,
+		Price:      trade.Price,
+		Quantity:   trade.Quantity,
+		Time:       time.Unix(0, trade.TradeTime*int64(time.Millisecond)),
+		BuyerMaker: trade.BuyerMaker,
+	}
+}
+
+// FromBinanceUserStreamEvent converts an event from the Binance user stream,
+// returning nil for event types not handled.
+func FromBinanceUserStreamEvent(event *binanceex.UserStreamEvent) *UserStreamEvent {
+	converted := &UserStreamEvent{
+		Time: event.EventTime,
+		Raw:  event.Raw,
+	}
+	switch event.EventType {
+	case binanceex.EventTypeExecutionReport:
+		converted.Type = UserStreamEventExecutionReport
+		converted.ExecutionReport = FromBinanceExecutionReport(event.ExecutionReport)
+	case binanceex.EventTypeListStatus:
+		converted.Type = UserStreamEventListStatus
+		converted.ListStatus = FromBinanceListStatus(event.ListStatus)
+	case binanceex.EventTypeOutboundAccountInfo:
+		converted.Type = UserStreamEventAccount
+		for _, balance := range event.OutboundAccountInfo.Balances {
+			converted.Balances = append(converted.Balances, Balance{
+				Asset:  balance.Asset,
+				Free:   balance.Free,
+				Locked: balance.Locked,
+			})
+		}
+	default:
+		return nil
+	}
+	return converted
+}
+
+// FromBinanceExecutionReport converts a Binance execution report, as
+// received on the user stream or saved for replay.
+func FromBinanceExecutionReport(report binanceapi.StreamExecutionReport) ExecutionReport {
+	return ExecutionReport{
+		Symbol:                report.Symbol,
+		OrderID:               report.OrderID,
+		ClientOrderID:         report.ClientOrderID,
+		OriginalClientOrderID: report.OriginalClientOrderID,
+		Side:                  OrderSide(report.Side),
+		Type:                  OrderType(report.OrderType),
+		TimeInForce:           TimeInForce(report.TimeInForce),
+		ExecutionType:         report.CurrentExecutionType,
+		Status:                OrderStatus(report.CurrentOrderStatus),
+		RejectReason:          report.OrderRejectReason,
+		Quantity:              report.Quantity,
+		Price:                 report.Price,
+		StopPrice:             report.StopPrice,
+		LastExecutedQuantity:  report.LastExecutedQuantity,
+		LastExecutedPrice:     report.LastExecutedPrice,
+		CumulativeQuantity:    report.CumulativeFilledQuantity,
+		Commission:            report.CommissionAmount,
+		CommissionAsset:       report.CommissionAsset,
+		TradeID:               report.TradeID,
+		Working:               report.IsWorking,
+		Maker:                 report.IsMaker,
+		TimeMillis:            report.EventTimeMillis,
+		TransactionTimeMillis: report.TransactionTimeMillis,
+	}
+}
+
+// ToBinanceExecutionReport converts an execution report to the Binance
+// format trades keep in their history.
+func ToBinanceExecutionReport(report ExecutionReport) binanceapi.StreamExecutionReport {
+	return binanceapi.StreamExecutionReport{
+		EventType:                string(binanceex.EventTypeExecutionReport),
+		EventTimeMillis:          report.TimeMillis,
+		Symbol:                   report.Symbol,
+		ClientOrderID:            report.ClientOrderID,
+		Side:                     binanceapi.OrderSide(report.Side),
+		OrderType:                string(report.Type),
+		TimeInForce:              binanceapi.TimeInForce(report.TimeInForce),
+		Quantity:                 report.Quantity,
+		Price:                    report.Price,
+		StopPrice:                report.StopPrice,
+		OriginalClientOrderID:    report.OriginalClientOrderID,
+		CurrentExecutionType:     report.ExecutionType,
+		CurrentOrderStatus:       binanceapi.OrderStatus(report.Status),
+		OrderRejectReason:        report.RejectReason,
+		OrderID:                  report.OrderID,
+		LastExecutedQuantity:     report.LastExecutedQuantity,
+		CumulativeFilledQuantity: report.CumulativeQuantity,
+		LastExecutedPrice:        report.LastExecutedPrice,
+		CommissionAmount:         report.Commission,
+		CommissionAsset:          report.CommissionAsset,
+		TransactionTimeMillis:    report.TransactionTimeMillis,
+		TradeID:                  report.TradeID,
+		IsWorking:                report.Working,
+		IsMaker:                  report.Maker,
+	}
+}
+
+// FromBinanceListStatus converts a Binance list status event.
+func FromBinanceListStatus(listStatus binanceex.StreamListStatus) ListStatus {
+	converted := ListStatus{
+		Symbol:                listStatus.Symbol,
+		OrderListID:           listStatus.OrderListID,
+		ListClientOrderID:     listStatus.ListClientOrderID,
+		ContingencyType:       listStatus.ContingencyType,
+		ListStatusType:        listStatus.ListStatusType,
+		ListOrderStatus:       listStatus.ListOrderStatus,
+		RejectReason:          listStatus.ListRejectReason,
+		TimeMillis:            listStatus.EventTimeMillis,
+		TransactionTimeMillis: listStatus.TransactionTime,
+	}
+	for _, order := range listStatus.Orders {
+		converted.Orders = append(converted.Orders, Order{
+			Symbol:        order.Symbol,
+			OrderID:       order.OrderID,
+			ClientOrderID: order.ClientOrderID,
+		})
+	}
+	return converted
+}
+
+// ToBinanceListStatus converts a list status to the Binance format trades
+// keep in their history.
+func ToBinanceListStatus(listStatus ListStatus) binanceex.StreamListStatus {
+	converted := binanceex.StreamListStatus{
+		EventType:         string(binanceex.EventTypeListStatus),
+		EventTimeMillis:   listStatus.TimeMillis,
+		Symbol:            listStatus.Symbol,
+		OrderListID:       listStatus.OrderListID,
+		ContingencyType:   listStatus.ContingencyType,
+		ListStatusType:    listStatus.ListStatusType,
+		ListOrderStatus:   listStatus.ListOrderStatus,
+		ListRejectReason:  listStatus.RejectReason,
+		ListClientOrderID: listStatus.ListClientOrderID,
+		TransactionTime:   listStatus.TransactionTimeMillis,
+	}
+	for _, order := range listStatus.Orders {
+		converted.Orders = append(converted.Orders, binanceex.StreamListStatusOrder{
+			Symbol:        order.Symbol,
+			OrderID:       order.OrderID,
+			ClientOrderID: order.ClientOrderID,
+		})
+	}
+	return converted
+}
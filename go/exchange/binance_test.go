@@ -0,0 +1,234 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package exchange
+
+import (
+	"encoding/json"
+	"github.com/crankykernel/binanceapi-go"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/crankykernel/maker/go/binanceex"
+	"testing"
+	"time"
+)
+
+func TestFromBinanceError(t *testing.T) {
+	err := fromBinanceError(&binanceex.RequestError{
+		StatusCode: 400,
+		Body:       []byte(`{"code":-2010,"msg":"Account has insufficient balance"}`),
+	})
+	apiError, ok := err.(*ApiError)
+	assert.True(t, ok)
+	assert.Equal(t, 400, apiError.StatusCode)
+	assert.Equal(t, binanceErrorNewOrderRejected, binanceErrorCode(apiError.Body))
+	assert.True(t, OrderRejected(err))
+
+	assert.False(t, OrderRejected(&ApiError{StatusCode: 400,
+		Body: []byte(`{"code":-2010,"msg":"Duplicate order sent."}`)}))
+	assert.False(t, OrderRejected(&ApiError{StatusCode: 503,
+		Body: []byte(`{"code":-1001,"msg":"Internal error; unable to process your request."}`)}))
+	assert.True(t, OrderRejected(&ApiError{StatusCode: 400,
+		Body: []byte(`{"code":-1013,"msg":"Filter failure: PRICE_FILTER"}`)}))
+
+	assert.Nil(t, fromBinanceError(nil))
+	assert.Equal(t, ErrOrderTimeout, fromBinanceError(ErrOrderTimeout))
+}
+
+func TestFromRestOrder(t *testing.T) {
+	order := fromRestOrder(&binanceex.RestOrder{
+		Symbol:           "ETHBTC",
+		OrderID:          1,
+		ClientOrderID:    "buy-1",
+		Status:           binanceapi.OrderStatusPartiallyFilled,
+		Side:             binanceapi.OrderSideBuy,
+		Price:            0.001,
+		Quantity:         2,
+		ExecutedQuantity: 1,
+	})
+	assert.Equal(t, OrderStatusPartiallyFilled, order.Status)
+	assert.True(t, order.Status.IsOpen())
+	assert.Equal(t, OrderSideBuy, order.Side)
+	assert.Equal(t, "buy-1", order.ClientOrderID)
+	assert.Equal(t, 1.0, order.ExecutedQuantity)
+}
+
+func TestFromBinanceUserStreamEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	raw := []byte(`{"e":"executionReport","E":1499405658658,"s":"ETHBTC",` +
+		`"c":"sell-1","S":"SELL","o":"LIMIT","f":"GTC","q":"1.00000000",` +
+		`"p":"0.10264410","P":"0.00000000","F":"0.00000000","g":-1,"C":"",` +
+		`"x":"TRADE","X":"PARTIALLY_FILLED","r":"NONE","i":4293153,` +
+		`"l":"0.50000000","z":"0.50000000","L":"0.10264410","n":"0.00005132",` +
+		`"N":"BTC","T":1499405658657,"t":42,"I":8641984,"w":false,"m":true,"M":false}`)
+	var binanceReport binanceapi.StreamExecutionReport
+	assert.Nil(json.Unmarshal(raw, &binanceReport))
+
+	event := FromBinanceUserStreamEvent(&binanceex.UserStreamEvent{
+		EventType:       binanceex.EventTypeExecutionReport,
+		EventTime:       time.Unix(0, binanceReport.EventTimeMillis*int64(time.Millisecond)),
+		ExecutionReport: binanceReport,
+		Raw:             raw,
+	})
+	assert.Equal(UserStreamEventExecutionReport, event.Type)
+	assert.Equal(raw, event.Raw)
+	report := event.ExecutionReport
+	assert.Equal("sell-1", report.ClientOrderID)
+	assert.Equal(OrderSideSell, report.Side)
+	assert.Equal(OrderTypeLimit, report.Type)
+	assert.Equal(OrderStatusPartiallyFilled, report.Status)
+	assert.Equal("TRADE", report.ExecutionType)
+	assert.Equal(0.5, report.LastExecutedQuantity)
+	assert.Equal(0.1026441, report.LastExecutedPrice)
+	assert.Equal(0.00005132, report.Commission)
+	assert.Equal("BTC", report.CommissionAsset)
+	assert.True(report.Maker)
+
+	// Trades keep the report in the Binance format, so nothing they use
+	// may be lost converting back.
+	converted := ToBinanceExecutionReport(report)
+	binanceReport.IcebergQuantity = 0
+	binanceReport.Ignore0 = 0
+	binanceReport.Ignore1 = 0
+	assert.Equal(binanceReport, converted)
+
+	listStatus := binanceex.StreamListStatus{
+		EventType:         string(binanceex.EventTypeListStatus),
+		EventTimeMillis:   1564034571105,
+		Symbol:            "ETHBTC",
+		OrderListID:       2,
+		ContingencyType:   "OCO",
+		ListStatusType:    "EXEC_STARTED",
+		ListOrderStatus:   "EXECUTING",
+		ListRejectReason:  "NONE",
+		ListClientOrderID: "list-1",
+		TransactionTime:   1564034571099,
+		Orders: []binanceex.StreamListStatusOrder{
+			{Symbol: "ETHBTC", OrderID: 3, ClientOrderID: "stop-1"},
+			{Symbol: "ETHBTC", OrderID: 4, ClientOrderID: "limit-1"},
+		},
+	}
+	event = FromBinanceUserStreamEvent(&binanceex.UserStreamEvent{
+		EventType:  binanceex.EventTypeListStatus,
+		ListStatus: listStatus,
+	})
+	assert.Equal(UserStreamEventListStatus, event.Type)
+	assert.Equal("list-1", event.ListStatus.ListClientOrderID)
+	assert.Equal("limit-1", event.ListStatus.Orders[1].ClientOrderID)
+	assert.Equal(listStatus, ToBinanceListStatus(event.ListStatus))
+
+	var accountInfo binanceapi.StreamOutboundAccountInfo
+	assert.Nil(json.Unmarshal([]byte(`{"e":"outboundAccountInfo","E":1499405658849,`+
+		`"B":[{"a":"BTC","f":"1.50000000","l":"0.25000000"}]}`), &accountInfo))
+	event = FromBinanceUserStreamEvent(&binanceex.UserStreamEvent{
+		EventType:           binanceex.EventTypeOutboundAccountInfo,
+		OutboundAccountInfo: accountInfo,
+	})
+	assert.Equal(UserStreamEventAccount, event.Type)
+	assert.Equal([]Balance{{Asset: "BTC", Free: 1.5, Locked: 0.25}}, event.Balances)
+
+	assert.Nil(FromBinanceUserStreamEvent(&binanceex.UserStreamEvent{
+		EventType: "balanceUpdate",
+	}))
+}
+
+func TestBinanceTradeSubscription(t *testing.T) {
+	assert := assert.New(t)
+	binance := NewBinanceExchange(nil, nil, binanceex.NewXTradeStreamManager(), nil)
+
+	channel := binance.SubscribeTrades()
+	source := binance.tradeSubscriptions[channel].source
+
+	go func() {
+		source <- &binanceapi.StreamAggTrade{
+			Symbol:     "ETHBTC",
+			TradeID:    7,
+			Price:      0.001,
+			Quantity:   2,
+			TradeTime:  1564034571099,
+			BuyerMaker: true,
+		}
+	}()
+	select {
+	case trade := <-channel:
+		assert.Equal(&MarketTrade{
+			Symbol:     "ETHBTC",
+			TradeID:    7,
+			Price:      0.001,
+			Quantity:   2,
+			Time:       time.Unix(0, 1564034571099*int64(time.Millisecond)),
+			BuyerMaker: true,
+		}, trade)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for trade")
+	}
+
+	// Left waiting for a subscriber that stopped reading, which must not
+	// keep it from unsubscribing.
+	source <- &binanceapi.StreamAggTrade{Symbol: "ETHBTC"}
+	unsubscribed := make(chan bool)
+	go func() {
+		binance.UnsubscribeTrades(channel)
+		close(unsubscribed)
+	}()
+	select {
+	case <-unsubscribed:
+	case <-time.After(time.Second):
+		t.Fatal("timed out unsubscribing")
+	}
+	assert.Empty(binance.tradeSubscriptions)
+}
+
+func TestBinanceUserStreamSubscription(t *testing.T) {
+	assert := assert.New(t)
+	binance := NewBinanceExchange(nil, nil, nil,
+		binanceex.NewBinanceUserDataStream(nil, nil))
+
+	channel := binance.SubscribeUserStream()
+	source := binance.userStreamSubscribers[channel].source
+
+	go func() {
+		// Not converted so not forwarded.
+		source <- &binanceex.UserStreamEvent{EventType: "balanceUpdate"}
+		source <- &binanceex.UserStreamEvent{
+			EventType: binanceex.EventTypeExecutionReport,
+			ExecutionReport: binanceapi.StreamExecutionReport{
+				ClientOrderID:      "buy-1",
+				CurrentOrderStatus: binanceapi.OrderStatusNew,
+			},
+		}
+	}()
+	select {
+	case event := <-channel:
+		assert.Equal(UserStreamEventExecutionReport, event.Type)
+		assert.Equal("buy-1", event.ExecutionReport.ClientOrderID)
+		assert.Equal(OrderStatusNew, event.ExecutionReport.Status)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+
+	source <- &binanceex.UserStreamEvent{EventType: binanceex.EventTypeExecutionReport}
+	unsubscribed := make(chan bool)
+	go func() {
+		binance.UnsubscribeUserStream(channel)
+		close(unsubscribed)
+	}()
+	select {
+	case <-unsubscribed:
+	case <-time.After(time.Second):
+		t.Fatal("timed out unsubscribing")
+	}
+	assert.Empty(binance.userStreamSubscribers)
+}
@@ -0,0 +1,445 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package exchange
+
+import (
+	"errors"
+	"fmt"
+	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/types"
+	"gitlab.com/crankykernel/maker/go/util"
+	"strings"
+	"time"
+)
+
+// Exchange is the interface the trade service uses to talk to a trading
+// venue. Binance is the real implementation, but anything implementing this
+// interface (a simulator, a test double) can be plugged in instead.
+type Exchange interface {
+	// Name returns a short name for the exchange, used in logging.
+	Name() string
+
+	// PostOrder submits a new order.
+	PostOrder(order OrderParameters) (*Order, error)
+
+	// PostStopOrder submits a stop loss limit sell order.
+	PostStopOrder(order StopOrderParameters) (*Order, error)
+
+	// PostOcoOrder submits a one-cancels-the-other sell of a limit order and
+	// a stop loss limit order. Cancelling either order cancels both.
+	PostOcoOrder(order OcoOrderParameters) (*OrderList, error)
+
+	// CancelOrder cancels an open order by its exchange order ID.
+	CancelOrder(symbol string, orderId int64) error
+
+	GetOrderByClientId(symbol string, clientOrderId string) (*Order, error)
+	GetOrderByOrderId(symbol string, orderId int64) (*Order, error)
+
+	// GetOpenOrders returns the open orders for a symbol.
+	GetOpenOrders(symbol string) ([]Order, error)
+
+	// GetBalance returns the total, free plus locked, balance of an asset.
+	GetBalance(asset string) (float64, error)
+
+	// GetFreeBalance returns the balance of an asset not locked in orders.
+	GetFreeBalance(asset string) (float64, error)
+
+	// GetOrderFills returns the fills of an order.
+	GetOrderFills(symbol string, orderId int64) ([]Fill, error)
+
+	GetPrice(symbol string, priceSource types.PriceSource) (float64, error)
+	GetSymbolInfo(symbol string) (SymbolInfo, error)
+
+	// AddSymbol and RemoveSymbol reference count interest in the trade
+	// stream for a symbol.
+	AddSymbol(symbol string)
+	RemoveSymbol(symbol string)
+
+	// SubscribeTrades returns a channel receiving the trades of the symbols
+	// added with AddSymbol. A subscriber must keep reading until it
+	// unsubscribes.
+	SubscribeTrades() TradeChannel
+	UnsubscribeTrades(channel TradeChannel)
+
+	// SubscribeUserStream returns a channel receiving the updates to the
+	// orders and balances of the account.
+	SubscribeUserStream() chan *UserStreamEvent
+	UnsubscribeUserStream(channel chan *UserStreamEvent)
+}
+
+// The order sides, types, statuses and time in force take the values Binance
+// uses, as trades store them.
+type OrderSide string
+
+const (
+	OrderSideBuy  OrderSide = "BUY"
+	OrderSideSell OrderSide = "SELL"
+)
+
+type OrderType string
+
+const (
+	OrderTypeLimit  OrderType = "LIMIT"
+	OrderTypeMarket OrderType = "MARKET"
+
+	// OrderTypeStopLossLimit is the type of a stop order.
+	OrderTypeStopLossLimit OrderType = "STOP_LOSS_LIMIT"
+
+	// OrderTypeLimitMaker is the type of the limit order of an OCO.
+	OrderTypeLimitMaker OrderType = "LIMIT_MAKER"
+)
+
+type OrderStatus string
+
+const (
+	OrderStatusNew             OrderStatus = "NEW"
+	OrderStatusPartiallyFilled OrderStatus = "PARTIALLY_FILLED"
+	OrderStatusFilled          OrderStatus = "FILLED"
+	OrderStatusCanceled        OrderStatus = "CANCELED"
+	OrderStatusRejected        OrderStatus = "REJECTED"
+	OrderStatusExpired         OrderStatus = "EXPIRED"
+)
+
+// IsOpen returns true for the statuses of an order still on the book.
+func (s OrderStatus) IsOpen() bool {
+	return s == OrderStatusNew || s == OrderStatusPartiallyFilled
+}
+
+type TimeInForce string
+
+const TimeInForceGTC TimeInForce = "GTC"
+
+// OrderParameters describe a new order. StopPrice is only set for stop
+// orders.
+type OrderParameters struct {
+	Symbol        string
+	Side          OrderSide
+	Type          OrderType
+	TimeInForce   TimeInForce
+	Quantity      float64
+	Price         float64
+	StopPrice     float64
+	ClientOrderID string
+}
+
+// Order is the exchange side view of an order.
+type Order struct {
+	Symbol        string
+	OrderID       int64
+	ClientOrderID string
+	Status        OrderStatus
+	TimeMillis    int64
+
+	// The quantity filled so far. May not be set for closed orders.
+	ExecutedQuantity float64
+
+	// Only set when an order is looked up by order ID or listed as open.
+	Side     OrderSide
+	Price    float64
+	Quantity float64
+}
+
+// StopOrderParameters describe a stop loss limit sell order: a limit sell at
+// Price that is placed on the book once the market trades at or below
+// StopPrice.
+type StopOrderParameters struct {
+	Symbol        string
+	Quantity      float64
+	StopPrice     float64
+	Price         float64
+	ClientOrderID string
+}
+
+// OcoOrderParameters describe an OCO sell: a limit sell at Price, and a stop
+// order at StopLimitPrice once the market trades at or below StopPrice, for
+// the same quantity. When one fills the other expires.
+type OcoOrderParameters struct {
+	Symbol             string
+	Quantity           float64
+	Price              float64
+	StopPrice          float64
+	StopLimitPrice     float64
+	ListClientOrderID  string
+	LimitClientOrderID string
+	StopClientOrderID  string
+}
+
+// OrderList is the exchange side view of an order list. Its orders only
+// have their IDs set.
+type OrderList struct {
+	OrderListID       int64
+	ListClientOrderID string
+	ListStatusType    string
+	ListOrderStatus   string
+	Orders            []Order
+}
+
+// SymbolStatusTrading is the status of a symbol that can be traded.
+const SymbolStatusTrading = "TRADING"
+
+// SymbolInfo holds the assets and the order filters of a symbol. Filters the
+// exchange doesn't have are left zero and not checked.
+type SymbolInfo struct {
+	BaseAsset   string
+	QuoteAsset  string
+	TickSize    float64
+	StepSize    float64
+	MinNotional float64
+
+	Status           string
+	OrderTypes       []string
+	MinPrice         float64
+	MaxPrice         float64
+	MinQty           float64
+	MaxQty           float64
+	MarketMinQty     float64
+	MarketMaxQty     float64
+	MarketStepSize   float64
+	MultiplierUp     float64
+	MultiplierDown   float64
+	ApplyToMarket    bool
+	MaxNumOrders     int64
+	MaxNumAlgoOrders int64
+}
+
+// MarketTrade is a trade between any two parties on the market of a symbol.
+type MarketTrade struct {
+	Symbol     string
+	TradeID    int64
+	Price      float64
+	Quantity   float64
+	Time       time.Time
+	BuyerMaker bool
+}
+
+type TradeChannel chan *MarketTrade
+
+// The kinds of user stream events.
+type UserStreamEventType string
+
+const (
+	UserStreamEventExecutionReport UserStreamEventType = "executionReport"
+	UserStreamEventListStatus      UserStreamEventType = "listStatus"
+	UserStreamEventAccount         UserStreamEventType = "account"
+)
+
+// UserStreamEvent is an update to an order, order list or the balances of
+// the account. Only the field of its type is set.
+type UserStreamEvent struct {
+	Type UserStreamEventType
+	Time time.Time
+
+	ExecutionReport ExecutionReport
+	ListStatus      ListStatus
+	Balances        []Balance
+
+	// The event as the exchange sent it, saved so trades can be replayed.
+	Raw []byte
+}
+
+// ExecutionReport is an update to an order: placed, filled, cancelled or
+// rejected. A cancel has a new client order ID, with the ID of the order
+// cancelled in OriginalClientOrderID.
+type ExecutionReport struct {
+	Symbol                string
+	OrderID               int64
+	ClientOrderID         string
+	OriginalClientOrderID string
+	Side                  OrderSide
+	Type                  OrderType
+	TimeInForce           TimeInForce
+
+	// What the report is for, as named by Binance: NEW, TRADE, CANCELED,
+	// REJECTED or EXPIRED.
+	ExecutionType string
+	Status        OrderStatus
+	RejectReason  string
+	Quantity      float64
+	Price         float64
+	StopPrice     float64
+
+	// Working is false for a stop order until it triggers.
+	Working bool
+
+	// The fill, if any, the report is for.
+	LastExecutedQuantity float64
+	LastExecutedPrice    float64
+	CumulativeQuantity   float64
+	Commission           float64
+	CommissionAsset      string
+	TradeID              int64
+	Maker                bool
+
+	TimeMillis            int64
+	TransactionTimeMillis int64
+}
+
+// ListStatus is an update to an order list.
+type ListStatus struct {
+	Symbol            string
+	OrderListID       int64
+	ListClientOrderID string
+	ContingencyType   string
+	ListStatusType    string
+	ListOrderStatus   string
+	RejectReason      string
+	Orders            []Order
+
+	TimeMillis            int64
+	TransactionTimeMillis int64
+}
+
+// Balance is the free and locked amount of an asset.
+type Balance struct {
+	Asset  string
+	Free   float64
+	Locked float64
+}
+
+// Fill is a single trade execution against one of our orders.
+type Fill struct {
+	OrderID         int64
+	Price           float64
+	Quantity        float64
+	Commission      float64
+	CommissionAsset string
+}
+
+func (f Fill) ToOrderFill() types.OrderFill {
+	return types.OrderFill{
+		Price:            f.Price,
+		Quantity:         f.Quantity,
+		CommissionAmount: f.Commission,
+		CommissionAsset:  f.CommissionAsset,
+		OrderID:          f.OrderID,
+	}
+}
+
+// ApiError is returned when the exchange rejected a request. The status code
+// and body are what the exchange sent so they can be forwarded to the client.
+type ApiError struct {
+	StatusCode int
+	Body       []byte
+}
+
+func (e *ApiError) Error() string {
+	return fmt.Sprintf("exchange error: status=%d; body=%s", e.StatusCode, string(e.Body))
+}
+
+// OrderRejected returns true if the exchange refused an order for a reason
+// sending it again won't change, such as a failed filter or a stop that
+// would trigger immediately.
+func OrderRejected(err error) bool {
+	apiError, ok := err.(*ApiError)
+	if !ok {
+		return false
+	}
+	switch binanceErrorCode(apiError.Body) {
+	case binanceErrorFilterFailure:
+		return true
+	case binanceErrorNewOrderRejected:
+		return !strings.Contains(string(apiError.Body), "Duplicate order")
+	}
+	return false
+}
+
+// OrderPendingError is returned when the outcome of an order is not known.
+// The order may still be placed, it is resolved in the background.
+type OrderPendingError struct {
+	Err error
+}
+
+func (e *OrderPendingError) Error() string {
+	return fmt.Sprintf("order pending: %v", e.Err)
+}
+
+// OrderPending returns true if the outcome of an order is not known yet. No
+// other order should be placed in its place until it is resolved.
+func OrderPending(err error) bool {
+	_, ok := err.(*OrderPendingError)
+	return ok
+}
+
+// ErrOrderNotFound is returned when looking up an order the exchange does
+// not have.
+var ErrOrderNotFound = errors.New("order not found")
+
+// BuyPrice returns the price to place a buy at: the manual price, or the
+// price from the price source offset by ticks.
+func BuyPrice(exchange Exchange, symbol string, priceSource types.PriceSource,
+	manualPrice float64, offsetTicks int64) (float64, error) {
+	if priceSource == types.PriceSourceManual {
+		return manualPrice, nil
+	}
+	price, err := exchange.GetPrice(symbol, priceSource)
+	if err != nil {
+		return 0, err
+	}
+	if offsetTicks != 0 {
+		newPrice, err := AdjustPriceByTicks(exchange, symbol, price, offsetTicks)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"symbol": symbol,
+			}).Errorf("Failed to lookup tick size")
+		}
+		log.WithFields(log.Fields{
+			"offsetTicks": offsetTicks,
+			"price":       fmt.Sprintf("%.8f", price),
+			"newPrice":    fmt.Sprintf("%.8f", newPrice),
+		}).Infof("Price adjusted by ticks")
+		price = newPrice
+	}
+	return price, nil
+}
+
+// AdjustPriceByTicks offsets a price by a number of ticks using the symbols
+// tick size.
+func AdjustPriceByTicks(exchange Exchange, symbol string, price float64, ticks int64) (float64, error) {
+	symbolInfo, err := exchange.GetSymbolInfo(symbol)
+	if err != nil {
+		return price, err
+	}
+	return util.Round8(price + (symbolInfo.TickSize * float64(ticks))), nil
+}
+
+// BuyQuantity returns the quantity to buy at price when spending quoteAmount
+// of the quote asset, or if balancePercent is set, that percent of the free
+// quote asset balance. The quantity is rounded down to the step size of the
+// symbol and an error returned if the order would be below the minimum
+// notional value.
+func BuyQuantity(exchange Exchange, symbol string, price float64,
+	quoteAmount float64, balancePercent float64) (float64, error) {
+	if price <= 0 {
+		return 0, fmt.Errorf("invalid price %.8f", price)
+	}
+	symbolInfo, err := exchange.GetSymbolInfo(symbol)
+	if err != nil {
+		return 0, err
+	}
+	if balancePercent > 0 {
+		balance, err := exchange.GetFreeBalance(symbolInfo.QuoteAsset)
+		if err != nil {
+			return 0, err
+		}
+		quoteAmount = balance * balancePercent / 100
+	}
+	quantity := util.FixQuantityToStepSize(quoteAmount/price, symbolInfo.StepSize)
+	if quantity <= 0 || quantity*price < symbolInfo.MinNotional {
+		return 0, fmt.Errorf("%.8f %s at %.8f is below the minimum notional of %.8f",
+			quantity, symbolInfo.BaseAsset, price, symbolInfo.MinNotional)
+	}
+	return quantity, nil
+}
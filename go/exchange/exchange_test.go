@@ -0,0 +1,82 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package exchange
+
+import (
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/crankykernel/maker/go/types"
+	"testing"
+)
+
+// The implementations of Exchange.
+var (
+	_ Exchange = &BinanceExchange{}
+	_ Exchange = &PaperExchange{}
+	_ Exchange = &JournalExchange{}
+)
+
+type balanceMarket struct {
+	testMarket
+	free float64
+}
+
+func (m *balanceMarket) GetSymbolInfo(symbol string) (SymbolInfo, error) {
+	return SymbolInfo{BaseAsset: "ETH", QuoteAsset: "BTC",
+		TickSize: 0.00000001, StepSize: 0.01, MinNotional: 0.001}, nil
+}
+
+func (m *balanceMarket) GetFreeBalance(asset string) (float64, error) {
+	return m.free, nil
+}
+
+func TestBuyQuantity(t *testing.T) {
+	assert := assert.New(t)
+	market := &balanceMarket{free: 0.5}
+
+	// Rounded down to the step size.
+	quantity, err := BuyQuantity(market, "ETHBTC", 0.03, 0.1, 0)
+	assert.Nil(err)
+	assert.Equal(3.33, quantity)
+
+	// A percent of the free quote balance.
+	quantity, err = BuyQuantity(market, "ETHBTC", 0.03, 0, 50)
+	assert.Nil(err)
+	assert.Equal(8.33, quantity)
+
+	// Below the minimum notional.
+	_, err = BuyQuantity(market, "ETHBTC", 0.03, 0.0009, 0)
+	assert.NotNil(err)
+	_, err = BuyQuantity(market, "ETHBTC", 0, 0.1, 0)
+	assert.NotNil(err)
+}
+
+func TestBuyPrice(t *testing.T) {
+	assert := assert.New(t)
+	market := &testMarket{price: 0.0010}
+
+	price, err := BuyPrice(market, "ETHBTC", types.PriceSourceManual, 0.0009, 0)
+	assert.Nil(err)
+	assert.Equal(0.0009, price)
+
+	price, err = BuyPrice(market, "ETHBTC", types.PriceSourceLast, 0, 0)
+	assert.Nil(err)
+	assert.Equal(0.0010, price)
+
+	// Offset by the tick size of the symbol.
+	price, err = BuyPrice(market, "ETHBTC", types.PriceSourceLast, 0, -2)
+	assert.Nil(err)
+	assert.Equal(0.00099998, price)
+}
@@ -0,0 +1,395 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package exchange
+
+import (
+	"errors"
+	"fmt"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/log"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The kinds of order submission journalled.
+const (
+	orderIntentKindOrder = "ORDER"
+	orderIntentKindStop  = "STOP"
+	orderIntentKindOco   = "OCO"
+)
+
+// ErrOrderTimeout is returned when no response to an order was received in
+// time. The order may or may not have been placed.
+var ErrOrderTimeout = errors.New("timed out waiting for order response")
+
+// JournalExchange wraps an exchange so that every order is journalled in the
+// database, by client order ID, before it is sent, and marked confirmed or
+// failed once the outcome is known.
+//
+// When the outcome of an order is unknown, because the connection failed or
+// the response did not arrive in time, an OrderPendingError is returned and
+// the order is resolved in the background. Once any request still in flight
+// has finished the order is looked up by its client order ID. If the
+// exchange does not have it, it is sent again with the same client order ID
+// so it can never be placed twice. An order is never sent again once a
+// failure has been returned for it.
+type JournalExchange struct {
+	Exchange
+
+	// Timeout is how long to wait for the response to an order. Orders are
+	// sent holding the execution lock of the trade service, so this is kept
+	// short.
+	Timeout time.Duration
+
+	// Retries is how many times an order that did not reach the exchange is
+	// sent again.
+	Retries int
+
+	// LookupRetries is how many times a failed lookup of an order is retried
+	// before the order is left pending until the next start.
+	LookupRetries int
+
+	// RetryInterval is the wait before looking up an order, doubled with
+	// each failed lookup up to MaxRetryInterval.
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
+
+	// OrderFailed, if set, is called with the client order ID of a pending
+	// order once it is known not to have been placed.
+	OrderFailed func(clientOrderId string, reason string)
+
+	// The orders being resolved in the background.
+	resolving sync.WaitGroup
+}
+
+func NewJournalExchange(exchange Exchange) *JournalExchange {
+	return &JournalExchange{
+		Exchange:         exchange,
+		Timeout:          10 * time.Second,
+		Retries:          3,
+		LookupRetries:    10,
+		RetryInterval:    time.Second,
+		MaxRetryInterval: time.Minute,
+	}
+}
+
+type postResult struct {
+	order     *Order
+	orderList *OrderList
+	err       error
+}
+
+// orderId returns the exchange order ID of the journalled order.
+func (r postResult) orderId(clientOrderId string) int64 {
+	if r.order != nil {
+		return r.order.OrderID
+	}
+	if r.orderList != nil {
+		for _, order := range r.orderList.Orders {
+			if order.ClientOrderID == clientOrderId {
+				return order.OrderID
+			}
+		}
+	}
+	return 0
+}
+
+func (e *JournalExchange) PostOrder(order OrderParameters) (*Order, error) {
+	if order.ClientOrderID == "" {
+		return e.Exchange.PostOrder(order)
+	}
+	result := e.submit(db.OrderIntent{
+		ClientOrderID: order.ClientOrderID,
+		Symbol:        order.Symbol,
+		Kind:          orderIntentKindOrder,
+		Params:        order,
+	}, func() postResult {
+		posted, err := e.Exchange.PostOrder(order)
+		return postResult{order: posted, err: err}
+	}, func() postResult {
+		return e.lookupOrder(order.Symbol, order.ClientOrderID)
+	})
+	return result.order, result.err
+}
+
+func (e *JournalExchange) PostStopOrder(order StopOrderParameters) (*Order, error) {
+	if order.ClientOrderID == "" {
+		return e.Exchange.PostStopOrder(order)
+	}
+	result := e.submit(db.OrderIntent{
+		ClientOrderID: order.ClientOrderID,
+		Symbol:        order.Symbol,
+		Kind:          orderIntentKindStop,
+		Params:        order,
+	}, func() postResult {
+		posted, err := e.Exchange.PostStopOrder(order)
+		return postResult{order: posted, err: err}
+	}, func() postResult {
+		return e.lookupOrder(order.Symbol, order.ClientOrderID)
+	})
+	return result.order, result.err
+}
+
+// PostOcoOrder journals an OCO by the client order ID of its limit order, as
+// orders, unlike lists, can be looked up by client order ID.
+func (e *JournalExchange) PostOcoOrder(order OcoOrderParameters) (*OrderList, error) {
+	if order.LimitClientOrderID == "" || order.StopClientOrderID == "" {
+		return e.Exchange.PostOcoOrder(order)
+	}
+	result := e.submit(db.OrderIntent{
+		ClientOrderID: order.LimitClientOrderID,
+		Symbol:        order.Symbol,
+		Kind:          orderIntentKindOco,
+		Params:        order,
+	}, func() postResult {
+		posted, err := e.Exchange.PostOcoOrder(order)
+		return postResult{orderList: posted, err: err}
+	}, func() postResult {
+		orderList := &OrderList{ListClientOrderID: order.ListClientOrderID}
+		for _, clientOrderId := range []string{order.LimitClientOrderID, order.StopClientOrderID} {
+			result := e.lookupOrder(order.Symbol, clientOrderId)
+			if result.err != nil {
+				return result
+			}
+			orderList.Orders = append(orderList.Orders, *result.order)
+		}
+		return postResult{orderList: orderList}
+	})
+	return result.orderList, result.err
+}
+
+func (e *JournalExchange) lookupOrder(symbol string, clientOrderId string) postResult {
+	order, err := e.Exchange.GetOrderByClientId(symbol, clientOrderId)
+	return postResult{order: order, err: err}
+}
+
+// submit journals an order and posts it. If the outcome is unknown an
+// OrderPendingError is returned and the order is resolved in the background.
+// The lookup function finds the order on the exchange by its client order
+// ID.
+func (e *JournalExchange) submit(intent db.OrderIntent, post func() postResult,
+	lookup func() postResult) postResult {
+	if err := db.DbSaveOrderIntent(intent); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"clientOrderId": intent.ClientOrderID,
+			"symbol":        intent.Symbol,
+			"kind":          intent.Kind,
+		}).Errorf("Failed to journal order, not sending it.")
+		return postResult{err: fmt.Errorf("failed to journal order: %v", err)}
+	}
+
+	result, inFlight := e.post(post)
+	if result.err == nil {
+		e.confirm(intent, result)
+		return result
+	}
+	if !outcomeUnknown(result.err) {
+		e.fail(intent, result.err.Error())
+		return result
+	}
+
+	e.resolving.Add(1)
+	go func() {
+		defer e.resolving.Done()
+		e.resolveUnknown(intent, result, inFlight, post, lookup)
+	}()
+	return postResult{err: &OrderPendingError{Err: result.err}}
+}
+
+// resolveUnknown resolves an order whose outcome is unknown, first waiting
+// for the request in flight, if any, as the order is never sent again while
+// the original request may still reach the exchange. The caller was told
+// the order is pending, so it may be sent again until it is failed.
+func (e *JournalExchange) resolveUnknown(intent db.OrderIntent, result postResult,
+	inFlight <-chan postResult, post func() postResult, lookup func() postResult) {
+	logFields := log.Fields{
+		"clientOrderId": intent.ClientOrderID,
+		"symbol":        intent.Symbol,
+		"kind":          intent.Kind,
+	}
+
+	for attempt := 0; ; attempt++ {
+		if inFlight != nil {
+			log.WithError(result.err).WithFields(logFields).
+				Warnf("Order outcome unknown, waiting for the request in flight.")
+			result = <-inFlight
+			inFlight = nil
+			if result.err == nil {
+				log.WithFields(logFields).Warnf("Order response arrived after timeout.")
+				e.confirm(intent, result)
+				return
+			}
+			if !outcomeUnknown(result.err) {
+				e.failPending(intent, result.err.Error())
+				return
+			}
+		}
+
+		log.WithError(result.err).WithFields(logFields).
+			Warnf("Order outcome unknown, looking it up by client order ID.")
+		found := e.resolve(lookup, logFields)
+		if found.err == nil {
+			log.WithFields(logFields).Infof("Order found on exchange.")
+			e.confirm(intent, found)
+			return
+		}
+		if found.err != ErrOrderNotFound {
+			// Left pending to be resolved on the next start.
+			log.WithError(found.err).WithFields(logFields).
+				Errorf("Failed to look up order, its outcome remains unknown.")
+			return
+		}
+		if attempt >= e.Retries {
+			e.failPending(intent, result.err.Error())
+			return
+		}
+		log.WithFields(logFields).WithField("attempt", attempt+1).
+			Warnf("Order not found on exchange, sending it again.")
+
+		result, inFlight = e.post(post)
+		if result.err == nil {
+			log.WithFields(logFields).Infof("Order sent again.")
+			e.confirm(intent, result)
+			return
+		}
+		if !outcomeUnknown(result.err) {
+			e.failPending(intent, result.err.Error())
+			return
+		}
+	}
+}
+
+// post sends an order, giving up on the response after the timeout. On a
+// timeout the channel the response will arrive on is returned too.
+func (e *JournalExchange) post(post func() postResult) (postResult, <-chan postResult) {
+	done := make(chan postResult, 1)
+	go func() {
+		done <- post()
+	}()
+	select {
+	case result := <-done:
+		return result, nil
+	case <-time.After(e.Timeout):
+		return postResult{err: ErrOrderTimeout}, done
+	}
+}
+
+// resolve looks up an order, retrying failed lookups with a backoff, as
+// lookups held back by the rate limiter fail rather than wait. The result
+// has ErrOrderNotFound if the exchange does not have the order.
+func (e *JournalExchange) resolve(lookup func() postResult, logFields log.Fields) postResult {
+	var result postResult
+	interval := e.RetryInterval
+	for attempt := 0; attempt <= e.LookupRetries; attempt++ {
+		time.Sleep(interval)
+		result = lookup()
+		if result.err == nil || result.err == ErrOrderNotFound {
+			break
+		}
+		log.WithError(result.err).WithFields(logFields).WithField("attempt", attempt+1).
+			Warnf("Failed to look up order.")
+		interval *= 2
+		if interval > e.MaxRetryInterval {
+			interval = e.MaxRetryInterval
+		}
+	}
+	return result
+}
+
+func (e *JournalExchange) confirm(intent db.OrderIntent, result postResult) {
+	if err := db.DbConfirmOrderIntent(intent.ClientOrderID,
+		result.orderId(intent.ClientOrderID)); err != nil {
+		log.WithError(err).WithField("clientOrderId", intent.ClientOrderID).
+			Errorf("Failed to confirm order intent.")
+	}
+}
+
+func (e *JournalExchange) fail(intent db.OrderIntent, reason string) {
+	if err := db.DbFailOrderIntent(intent.ClientOrderID, reason); err != nil {
+		log.WithError(err).WithField("clientOrderId", intent.ClientOrderID).
+			Errorf("Failed to fail order intent.")
+	}
+}
+
+// failPending fails an order that was reported pending, letting the owner
+// of the order know it was never placed.
+func (e *JournalExchange) failPending(intent db.OrderIntent, reason string) {
+	e.fail(intent, reason)
+	if e.OrderFailed != nil {
+		e.OrderFailed(intent.ClientOrderID, reason)
+	}
+}
+
+// ResolvePending resolves the orders journalled by a previous run whose
+// outcome was never known, by looking them up on the exchange. They are not
+// sent again as the trades they belong to may have moved on. Set
+// OrderFailed first so the trades of orders not found are updated.
+func (e *JournalExchange) ResolvePending() error {
+	intents, err := db.DbGetPendingOrderIntents()
+	if err != nil {
+		return err
+	}
+	for _, intent := range intents {
+		logFields := log.Fields{
+			"clientOrderId": intent.ClientOrderID,
+			"symbol":        intent.Symbol,
+			"kind":          intent.Kind,
+			"created":       intent.Created,
+		}
+		order, err := e.Exchange.GetOrderByClientId(intent.Symbol, intent.ClientOrderID)
+		switch {
+		case err == nil:
+			log.WithFields(logFields).WithField("orderId", order.OrderID).
+				Infof("Resolved pending order: found on exchange.")
+			e.confirm(intent, postResult{order: order})
+		case err == ErrOrderNotFound:
+			log.WithFields(logFields).
+				Warnf("Resolved pending order: not found on exchange.")
+			e.failPending(intent, "not found on exchange")
+		default:
+			log.WithError(err).WithFields(logFields).
+				Errorf("Failed to resolve pending order.")
+		}
+	}
+	return nil
+}
+
+// outcomeUnknown returns true if an error posting an order leaves it unknown
+// whether the order was placed.
+func outcomeUnknown(err error) bool {
+	switch err := err.(type) {
+	case *ApiError:
+		return responseOutcomeUnknown(err.StatusCode, err.Body)
+	case net.Error:
+		return true
+	}
+	return err == ErrOrderTimeout || err == io.ErrUnexpectedEOF
+}
+
+func responseOutcomeUnknown(statusCode int, body []byte) bool {
+	switch binanceErrorCode(body) {
+	case binanceErrorUnknown, binanceErrorDisconnected,
+		binanceErrorUnexpectedResponse, binanceErrorTimeout:
+		return true
+	case binanceErrorNewOrderRejected:
+		// An order sent again that the exchange already has.
+		return strings.Contains(string(body), "Duplicate order")
+	}
+	return statusCode >= 500
+}
@@ -0,0 +1,277 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package exchange
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/crankykernel/maker/go/db"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// flakyExchange loses the responses to the first orders posted. If send is
+// set the lost orders still reach the paper exchange. Every order is delayed
+// by delay. The first lookups fail as rate limited.
+type flakyExchange struct {
+	*PaperExchange
+	failures       int
+	send           bool
+	delay          time.Duration
+	posts          int
+	lookupFailures int
+	lookups        int
+}
+
+func (e *flakyExchange) PostOrder(order OrderParameters) (*Order, error) {
+	e.posts++
+	time.Sleep(e.delay)
+	if e.posts > e.failures {
+		return e.PaperExchange.PostOrder(order)
+	}
+	if e.send {
+		e.PaperExchange.PostOrder(order)
+	}
+	return nil, &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+}
+
+func (e *flakyExchange) GetOrderByClientId(symbol string, clientOrderId string) (*Order, error) {
+	e.lookups++
+	if e.lookups <= e.lookupFailures {
+		return nil, &ApiError{StatusCode: 429, Body: []byte(`{"code":-1003,"msg":"Too many requests."}`)}
+	}
+	return e.PaperExchange.GetOrderByClientId(symbol, clientOrderId)
+}
+
+func newJournalTest(t *testing.T, failures int, send bool) (*JournalExchange, *flakyExchange, *[]string, func()) {
+	directory, err := ioutil.TempDir("", "maker-journal")
+	assert.Nil(t, err)
+	db.DbOpenFile(path.Join(directory, "maker.db"))
+	flaky := &flakyExchange{
+		PaperExchange: NewPaperExchange(&testMarket{price: 0.0010}),
+		failures:      failures,
+		send:          send,
+	}
+	journal := NewJournalExchange(flaky)
+	journal.RetryInterval = time.Millisecond
+	failed := []string{}
+	journal.OrderFailed = func(clientOrderId string, reason string) {
+		failed = append(failed, clientOrderId)
+	}
+	return journal, flaky, &failed, func() {
+		db.DbClose()
+		os.RemoveAll(directory)
+	}
+}
+
+func testBuyOrder(clientOrderId string) OrderParameters {
+	return OrderParameters{
+		Symbol:        "ETHBTC",
+		Side:          OrderSideBuy,
+		Type:          OrderTypeLimit,
+		Quantity:      10,
+		Price:         0.0009,
+		ClientOrderID: clientOrderId,
+	}
+}
+
+func TestJournalExchange(t *testing.T) {
+	t.Run("response lost", func(t *testing.T) {
+		journal, flaky, failed, cleanup := newJournalTest(t, 1, true)
+		defer cleanup()
+
+		// The order is found by its client order ID and not sent again.
+		_, err := journal.PostOrder(testBuyOrder("buy-1"))
+		assert.True(t, OrderPending(err))
+		journal.resolving.Wait()
+		assert.Equal(t, 1, flaky.posts)
+		openOrders, err := flaky.GetOpenOrders("ETHBTC")
+		assert.Nil(t, err)
+		assert.Len(t, openOrders, 1)
+		assert.Len(t, *failed, 0)
+
+		pending, err := db.DbGetPendingOrderIntents()
+		assert.Nil(t, err)
+		assert.Len(t, pending, 0)
+	})
+
+	t.Run("request lost", func(t *testing.T) {
+		journal, flaky, failed, cleanup := newJournalTest(t, 2, false)
+		defer cleanup()
+
+		// The order is sent again with the same client order ID.
+		_, err := journal.PostOrder(testBuyOrder("buy-1"))
+		assert.True(t, OrderPending(err))
+		journal.resolving.Wait()
+		assert.Equal(t, 3, flaky.posts)
+		openOrders, err := flaky.GetOpenOrders("ETHBTC")
+		assert.Nil(t, err)
+		assert.Len(t, openOrders, 1)
+		assert.Equal(t, "buy-1", openOrders[0].ClientOrderID)
+		assert.Len(t, *failed, 0)
+		pending, err := db.DbGetPendingOrderIntents()
+		assert.Nil(t, err)
+		assert.Len(t, pending, 0)
+	})
+
+	t.Run("response timeout", func(t *testing.T) {
+		journal, flaky, _, cleanup := newJournalTest(t, 0, false)
+		defer cleanup()
+		flaky.delay = 20 * time.Millisecond
+		journal.Timeout = 5 * time.Millisecond
+
+		// The late response confirms the order.
+		_, err := journal.PostOrder(testBuyOrder("buy-1"))
+		assert.Equal(t, &OrderPendingError{Err: ErrOrderTimeout}, err)
+		journal.resolving.Wait()
+		assert.Equal(t, 1, flaky.posts)
+		pending, err := db.DbGetPendingOrderIntents()
+		assert.Nil(t, err)
+		assert.Len(t, pending, 0)
+	})
+
+	t.Run("lost response after timeout", func(t *testing.T) {
+		journal, flaky, _, cleanup := newJournalTest(t, 1, true)
+		defer cleanup()
+		flaky.delay = 20 * time.Millisecond
+		journal.Timeout = 5 * time.Millisecond
+
+		// Not sent again while the first request is in flight, and found
+		// once it has reached the exchange.
+		_, err := journal.PostOrder(testBuyOrder("buy-1"))
+		assert.Equal(t, &OrderPendingError{Err: ErrOrderTimeout}, err)
+		journal.resolving.Wait()
+		assert.Equal(t, 1, flaky.posts)
+		openOrders, err := flaky.GetOpenOrders("ETHBTC")
+		assert.Nil(t, err)
+		assert.Len(t, openOrders, 1)
+		pending, err := db.DbGetPendingOrderIntents()
+		assert.Nil(t, err)
+		assert.Len(t, pending, 0)
+	})
+
+	t.Run("rejected after timeout", func(t *testing.T) {
+		journal, flaky, failed, cleanup := newJournalTest(t, 0, false)
+		defer cleanup()
+		flaky.delay = 20 * time.Millisecond
+		journal.Timeout = 5 * time.Millisecond
+
+		// The late rejection fails the pending order, which is not sent
+		// again.
+		order := testBuyOrder("buy-1")
+		order.Type = "BOGUS"
+		_, err := journal.PostOrder(order)
+		assert.True(t, OrderPending(err))
+		journal.resolving.Wait()
+		assert.Equal(t, 1, flaky.posts)
+		assert.Equal(t, []string{"buy-1"}, *failed)
+		pending, err := db.DbGetPendingOrderIntents()
+		assert.Nil(t, err)
+		assert.Len(t, pending, 0)
+	})
+
+	t.Run("lookup rate limited", func(t *testing.T) {
+		journal, flaky, _, cleanup := newJournalTest(t, 1, true)
+		defer cleanup()
+		flaky.lookupFailures = 3
+
+		// Failed lookups are retried, the order is still not sent again.
+		_, err := journal.PostOrder(testBuyOrder("buy-1"))
+		assert.True(t, OrderPending(err))
+		journal.resolving.Wait()
+		assert.Equal(t, 1, flaky.posts)
+		assert.Equal(t, 4, flaky.lookups)
+		pending, err := db.DbGetPendingOrderIntents()
+		assert.Nil(t, err)
+		assert.Len(t, pending, 0)
+	})
+
+	t.Run("retries exhausted", func(t *testing.T) {
+		journal, flaky, failed, cleanup := newJournalTest(t, 10, false)
+		defer cleanup()
+
+		_, err := journal.PostOrder(testBuyOrder("buy-1"))
+		assert.True(t, OrderPending(err))
+		journal.resolving.Wait()
+		assert.Equal(t, journal.Retries+1, flaky.posts)
+		assert.Equal(t, []string{"buy-1"}, *failed)
+		pending, err := db.DbGetPendingOrderIntents()
+		assert.Nil(t, err)
+		assert.Len(t, pending, 0)
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		journal, flaky, failed, cleanup := newJournalTest(t, 0, false)
+		defer cleanup()
+
+		// A rejection is final, and returned to the caller.
+		order := testBuyOrder("buy-1")
+		order.Type = "BOGUS"
+		_, err := journal.PostOrder(order)
+		assert.NotNil(t, err)
+		assert.False(t, OrderPending(err))
+		assert.Equal(t, 1, flaky.posts)
+		assert.Len(t, *failed, 0)
+		pending, err := db.DbGetPendingOrderIntents()
+		assert.Nil(t, err)
+		assert.Len(t, pending, 0)
+	})
+
+	t.Run("client order ID reused", func(t *testing.T) {
+		journal, flaky, _, cleanup := newJournalTest(t, 0, false)
+		defer cleanup()
+
+		// An order that may be on the exchange is never sent again.
+		_, err := journal.PostOrder(testBuyOrder("buy-1"))
+		assert.Nil(t, err)
+		_, err = journal.PostOrder(testBuyOrder("buy-1"))
+		assert.NotNil(t, err)
+		assert.Equal(t, 1, flaky.posts)
+	})
+
+	t.Run("resolve pending", func(t *testing.T) {
+		journal, flaky, failed, cleanup := newJournalTest(t, 0, false)
+		defer cleanup()
+
+		// Intents left pending by a crash, one of which reached the
+		// exchange.
+		for _, clientOrderId := range []string{"buy-1", "buy-2"} {
+			assert.Nil(t, db.DbSaveOrderIntent(db.OrderIntent{
+				ClientOrderID: clientOrderId,
+				Symbol:        "ETHBTC",
+				Kind:          orderIntentKindOrder,
+				Params:        testBuyOrder(clientOrderId),
+			}))
+		}
+		_, err := flaky.PaperExchange.PostOrder(testBuyOrder("buy-1"))
+		assert.Nil(t, err)
+
+		assert.Nil(t, journal.ResolvePending())
+		pending, err := db.DbGetPendingOrderIntents()
+		assert.Nil(t, err)
+		assert.Len(t, pending, 0)
+		assert.Equal(t, []string{"buy-2"}, *failed)
+
+		// Nothing is sent again.
+		openOrders, err := flaky.GetOpenOrders("ETHBTC")
+		assert.Nil(t, err)
+		assert.Len(t, openOrders, 1)
+	})
+}
@@ -0,0 +1,793 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package exchange
+
+import (
+	"encoding/json"
+	"fmt"
+	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/types"
+	"gitlab.com/crankykernel/maker/go/util"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Quote assets used to split a symbol into its base and quote asset for
+// commission accounting on simulated fills.
+var quoteAssets = []string{"USDT", "TUSD", "USDC", "USDS", "PAX", "BTC", "ETH", "BNB"}
+
+type paperOrder struct {
+	params         OrderParameters
+	orderId        int64
+	status         OrderStatus
+	filledQuantity float64
+	timeMillis     int64
+
+	// A stop order is matched like a limit order once triggered.
+	stopPrice float64
+	triggered bool
+
+	// The order list the order is part of, 0 if none.
+	orderListId int64
+}
+
+type paperOrderList struct {
+	orderListId       int64
+	listClientOrderId string
+	symbol            string
+	orderIds          []int64
+	done              bool
+}
+
+func (o *paperOrder) remaining() float64 {
+	return util.Round8(o.params.Quantity - o.filledQuantity)
+}
+
+// PaperExchange is a simulated exchange. Orders are kept in memory and filled
+// against the aggregate trade feed passed to OnTrade. Market data (prices,
+// symbol info and the trade stream) comes from the wrapped market exchange.
+//
+// Execution reports are generated for every order change and delivered to
+// user stream subscribers just like the Binance user data stream would.
+//
+// Balances are only simulated once one is set with SetBalance, fills then
+// change the balances of their assets.
+type PaperExchange struct {
+	market Exchange
+
+	lock            sync.Mutex
+	nextOrderId     int64
+	orders          map[int64]*paperOrder
+	nextOrderListId int64
+	orderLists      map[int64]*paperOrderList
+	fills           map[string][]Fill
+	lastPrice       map[string]float64
+
+	// The simulated balance of each asset, nil if balances are not
+	// simulated.
+	balances map[string]float64
+
+	// Events are queued under lock and delivered after it is released, so
+	// a slow subscriber never stalls the exchange.
+	events      []*UserStreamEvent
+	eventsReady chan struct{}
+
+	subscribersLock sync.RWMutex
+	subscribers     map[chan *UserStreamEvent]bool
+}
+
+func NewPaperExchange(market Exchange) *PaperExchange {
+	e := newPaperExchange(market)
+	go e.dispatchLoop()
+	return e
+}
+
+// NewSteppedPaperExchange creates a paper exchange that does not deliver
+// execution reports to subscribers. Instead they are collected with
+// PendingEvents so a replay can process them deterministically.
+func NewSteppedPaperExchange(market Exchange) *PaperExchange {
+	return newPaperExchange(market)
+}
+
+func newPaperExchange(market Exchange) *PaperExchange {
+	return &PaperExchange{
+		market:          market,
+		nextOrderId:     1,
+		orders:          make(map[int64]*paperOrder),
+		nextOrderListId: 1,
+		orderLists:      make(map[int64]*paperOrderList),
+		fills:           make(map[string][]Fill),
+		lastPrice:       make(map[string]float64),
+		subscribers:     make(map[chan *UserStreamEvent]bool),
+		eventsReady:     make(chan struct{}, 1),
+	}
+}
+
+// RunLiveFeed matches open orders against the live trade stream of the
+// wrapped market exchange. It does not return.
+func (e *PaperExchange) RunLiveFeed() {
+	channel := e.market.SubscribeTrades()
+	for trade := range channel {
+		e.OnTrade(trade)
+	}
+}
+
+func (e *PaperExchange) Name() string {
+	return "paper"
+}
+
+// PendingEvents returns the execution reports generated since the last call.
+// Only for use with a stepped paper exchange.
+func (e *PaperExchange) PendingEvents() []*UserStreamEvent {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	events := e.events
+	e.events = nil
+	if events == nil {
+		events = []*UserStreamEvent{}
+	}
+	return events
+}
+
+func (e *PaperExchange) dispatchLoop() {
+	for range e.eventsReady {
+		for _, event := range e.PendingEvents() {
+			e.subscribersLock.RLock()
+			for channel := range e.subscribers {
+				channel <- event
+			}
+			e.subscribersLock.RUnlock()
+		}
+	}
+}
+
+// queueEvent queues an event for delivery. Must be called with the lock
+// held.
+func (e *PaperExchange) queueEvent(event *UserStreamEvent) {
+	e.events = append(e.events, event)
+	select {
+	case e.eventsReady <- struct{}{}:
+	default:
+	}
+}
+
+func (e *PaperExchange) PostOrder(params OrderParameters) (*Order, error) {
+	if _, err := e.market.GetSymbolInfo(params.Symbol); err != nil {
+		return nil, fmt.Errorf("invalid symbol %s: %v", params.Symbol, err)
+	}
+	if params.Quantity <= 0 {
+		return nil, fmt.Errorf("invalid quantity: %f", params.Quantity)
+	}
+	switch params.Type {
+	case OrderTypeMarket:
+	case OrderTypeLimit:
+		if params.Price <= 0 {
+			return nil, fmt.Errorf("invalid price: %f", params.Price)
+		}
+	default:
+		return nil, fmt.Errorf("order type not supported by paper exchange: %s", params.Type)
+	}
+
+	lastPrice, err := e.getLastPrice(params.Symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	order := &paperOrder{
+		params:     params,
+		orderId:    e.nextOrderId,
+		status:     OrderStatusNew,
+		timeMillis: time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	e.nextOrderId++
+	e.orders[order.orderId] = order
+
+	log.WithFields(log.Fields{
+		"symbol":        params.Symbol,
+		"side":          params.Side,
+		"type":          params.Type,
+		"price":         params.Price,
+		"quantity":      params.Quantity,
+		"clientOrderId": params.ClientOrderID,
+		"orderId":       order.orderId,
+	}).Infof("Paper exchange: order accepted")
+
+	e.emitReport(order, Fill{}, order.params.ClientOrderID, "")
+
+	// Market orders, and limit orders that would cross the book, fill
+	// immediately at the last price.
+	switch {
+	case params.Type == OrderTypeMarket:
+		e.fill(order, lastPrice, order.remaining())
+	case params.Side == OrderSideBuy && params.Price >= lastPrice:
+		e.fill(order, lastPrice, order.remaining())
+	case params.Side == OrderSideSell && params.Price <= lastPrice:
+		e.fill(order, lastPrice, order.remaining())
+	}
+
+	return order.toOrder(), nil
+}
+
+// PostStopOrder accepts a stop order. Like Binance, a stop order that would
+// trigger immediately is rejected.
+func (e *PaperExchange) PostStopOrder(params StopOrderParameters) (*Order, error) {
+	if _, err := e.market.GetSymbolInfo(params.Symbol); err != nil {
+		return nil, fmt.Errorf("invalid symbol %s: %v", params.Symbol, err)
+	}
+	if params.Quantity <= 0 {
+		return nil, fmt.Errorf("invalid quantity: %f", params.Quantity)
+	}
+	if params.Price <= 0 || params.StopPrice <= 0 {
+		return nil, fmt.Errorf("invalid price: %f, stop price: %f",
+			params.Price, params.StopPrice)
+	}
+
+	lastPrice, err := e.getLastPrice(params.Symbol)
+	if err != nil {
+		return nil, err
+	}
+	if lastPrice <= params.StopPrice {
+		return nil, fmt.Errorf("stop price %f would trigger immediately", params.StopPrice)
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	order := &paperOrder{
+		params: OrderParameters{
+			Symbol:        params.Symbol,
+			Side:          OrderSideSell,
+			Type:          OrderTypeStopLossLimit,
+			TimeInForce:   TimeInForceGTC,
+			Quantity:      params.Quantity,
+			Price:         params.Price,
+			ClientOrderID: params.ClientOrderID,
+		},
+		orderId:    e.nextOrderId,
+		status:     OrderStatusNew,
+		timeMillis: time.Now().UnixNano() / int64(time.Millisecond),
+		stopPrice:  params.StopPrice,
+	}
+	e.nextOrderId++
+	e.orders[order.orderId] = order
+
+	log.WithFields(log.Fields{
+		"symbol":        params.Symbol,
+		"stopPrice":     params.StopPrice,
+		"price":         params.Price,
+		"quantity":      params.Quantity,
+		"clientOrderId": params.ClientOrderID,
+		"orderId":       order.orderId,
+	}).Infof("Paper exchange: stop order accepted")
+
+	e.emitReport(order, Fill{}, order.params.ClientOrderID, "")
+
+	return order.toOrder(), nil
+}
+
+// PostOcoOrder accepts an OCO sell. Like Binance, the limit price must be
+// above the last price and the stop price below it.
+func (e *PaperExchange) PostOcoOrder(params OcoOrderParameters) (*OrderList, error) {
+	if _, err := e.market.GetSymbolInfo(params.Symbol); err != nil {
+		return nil, fmt.Errorf("invalid symbol %s: %v", params.Symbol, err)
+	}
+	if params.Quantity <= 0 {
+		return nil, fmt.Errorf("invalid quantity: %f", params.Quantity)
+	}
+	if params.Price <= 0 || params.StopPrice <= 0 || params.StopLimitPrice <= 0 {
+		return nil, fmt.Errorf("invalid price: %f, stop price: %f, stop limit price: %f",
+			params.Price, params.StopPrice, params.StopLimitPrice)
+	}
+
+	lastPrice, err := e.getLastPrice(params.Symbol)
+	if err != nil {
+		return nil, err
+	}
+	if params.Price <= lastPrice || params.StopPrice >= lastPrice {
+		return nil, fmt.Errorf("price %f and stop price %f must be either side of last price %f",
+			params.Price, params.StopPrice, lastPrice)
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	orderList := &paperOrderList{
+		orderListId:       e.nextOrderListId,
+		listClientOrderId: params.ListClientOrderID,
+		symbol:            params.Symbol,
+	}
+	e.nextOrderListId++
+	e.orderLists[orderList.orderListId] = orderList
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	legs := []*paperOrder{
+		{
+			params: OrderParameters{
+				Symbol:        params.Symbol,
+				Side:          OrderSideSell,
+				Type:          OrderTypeStopLossLimit,
+				TimeInForce:   TimeInForceGTC,
+				Quantity:      params.Quantity,
+				Price:         params.StopLimitPrice,
+				ClientOrderID: params.StopClientOrderID,
+			},
+			stopPrice: params.StopPrice,
+		},
+		{
+			params: OrderParameters{
+				Symbol:        params.Symbol,
+				Side:          OrderSideSell,
+				Type:          OrderTypeLimitMaker,
+				Quantity:      params.Quantity,
+				Price:         params.Price,
+				ClientOrderID: params.LimitClientOrderID,
+			},
+		},
+	}
+	result := &OrderList{
+		OrderListID:       orderList.orderListId,
+		ListClientOrderID: orderList.listClientOrderId,
+		ListStatusType:    "EXEC_STARTED",
+		ListOrderStatus:   "EXECUTING",
+	}
+	for _, order := range legs {
+		order.orderId = e.nextOrderId
+		order.status = OrderStatusNew
+		order.timeMillis = now
+		order.orderListId = orderList.orderListId
+		e.nextOrderId++
+		e.orders[order.orderId] = order
+		orderList.orderIds = append(orderList.orderIds, order.orderId)
+		result.Orders = append(result.Orders, *order.toOrder())
+	}
+
+	log.WithFields(log.Fields{
+		"symbol":        params.Symbol,
+		"price":         params.Price,
+		"stopPrice":     params.StopPrice,
+		"quantity":      params.Quantity,
+		"clientOrderId": params.ListClientOrderID,
+		"orderListId":   orderList.orderListId,
+	}).Infof("Paper exchange: OCO order accepted")
+
+	for _, order := range legs {
+		e.emitReport(order, Fill{}, order.params.ClientOrderID, "")
+	}
+	e.emitListStatus(orderList, result.ListStatusType, result.ListOrderStatus)
+
+	return result, nil
+}
+
+// OnTrade matches open limit orders, and triggered stop orders, for the
+// trade's symbol against the trade. Buy orders fill when the market trades
+// at or below their price, sell orders when it trades at or above their
+// price, up to the quantity of the trade.
+func (e *PaperExchange) OnTrade(trade *MarketTrade) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.lastPrice[trade.Symbol] = trade.Price
+	available := trade.Quantity
+
+	for _, order := range e.bookOrders(trade.Symbol) {
+		if available <= 0 {
+			break
+		}
+		if !order.status.IsOpen() {
+			continue
+		}
+		if order.params.Type == OrderTypeStopLossLimit && !order.triggered {
+			if trade.Price > order.stopPrice {
+				continue
+			}
+			order.triggered = true
+			e.endOrderList(order, OrderStatusExpired)
+		} else if order.params.Type != OrderTypeLimit &&
+			order.params.Type != OrderTypeLimitMaker {
+			continue
+		}
+		switch order.params.Side {
+		case OrderSideBuy:
+			if trade.Price > order.params.Price {
+				continue
+			}
+		case OrderSideSell:
+			if trade.Price < order.params.Price {
+				continue
+			}
+		}
+		quantity := math.Min(order.remaining(), available)
+		available = util.Round8(available - quantity)
+		e.fill(order, order.params.Price, quantity)
+	}
+}
+
+// bookOrders returns the open orders of a symbol in the order they are
+// matched: buys then sells, each by price then time priority. Must be
+// called with the lock held.
+func (e *PaperExchange) bookOrders(symbol string) []*paperOrder {
+	orders := []*paperOrder{}
+	for _, order := range e.orders {
+		if order.params.Symbol == symbol && order.status.IsOpen() {
+			orders = append(orders, order)
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool {
+		a, b := orders[i], orders[j]
+		if a.params.Side != b.params.Side {
+			return a.params.Side == OrderSideBuy
+		}
+		if a.params.Price != b.params.Price {
+			if a.params.Side == OrderSideBuy {
+				return a.params.Price > b.params.Price
+			}
+			return a.params.Price < b.params.Price
+		}
+		return a.orderId < b.orderId
+	})
+	return orders
+}
+
+// Must be called with the lock held.
+func (e *PaperExchange) fill(order *paperOrder, price float64, quantity float64) {
+	order.filledQuantity = util.Round8(order.filledQuantity + quantity)
+	if order.remaining() <= 0 {
+		order.status = OrderStatusFilled
+	} else {
+		order.status = OrderStatusPartiallyFilled
+	}
+
+	baseAsset, quoteAsset := splitSymbol(order.params.Symbol)
+	fill := Fill{
+		OrderID:  order.orderId,
+		Price:    price,
+		Quantity: quantity,
+	}
+	if order.params.Side == OrderSideBuy {
+		fill.CommissionAsset = baseAsset
+		fill.Commission = util.Round8(quantity * types.DEFAULT_FEE)
+	} else {
+		fill.CommissionAsset = quoteAsset
+		fill.Commission = util.Round8(price * quantity * types.DEFAULT_FEE)
+	}
+	e.fills[order.params.Symbol] = append(e.fills[order.params.Symbol], fill)
+	e.applyBalances(order.params.Side, baseAsset, quoteAsset, fill)
+
+	log.WithFields(log.Fields{
+		"symbol":   order.params.Symbol,
+		"side":     order.params.Side,
+		"orderId":  order.orderId,
+		"price":    price,
+		"quantity": quantity,
+		"status":   order.status,
+	}).Infof("Paper exchange: order filled")
+
+	e.emitReport(order, fill, order.params.ClientOrderID, "")
+
+	// Like Binance, the other orders of an OCO expire when one executes.
+	e.endOrderList(order, OrderStatusExpired)
+}
+
+// Ends the order list of an order that executed or was cancelled, setting
+// the other open orders of the list to status. Must be called with the lock
+// held.
+func (e *PaperExchange) endOrderList(order *paperOrder, status OrderStatus) {
+	orderList, ok := e.orderLists[order.orderListId]
+	if !ok || orderList.done {
+		return
+	}
+	orderList.done = true
+	for _, orderId := range orderList.orderIds {
+		other := e.orders[orderId]
+		if other == order || !other.status.IsOpen() {
+			continue
+		}
+		other.status = status
+		if status == OrderStatusCanceled {
+			e.emitReport(other, Fill{}, fmt.Sprintf("cancel-%d", orderId),
+				other.params.ClientOrderID)
+		} else {
+			e.emitReport(other, Fill{}, other.params.ClientOrderID, "")
+		}
+	}
+	e.emitListStatus(orderList, "ALL_DONE", "ALL_DONE")
+}
+
+// Events are sent with the raw event in the Binance format, as saved for
+// replay. Must be called with the lock held.
+func (e *PaperExchange) emitListStatus(orderList *paperOrderList, listStatusType string,
+	listOrderStatus string) {
+	now := time.Now()
+	listStatus := ListStatus{
+		Symbol:                orderList.symbol,
+		OrderListID:           orderList.orderListId,
+		ListClientOrderID:     orderList.listClientOrderId,
+		ContingencyType:       "OCO",
+		ListStatusType:        listStatusType,
+		ListOrderStatus:       listOrderStatus,
+		RejectReason:          "NONE",
+		TimeMillis:            now.UnixNano() / int64(time.Millisecond),
+		TransactionTimeMillis: now.UnixNano() / int64(time.Millisecond),
+	}
+	for _, orderId := range orderList.orderIds {
+		listStatus.Orders = append(listStatus.Orders, Order{
+			Symbol:        orderList.symbol,
+			OrderID:       orderId,
+			ClientOrderID: e.orders[orderId].params.ClientOrderID,
+		})
+	}
+	raw, err := json.Marshal(ToBinanceListStatus(listStatus))
+	if err != nil {
+		log.WithError(err).Errorf("Paper exchange: failed to encode list status")
+	}
+	e.queueEvent(&UserStreamEvent{
+		Type:       UserStreamEventListStatus,
+		Time:       now,
+		ListStatus: listStatus,
+		Raw:        raw,
+	})
+}
+
+// Must be called with the lock held.
+func (e *PaperExchange) emitReport(order *paperOrder, fill Fill,
+	clientOrderId string, origClientOrderId string) {
+	now := time.Now()
+	report := ExecutionReport{
+		Symbol:                order.params.Symbol,
+		OrderID:               order.orderId,
+		ClientOrderID:         clientOrderId,
+		OriginalClientOrderID: origClientOrderId,
+		Side:                  order.params.Side,
+		Type:                  order.params.Type,
+		Status:                order.status,
+		Quantity:              order.params.Quantity,
+		Price:                 order.params.Price,
+		LastExecutedQuantity:  fill.Quantity,
+		LastExecutedPrice:     fill.Price,
+		Commission:            fill.Commission,
+		CommissionAsset:       fill.CommissionAsset,
+		TimeMillis:            now.UnixNano() / int64(time.Millisecond),
+	}
+	raw, err := json.Marshal(ToBinanceExecutionReport(report))
+	if err != nil {
+		log.WithError(err).Errorf("Paper exchange: failed to encode execution report")
+	}
+	e.queueEvent(&UserStreamEvent{
+		Type:            UserStreamEventExecutionReport,
+		Time:            now,
+		ExecutionReport: report,
+		Raw:             raw,
+	})
+}
+
+func (e *PaperExchange) CancelOrder(symbol string, orderId int64) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	order, ok := e.orders[orderId]
+	if !ok || order.params.Symbol != symbol {
+		return fmt.Errorf("unknown order: %d", orderId)
+	}
+	if !order.status.IsOpen() {
+		return fmt.Errorf("order %d not open: %s", orderId, order.status)
+	}
+	order.status = OrderStatusCanceled
+
+	// Like Binance, the cancel report carries a new client order ID, with the
+	// original in the origClientOrderId field.
+	e.emitReport(order, Fill{}, fmt.Sprintf("cancel-%d", orderId),
+		order.params.ClientOrderID)
+
+	// Cancelling one order of an OCO cancels the list.
+	e.endOrderList(order, OrderStatusCanceled)
+	return nil
+}
+
+func (e *PaperExchange) GetOrderByClientId(symbol string, clientOrderId string) (*Order, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for _, order := range e.orders {
+		if order.params.Symbol == symbol && order.params.ClientOrderID == clientOrderId {
+			return order.toOrder(), nil
+		}
+	}
+	return nil, ErrOrderNotFound
+}
+
+func (e *PaperExchange) GetOrderByOrderId(symbol string, orderId int64) (*Order, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	order, ok := e.orders[orderId]
+	if !ok || order.params.Symbol != symbol {
+		return nil, ErrOrderNotFound
+	}
+	return order.toOrder(), nil
+}
+
+func (e *PaperExchange) GetOpenOrders(symbol string) ([]Order, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	orders := []Order{}
+	for _, order := range e.orders {
+		if order.params.Symbol == symbol && order.status.IsOpen() {
+			orders = append(orders, *order.toOrder())
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool {
+		return orders[i].OrderID < orders[j].OrderID
+	})
+	return orders, nil
+}
+
+func (o *paperOrder) toOrder() *Order {
+	return &Order{
+		Symbol:        o.params.Symbol,
+		OrderID:       o.orderId,
+		ClientOrderID: o.params.ClientOrderID,
+		Status:        o.status,
+		TimeMillis:    o.timeMillis,
+
+		ExecutedQuantity: o.filledQuantity,
+		Side:             o.params.Side,
+		Price:            o.params.Price,
+		Quantity:         o.params.Quantity,
+	}
+}
+
+// SetBalance sets the simulated balance of an asset. Once a balance is set
+// fills are applied to the balances of their assets.
+func (e *PaperExchange) SetBalance(asset string, balance float64) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.balances == nil {
+		e.balances = make(map[string]float64)
+	}
+	e.balances[asset] = balance
+}
+
+// GetBalance returns the simulated balance of an asset. Assets without a
+// balance, set or changed by a fill, return an error rather than 0 so they
+// are not taken for sold.
+func (e *PaperExchange) GetBalance(asset string) (float64, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	balance, ok := e.balances[asset]
+	if !ok {
+		return 0, fmt.Errorf("no paper balance for %s, set one with --paper-balance", asset)
+	}
+	return balance, nil
+}
+
+// GetFreeBalance returns the simulated balance of an asset less what its
+// open orders hold.
+func (e *PaperExchange) GetFreeBalance(asset string) (float64, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	balance, ok := e.balances[asset]
+	if !ok {
+		return 0, fmt.Errorf("no paper balance for %s, set one with --paper-balance", asset)
+	}
+	for _, order := range e.orders {
+		if !order.status.IsOpen() {
+			continue
+		}
+		baseAsset, quoteAsset := splitSymbol(order.params.Symbol)
+		switch order.params.Side {
+		case OrderSideBuy:
+			if quoteAsset == asset {
+				balance -= order.remaining() * order.params.Price
+			}
+		case OrderSideSell:
+			// The orders of an OCO hold the same quantity.
+			if baseAsset == asset && !(order.orderListId != 0 &&
+				order.params.Type == OrderTypeStopLossLimit) {
+				balance -= order.remaining()
+			}
+		}
+	}
+	return util.Round8(math.Max(balance, 0)), nil
+}
+
+// Applies a fill to the simulated balances, if any. Must be called with the
+// lock held.
+func (e *PaperExchange) applyBalances(side OrderSide, baseAsset string, quoteAsset string,
+	fill Fill) {
+	if e.balances == nil {
+		return
+	}
+	quoteQuantity := fill.Price * fill.Quantity
+	if side == OrderSideBuy {
+		e.balances[baseAsset] = util.Round8(e.balances[baseAsset] + fill.Quantity - fill.Commission)
+		e.balances[quoteAsset] = util.Round8(e.balances[quoteAsset] - quoteQuantity)
+	} else {
+		e.balances[baseAsset] = util.Round8(e.balances[baseAsset] - fill.Quantity)
+		e.balances[quoteAsset] = util.Round8(e.balances[quoteAsset] + quoteQuantity - fill.Commission)
+	}
+}
+
+func (e *PaperExchange) GetOrderFills(symbol string, orderId int64) ([]Fill, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	fills := []Fill{}
+	for _, fill := range e.fills[symbol] {
+		if fill.OrderID == orderId {
+			fills = append(fills, fill)
+		}
+	}
+	return fills, nil
+}
+
+func (e *PaperExchange) getLastPrice(symbol string) (float64, error) {
+	e.lock.Lock()
+	price, ok := e.lastPrice[symbol]
+	e.lock.Unlock()
+	if ok {
+		return price, nil
+	}
+	return e.market.GetPrice(symbol, types.PriceSourceLast)
+}
+
+func (e *PaperExchange) GetPrice(symbol string, priceSource types.PriceSource) (float64, error) {
+	return e.market.GetPrice(symbol, priceSource)
+}
+
+func (e *PaperExchange) GetSymbolInfo(symbol string) (SymbolInfo, error) {
+	return e.market.GetSymbolInfo(symbol)
+}
+
+func (e *PaperExchange) AddSymbol(symbol string) {
+	e.market.AddSymbol(symbol)
+}
+
+func (e *PaperExchange) RemoveSymbol(symbol string) {
+	e.market.RemoveSymbol(symbol)
+}
+
+func (e *PaperExchange) SubscribeTrades() TradeChannel {
+	return e.market.SubscribeTrades()
+}
+
+func (e *PaperExchange) UnsubscribeTrades(channel TradeChannel) {
+	e.market.UnsubscribeTrades(channel)
+}
+
+func (e *PaperExchange) SubscribeUserStream() chan *UserStreamEvent {
+	e.subscribersLock.Lock()
+	defer e.subscribersLock.Unlock()
+	channel := make(chan *UserStreamEvent)
+	e.subscribers[channel] = true
+	return channel
+}
+
+func (e *PaperExchange) UnsubscribeUserStream(channel chan *UserStreamEvent) {
+	e.subscribersLock.Lock()
+	defer e.subscribersLock.Unlock()
+	delete(e.subscribers, channel)
+}
+
+func splitSymbol(symbol string) (baseAsset string, quoteAsset string) {
+	for _, quote := range quoteAssets {
+		if strings.HasSuffix(symbol, quote) && len(symbol) > len(quote) {
+			return strings.TrimSuffix(symbol, quote), quote
+		}
+	}
+	return symbol, ""
+}
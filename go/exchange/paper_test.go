@@ -0,0 +1,198 @@
+package exchange
+
+import (
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/crankykernel/maker/go/types"
+	"testing"
+	"time"
+)
+
+// A market data only exchange for driving the paper exchange in tests.
+type testMarket struct {
+	Exchange
+	price float64
+}
+
+func (m *testMarket) GetPrice(symbol string, priceSource types.PriceSource) (float64, error) {
+	return m.price, nil
+}
+
+func (m *testMarket) GetSymbolInfo(symbol string) (SymbolInfo, error) {
+	return SymbolInfo{TickSize: 0.00000001, StepSize: 1}, nil
+}
+
+func nextReport(t *testing.T, channel chan *UserStreamEvent) ExecutionReport {
+	select {
+	case event := <-channel:
+		return event.ExecutionReport
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for execution report")
+	}
+	return ExecutionReport{}
+}
+
+func TestPaperExchangeLimitOrder(t *testing.T) {
+	assert := assert.New(t)
+	paper := NewPaperExchange(&testMarket{price: 0.0010})
+	channel := paper.SubscribeUserStream()
+
+	order, err := paper.PostOrder(OrderParameters{
+		Symbol:        "ETHBTC",
+		Side:          OrderSideBuy,
+		Type:          OrderTypeLimit,
+		Quantity:      10,
+		Price:         0.0009,
+		ClientOrderID: "buy-1",
+	})
+	assert.Nil(err)
+	assert.Equal(OrderStatusNew, nextReport(t, channel).Status)
+
+	// Trades above the limit price do not fill.
+	paper.OnTrade(&MarketTrade{Symbol: "ETHBTC", Price: 0.00095, Quantity: 100})
+
+	// A smaller trade at the price results in a partial fill.
+	paper.OnTrade(&MarketTrade{Symbol: "ETHBTC", Price: 0.0009, Quantity: 4})
+	report := nextReport(t, channel)
+	assert.Equal(OrderStatusPartiallyFilled, report.Status)
+	assert.Equal(float64(4), report.LastExecutedQuantity)
+	assert.Equal("ETH", report.CommissionAsset)
+
+	paper.OnTrade(&MarketTrade{Symbol: "ETHBTC", Price: 0.0008, Quantity: 100})
+	report = nextReport(t, channel)
+	assert.Equal(OrderStatusFilled, report.Status)
+	assert.Equal(float64(6), report.LastExecutedQuantity)
+	assert.Equal(0.0009, report.LastExecutedPrice)
+
+	assert.NotNil(paper.CancelOrder("ETHBTC", order.OrderID))
+
+	fills, err := paper.GetOrderFills("ETHBTC", order.OrderID)
+	assert.Nil(err)
+	assert.Len(fills, 2)
+}
+
+func TestPaperExchangeMarketOrder(t *testing.T) {
+	assert := assert.New(t)
+	paper := NewPaperExchange(&testMarket{price: 0.0010})
+	channel := paper.SubscribeUserStream()
+
+	_, err := paper.PostOrder(OrderParameters{
+		Symbol:        "ETHBTC",
+		Side:          OrderSideSell,
+		Type:          OrderTypeMarket,
+		Quantity:      10,
+		ClientOrderID: "sell-1",
+	})
+	assert.Nil(err)
+	assert.Equal(OrderStatusNew, nextReport(t, channel).Status)
+	report := nextReport(t, channel)
+	assert.Equal(OrderStatusFilled, report.Status)
+	assert.Equal(0.0010, report.LastExecutedPrice)
+	assert.Equal("BTC", report.CommissionAsset)
+}
+
+func TestPaperExchangeCancel(t *testing.T) {
+	assert := assert.New(t)
+	paper := NewPaperExchange(&testMarket{price: 0.0010})
+	channel := paper.SubscribeUserStream()
+
+	order, err := paper.PostOrder(OrderParameters{
+		Symbol:        "ETHBTC",
+		Side:          OrderSideSell,
+		Type:          OrderTypeLimit,
+		Quantity:      10,
+		Price:         0.0020,
+		ClientOrderID: "sell-1",
+	})
+	assert.Nil(err)
+	nextReport(t, channel)
+
+	assert.Nil(paper.CancelOrder("ETHBTC", order.OrderID))
+	report := nextReport(t, channel)
+	assert.Equal(OrderStatusCanceled, report.Status)
+	assert.Equal("sell-1", report.OriginalClientOrderID)
+}
+
+// Orders are matched by price then time priority, whatever order the map
+// holds them in.
+func TestPaperExchangeMatchingPriority(t *testing.T) {
+	assert := assert.New(t)
+	paper := NewSteppedPaperExchange(&testMarket{price: 0.0010})
+
+	postBuy := func(clientOrderId string, price float64) int64 {
+		order, err := paper.PostOrder(OrderParameters{
+			Symbol:        "ETHBTC",
+			Side:          OrderSideBuy,
+			Type:          OrderTypeLimit,
+			Quantity:      10,
+			Price:         price,
+			ClientOrderID: clientOrderId,
+		})
+		assert.Nil(err)
+		return order.OrderID
+	}
+	first := postBuy("buy-1", 0.0008)
+	second := postBuy("buy-2", 0.0008)
+	best := postBuy("buy-3", 0.0009)
+
+	status := func(orderId int64) OrderStatus {
+		order, err := paper.GetOrderByOrderId("ETHBTC", orderId)
+		assert.Nil(err)
+		return order.Status
+	}
+
+	paper.OnTrade(&MarketTrade{Symbol: "ETHBTC", Price: 0.0008, Quantity: 10})
+	assert.Equal(OrderStatusFilled, status(best))
+	assert.Equal(OrderStatusNew, status(first))
+
+	paper.OnTrade(&MarketTrade{Symbol: "ETHBTC", Price: 0.0008, Quantity: 10})
+	assert.Equal(OrderStatusFilled, status(first))
+	assert.Equal(OrderStatusNew, status(second))
+
+	// A report for each new order and each fill.
+	assert.Len(paper.PendingEvents(), 5)
+}
+
+func TestPaperExchangeBalances(t *testing.T) {
+	assert := assert.New(t)
+	paper := NewSteppedPaperExchange(&testMarket{price: 0.0010})
+
+	_, err := paper.GetFreeBalance("BTC")
+	assert.NotNil(err)
+
+	paper.SetBalance("BTC", 1)
+	_, err = paper.PostOrder(OrderParameters{
+		Symbol:   "ETHBTC",
+		Side:     OrderSideBuy,
+		Type:     OrderTypeLimit,
+		Quantity: 100,
+		Price:    0.0009,
+	})
+	assert.Nil(err)
+	free, err := paper.GetFreeBalance("BTC")
+	assert.Nil(err)
+	assert.Equal(0.91, free)
+
+	// Unknown until a fill, so not mistaken for sold.
+	_, err = paper.GetBalance("ETH")
+	assert.NotNil(err)
+
+	paper.OnTrade(&MarketTrade{Symbol: "ETHBTC", Price: 0.0008, Quantity: 1000})
+	balance, err := paper.GetBalance("BTC")
+	assert.Nil(err)
+	assert.Equal(0.91, balance)
+	balance, err = paper.GetBalance("ETH")
+	assert.Nil(err)
+	assert.Equal(99.9, balance)
+
+	_, err = paper.PostOrder(OrderParameters{
+		Symbol:   "ETHBTC",
+		Side:     OrderSideSell,
+		Type:     OrderTypeLimit,
+		Quantity: 50,
+		Price:    0.0011,
+	})
+	assert.Nil(err)
+	free, err = paper.GetFreeBalance("ETH")
+	assert.Nil(err)
+	assert.Equal(49.9, free)
+}
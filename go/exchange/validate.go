@@ -0,0 +1,275 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package exchange
+
+import (
+	"fmt"
+	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/types"
+	"math"
+	"strconv"
+)
+
+// OrderError is returned when an order fails one of the symbol filters of
+// the exchange. Field is the order parameter at fault, and Filter the
+// exchange filter that failed.
+type OrderError struct {
+	Field   string
+	Filter  string
+	Message string
+}
+
+func (e *OrderError) Error() string {
+	if e.Filter != "" {
+		return fmt.Sprintf("%s: %s (%s)", e.Field, e.Message, e.Filter)
+	}
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// True if value is a whole number of steps above min.
+func isStepMultiple(value float64, min float64, step float64) bool {
+	steps := (value - min) / step
+	return math.Abs(steps-math.Round(steps)) < 0.000001
+}
+
+// ValidateOrder checks an order against the symbol filters of the exchange
+// before it is sent. Filters the symbol info doesn't have are not checked.
+// The percent price filter is checked against the last price instead of the
+// average price the exchange uses.
+func ValidateOrder(exchange Exchange, order OrderParameters) error {
+	symbolInfo, err := exchange.GetSymbolInfo(order.Symbol)
+	if err != nil {
+		return &OrderError{
+			Field:   "symbol",
+			Message: fmt.Sprintf("failed to get info for %s: %v", order.Symbol, err),
+		}
+	}
+	if err := validateOrder(symbolInfo, order, func() float64 {
+		lastPrice, err := exchange.GetPrice(order.Symbol, types.PriceSourceLast)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"symbol": order.Symbol,
+			}).Warnf("Failed to get last price to validate order.")
+			return 0
+		}
+		return lastPrice
+	}); err != nil {
+		return err
+	}
+
+	if symbolInfo.MaxNumOrders > 0 {
+		openOrders, err := exchange.GetOpenOrders(order.Symbol)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"symbol": order.Symbol,
+			}).Warnf("Failed to get open orders to validate order.")
+		} else if int64(len(openOrders)) >= symbolInfo.MaxNumOrders {
+			return &OrderError{
+				Field:  "symbol",
+				Filter: "MAX_NUM_ORDERS",
+				Message: fmt.Sprintf("%d orders already open, the maximum for %s",
+					len(openOrders), order.Symbol),
+			}
+		}
+	}
+
+	return nil
+}
+
+// ValidateExitOrder checks an order selling out of a trade against the symbol
+// filters. Unlike ValidateOrder it makes no requests beyond the symbol info,
+// as an exit may be placed on every trade of the symbol, so the filters that
+// need the last price or the open orders are not checked.
+func ValidateExitOrder(exchange Exchange, order OrderParameters) error {
+	symbolInfo, err := exchange.GetSymbolInfo(order.Symbol)
+	if err != nil {
+		return &OrderError{
+			Field:   "symbol",
+			Message: fmt.Sprintf("failed to get info for %s: %v", order.Symbol, err),
+		}
+	}
+	return validateOrder(symbolInfo, order, func() float64 {
+		return 0
+	})
+}
+
+// Checks the order against the filters of the symbol info. The last price is
+// only looked up if a filter needs it, and not checked if 0.
+func validateOrder(symbolInfo SymbolInfo, order OrderParameters,
+	lastPrice func() float64) error {
+	if symbolInfo.Status != "" && symbolInfo.Status != SymbolStatusTrading {
+		return &OrderError{
+			Field:   "symbol",
+			Message: fmt.Sprintf("%s is not trading, status is %s", order.Symbol, symbolInfo.Status),
+		}
+	}
+
+	if len(symbolInfo.OrderTypes) > 0 {
+		allowed := false
+		for _, orderType := range symbolInfo.OrderTypes {
+			if orderType == string(order.Type) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return &OrderError{
+				Field:   "type",
+				Message: fmt.Sprintf("%s orders not allowed for %s", order.Type, order.Symbol),
+			}
+		}
+	}
+
+	if err := validateQuantity(order.Quantity, "LOT_SIZE", symbolInfo.MinQty,
+		symbolInfo.MaxQty, symbolInfo.StepSize); err != nil {
+		return err
+	}
+
+	if order.Type == OrderTypeMarket {
+		if err := validateQuantity(order.Quantity, "MARKET_LOT_SIZE", symbolInfo.MarketMinQty,
+			symbolInfo.MarketMaxQty, symbolInfo.MarketStepSize); err != nil {
+			return err
+		}
+		if symbolInfo.MinNotional > 0 && symbolInfo.ApplyToMarket {
+			if price := lastPrice(); price > 0 && price*order.Quantity < symbolInfo.MinNotional {
+				return &OrderError{
+					Field:  "quantity",
+					Filter: "MIN_NOTIONAL",
+					Message: fmt.Sprintf("value of %s at last price %s below minimum %s",
+						formatValue(order.Quantity), formatValue(price),
+						formatValue(symbolInfo.MinNotional)),
+				}
+			}
+		}
+		return nil
+	}
+
+	if err := validatePrice(order.Price, symbolInfo); err != nil {
+		return err
+	}
+	if order.StopPrice > 0 {
+		if err := validatePrice(order.StopPrice, symbolInfo); err != nil {
+			err.(*OrderError).Field = "stopPrice"
+			return err
+		}
+	}
+
+	if symbolInfo.MultiplierUp > 0 || symbolInfo.MultiplierDown > 0 {
+		if price := lastPrice(); price > 0 {
+			if symbolInfo.MultiplierUp > 0 && order.Price > price*symbolInfo.MultiplierUp {
+				return &OrderError{
+					Field:  "price",
+					Filter: "PERCENT_PRICE",
+					Message: fmt.Sprintf("%s above %s times last price %s",
+						formatValue(order.Price), formatValue(symbolInfo.MultiplierUp),
+						formatValue(price)),
+				}
+			}
+			if order.Price < price*symbolInfo.MultiplierDown {
+				return &OrderError{
+					Field:  "price",
+					Filter: "PERCENT_PRICE",
+					Message: fmt.Sprintf("%s below %s times last price %s",
+						formatValue(order.Price), formatValue(symbolInfo.MultiplierDown),
+						formatValue(price)),
+				}
+			}
+		}
+	}
+
+	if order.Price*order.Quantity < symbolInfo.MinNotional {
+		return &OrderError{
+			Field:  "quantity",
+			Filter: "MIN_NOTIONAL",
+			Message: fmt.Sprintf("value of %s at %s below minimum %s",
+				formatValue(order.Quantity), formatValue(order.Price),
+				formatValue(symbolInfo.MinNotional)),
+		}
+	}
+
+	return nil
+}
+
+func validateQuantity(quantity float64, filter string, minQty float64, maxQty float64,
+	stepSize float64) error {
+	if quantity <= 0 {
+		return &OrderError{
+			Field:   "quantity",
+			Message: fmt.Sprintf("%s must be greater than 0", formatValue(quantity)),
+		}
+	}
+	if quantity < minQty {
+		return &OrderError{
+			Field:   "quantity",
+			Filter:  filter,
+			Message: fmt.Sprintf("%s below minimum %s", formatValue(quantity), formatValue(minQty)),
+		}
+	}
+	if maxQty > 0 && quantity > maxQty {
+		return &OrderError{
+			Field:   "quantity",
+			Filter:  filter,
+			Message: fmt.Sprintf("%s above maximum %s", formatValue(quantity), formatValue(maxQty)),
+		}
+	}
+	if stepSize > 0 && !isStepMultiple(quantity, minQty, stepSize) {
+		return &OrderError{
+			Field:  "quantity",
+			Filter: filter,
+			Message: fmt.Sprintf("%s not a multiple of step size %s", formatValue(quantity),
+				formatValue(stepSize)),
+		}
+	}
+	return nil
+}
+
+func validatePrice(price float64, symbolInfo SymbolInfo) error {
+	if price <= 0 {
+		return &OrderError{
+			Field:   "price",
+			Message: fmt.Sprintf("%s must be greater than 0", formatValue(price)),
+		}
+	}
+	if price < symbolInfo.MinPrice {
+		return &OrderError{
+			Field:  "price",
+			Filter: "PRICE_FILTER",
+			Message: fmt.Sprintf("%s below minimum %s", formatValue(price),
+				formatValue(symbolInfo.MinPrice)),
+		}
+	}
+	if symbolInfo.MaxPrice > 0 && price > symbolInfo.MaxPrice {
+		return &OrderError{
+			Field:  "price",
+			Filter: "PRICE_FILTER",
+			Message: fmt.Sprintf("%s above maximum %s", formatValue(price),
+				formatValue(symbolInfo.MaxPrice)),
+		}
+	}
+	if symbolInfo.TickSize > 0 && !isStepMultiple(price, symbolInfo.MinPrice, symbolInfo.TickSize) {
+		return &OrderError{
+			Field:  "price",
+			Filter: "PRICE_FILTER",
+			Message: fmt.Sprintf("%s not a multiple of tick size %s", formatValue(price),
+				formatValue(symbolInfo.TickSize)),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package exchange
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestValidateOrder(t *testing.T) {
+	assert := assert.New(t)
+	symbolInfo := SymbolInfo{
+		Status:         SymbolStatusTrading,
+		OrderTypes:     []string{"LIMIT", "MARKET"},
+		TickSize:       0.000001,
+		MinPrice:       0.000001,
+		MaxPrice:       100000,
+		MultiplierUp:   5,
+		MultiplierDown: 0.2,
+		StepSize:       0.001,
+		MinQty:         0.001,
+		MaxQty:         100000,
+		MarketMinQty:   0.001,
+		MarketMaxQty:   1000,
+		MinNotional:    0.001,
+		ApplyToMarket:  true,
+	}
+	lastPrice := func() float64 {
+		return 0.03
+	}
+	order := OrderParameters{
+		Symbol:   "ETHBTC",
+		Side:     OrderSideBuy,
+		Type:     OrderTypeLimit,
+		Price:    0.031,
+		Quantity: 1.5,
+	}
+	assert.Nil(validateOrder(symbolInfo, order, lastPrice))
+
+	check := func(order OrderParameters, field string, filter string) {
+		err := validateOrder(symbolInfo, order, lastPrice)
+		if assert.NotNil(err) {
+			assert.Equal(field, err.(*OrderError).Field)
+			assert.Equal(filter, err.(*OrderError).Filter)
+		}
+	}
+
+	invalid := order
+	invalid.Price = 0.0310005
+	check(invalid, "price", "PRICE_FILTER")
+	invalid.Price = 0.2
+	check(invalid, "price", "PERCENT_PRICE")
+	invalid = order
+	invalid.Quantity = 1.5005
+	check(invalid, "quantity", "LOT_SIZE")
+	invalid.Quantity = 0.01
+	check(invalid, "quantity", "MIN_NOTIONAL")
+	invalid = order
+	invalid.Type = OrderType("STOP_LOSS")
+	check(invalid, "type", "")
+
+	market := OrderParameters{
+		Symbol:   "ETHBTC",
+		Side:     OrderSideSell,
+		Type:     OrderTypeMarket,
+		Quantity: 1.5,
+	}
+	assert.Nil(validateOrder(symbolInfo, market, lastPrice))
+	market.Quantity = 2000
+	check(market, "quantity", "MARKET_LOT_SIZE")
+
+	stop := OrderParameters{
+		Symbol:    "ETHBTC",
+		Side:      OrderSideSell,
+		Type:      OrderTypeLimit,
+		Quantity:  1.5,
+		Price:     0.028,
+		StopPrice: 0.0281,
+	}
+	assert.Nil(validateOrder(symbolInfo, stop, lastPrice))
+	stop.StopPrice = 0.02810005
+	check(stop, "stopPrice", "PRICE_FILTER")
+
+	symbolInfo.Status = "BREAK"
+	check(order, "symbol", "")
+}
+
+type symbolInfoExchange struct {
+	Exchange
+	symbolInfo SymbolInfo
+}
+
+func (e *symbolInfoExchange) GetSymbolInfo(symbol string) (SymbolInfo, error) {
+	return e.symbolInfo, nil
+}
+
+// Exits are checked without looking up the last price or open orders, which
+// would panic on the embedded nil exchange.
+func TestValidateExitOrder(t *testing.T) {
+	ex := &symbolInfoExchange{symbolInfo: SymbolInfo{
+		Status:         SymbolStatusTrading,
+		TickSize:       0.000001,
+		MinPrice:       0.000001,
+		MultiplierUp:   5,
+		MultiplierDown: 0.2,
+		StepSize:       0.001,
+		MinQty:         0.001,
+		MarketMinQty:   0.001,
+		MinNotional:    0.001,
+		ApplyToMarket:  true,
+		MaxNumOrders:   1,
+	}}
+	market := OrderParameters{
+		Symbol:   "ETHBTC",
+		Side:     OrderSideSell,
+		Type:     OrderTypeMarket,
+		Quantity: 1.5,
+	}
+	assert.Nil(t, ValidateExitOrder(ex, market))
+	market.Quantity = 1.5005
+	assert.NotNil(t, ValidateExitOrder(ex, market))
+
+	limit := OrderParameters{
+		Symbol:   "ETHBTC",
+		Side:     OrderSideSell,
+		Type:     OrderTypeLimit,
+		Quantity: 1.5,
+		Price:    0.031,
+	}
+	assert.Nil(t, ValidateExitOrder(ex, limit))
+	limit.Quantity = 0.01
+	err := ValidateExitOrder(ex, limit)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "MIN_NOTIONAL", err.(*OrderError).Filter)
+	}
+}
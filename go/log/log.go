@@ -32,6 +32,7 @@ type LogLevel = logrus.Level
 const (
 	LogLevelDebug LogLevel = logrus.DebugLevel
 	LogLevelInfo  LogLevel = logrus.InfoLevel
+	LogLevelWarn  LogLevel = logrus.WarnLevel
 )
 
 var logLevel = LogLevelInfo
@@ -0,0 +1,188 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package recorder
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gitlab.com/crankykernel/maker/go/binanceex"
+)
+
+// Records are stored with short keys and numeric values to keep segments
+// small.
+type tradeRecord struct {
+	ID         int64   `json:"a"`
+	Time       int64   `json:"T"`
+	Price      float64 `json:"p"`
+	Quantity   float64 `json:"q"`
+	BuyerMaker bool    `json:"m"`
+}
+
+type bookTickerRecord struct {
+	UpdateID    int64   `json:"u"`
+	Time        int64   `json:"T"`
+	BidPrice    float64 `json:"b"`
+	BidQuantity float64 `json:"B"`
+	AskPrice    float64 `json:"a"`
+	AskQuantity float64 `json:"A"`
+}
+
+type BookTicker struct {
+	Symbol      string
+	UpdateID    int64
+	Time        time.Time
+	BidPrice    float64
+	BidQuantity float64
+	AskPrice    float64
+	AskQuantity float64
+}
+
+// ReadTrades returns the recorded aggregate trades for a symbol between start
+// and end, in the same form as trades loaded from the Binance REST API.
+func ReadTrades(directory string, symbol string, start time.Time, end time.Time) ([]binanceex.AggTrade, error) {
+	symbol = strings.ToUpper(symbol)
+	trades := []binanceex.AggTrade{}
+	err := readSegments(directory, symbol, StreamTypeAggTrade, start, end, func(decoder *json.Decoder) error {
+		var record tradeRecord
+		if err := decoder.Decode(&record); err != nil {
+			return err
+		}
+		t := fromMillis(record.Time)
+		if t.Before(start) || t.After(end) {
+			return nil
+		}
+		trades = append(trades, binanceex.AggTrade{
+			Symbol:     symbol,
+			ID:         record.ID,
+			Price:      record.Price,
+			Quantity:   record.Quantity,
+			Time:       t,
+			BuyerMaker: record.BuyerMaker,
+		})
+		return nil
+	})
+	return trades, err
+}
+
+// ReadBookTickers returns the recorded book ticker updates for a symbol
+// between start and end.
+func ReadBookTickers(directory string, symbol string, start time.Time, end time.Time) ([]BookTicker, error) {
+	symbol = strings.ToUpper(symbol)
+	tickers := []BookTicker{}
+	err := readSegments(directory, symbol, StreamTypeBookTicker, start, end, func(decoder *json.Decoder) error {
+		var record bookTickerRecord
+		if err := decoder.Decode(&record); err != nil {
+			return err
+		}
+		t := fromMillis(record.Time)
+		if t.Before(start) || t.After(end) {
+			return nil
+		}
+		tickers = append(tickers, BookTicker{
+			Symbol:      symbol,
+			UpdateID:    record.UpdateID,
+			Time:        t,
+			BidPrice:    record.BidPrice,
+			BidQuantity: record.BidQuantity,
+			AskPrice:    record.AskPrice,
+			AskQuantity: record.AskQuantity,
+		})
+		return nil
+	})
+	return tickers, err
+}
+
+// readSegments calls decode for each record of the segments overlapping
+// start and end, in time order.
+func readSegments(directory string, symbol string, streamType StreamType,
+	start time.Time, end time.Time, decode func(*json.Decoder) error) error {
+	filenames, err := findSegments(directory, symbol, streamType, start, end)
+	if err != nil {
+		return err
+	}
+	for _, filename := range filenames {
+		if err := readSegment(filename, decode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func findSegments(directory string, symbol string, streamType StreamType,
+	start time.Time, end time.Time) ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(directory, symbol))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	filenames := []string{}
+	for _, entry := range entries {
+		segmentType, segmentStart, err := parseSegmentFilename(entry.Name())
+		if err != nil || segmentType != streamType {
+			continue
+		}
+		if segmentStart.Add(time.Hour).Before(start) || segmentStart.After(end) {
+			continue
+		}
+		filenames = append(filenames, filepath.Join(directory, symbol, entry.Name()))
+	}
+	// The time format sorts lexically.
+	sort.Strings(filenames)
+	return filenames, nil
+}
+
+func readSegment(filename string, decode func(*json.Decoder) error) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(bufio.NewReader(file))
+	if err != nil {
+		// An empty segment from a crash right after creation.
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	defer reader.Close()
+	decoder := json.NewDecoder(reader)
+	for {
+		err := decode(decoder)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			// The last segment written before a crash may be truncated,
+			// keep the records read so far.
+			if err == io.ErrUnexpectedEOF || err == gzip.ErrChecksum {
+				return nil
+			}
+			return err
+		}
+	}
+}
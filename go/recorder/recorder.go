@@ -0,0 +1,278 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package recorder
+
+import (
+	"encoding/json"
+	"fmt"
+	"gitlab.com/crankykernel/maker/go/binanceex"
+	"gitlab.com/crankykernel/maker/go/log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Options struct {
+	// Directory segments are written to, one sub-directory per symbol.
+	Directory string
+
+	// Symbols to record.
+	Symbols []string
+
+	// Also record the book ticker stream.
+	BookTicker bool
+
+	// Segments older than this are removed. 0 for no limit.
+	MaxAge time.Duration
+
+	// The oldest segments are removed when the total size exceeds this
+	// many bytes. 0 for no limit.
+	MaxSize int64
+}
+
+// Recorder writes market data streams to compressed segment files.
+type Recorder struct {
+	options  Options
+	symbols  map[string]bool
+	segments *segmentSet
+}
+
+func New(options Options) *Recorder {
+	symbols := make(map[string]bool)
+	for _, symbol := range options.Symbols {
+		symbols[strings.ToUpper(symbol)] = true
+	}
+	return &Recorder{
+		options:  options,
+		symbols:  symbols,
+		segments: newSegmentSet(options.Directory),
+	}
+}
+
+// Symbols returns the symbols being recorded.
+func (r *Recorder) Symbols() []string {
+	symbols := []string{}
+	for symbol := range r.symbols {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+	return symbols
+}
+
+// The aggTrade stream message as sent by Binance.
+type streamAggTrade struct {
+	Symbol     string `json:"s"`
+	ID         int64  `json:"a"`
+	Price      string `json:"p"`
+	Quantity   string `json:"q"`
+	TradeTime  int64  `json:"T"`
+	BuyerMaker bool   `json:"m"`
+}
+
+// The bookTicker stream message as sent by Binance.
+type streamBookTicker struct {
+	UpdateID    int64  `json:"u"`
+	Symbol      string `json:"s"`
+	BidPrice    string `json:"b"`
+	BidQuantity string `json:"B"`
+	AskPrice    string `json:"a"`
+	AskQuantity string `json:"A"`
+}
+
+// RecordAggTrade records a raw aggTrade stream message if its symbol is being
+// recorded. Suitable for use as the trade stream manager recorder hook.
+func (r *Recorder) RecordAggTrade(symbol string, payload []byte) {
+	symbol = strings.ToUpper(symbol)
+	if !r.symbols[symbol] {
+		return
+	}
+	var message streamAggTrade
+	if err := json.Unmarshal(payload, &message); err != nil {
+		log.WithError(err).WithField("symbol", symbol).
+			Errorf("Recorder: failed to decode aggTrade message")
+		return
+	}
+	record := tradeRecord{
+		ID:         message.ID,
+		Price:      parseFloat(message.Price),
+		Quantity:   parseFloat(message.Quantity),
+		Time:       message.TradeTime,
+		BuyerMaker: message.BuyerMaker,
+	}
+	r.write(symbol, StreamTypeAggTrade, fromMillis(record.Time), record)
+}
+
+func (r *Recorder) recordBookTicker(symbol string, payload []byte) {
+	var message streamBookTicker
+	if err := json.Unmarshal(payload, &message); err != nil {
+		log.WithError(err).WithField("symbol", symbol).
+			Errorf("Recorder: failed to decode bookTicker message")
+		return
+	}
+	// Book ticker messages are not timestamped, use the time received.
+	now := time.Now()
+	record := bookTickerRecord{
+		UpdateID:    message.UpdateID,
+		Time:        toMillis(now),
+		BidPrice:    parseFloat(message.BidPrice),
+		BidQuantity: parseFloat(message.BidQuantity),
+		AskPrice:    parseFloat(message.AskPrice),
+		AskQuantity: parseFloat(message.AskQuantity),
+	}
+	r.write(symbol, StreamTypeBookTicker, now, record)
+}
+
+func (r *Recorder) write(symbol string, streamType StreamType, t time.Time, record interface{}) {
+	if err := r.segments.write(symbol, streamType, t, record); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"symbol": symbol,
+			"stream": streamType,
+		}).Errorf("Recorder: failed to write record")
+	}
+}
+
+// Run starts the book ticker streams if enabled, and the flush and retention
+// loops. It does not return.
+func (r *Recorder) Run() {
+	log.WithFields(log.Fields{
+		"symbols":    r.Symbols(),
+		"bookTicker": r.options.BookTicker,
+		"directory":  r.options.Directory,
+	}).Infof("Starting market data recorder")
+
+	if r.options.BookTicker {
+		for symbol := range r.symbols {
+			go r.runBookTickerStream(symbol)
+		}
+	}
+
+	flushTicker := time.NewTicker(5 * time.Second)
+	retentionTicker := time.NewTicker(10 * time.Minute)
+	r.applyRetention()
+	for {
+		select {
+		case <-flushTicker.C:
+			r.segments.flush()
+		case <-retentionTicker.C:
+			r.applyRetention()
+		}
+	}
+}
+
+// Close flushes and closes all open segments.
+func (r *Recorder) Close() {
+	r.segments.closeAll()
+}
+
+func (r *Recorder) runBookTickerStream(symbol string) {
+	streamName := fmt.Sprintf("%s@bookTicker", strings.ToLower(symbol))
+	for {
+		stream, err := binanceex.OpenSingleStream(streamName)
+		if err != nil {
+			log.WithError(err).WithField("stream", streamName).
+				Errorf("Recorder: failed to open book ticker stream")
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		for {
+			payload, err := stream.Next()
+			if err != nil {
+				log.WithError(err).WithField("stream", streamName).
+					Errorf("Recorder: failed to read book ticker stream")
+				stream.Close()
+				break
+			}
+			r.recordBookTicker(symbol, payload)
+		}
+		time.Sleep(1 * time.Second)
+	}
+}
+
+type segmentFile struct {
+	path      string
+	startTime time.Time
+	size      int64
+}
+
+// applyRetention removes segments older than the max age, then the oldest
+// segments until the total size is under the max size. Open segments are
+// never removed.
+func (r *Recorder) applyRetention() {
+	files := []segmentFile{}
+	filepath.Walk(r.options.Directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(path, segmentExtension) {
+			return nil
+		}
+		_, startTime, err := parseSegmentFilename(path)
+		if err != nil {
+			return nil
+		}
+		files = append(files, segmentFile{
+			path:      path,
+			startTime: startTime,
+			size:      info.Size(),
+		})
+		return nil
+	})
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].startTime.Before(files[j].startTime)
+	})
+
+	totalSize := int64(0)
+	for _, file := range files {
+		totalSize += file.size
+	}
+
+	for _, file := range files {
+		expired := r.options.MaxAge > 0 &&
+			time.Since(file.startTime) > r.options.MaxAge+time.Hour
+		oversize := r.options.MaxSize > 0 && totalSize > r.options.MaxSize
+		if !expired && !oversize {
+			continue
+		}
+		if r.segments.isOpen(file.path) {
+			continue
+		}
+		if err := os.Remove(file.path); err != nil {
+			log.WithError(err).WithField("filename", file.path).
+				Errorf("Recorder: failed to remove segment")
+			continue
+		}
+		log.WithFields(log.Fields{
+			"filename": file.path,
+			"expired":  expired,
+			"oversize": oversize,
+		}).Infof("Recorder: removed segment")
+		totalSize -= file.size
+	}
+}
+
+func parseFloat(value string) float64 {
+	f, _ := strconv.ParseFloat(value, 64)
+	return f
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func fromMillis(millis int64) time.Time {
+	return time.Unix(0, millis*int64(time.Millisecond))
+}
@@ -0,0 +1,81 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package recorder
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func aggTradePayload(id int64, price string, t time.Time) []byte {
+	return []byte(fmt.Sprintf(`{"e":"aggTrade","s":"ETHBTC","a":%d,"p":"%s","q":"1.5","T":%d,"m":true}`,
+		id, price, toMillis(t)))
+}
+
+func TestRecordAndReadTrades(t *testing.T) {
+	directory, err := ioutil.TempDir("", "maker-recorder")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+
+	now := time.Now()
+	recorder := New(Options{Directory: directory, Symbols: []string{"ethbtc"}})
+	recorder.RecordAggTrade("ethbtc", aggTradePayload(1, "0.031", now))
+	recorder.RecordAggTrade("ethbtc", aggTradePayload(2, "0.032", now.Add(time.Millisecond)))
+	recorder.RecordAggTrade("bnbbtc", aggTradePayload(3, "0.001", now))
+	recorder.Close()
+
+	// Reopening a segment appends to it.
+	recorder = New(Options{Directory: directory, Symbols: []string{"ETHBTC"}})
+	recorder.RecordAggTrade("ethbtc", aggTradePayload(4, "0.033", now.Add(2*time.Millisecond)))
+	recorder.Close()
+
+	trades, err := ReadTrades(directory, "ethbtc", now.Add(-time.Minute), now.Add(time.Minute))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(trades))
+	assert.Equal(t, int64(1), trades[0].ID)
+	assert.Equal(t, "ETHBTC", trades[0].Symbol)
+	assert.Equal(t, 0.031, trades[0].Price)
+	assert.Equal(t, 1.5, trades[0].Quantity)
+	assert.Equal(t, int64(4), trades[2].ID)
+
+	trades, err = ReadTrades(directory, "BNBBTC", now.Add(-time.Minute), now.Add(time.Minute))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(trades))
+}
+
+func TestRetentionMaxSize(t *testing.T) {
+	directory, err := ioutil.TempDir("", "maker-recorder")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+
+	now := time.Now()
+	recorder := New(Options{Directory: directory, Symbols: []string{"ETHBTC"}, MaxSize: 1})
+	recorder.RecordAggTrade("ETHBTC", aggTradePayload(1, "0.031", now.Add(-2*time.Hour)))
+	recorder.RecordAggTrade("ETHBTC", aggTradePayload(2, "0.032", now))
+
+	// The current segment is still open and must survive.
+	recorder.applyRetention()
+	recorder.Close()
+
+	trades, err := ReadTrades(directory, "ETHBTC", now.Add(-3*time.Hour), now.Add(time.Minute))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(trades))
+	assert.Equal(t, int64(2), trades[0].ID)
+}
@@ -0,0 +1,187 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package recorder
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type StreamType string
+
+const (
+	StreamTypeAggTrade   StreamType = "aggTrade"
+	StreamTypeBookTicker StreamType = "bookTicker"
+)
+
+const segmentExtension = ".jsonl.gz"
+
+// Segments are rotated every hour, the segment time is in the filename.
+const segmentTimeFormat = "2006010215"
+
+// segmentFilename returns the filename of the segment a record at the given
+// time belongs to, relative to the recorder directory.
+func segmentFilename(symbol string, streamType StreamType, t time.Time) string {
+	return filepath.Join(symbol, fmt.Sprintf("%s-%s%s", streamType,
+		t.UTC().Format(segmentTimeFormat), segmentExtension))
+}
+
+// parseSegmentFilename returns the stream type and start time of a segment
+// from its base filename.
+func parseSegmentFilename(filename string) (StreamType, time.Time, error) {
+	base := strings.TrimSuffix(filepath.Base(filename), segmentExtension)
+	parts := strings.SplitN(base, "-", 2)
+	if len(parts) != 2 {
+		return "", time.Time{}, fmt.Errorf("invalid segment filename: %s", filename)
+	}
+	startTime, err := time.ParseInLocation(segmentTimeFormat, parts[1], time.UTC)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("invalid segment filename: %s", filename)
+	}
+	return StreamType(parts[0]), startTime, nil
+}
+
+// segmentWriter appends newline delimited JSON records to a gzip compressed
+// segment file.
+type segmentWriter struct {
+	filename string
+	file     *os.File
+	gzip     *gzip.Writer
+	buffer   *bufio.Writer
+	encoder  *json.Encoder
+}
+
+func openSegmentWriter(filename string) (*segmentWriter, error) {
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return nil, err
+	}
+	// Each open appends a new gzip member. Readers handle multiple members
+	// transparently, so reopening a segment after a restart is safe.
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	gzipWriter := gzip.NewWriter(file)
+	buffer := bufio.NewWriter(gzipWriter)
+	return &segmentWriter{
+		filename: filename,
+		file:     file,
+		gzip:     gzipWriter,
+		buffer:   buffer,
+		encoder:  json.NewEncoder(buffer),
+	}, nil
+}
+
+func (w *segmentWriter) write(record interface{}) error {
+	return w.encoder.Encode(record)
+}
+
+// flush pushes buffered records through to the file so they are readable
+// even if Maker exits without closing the segment.
+func (w *segmentWriter) flush() error {
+	if err := w.buffer.Flush(); err != nil {
+		return err
+	}
+	return w.gzip.Flush()
+}
+
+func (w *segmentWriter) close() error {
+	if err := w.buffer.Flush(); err != nil {
+		w.file.Close()
+		return err
+	}
+	if err := w.gzip.Close(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// segmentSet holds the currently open segment for each symbol and stream.
+type segmentSet struct {
+	lock      sync.Mutex
+	directory string
+	writers   map[string]*segmentWriter
+}
+
+func newSegmentSet(directory string) *segmentSet {
+	return &segmentSet{
+		directory: directory,
+		writers:   make(map[string]*segmentWriter),
+	}
+}
+
+func (s *segmentSet) write(symbol string, streamType StreamType, t time.Time, record interface{}) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := fmt.Sprintf("%s/%s", symbol, streamType)
+	filename := filepath.Join(s.directory, segmentFilename(symbol, streamType, t))
+
+	writer := s.writers[key]
+	if writer != nil && writer.filename != filename {
+		if err := writer.close(); err != nil {
+			return err
+		}
+		writer = nil
+	}
+	if writer == nil {
+		var err error
+		writer, err = openSegmentWriter(filename)
+		if err != nil {
+			delete(s.writers, key)
+			return err
+		}
+		s.writers[key] = writer
+	}
+	return writer.write(record)
+}
+
+func (s *segmentSet) flush() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, writer := range s.writers {
+		writer.flush()
+	}
+}
+
+// isOpen returns true if the filename is a segment currently being written.
+func (s *segmentSet) isOpen(filename string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, writer := range s.writers {
+		if writer.filename == filename {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *segmentSet) closeAll() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for key, writer := range s.writers {
+		writer.close()
+		delete(s.writers, key)
+	}
+}
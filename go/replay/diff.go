@@ -0,0 +1,121 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package replay
+
+import (
+	"encoding/json"
+	"fmt"
+	"gitlab.com/crankykernel/maker/go/types"
+	"math"
+	"reflect"
+	"sort"
+)
+
+// Differences in numeric fields smaller than this are ignored, as values are
+// generally rounded to 8 decimal places.
+const floatTolerance = 0.000000005
+
+type Difference struct {
+	Field    string      `json:"field"`
+	Stored   interface{} `json:"stored"`
+	Replayed interface{} `json:"replayed"`
+}
+
+// Diff compares two trade states field by field, ignoring the history. Nested
+// fields are named with dots and list elements with an index, for example
+// "StopLoss.Percent" or "BuySideFills[1].Quantity".
+func Diff(stored types.TradeState, replayed types.TradeState) ([]Difference, error) {
+	stored.History = nil
+	replayed.History = nil
+
+	storedFields, err := flatten(stored)
+	if err != nil {
+		return nil, err
+	}
+	replayedFields, err := flatten(replayed)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for name := range storedFields {
+		names = append(names, name)
+	}
+	for name := range replayedFields {
+		if _, ok := storedFields[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	differences := []Difference{}
+	for _, name := range names {
+		a, b := storedFields[name], replayedFields[name]
+		if !equal(a, b) {
+			differences = append(differences, Difference{
+				Field:    name,
+				Stored:   a,
+				Replayed: b,
+			})
+		}
+	}
+	return differences, nil
+}
+
+func equal(a interface{}, b interface{}) bool {
+	if fa, ok := a.(float64); ok {
+		if fb, ok := b.(float64); ok {
+			return math.Abs(fa-fb) < floatTolerance
+		}
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// Flatten the JSON encoding of a value into a map of field names to values.
+func flatten(value interface{}) (map[string]interface{}, error) {
+	buf, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(buf, &decoded); err != nil {
+		return nil, err
+	}
+	fields := map[string]interface{}{}
+	flattenInto(fields, "", decoded)
+	return fields, nil
+}
+
+func flattenInto(fields map[string]interface{}, prefix string, value interface{}) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			name := key
+			if prefix != "" {
+				name = prefix + "." + key
+			}
+			flattenInto(fields, name, child)
+		}
+	case []interface{}:
+		for i, child := range value {
+			flattenInto(fields, fmt.Sprintf("%s[%d]", prefix, i), child)
+		}
+	default:
+		if value != nil {
+			fields[prefix] = value
+		}
+	}
+}
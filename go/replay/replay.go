@@ -0,0 +1,503 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package replay rebuilds the state of a trade from the raw execution
+// reports saved by the server and the user actions recorded in the trade
+// history, and compares the result to the stored state.
+package replay
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/crankykernel/binanceapi-go"
+	"gitlab.com/crankykernel/maker/go/binanceex"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/types"
+	"sort"
+	"time"
+)
+
+type Result struct {
+	TradeID string `json:"tradeId"`
+
+	// The number of execution reports replayed.
+	Reports int `json:"reports"`
+
+	Stored      types.TradeState `json:"stored"`
+	Replayed    types.TradeState `json:"replayed"`
+	Differences []Difference     `json:"differences"`
+}
+
+// Repaired returns the replayed state to save over the stored state. The
+// stored history is kept, with an entry recording the differences repaired.
+func (r *Result) Repaired() types.TradeState {
+	state := r.Replayed
+	state.History = append([]types.HistoryEntry{}, r.Stored.History...)
+	state.History = append(state.History, types.HistoryEntry{
+		Timestamp: time.Now(),
+		Type:      types.HistoryTypeReplayRepair,
+		Fields: map[string]interface{}{
+			"reports":     r.Reports,
+			"differences": r.Differences,
+		},
+	})
+	return state
+}
+
+// ReplayTrade replays a trade using the execution reports saved in the
+// database for its client order IDs. The step size of the symbol is required
+// to calculate the sellable quantity when fees are not paid in BNB.
+func ReplayTrade(stored types.TradeState, stepSize float64) (*Result, error) {
+	clientOrderIds := []string{}
+	for clientOrderId := range stored.ClientOrderIDs {
+		clientOrderIds = append(clientOrderIds, clientOrderId)
+	}
+	sort.Strings(clientOrderIds)
+
+	reports, err := db.DbGetRawExecutionReports(clientOrderIds)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load execution reports: %v", err)
+	}
+	return Replay(stored, reports, stepSize)
+}
+
+// Replay folds the raw execution reports, in the order given, and the user
+// actions from the history of the stored trade, in timestamp order, into a new
+// trade state.
+//
+// Fields driven by the price stream, such as the last price and whether the
+// stop loss or trailing profit triggered, can't be replayed so are copied from
+// the stored state.
+func Replay(stored types.TradeState, rawReports [][]byte, stepSize float64) (*Result, error) {
+	reports := []types.HistoryEntry{}
+	for _, raw := range rawReports {
+		var report binanceapi.StreamExecutionReport
+		if err := json.Unmarshal(raw, &report); err != nil {
+			return nil, fmt.Errorf("failed to decode execution report: %v", err)
+		}
+		reports = append(reports, types.HistoryEntry{
+			Timestamp: time.Unix(0, report.EventTimeMillis*int64(time.Millisecond)),
+			Type:      types.HistoryTypeExecutionReport,
+			Fields:    report,
+		})
+	}
+
+	actions := []types.HistoryEntry{}
+	for _, entry := range stored.History {
+		if entry.Type != types.HistoryTypeExecutionReport {
+			actions = append(actions, entry)
+		}
+	}
+
+	// The report of a new order can be timestamped before the entry
+	// recording the order was placed, hold it back until the order is known.
+	placed := placementTimes(actions)
+	for i := range reports {
+		report := reports[i].Fields.(binanceapi.StreamExecutionReport)
+		if timestamp, ok := placed[report.ClientOrderID]; ok && reports[i].Timestamp.Before(timestamp) {
+			reports[i].Timestamp = timestamp
+		}
+	}
+
+	trade := types.NewTradeWithState(initialState(stored))
+	for _, entry := range merge(actions, reports) {
+		trade.AddHistory(entry)
+		if entry.Type == types.HistoryTypeExecutionReport {
+			report := entry.Fields.(binanceapi.StreamExecutionReport)
+			trade.ApplyExecutionReport(report, entry.Timestamp, stepSize)
+		} else if err := applyAction(trade, entry, stepSize); err != nil {
+			return nil, err
+		}
+	}
+
+	trade.State.LastPrice = stored.LastPrice
+	trade.State.StopLoss.Triggered = stored.StopLoss.Triggered
+	trade.State.StopLoss.HighPrice = stored.StopLoss.HighPrice
+	trade.State.StopLoss.Price = stored.StopLoss.Price
+	trade.State.TrailingProfit.Activated = stored.TrailingProfit.Activated
+	trade.State.TrailingProfit.Price = stored.TrailingProfit.Price
+	trade.State.TrailingProfit.Triggered = stored.TrailingProfit.Triggered
+	trade.State.TrailingBuy.Activated = stored.TrailingBuy.Activated
+	trade.State.TrailingBuy.Price = stored.TrailingBuy.Price
+	trade.State.TrailingBuy.Triggered = stored.TrailingBuy.Triggered
+	if len(trade.State.SellSideFills) == 0 {
+		trade.State.ProfitPercent = stored.ProfitPercent
+	}
+
+	differences, err := Diff(stored, trade.State)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Result{
+		TradeID:     stored.TradeID,
+		Reports:     len(reports),
+		Stored:      stored,
+		Replayed:    trade.State,
+		Differences: differences,
+	}, nil
+}
+
+// The state of the trade before any actions or reports are applied. If the
+// trade has no creation entry, from before history was recorded, the exit
+// settings are taken from the stored state.
+func initialState(stored types.TradeState) types.TradeState {
+	state := types.TradeState{
+		Version:        stored.Version,
+		TradeID:        stored.TradeID,
+		Symbol:         stored.Symbol,
+		OpenTime:       stored.OpenTime,
+		Status:         types.TradeStatusNew,
+		Fee:            types.DEFAULT_FEE,
+		ClientOrderIDs: map[string]bool{},
+	}
+	for clientOrderId := range stored.ClientOrderIDs {
+		state.ClientOrderIDs[clientOrderId] = true
+	}
+
+	created := false
+	for _, entry := range stored.History {
+		if entry.Type == types.HistoryTypeCreated || entry.Type == types.HistoryTypeAdopted {
+			created = true
+			break
+		}
+	}
+	if !created {
+		state.StopLoss = stored.StopLoss
+		state.StopLoss.Orders = nil
+		state.LimitSell = stored.LimitSell
+		state.TrailingProfit = stored.TrailingProfit
+		for _, target := range stored.TakeProfit {
+			state.TakeProfit = append(state.TakeProfit, types.TakeProfitTarget{
+				QuantityPercent: target.QuantityPercent,
+				ProfitPercent:   target.ProfitPercent,
+			})
+		}
+	}
+
+	return state
+}
+
+// The times sell orders, and the buy orders of triggered entries and chased
+// buys, were recorded as placed, by client order ID.
+func placementTimes(actions []types.HistoryEntry) map[string]time.Time {
+	placed := map[string]time.Time{}
+	for _, entry := range actions {
+		if entry.Type != types.HistoryTypeSellOrder &&
+			entry.Type != types.HistoryTypeEntryTriggered &&
+			entry.Type != types.HistoryTypeBuyReplace {
+			continue
+		}
+		var fields struct {
+			ClientOrderID string `json:"clientOrderId"`
+		}
+		if err := decodeFields(entry, &fields); err != nil || fields.ClientOrderID == "" {
+			continue
+		}
+		placed[fields.ClientOrderID] = entry.Timestamp
+	}
+	return placed
+}
+
+// Merge the actions and reports by timestamp, keeping the order within each.
+// On equal timestamps the action comes first.
+func merge(actions []types.HistoryEntry, reports []types.HistoryEntry) []types.HistoryEntry {
+	entries := []types.HistoryEntry{}
+	for len(actions) > 0 || len(reports) > 0 {
+		if len(reports) == 0 ||
+			(len(actions) > 0 && !actions[0].Timestamp.After(reports[0].Timestamp)) {
+			entries = append(entries, actions[0])
+			actions = actions[1:]
+		} else {
+			entries = append(entries, reports[0])
+			reports = reports[1:]
+		}
+	}
+	return entries
+}
+
+func applyAction(trade *types.Trade, entry types.HistoryEntry, stepSize float64) error {
+	var fields struct {
+		// Creation.
+		LimitSellEnabled        bool                      `json:"limitSellEnabled"`
+		LimitSellType           types.LimitSellType       `json:"limitSellType"`
+		LimitSellPercent        float64                   `json:"limitSellPercent"`
+		LimitSellPrice          float64                   `json:"limitSellPrice"`
+		StopLossEnabled         bool                      `json:"stopLossEnabled"`
+		StopLossPercent         float64                   `json:"stopLossPercent"`
+		StopLossTrailing        bool                      `json:"stopLossTrailing"`
+		StopLossTicks           int64                     `json:"stopLossTicks"`
+		StopLossBreakEven       float64                   `json:"stopLossBreakEven"`
+		StopLossBreakEvenBuffer float64                   `json:"stopLossBreakEvenBuffer"`
+		StopLossOnExchange      bool                      `json:"stopLossOnExchange"`
+		TrailingProfitEnabled   bool                      `json:"trailingProfitEnabled"`
+		TrailingProfitPercent   float64                   `json:"trailingProfitPercent"`
+		TrailingProfitDeviation float64                   `json:"trailingProfitDeviation"`
+		TakeProfit              []types.TakeProfitSetting `json:"takeProfit"`
+		PriceSource             types.PriceSource         `json:"priceSource"`
+		OffsetTicks             int64                     `json:"offsetTicks"`
+		EntryCondition          types.EntryConditionType  `json:"entryCondition"`
+		EntryPrice              float64                   `json:"entryPrice"`
+		EntryHours              float64                   `json:"entryHours"`
+		TrailingBuyEnabled      bool                      `json:"trailingBuyEnabled"`
+		TrailingBuyDeviation    float64                   `json:"trailingBuyDeviation"`
+		BuyChaseEnabled         bool                      `json:"buyChaseEnabled"`
+		BuyChaseInterval        int64                     `json:"buyChaseInterval"`
+		BuyChaseTicks           int64                     `json:"buyChaseTicks"`
+		BuyChaseMaxPrice        float64                   `json:"buyChaseMaxPrice"`
+		BuyTimeout              int64                     `json:"buyTimeout"`
+		SellChaseEnabled        bool                      `json:"sellChaseEnabled"`
+		SellChaseInterval       int64                     `json:"sellChaseInterval"`
+		SellChaseTicks          int64                     `json:"sellChaseTicks"`
+		SellChaseMinProfit      float64                   `json:"sellChaseMinProfit"`
+		QuoteAmount             float64                   `json:"quoteAmount"`
+		BalancePercent          float64                   `json:"balancePercent"`
+
+		// Buy chasing.
+		NewPrice float64 `json:"newPrice"`
+
+		// Updates.
+		Enable        bool                `json:"enable"`
+		Percent       float64             `json:"percent"`
+		Deviation     float64             `json:"deviation"`
+		Price         float64             `json:"price"`
+		Type          types.LimitSellType `json:"type"`
+		SellOrderType string              `json:"sellOrderType"`
+		Success       bool                `json:"success"`
+		Armed         bool                `json:"armed"`
+
+		// Take profit and stop orders.
+		Targets       []types.TakeProfitSetting `json:"targets"`
+		Target        *int                      `json:"target"`
+		StopOrder     *int                      `json:"stopOrder"`
+		StopPrice     float64                   `json:"stopPrice"`
+		ClientOrderID string                    `json:"clientOrderId"`
+		Quantity      float64                   `json:"quantity"`
+
+		// OCO orders.
+		OrderList          string `json:"orderList"`
+		OrderListID        int64  `json:"orderListId"`
+		LimitClientOrderID string `json:"limitClientOrderId"`
+	}
+	if err := decodeFields(entry, &fields); err != nil {
+		return err
+	}
+
+	switch entry.Type {
+	case types.HistoryTypeAdopted:
+		var adoption types.Adoption
+		if err := decodeFields(entry, &adoption); err != nil {
+			return err
+		}
+		if err := trade.ApplyAdoption(adoption, stepSize); err != nil {
+			return err
+		}
+	case types.HistoryTypeCreated:
+		trade.State.OpenTime = entry.Timestamp
+		if fields.StopLossEnabled {
+			trade.SetStopLoss(true, fields.StopLossPercent)
+			trade.SetStopLossTrailing(fields.StopLossTrailing, fields.StopLossTicks)
+			trade.SetStopLossBreakEven(fields.StopLossBreakEven, fields.StopLossBreakEvenBuffer)
+			trade.SetStopLossOnExchange(fields.StopLossOnExchange)
+		}
+		if fields.TrailingProfitEnabled {
+			trade.SetTrailingProfit(true, fields.TrailingProfitPercent,
+				fields.TrailingProfitDeviation)
+		}
+		if fields.LimitSellEnabled {
+			switch fields.LimitSellType {
+			case types.LimitSellTypePercent:
+				trade.SetLimitSellByPercent(fields.LimitSellPercent)
+			case types.LimitSellTypePrice:
+				trade.SetLimitSellByPrice(fields.LimitSellPrice)
+			}
+		}
+		if len(fields.TakeProfit) > 0 {
+			if err := trade.SetTakeProfit(fields.TakeProfit); err != nil {
+				return err
+			}
+		}
+		trade.SetBuyChase(fields.BuyChaseEnabled, fields.BuyChaseInterval,
+			fields.BuyChaseTicks, fields.BuyChaseMaxPrice)
+		trade.State.BuyTimeout = fields.BuyTimeout
+		if fields.SellChaseEnabled {
+			trade.ApplySellChaseSettings(types.SellChaseSettings{
+				Enabled:   true,
+				Interval:  fields.SellChaseInterval,
+				Ticks:     fields.SellChaseTicks,
+				MinProfit: fields.SellChaseMinProfit,
+			})
+		}
+		if fields.EntryCondition != "" || fields.TrailingBuyEnabled {
+			entryCondition := types.NewEntryCondition(entry.Timestamp, fields.EntryCondition,
+				fields.EntryPrice, fields.EntryHours)
+			entryCondition.Quantity = fields.Quantity
+			entryCondition.PriceSource = fields.PriceSource
+			entryCondition.BuyPrice = fields.Price
+			entryCondition.OffsetTicks = fields.OffsetTicks
+			entryCondition.QuoteAmount = fields.QuoteAmount
+			entryCondition.BalancePercent = fields.BalancePercent
+			trade.Arm(*entryCondition)
+			trade.SetTrailingBuy(fields.TrailingBuyEnabled, fields.TrailingBuyDeviation)
+		}
+	case types.HistoryTypeTakeProfitUpdate:
+		if err := trade.SetTakeProfit(fields.Targets); err != nil {
+			return err
+		}
+	case types.HistoryTypeStopLossUpdate:
+		var settings types.StopLossSettings
+		if err := decodeFields(entry, &settings); err != nil {
+			return err
+		}
+		trade.ApplyStopLossSettings(settings)
+	case types.HistoryTypeSellChaseUpdate:
+		var settings types.SellChaseSettings
+		if err := decodeFields(entry, &settings); err != nil {
+			return err
+		}
+		trade.ApplySellChaseSettings(settings)
+	case types.HistoryTypeSellChase:
+		trade.State.SellChase.Count++
+	case types.HistoryTypeStopLossBreakEven:
+		trade.State.StopLoss.BreakEvenActivated = true
+	case types.HistoryTypeTrailingProfitUpdate:
+		trade.SetTrailingProfit(fields.Enable, fields.Percent, fields.Deviation)
+	case types.HistoryTypeLimitSellUpdate:
+		switch fields.Type {
+		case types.LimitSellTypePercent:
+			trade.SetLimitSellByPercent(fields.Percent)
+		case types.LimitSellTypePrice:
+			trade.SetLimitSellByPrice(fields.Price)
+		}
+	case types.HistoryTypeSellOrder:
+		switch fields.SellOrderType {
+		case "limitSellByPercent":
+			trade.SetLimitSellByPercent(fields.Percent)
+			trade.State.LimitSell.Price = fields.Price
+		case "limitSellByPrice":
+			trade.SetLimitSellByPrice(fields.Price)
+		case "takeProfit":
+			if fields.Target == nil || *fields.Target >= len(trade.State.TakeProfit) {
+				return fmt.Errorf("take profit target not found for %s history entry", entry.Type)
+			}
+			target := &trade.State.TakeProfit[*fields.Target]
+			target.ClientOrderID = fields.ClientOrderID
+			target.Quantity = fields.Quantity
+			target.Price = fields.Price
+			if !fields.Success {
+				target.Status = "REJECTED"
+			}
+		case "stopLoss":
+			order := types.StopOrder{
+				ClientOrderID: fields.ClientOrderID,
+				Quantity:      fields.Quantity,
+				StopPrice:     fields.StopPrice,
+				Price:         fields.Price,
+			}
+			if !fields.Success {
+				order.Status = "REJECTED"
+			}
+			trade.State.StopLoss.Orders = append(trade.State.StopLoss.Orders, order)
+			if fields.OrderList != "" && fields.Success {
+				trade.State.OrderList = &types.OrderList{
+					ListClientOrderID:  fields.OrderList,
+					OrderListID:        fields.OrderListID,
+					LimitClientOrderID: fields.LimitClientOrderID,
+					StopClientOrderID:  fields.ClientOrderID,
+				}
+			}
+		}
+	case types.HistoryTypeListStatus:
+		var listStatus binanceex.StreamListStatus
+		if err := decodeFields(entry, &listStatus); err != nil {
+			return err
+		}
+		trade.ApplyListStatus(listStatus.ListClientOrderID, listStatus.OrderListID,
+			listStatus.ListStatusType, listStatus.ListOrderStatus)
+	case types.HistoryTypeSellCanceled:
+		if fields.Target != nil {
+			if fields.Success && *fields.Target < len(trade.State.TakeProfit) {
+				trade.State.TakeProfit[*fields.Target].Status = binanceapi.OrderStatusCanceled
+			}
+		} else if fields.StopOrder != nil {
+			if fields.Success && *fields.StopOrder < len(trade.State.StopLoss.Orders) {
+				trade.State.StopLoss.Orders[*fields.StopOrder].Status = binanceapi.OrderStatusCanceled
+			}
+		} else if fields.Success {
+			trade.State.LimitSell.Enabled = false
+		}
+	case types.HistoryTypeEntryTriggered:
+		trade.State.Status = types.TradeStatusNew
+		if trade.State.Entry != nil {
+			trade.State.Entry.TriggerPrice = fields.Price
+			if fields.Quantity > 0 {
+				trade.State.Entry.Quantity = fields.Quantity
+			}
+		}
+	case types.HistoryTypeEntryExpired:
+		closeTime := entry.Timestamp
+		trade.State.Status = types.TradeStatusCanceled
+		trade.State.CloseTime = &closeTime
+	case types.HistoryTypeBuyCanceled:
+		if fields.Armed {
+			closeTime := entry.Timestamp
+			trade.State.Status = types.TradeStatusCanceled
+			trade.State.CloseTime = &closeTime
+		} else if !fields.Success {
+			trade.State.BuyChase.Replacing = false
+		}
+	case types.HistoryTypeBuyChase:
+		chaseTime := entry.Timestamp
+		trade.State.BuyChase.Replacing = true
+		trade.State.BuyChase.Count++
+		trade.State.BuyChase.Time = &chaseTime
+		trade.State.BuyChase.Price = fields.NewPrice
+	case types.HistoryTypeBuyReplace:
+		trade.State.BuyChase.Replacing = false
+		if !fields.Success {
+			trade.EndBuy()
+			if trade.State.Status == types.TradeStatusCanceled {
+				closeTime := entry.Timestamp
+				trade.State.CloseTime = &closeTime
+			}
+		}
+	case types.HistoryTypeAbandoned:
+		closeTime := entry.Timestamp
+		trade.State.Status = types.TradeStatusAbandoned
+		trade.State.CloseTime = &closeTime
+	case types.HistoryTypeFailed:
+		closeTime := entry.Timestamp
+		trade.State.Status = types.TradeStatusFailed
+		trade.State.CloseTime = &closeTime
+	}
+
+	return nil
+}
+
+// Decodes the fields of a history entry, which are a map when loaded from
+// the database, into v.
+func decodeFields(entry types.HistoryEntry, v interface{}) error {
+	if entry.Fields == nil {
+		return nil
+	}
+	buf, err := json.Marshal(entry.Fields)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(buf, v); err != nil {
+		return fmt.Errorf("failed to decode %s history entry: %v", entry.Type, err)
+	}
+	return nil
+}
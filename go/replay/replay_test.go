@@ -0,0 +1,854 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package replay
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/crankykernel/binanceapi-go"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/crankykernel/maker/go/binanceex"
+	"gitlab.com/crankykernel/maker/go/types"
+	"testing"
+	"time"
+)
+
+func rawReport(t *testing.T, eventTime int64, clientOrderId string, side string,
+	status string, orderId int64, quantity string, price string) []byte {
+	report := map[string]interface{}{
+		"e": "executionReport",
+		"E": eventTime,
+		"s": "ETHBTC",
+		"c": clientOrderId,
+		"S": side,
+		"o": "LIMIT",
+		"f": "GTC",
+		"q": quantity,
+		"p": price,
+		"P": "0",
+		"F": "0",
+		"C": "",
+		"X": status,
+		"i": orderId,
+		"l": "0",
+		"z": "0",
+		"L": "0",
+		"n": "0",
+		"N": "BNB",
+	}
+	if status == "FILLED" {
+		report["l"] = quantity
+		report["z"] = quantity
+		report["L"] = price
+		report["n"] = "0.0001"
+	}
+	buf, err := json.Marshal(report)
+	assert.Nil(t, err)
+	return buf
+}
+
+func TestReplay(t *testing.T) {
+	reports := [][]byte{
+		rawReport(t, 1000, "buy", "BUY", "NEW", 1, "1.0", "0.03"),
+		rawReport(t, 2000, "buy", "BUY", "FILLED", 1, "1.0", "0.03"),
+		// The sell fill arriving before the new.
+		rawReport(t, 4000, "sell", "SELL", "FILLED", 2, "1.0", "0.031"),
+		rawReport(t, 3000, "sell", "SELL", "NEW", 2, "1.0", "0.031"),
+	}
+
+	trade := types.NewTrade()
+	trade.State.TradeID = "trade"
+	trade.State.Symbol = "ETHBTC"
+	trade.AddClientOrderID("buy")
+	trade.AddClientOrderID("sell")
+	trade.AddHistory(types.HistoryEntry{
+		Timestamp: time.Unix(0, 0),
+		Type:      types.HistoryTypeCreated,
+		Fields: map[string]interface{}{
+			"stopLossEnabled": true,
+			"stopLossPercent": 2.0,
+		},
+	})
+	trade.SetStopLoss(true, 2)
+	for _, raw := range reports {
+		var report binanceapi.StreamExecutionReport
+		assert.Nil(t, json.Unmarshal(raw, &report))
+		trade.ApplyExecutionReport(report,
+			time.Unix(0, report.EventTimeMillis*int64(time.Millisecond)), 0)
+	}
+	assert.Equal(t, types.TradeStatusDone, trade.State.Status)
+
+	result, err := Replay(trade.State, reports, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, result.Reports)
+	assert.Empty(t, result.Differences)
+	assert.Equal(t, 5, len(result.Replayed.History))
+	assert.True(t, result.Replayed.StopLoss.Enabled)
+
+	// A stored trade that missed the sell fill.
+	stored := trade.State
+	stored.SellSideFills = nil
+	stored.Status = types.TradeStatusPendingSell
+	result, err = Replay(stored, reports, 0)
+	assert.Nil(t, err)
+	fields := map[string]bool{}
+	for _, difference := range result.Differences {
+		fields[difference.Field] = true
+	}
+	assert.True(t, fields["Status"])
+	assert.True(t, fields["SellSideFills[0].Price"])
+	assert.Equal(t, types.TradeStatusDone, result.Replayed.Status)
+
+	repaired := result.Repaired()
+	assert.Equal(t, len(stored.History)+1, len(repaired.History))
+	assert.Equal(t, types.HistoryTypeReplayRepair, repaired.History[len(repaired.History)-1].Type)
+}
+
+func TestDiffFloatTolerance(t *testing.T) {
+	a := types.TradeState{BuyCost: 0.1 + 0.2}
+	b := types.TradeState{BuyCost: 0.3}
+	differences, err := Diff(a, b)
+	assert.Nil(t, err)
+	assert.Empty(t, differences)
+
+	b.BuyCost = 0.31
+	differences, err = Diff(a, b)
+	assert.Nil(t, err)
+	assert.Len(t, differences, 1)
+	assert.Equal(t, "BuyCost", differences[0].Field)
+}
+
+// Replaces fields of a raw report, such as the last executed quantity of a
+// partial fill.
+func rawReportWith(t *testing.T, raw []byte, fields map[string]interface{}) []byte {
+	report := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal(raw, &report))
+	for key, value := range fields {
+		report[key] = value
+	}
+	buf, err := json.Marshal(report)
+	assert.Nil(t, err)
+	return buf
+}
+
+func TestReplayAdoption(t *testing.T) {
+	// Adopted with half of the order filled, the rest filling after.
+	trade := types.NewTrade()
+	trade.State.TradeID = "trade"
+	trade.State.Symbol = "ETHBTC"
+	trade.AddClientOrderID("web_1")
+	trade.AddHistory(types.HistoryEntry{
+		Timestamp: time.Unix(1, 0),
+		Type:      types.HistoryTypeAdopted,
+		Fields: types.Adoption{
+			Symbol:      "ETHBTC",
+			OrderID:     1,
+			OrderStatus: binanceapi.OrderStatusPartiallyFilled,
+			Quantity:    2,
+			Price:       0.03,
+			Fills: []types.OrderFill{
+				{Price: 0.03, Quantity: 1, CommissionAsset: "BNB",
+					CommissionAmount: 0.0001, OrderID: 1},
+			},
+			StopLossEnabled: true,
+			StopLossPercent: 5,
+		},
+	})
+	reports := [][]byte{
+		rawReportWith(t, rawReport(t, 2000, "web_1", "BUY", "FILLED", 1, "2.0", "0.03"),
+			map[string]interface{}{"l": "1.0"}),
+	}
+
+	result, err := Replay(trade.State, reports, 0.001)
+	assert.Nil(t, err)
+	replayed := result.Replayed
+	assert.Equal(t, types.TradeStatusWatching, replayed.Status)
+	assert.Equal(t, int64(1), replayed.BuyOrderId)
+	assert.Len(t, replayed.BuySideFills, 2)
+	assert.Equal(t, float64(2), replayed.BuyFillQuantity)
+	assert.Equal(t, float64(2), replayed.SellableQuantity)
+	assert.True(t, replayed.StopLoss.Enabled)
+	assert.Equal(t, float64(5), replayed.StopLoss.Percent)
+}
+
+func TestReplayTakeProfit(t *testing.T) {
+	trade := types.NewTrade()
+	trade.State.TradeID = "trade"
+	trade.State.Symbol = "ETHBTC"
+	for _, clientOrderId := range []string{"buy", "tp0", "tp1", "tp2"} {
+		trade.AddClientOrderID(clientOrderId)
+	}
+	trade.AddHistory(types.HistoryEntry{
+		Timestamp: time.Unix(0, 0),
+		Type:      types.HistoryTypeCreated,
+		Fields: map[string]interface{}{
+			"takeProfit": []types.TakeProfitSetting{
+				{QuantityPercent: 50, ProfitPercent: 2},
+			},
+		},
+	})
+	trade.AddHistory(types.HistoryEntry{
+		Timestamp: time.Unix(3, 0),
+		Type:      types.HistoryTypeTakeProfitUpdate,
+		Fields: map[string]interface{}{
+			"targets": []types.TakeProfitSetting{
+				{QuantityPercent: 40, ProfitPercent: 2},
+				{QuantityPercent: 40, ProfitPercent: 4},
+				{QuantityPercent: 20, ProfitPercent: 6},
+			},
+		},
+	})
+	for i, target := range []struct {
+		quantity float64
+		price    float64
+		success  bool
+	}{
+		{0.8, 0.0306, true},
+		{0.8, 0.0312, true},
+		// Rejected by the exchange.
+		{0.4, 0.0318, false},
+	} {
+		trade.AddHistory(types.HistoryEntry{
+			Timestamp: time.Unix(4, 0),
+			Type:      types.HistoryTypeSellOrder,
+			Fields: map[string]interface{}{
+				"sellOrderType": "takeProfit",
+				"target":        i,
+				"price":         target.price,
+				"quantity":      target.quantity,
+				"clientOrderId": fmt.Sprintf("tp%d", i),
+				"success":       target.success,
+			},
+		})
+	}
+	trade.AddHistory(types.HistoryEntry{
+		Timestamp: time.Unix(6, 0),
+		Type:      types.HistoryTypeSellCanceled,
+		Fields: map[string]interface{}{
+			"sellOrderId": 3,
+			"target":      1,
+			"success":     true,
+		},
+	})
+	reports := [][]byte{
+		rawReport(t, 1000, "buy", "BUY", "NEW", 1, "2.0", "0.03"),
+		rawReport(t, 2000, "buy", "BUY", "FILLED", 1, "2.0", "0.03"),
+		rawReport(t, 4000, "tp0", "SELL", "NEW", 2, "0.8", "0.0306"),
+		rawReport(t, 4000, "tp1", "SELL", "NEW", 3, "0.8", "0.0312"),
+		rawReport(t, 5000, "tp0", "SELL", "FILLED", 2, "0.8", "0.0306"),
+		rawReport(t, 6000, "tp1", "SELL", "CANCELED", 3, "0.8", "0.0312"),
+	}
+
+	result, err := Replay(trade.State, reports, 0.001)
+	assert.Nil(t, err)
+	targets := result.Replayed.TakeProfit
+	assert.Len(t, targets, 3)
+	assert.Equal(t, "tp0", targets[0].ClientOrderID)
+	assert.Equal(t, int64(2), targets[0].OrderID)
+	assert.Equal(t, 0.0306, targets[0].Price)
+	assert.Equal(t, binanceapi.OrderStatusFilled, targets[0].Status)
+	assert.Equal(t, 0.8, targets[0].FillQuantity)
+	assert.Equal(t, binanceapi.OrderStatusCanceled, targets[1].Status)
+	assert.Equal(t, binanceapi.OrderStatus("REJECTED"), targets[2].Status)
+	assert.Equal(t, 0.8, result.Replayed.SellFillQuantity)
+	assert.Equal(t, types.TradeStatusWatching, result.Replayed.Status)
+}
+
+func TestReplayTrailingStopLoss(t *testing.T) {
+	reports := [][]byte{
+		rawReport(t, 1000, "buy", "BUY", "NEW", 1, "2.0", "0.03"),
+		rawReport(t, 2000, "buy", "BUY", "FILLED", 1, "2.0", "0.03"),
+	}
+
+	trade := types.NewTrade()
+	trade.State.TradeID = "trade"
+	trade.State.Symbol = "ETHBTC"
+	trade.AddClientOrderID("buy")
+	trade.AddHistory(types.HistoryEntry{
+		Timestamp: time.Unix(0, 0),
+		Type:      types.HistoryTypeCreated,
+		Fields: map[string]interface{}{
+			"stopLossEnabled":  true,
+			"stopLossPercent":  5.0,
+			"stopLossTrailing": true,
+		},
+	})
+
+	// Trailing from the creation settings.
+	result, err := Replay(trade.State, reports, 0.001)
+	assert.Nil(t, err)
+	assert.True(t, result.Replayed.StopLoss.Trailing)
+	assert.Equal(t, int64(0), result.Replayed.StopLoss.Ticks)
+
+	// Then trailing by ticks once updated.
+	trade.AddHistory(types.HistoryEntry{
+		Timestamp: time.Unix(3, 0),
+		Type:      types.HistoryTypeStopLossUpdate,
+		Fields: map[string]interface{}{
+			"enable":   true,
+			"percent":  5.0,
+			"trailing": true,
+			"ticks":    100,
+		},
+	})
+	result, err = Replay(trade.State, reports, 0.001)
+	assert.Nil(t, err)
+	assert.True(t, result.Replayed.StopLoss.Enabled)
+	assert.True(t, result.Replayed.StopLoss.Trailing)
+	assert.Equal(t, int64(100), result.Replayed.StopLoss.Ticks)
+	assert.Equal(t, types.TradeStatusWatching, result.Replayed.Status)
+}
+
+func TestReplayBreakEven(t *testing.T) {
+	trade := types.NewTrade()
+	trade.State.TradeID = "trade"
+	trade.State.Symbol = "ETHBTC"
+	trade.AddClientOrderID("buy")
+	trade.AddHistory(types.HistoryEntry{
+		Timestamp: time.Unix(0, 0),
+		Type:      types.HistoryTypeCreated,
+		Fields: map[string]interface{}{
+			"stopLossEnabled":         true,
+			"stopLossPercent":         5.0,
+			"stopLossBreakEven":       10.0,
+			"stopLossBreakEvenBuffer": 1.0,
+		},
+	})
+	trade.AddHistory(types.HistoryEntry{
+		Timestamp: time.Unix(3, 0),
+		Type:      types.HistoryTypeStopLossBreakEven,
+		Fields: map[string]interface{}{
+			"profitPercent": 10.0,
+			"price":         0.030603,
+		},
+	})
+
+	result, err := Replay(trade.State, [][]byte{
+		rawReport(t, 1000, "buy", "BUY", "NEW", 1, "2.0", "0.03"),
+		rawReport(t, 2000, "buy", "BUY", "FILLED", 1, "2.0", "0.03"),
+	}, 0.001)
+	assert.Nil(t, err)
+	assert.Equal(t, float64(10), result.Replayed.StopLoss.BreakEvenPercent)
+	assert.Equal(t, float64(1), result.Replayed.StopLoss.BreakEvenBuffer)
+	assert.True(t, result.Replayed.StopLoss.BreakEvenActivated)
+}
+
+func TestReplayStopOrders(t *testing.T) {
+	trade := types.NewTrade()
+	trade.State.TradeID = "trade"
+	trade.State.Symbol = "ETHBTC"
+	for _, clientOrderId := range []string{"buy", "stop0", "stop1", "stop2"} {
+		trade.AddClientOrderID(clientOrderId)
+	}
+	trade.AddHistory(types.HistoryEntry{
+		Timestamp: time.Unix(0, 0),
+		Type:      types.HistoryTypeCreated,
+		Fields: map[string]interface{}{
+			"stopLossEnabled":    true,
+			"stopLossPercent":    5.0,
+			"stopLossOnExchange": true,
+		},
+	})
+	stopOrder := func(seconds int64, clientOrderId string, stopPrice float64, success bool) {
+		trade.AddHistory(types.HistoryEntry{
+			Timestamp: time.Unix(seconds, 0),
+			Type:      types.HistoryTypeSellOrder,
+			Fields: map[string]interface{}{
+				"sellOrderType": "stopLoss",
+				"stopPrice":     stopPrice,
+				"price":         stopPrice - 0.0003,
+				"quantity":      2.0,
+				"clientOrderId": clientOrderId,
+				"success":       success,
+			},
+		})
+	}
+
+	// The first stop order is replaced by a higher one, which is rejected
+	// once before being placed.
+	stopOrder(3, "stop0", 0.0285, true)
+	trade.AddHistory(types.HistoryEntry{
+		Timestamp: time.Unix(4, 0),
+		Type:      types.HistoryTypeSellCanceled,
+		Fields: map[string]interface{}{
+			"sellOrderId": 2,
+			"stopOrder":   0,
+			"success":     true,
+		},
+	})
+	stopOrder(4, "stop1", 0.0288, false)
+	stopOrder(5, "stop2", 0.0288, true)
+
+	result, err := Replay(trade.State, [][]byte{
+		rawReport(t, 1000, "buy", "BUY", "NEW", 1, "2.0", "0.03"),
+		rawReport(t, 2000, "buy", "BUY", "FILLED", 1, "2.0", "0.03"),
+		rawReport(t, 3000, "stop0", "SELL", "NEW", 2, "2.0", "0.0282"),
+		rawReport(t, 4000, "stop0", "SELL", "CANCELED", 2, "2.0", "0.0282"),
+		rawReport(t, 5000, "stop2", "SELL", "NEW", 3, "2.0", "0.0285"),
+		rawReport(t, 6000, "stop2", "SELL", "FILLED", 3, "2.0", "0.0285"),
+	}, 0.001)
+	assert.Nil(t, err)
+	orders := result.Replayed.StopLoss.Orders
+	assert.Len(t, orders, 3)
+	assert.Equal(t, binanceapi.OrderStatusCanceled, orders[0].Status)
+	assert.Equal(t, int64(2), orders[0].OrderID)
+	assert.Equal(t, binanceapi.OrderStatus("REJECTED"), orders[1].Status)
+	assert.Equal(t, "stop2", orders[2].ClientOrderID)
+	assert.Equal(t, 0.0288, orders[2].StopPrice)
+	assert.Equal(t, binanceapi.OrderStatusFilled, orders[2].Status)
+	assert.Equal(t, float64(2), result.Replayed.SellFillQuantity)
+	assert.Equal(t, types.TradeStatusDone, result.Replayed.Status)
+}
+
+func TestReplayOrderList(t *testing.T) {
+	trade := types.NewTrade()
+	trade.State.TradeID = "trade"
+	trade.State.Symbol = "ETHBTC"
+	for _, clientOrderId := range []string{"buy", "limit0", "stop0"} {
+		trade.AddClientOrderID(clientOrderId)
+	}
+	trade.AddHistory(types.HistoryEntry{
+		Timestamp: time.Unix(0, 0),
+		Type:      types.HistoryTypeCreated,
+		Fields: map[string]interface{}{
+			"limitSellEnabled":   true,
+			"limitSellType":      types.LimitSellTypePercent,
+			"limitSellPercent":   10.0,
+			"stopLossEnabled":    true,
+			"stopLossPercent":    5.0,
+			"stopLossOnExchange": true,
+		},
+	})
+	trade.AddHistory(types.HistoryEntry{
+		Timestamp: time.Unix(3, 0),
+		Type:      types.HistoryTypeSellOrder,
+		Fields: map[string]interface{}{
+			"sellOrderType":      "stopLoss",
+			"stopPrice":          0.0285,
+			"price":              0.0282,
+			"quantity":           2.0,
+			"clientOrderId":      "stop0",
+			"orderList":          "list0",
+			"orderListId":        7,
+			"limitClientOrderId": "limit0",
+			"success":            true,
+		},
+	})
+	for _, status := range []binanceex.StreamListStatus{
+		{ListStatusType: "EXEC_STARTED", ListOrderStatus: "EXECUTING", EventTimeMillis: 3000},
+		{ListStatusType: "ALL_DONE", ListOrderStatus: "ALL_DONE", EventTimeMillis: 4000},
+	} {
+		status.EventType = "listStatus"
+		status.Symbol = "ETHBTC"
+		status.OrderListID = 7
+		status.ContingencyType = "OCO"
+		status.ListClientOrderID = "list0"
+		trade.AddHistory(types.HistoryEntry{
+			Timestamp: time.Unix(0, status.EventTimeMillis*int64(time.Millisecond)),
+			Type:      types.HistoryTypeListStatus,
+			Fields:    status,
+		})
+	}
+
+	// The stop fills and the limit maker expires.
+	result, err := Replay(trade.State, [][]byte{
+		rawReport(t, 1000, "buy", "BUY", "NEW", 1, "2.0", "0.03"),
+		rawReport(t, 2000, "buy", "BUY", "FILLED", 1, "2.0", "0.03"),
+		rawReportWith(t, rawReport(t, 3000, "limit0", "SELL", "NEW", 2, "2.0", "0.033"),
+			map[string]interface{}{"o": "LIMIT_MAKER"}),
+		rawReport(t, 3000, "stop0", "SELL", "NEW", 3, "2.0", "0.0282"),
+		rawReport(t, 4000, "stop0", "SELL", "FILLED", 3, "2.0", "0.0282"),
+		rawReport(t, 4000, "limit0", "SELL", "EXPIRED", 2, "2.0", "0.033"),
+	}, 0.001)
+	assert.Nil(t, err)
+	replayed := result.Replayed
+	assert.NotNil(t, replayed.OrderList)
+	assert.Equal(t, "list0", replayed.OrderList.ListClientOrderID)
+	assert.Equal(t, int64(7), replayed.OrderList.OrderListID)
+	assert.Equal(t, "limit0", replayed.OrderList.LimitClientOrderID)
+	assert.Equal(t, "stop0", replayed.OrderList.StopClientOrderID)
+	assert.Equal(t, "ALL_DONE", replayed.OrderList.ListOrderStatus)
+	assert.Equal(t, "LIMIT_MAKER", string(replayed.SellOrder.Type))
+	assert.Equal(t, binanceapi.OrderStatus("EXPIRED"), replayed.SellOrder.Status)
+	assert.Equal(t, binanceapi.OrderStatusFilled, replayed.StopLoss.Orders[0].Status)
+	assert.Equal(t, float64(2), replayed.SellFillQuantity)
+	assert.Equal(t, types.TradeStatusDone, replayed.Status)
+}
+
+func TestReplayEntry(t *testing.T) {
+	newArmedTrade := func(clientOrderIds ...string) *types.Trade {
+		trade := types.NewTrade()
+		trade.State.TradeID = "trade"
+		trade.State.Symbol = "ETHBTC"
+		for _, clientOrderId := range clientOrderIds {
+			trade.AddClientOrderID(clientOrderId)
+		}
+		trade.AddHistory(types.HistoryEntry{
+			Timestamp: time.Unix(0, 0),
+			Type:      types.HistoryTypeCreated,
+			Fields: map[string]interface{}{
+				"quantity":       2.0,
+				"priceSource":    types.PriceSourceLast,
+				"entryCondition": types.EntryConditionPriceAbove,
+				"entryPrice":     0.031,
+				"entryHours":     1.0,
+			},
+		})
+		return trade
+	}
+
+	t.Run("triggered", func(t *testing.T) {
+		trade := newArmedTrade("buy")
+		trade.AddHistory(types.HistoryEntry{
+			Timestamp: time.Unix(3, 0),
+			Type:      types.HistoryTypeEntryTriggered,
+			Fields: map[string]interface{}{
+				"price":         0.0311,
+				"buyPrice":      0.0311,
+				"quantity":      2.0,
+				"clientOrderId": "buy",
+			},
+		})
+
+		// The report of the buy is timestamped before the trigger was
+		// recorded.
+		result, err := Replay(trade.State, [][]byte{
+			rawReport(t, 2900, "buy", "BUY", "NEW", 1, "2.0", "0.0311"),
+			rawReport(t, 4000, "buy", "BUY", "FILLED", 1, "2.0", "0.0311"),
+		}, 0.001)
+		assert.Nil(t, err)
+		replayed := result.Replayed
+		assert.Equal(t, types.TradeStatusWatching, replayed.Status)
+		assert.Equal(t, types.EntryConditionPriceAbove, replayed.Entry.Type)
+		assert.Equal(t, 0.031, replayed.Entry.Price)
+		assert.Equal(t, time.Unix(3600, 0), *replayed.Entry.Expires)
+		assert.Equal(t, 0.0311, replayed.Entry.TriggerPrice)
+		assert.Equal(t, float64(2), replayed.BuyFillQuantity)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		trade := newArmedTrade()
+		trade.AddHistory(types.HistoryEntry{
+			Timestamp: time.Unix(3600, 0),
+			Type:      types.HistoryTypeEntryExpired,
+		})
+		result, err := Replay(trade.State, nil, 0.001)
+		assert.Nil(t, err)
+		assert.Equal(t, types.TradeStatusCanceled, result.Replayed.Status)
+		assert.Equal(t, time.Unix(3600, 0), *result.Replayed.CloseTime)
+	})
+
+	t.Run("canceled while armed", func(t *testing.T) {
+		trade := newArmedTrade()
+		trade.AddHistory(types.HistoryEntry{
+			Timestamp: time.Unix(5, 0),
+			Type:      types.HistoryTypeBuyCanceled,
+			Fields: map[string]interface{}{
+				"success": true,
+				"armed":   true,
+			},
+		})
+		result, err := Replay(trade.State, nil, 0.001)
+		assert.Nil(t, err)
+		assert.Equal(t, types.TradeStatusCanceled, result.Replayed.Status)
+		assert.Equal(t, time.Unix(5, 0), *result.Replayed.CloseTime)
+	})
+}
+
+func TestReplayTrailingBuy(t *testing.T) {
+	trade := types.NewTrade()
+	trade.State.TradeID = "trade"
+	trade.State.Symbol = "ETHBTC"
+	trade.AddClientOrderID("buy")
+	trade.AddHistory(types.HistoryEntry{
+		Timestamp: time.Unix(0, 0),
+		Type:      types.HistoryTypeCreated,
+		Fields: map[string]interface{}{
+			"quantity":             2.0,
+			"priceSource":          types.PriceSourceLast,
+			"trailingBuyEnabled":   true,
+			"trailingBuyDeviation": 5.0,
+		},
+	})
+
+	// Bought on the rebound from a low of 0.03.
+	trade.AddHistory(types.HistoryEntry{
+		Timestamp: time.Unix(3, 0),
+		Type:      types.HistoryTypeEntryTriggered,
+		Fields: map[string]interface{}{
+			"price":         0.0315,
+			"buyPrice":      0.0315,
+			"quantity":      2.0,
+			"clientOrderId": "buy",
+			"lowPrice":      0.03,
+		},
+	})
+
+	result, err := Replay(trade.State, [][]byte{
+		rawReport(t, 3000, "buy", "BUY", "NEW", 1, "2.0", "0.0315"),
+		rawReport(t, 4000, "buy", "BUY", "FILLED", 1, "2.0", "0.0315"),
+	}, 0.001)
+	assert.Nil(t, err)
+	replayed := result.Replayed
+	assert.True(t, replayed.TrailingBuy.Enabled)
+	assert.Equal(t, float64(5), replayed.TrailingBuy.Deviation)
+	assert.Equal(t, types.EntryConditionNone, replayed.Entry.Type)
+	assert.Equal(t, 0.0315, replayed.Entry.TriggerPrice)
+	assert.Equal(t, types.TradeStatusWatching, replayed.Status)
+}
+
+func TestReplayBuyChase(t *testing.T) {
+	trade := types.NewTrade()
+	trade.State.TradeID = "trade"
+	trade.State.Symbol = "ETHBTC"
+	trade.AddClientOrderID("buy0")
+	trade.AddClientOrderID("buy1")
+	trade.AddHistory(types.HistoryEntry{
+		Timestamp: time.Unix(0, 0),
+		Type:      types.HistoryTypeCreated,
+		Fields: map[string]interface{}{
+			"buyChaseEnabled":  true,
+			"buyChaseTicks":    1,
+			"buyChaseMaxPrice": 0.0302,
+		},
+	})
+
+	// Each chase cancels the buy and replaces it with what is left to buy.
+	// The replacement of the second chase fails, the trade goes on with
+	// what was filled.
+	for _, chase := range []struct {
+		seconds       int64
+		price         float64
+		newPrice      float64
+		clientOrderId string
+		quantity      float64
+		success       bool
+	}{
+		{3, 0.03, 0.0301, "buy1", 1.5, true},
+		{5, 0.0301, 0.0302, "buy2", 1.0, false},
+	} {
+		timestamp := time.Unix(chase.seconds, 0)
+		trade.AddHistory(types.HistoryEntry{
+			Timestamp: timestamp,
+			Type:      types.HistoryTypeBuyChase,
+			Fields: map[string]interface{}{
+				"price":    chase.price,
+				"newPrice": chase.newPrice,
+				"bestBid":  chase.newPrice,
+			},
+		})
+		trade.AddHistory(types.HistoryEntry{
+			Timestamp: timestamp,
+			Type:      types.HistoryTypeBuyCanceled,
+			Fields:    map[string]interface{}{"success": true},
+		})
+		trade.AddHistory(types.HistoryEntry{
+			Timestamp: timestamp,
+			Type:      types.HistoryTypeBuyReplace,
+			Fields: map[string]interface{}{
+				"clientOrderId": chase.clientOrderId,
+				"price":         chase.newPrice,
+				"quantity":      chase.quantity,
+				"success":       chase.success,
+			},
+		})
+	}
+
+	halfFilled := func(price string) map[string]interface{} {
+		return map[string]interface{}{"l": "0.5", "z": "0.5", "L": price, "n": "0.0001"}
+	}
+	result, err := Replay(trade.State, [][]byte{
+		rawReport(t, 1000, "buy0", "BUY", "NEW", 1, "2.0", "0.03"),
+		rawReportWith(t, rawReport(t, 2000, "buy0", "BUY", "PARTIALLY_FILLED", 1, "2.0", "0.03"),
+			halfFilled("0.03")),
+		rawReport(t, 3000, "buy0", "BUY", "CANCELED", 1, "2.0", "0.03"),
+		rawReport(t, 3000, "buy1", "BUY", "NEW", 2, "1.5", "0.0301"),
+		rawReportWith(t, rawReport(t, 4000, "buy1", "BUY", "PARTIALLY_FILLED", 2, "1.5", "0.0301"),
+			halfFilled("0.0301")),
+		rawReport(t, 5000, "buy1", "BUY", "CANCELED", 2, "1.5", "0.0301"),
+	}, 0.001)
+	assert.Nil(t, err)
+	replayed := result.Replayed
+	assert.True(t, replayed.BuyChase.Enabled)
+	assert.Equal(t, 2, replayed.BuyChase.Count)
+	assert.Equal(t, 0.0302, replayed.BuyChase.Price)
+	assert.Equal(t, time.Unix(5, 0), *replayed.BuyChase.Time)
+	assert.False(t, replayed.BuyChase.Replacing)
+	assert.Equal(t, int64(2), replayed.BuyOrderId)
+	assert.Len(t, replayed.BuySideFills, 2)
+	assert.Equal(t, float64(1), replayed.BuyFillQuantity)
+	assert.Equal(t, types.TradeStatusWatching, replayed.Status)
+}
+
+func TestReplaySellChase(t *testing.T) {
+	trade := types.NewTrade()
+	trade.State.TradeID = "trade"
+	trade.State.Symbol = "ETHBTC"
+	for _, clientOrderId := range []string{"buy", "sell0", "sell1"} {
+		trade.AddClientOrderID(clientOrderId)
+	}
+	for _, entry := range []types.HistoryEntry{
+		{
+			Timestamp: time.Unix(0, 0),
+			Type:      types.HistoryTypeCreated,
+			Fields: map[string]interface{}{
+				"limitSellEnabled":   true,
+				"limitSellType":      types.LimitSellTypePercent,
+				"limitSellPercent":   10.0,
+				"sellChaseEnabled":   true,
+				"sellChaseInterval":  60,
+				"sellChaseTicks":     1,
+				"sellChaseMinProfit": 2.0,
+			},
+		},
+		{
+			Timestamp: time.Unix(3, 0),
+			Type:      types.HistoryTypeSellOrder,
+			Fields: map[string]interface{}{
+				"sellOrderType": "limitSellByPercent",
+				"percent":       10.0,
+				"price":         0.033,
+				"quantity":      2.0,
+				"clientOrderId": "sell0",
+			},
+		},
+		{
+			Timestamp: time.Unix(4, 0),
+			Type:      types.HistoryTypeSellChaseUpdate,
+			Fields: types.SellChaseSettings{
+				Enabled:   true,
+				Interval:  60,
+				Ticks:     2,
+				MinProfit: 2,
+			},
+		},
+		// Chased down to the best ask, the limit sell is now by price.
+		{
+			Timestamp: time.Unix(5, 0),
+			Type:      types.HistoryTypeSellChase,
+			Fields: map[string]interface{}{
+				"price":    0.033,
+				"newPrice": 0.032,
+				"bestAsk":  0.032,
+				"floor":    0.0306,
+			},
+		},
+		{
+			Timestamp: time.Unix(5, 0),
+			Type:      types.HistoryTypeSellCanceled,
+			Fields: map[string]interface{}{
+				"sellOrderId": 2,
+				"success":     true,
+			},
+		},
+		{
+			Timestamp: time.Unix(5, 0),
+			Type:      types.HistoryTypeSellOrder,
+			Fields: map[string]interface{}{
+				"sellOrderType": "limitSellByPrice",
+				"price":         0.032,
+				"quantity":      2.0,
+				"clientOrderId": "sell1",
+			},
+		},
+	} {
+		trade.AddHistory(entry)
+	}
+
+	result, err := Replay(trade.State, [][]byte{
+		rawReport(t, 1000, "buy", "BUY", "NEW", 1, "2.0", "0.03"),
+		rawReport(t, 2000, "buy", "BUY", "FILLED", 1, "2.0", "0.03"),
+		rawReport(t, 3000, "sell0", "SELL", "NEW", 2, "2.0", "0.033"),
+		rawReport(t, 5000, "sell0", "SELL", "CANCELED", 2, "2.0", "0.033"),
+		rawReport(t, 5000, "sell1", "SELL", "NEW", 3, "2.0", "0.032"),
+		rawReport(t, 6000, "sell1", "SELL", "FILLED", 3, "2.0", "0.032"),
+	}, 0.001)
+	assert.Nil(t, err)
+	replayed := result.Replayed
+	assert.True(t, replayed.SellChase.Enabled)
+	assert.Equal(t, int64(2), replayed.SellChase.Ticks)
+	assert.Equal(t, 1, replayed.SellChase.Count)
+	assert.Equal(t, types.LimitSellTypePrice, replayed.LimitSell.Type)
+	assert.Equal(t, 0.032, replayed.LimitSell.Price)
+	assert.Equal(t, int64(3), replayed.SellOrderId)
+	assert.Equal(t, float64(2), replayed.SellFillQuantity)
+	assert.Equal(t, types.TradeStatusDone, replayed.Status)
+}
+
+func TestReplayQuoteAmountEntry(t *testing.T) {
+	// The quantity is only worked out from the quote amount once the entry
+	// condition is met.
+	trade := types.NewTrade()
+	trade.State.TradeID = "trade"
+	trade.State.Symbol = "ETHBTC"
+	trade.AddClientOrderID("buy")
+	trade.AddHistory(types.HistoryEntry{
+		Timestamp: time.Unix(0, 0),
+		Type:      types.HistoryTypeCreated,
+		Fields: map[string]interface{}{
+			"priceSource":    types.PriceSourceLast,
+			"entryCondition": types.EntryConditionPriceBelow,
+			"entryPrice":     0.03,
+			"quoteAmount":    0.06,
+		},
+	})
+	result, err := Replay(trade.State, nil, 0.001)
+	assert.Nil(t, err)
+	assert.Equal(t, 0.06, result.Replayed.Entry.QuoteAmount)
+	assert.Equal(t, float64(0), result.Replayed.Entry.Quantity)
+	assert.Equal(t, types.TradeStatusArmed, result.Replayed.Status)
+
+	trade.AddHistory(types.HistoryEntry{
+		Timestamp: time.Unix(3, 0),
+		Type:      types.HistoryTypeEntryTriggered,
+		Fields: map[string]interface{}{
+			"price":         0.03,
+			"buyPrice":      0.03,
+			"quantity":      2.0,
+			"clientOrderId": "buy",
+		},
+	})
+	result, err = Replay(trade.State, [][]byte{
+		rawReport(t, 3000, "buy", "BUY", "NEW", 1, "2.0", "0.03"),
+		rawReport(t, 4000, "buy", "BUY", "FILLED", 1, "2.0", "0.03"),
+	}, 0.001)
+	assert.Nil(t, err)
+	assert.Equal(t, 0.06, result.Replayed.Entry.QuoteAmount)
+	assert.Equal(t, float64(2), result.Replayed.Entry.Quantity)
+	assert.Equal(t, float64(2), result.Replayed.BuyFillQuantity)
+	assert.Equal(t, types.TradeStatusWatching, result.Replayed.Status)
+}
+
+func TestReplayBalancePercentEntry(t *testing.T) {
+	trade := types.NewTrade()
+	trade.State.TradeID = "trade"
+	trade.State.Symbol = "ETHBTC"
+	trade.AddHistory(types.HistoryEntry{
+		Timestamp: time.Unix(0, 0),
+		Type:      types.HistoryTypeCreated,
+		Fields: map[string]interface{}{
+			"priceSource":    types.PriceSourceLast,
+			"entryCondition": types.EntryConditionPriceBelow,
+			"entryPrice":     0.03,
+			"balancePercent": 50.0,
+		},
+	})
+	result, err := Replay(trade.State, nil, 0.001)
+	assert.Nil(t, err)
+	assert.Equal(t, float64(50), result.Replayed.Entry.BalancePercent)
+	assert.Equal(t, float64(0), result.Replayed.Entry.Quantity)
+	assert.Equal(t, types.TradeStatusArmed, result.Replayed.Status)
+}
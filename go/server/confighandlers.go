@@ -17,8 +17,9 @@ package server
 
 import (
 	"encoding/json"
-	"github.com/crankykernel/binanceapi-go"
+	"gitlab.com/crankykernel/maker/go/binanceex"
 	"gitlab.com/crankykernel/maker/go/config"
+	"gitlab.com/crankykernel/maker/go/credentials"
 	"gitlab.com/crankykernel/maker/go/log"
 	"net/http"
 )
@@ -43,26 +44,53 @@ func SavePreferencesHandler(w http.ResponseWriter, r *http.Request) {
 	config.WriteConfig(ServerFlags.ConfigFilename)
 }
 
-func SaveBinanceConfigHandler(w http.ResponseWriter, r *http.Request) {
-	type binanceApiConfiguration struct {
-		ApiKey    string `json:"key"`
-		ApiSecret string `json:"secret"`
-	}
+// SaveBinanceConfigHandler saves the Binance API credentials to the
+// credential store. They are never written to the configuration file, so
+// without an unlocked store the request is refused.
+func SaveBinanceConfigHandler(store *credentials.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !store.IsUnlocked() {
+			log.WithField("filename", store.Filename()).
+				Warnf("Refusing to save Binance API credentials without an unlocked credential store.")
+			WriteJsonError(w, http.StatusConflict,
+				"no credential store, run \"maker credentials set\" to save the Binance API credentials")
+			return
+		}
 
-	var request binanceApiConfiguration
-	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&request); err != nil {
-		log.WithFields(log.Fields{
-			"path":   r.URL.Path,
-			"method": r.Method,
-		}).WithError(err).Errorf("Failed to decode Binance configuration.")
-		WriteJsonError(w, http.StatusBadRequest, err.Error())
-		return
-	}
+		type binanceApiConfiguration struct {
+			ApiKey    string `json:"key"`
+			ApiSecret string `json:"secret"`
+		}
 
-	config.Set("binance.api.key", request.ApiKey)
-	config.Set("binance.api.secret", request.ApiSecret)
-	config.WriteConfig(ServerFlags.ConfigFilename)
+		var request binanceApiConfiguration
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&request); err != nil {
+			log.WithFields(log.Fields{
+				"path":   r.URL.Path,
+				"method": r.Method,
+			}).WithError(err).Errorf("Failed to decode Binance configuration.")
+			WriteJsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		// The client never sees the stored secret, an empty secret means keep
+		// the existing one.
+		if request.ApiSecret == "" {
+			request.ApiSecret = config.GetString("binance.api.secret")
+		}
+
+		err := store.Save(&credentials.Credentials{
+			BinanceApiKey:    request.ApiKey,
+			BinanceApiSecret: request.ApiSecret,
+		})
+		if err != nil {
+			log.WithError(err).Errorf("Failed to save credential store.")
+			WriteJsonError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		config.SetSecret("binance.api.key", request.ApiKey)
+		config.SetSecret("binance.api.secret", request.ApiSecret)
+	}
 }
 
 func BinanceTestHandler(w http.ResponseWriter, r *http.Request) {
@@ -77,14 +105,15 @@ func BinanceTestHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	binanceApiSecret := r.FormValue("binance.api.secret")
+	if binanceApiSecret == "" {
+		binanceApiSecret = config.GetString("binance.api.secret")
+	}
 	if binanceApiSecret == "" {
 		WriteJsonError(w, http.StatusBadRequest, "missing binance.api.secret")
 		return
 	}
 
-	client := binanceapi.NewRestClient().WithAuth(binanceApiKey, binanceApiSecret)
-	_, err := client.GetAccount()
-	if err != nil {
+	if err := binanceex.CheckCredentials(binanceApiKey, binanceApiSecret); err != nil {
 		log.WithError(err).Warn("Binance account authentication test failed.")
 		WriteJsonResponse(w, http.StatusOK, map[string]interface{}{
 			"ok":    false,
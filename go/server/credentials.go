@@ -0,0 +1,47 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"gitlab.com/crankykernel/maker/go/config"
+	"gitlab.com/crankykernel/maker/go/credentials"
+	"gitlab.com/crankykernel/maker/go/log"
+)
+
+// unlockCredentialStore loads the Binance credentials from the encrypted
+// credential store, if one exists, into memory. Maker will not start if the
+// store can't be unlocked.
+func unlockCredentialStore(store *credentials.Store) {
+	if !store.Exists() {
+		if config.GetString("binance.api.secret") != "" {
+			log.WithField("filename", ServerFlags.ConfigFilename).
+				Warnf("Binance API credentials are stored unencrypted, run \"maker credentials import\" to encrypt them")
+		}
+		return
+	}
+
+	passphrase, err := credentials.ReadPassphrase(ServerFlags.CredentialsKeyFile)
+	if err != nil {
+		log.Fatalf("Failed to read credential store passphrase: %v", err)
+	}
+	creds, err := store.Unlock(passphrase)
+	if err != nil {
+		log.Fatalf("Failed to unlock credential store %s: %v", store.Filename(), err)
+	}
+	config.SetSecret("binance.api.key", creds.BinanceApiKey)
+	config.SetSecret("binance.api.secret", creds.BinanceApiSecret)
+	log.WithField("filename", store.Filename()).Infof("Unlocked credential store")
+}
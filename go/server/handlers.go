@@ -18,13 +18,14 @@ package server
 import (
 	"encoding/json"
 	"fmt"
-	"github.com/crankykernel/binanceapi-go"
 	"github.com/gobuffalo/packr"
 	"github.com/gorilla/mux"
 	"github.com/spf13/viper"
-	"gitlab.com/crankykernel/maker/go/binanceex"
+	"gitlab.com/crankykernel/maker/go/config"
 	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/exchange"
 	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/replay"
 	"gitlab.com/crankykernel/maker/go/tradeservice"
 	"gitlab.com/crankykernel/maker/go/types"
 	"gitlab.com/crankykernel/maker/go/version"
@@ -33,6 +34,7 @@ import (
 	"net/http"
 	"runtime"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -143,8 +145,7 @@ func updateTradeStopLossSettingsHandler(tradeService *tradeservice.TradeService)
 		}
 
 		var tradeId string
-		var enable bool
-		var percent float64
+		var settings types.StopLossSettings
 
 		vars := mux.Vars(r)
 		tradeId = vars["tradeId"]
@@ -153,21 +154,53 @@ func updateTradeStopLossSettingsHandler(tradeService *tradeservice.TradeService)
 			return
 		}
 
-		if enable, err = strconv.ParseBool(r.FormValue("enable")); err != nil {
+		if settings.Enabled, err = strconv.ParseBool(r.FormValue("enable")); err != nil {
 			WriteBadRequestError(w)
 			return
 		}
-		if percent, err = strconv.ParseFloat(r.FormValue("percent"), 64); err != nil {
+		if settings.Percent, err = strconv.ParseFloat(r.FormValue("percent"), 64); err != nil {
 			WriteBadRequestError(w)
 			return
 		}
 
+		// Optional.
+		if r.FormValue("trailing") != "" {
+			if settings.Trailing, err = strconv.ParseBool(r.FormValue("trailing")); err != nil {
+				WriteBadRequestError(w)
+				return
+			}
+		}
+		if r.FormValue("ticks") != "" {
+			if settings.Ticks, err = strconv.ParseInt(r.FormValue("ticks"), 10, 64); err != nil || settings.Ticks < 0 {
+				WriteBadRequestError(w)
+				return
+			}
+		}
+		if r.FormValue("breakEvenPercent") != "" {
+			if settings.BreakEvenPercent, err = strconv.ParseFloat(r.FormValue("breakEvenPercent"), 64); err != nil {
+				WriteBadRequestError(w)
+				return
+			}
+		}
+		if r.FormValue("breakEvenBuffer") != "" {
+			if settings.BreakEvenBuffer, err = strconv.ParseFloat(r.FormValue("breakEvenBuffer"), 64); err != nil {
+				WriteBadRequestError(w)
+				return
+			}
+		}
+		if r.FormValue("onExchange") != "" {
+			if settings.OnExchange, err = strconv.ParseBool(r.FormValue("onExchange")); err != nil {
+				WriteBadRequestError(w)
+				return
+			}
+		}
+
 		trade := tradeService.FindTradeByLocalID(tradeId)
 		if trade == nil {
 			log.Printf("Failed to find trade with ID %s.", tradeId)
 			WriteJsonError(w, http.StatusNotFound, "")
 		} else {
-			tradeService.UpdateStopLoss(trade, enable, percent)
+			tradeService.UpdateStopLoss(trade, settings)
 			WriteJsonResponse(w, http.StatusOK, nil)
 		}
 	}
@@ -227,6 +260,69 @@ func updateTradeTrailingProfitSettingsHandler(tradeService *tradeservice.TradeSe
 	}
 }
 
+// Update sell chase settings for a trade.
+//
+// Router paths vars:
+// - tradeId
+//
+// Query string parameters:
+// - enable
+// - interval (optional)
+// - ticks (optional)
+// - minProfit (optional)
+func updateTradeSellChaseSettingsHandler(tradeService *tradeservice.TradeService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		if err = r.ParseForm(); err != nil {
+			WriteBadRequestError(w)
+			return
+		}
+
+		var settings types.SellChaseSettings
+
+		tradeId := mux.Vars(r)["tradeId"]
+		if tradeId == "" {
+			WriteBadRequestError(w)
+			return
+		}
+
+		if settings.Enabled, err = strconv.ParseBool(r.FormValue("enable")); err != nil {
+			WriteBadRequestError(w)
+			return
+		}
+
+		// Optional.
+		if r.FormValue("interval") != "" {
+			if settings.Interval, err = strconv.ParseInt(r.FormValue("interval"), 10, 64); err != nil || settings.Interval < 0 {
+				WriteBadRequestError(w)
+				return
+			}
+		}
+		if r.FormValue("ticks") != "" {
+			if settings.Ticks, err = strconv.ParseInt(r.FormValue("ticks"), 10, 64); err != nil || settings.Ticks < 0 {
+				WriteBadRequestError(w)
+				return
+			}
+		}
+		if r.FormValue("minProfit") != "" {
+			if settings.MinProfit, err = strconv.ParseFloat(r.FormValue("minProfit"), 64); err != nil {
+				WriteBadRequestError(w)
+				return
+			}
+		}
+
+		trade := tradeService.FindTradeByLocalID(tradeId)
+		if trade == nil {
+			log.Printf("Failed to find trade with ID %s.", tradeId)
+			WriteJsonError(w, http.StatusNotFound, "")
+		} else {
+			tradeService.UpdateSellChase(trade, settings)
+			WriteJsonResponse(w, http.StatusOK, nil)
+		}
+	}
+}
+
 func deleteBuyHandler(tradeService *tradeservice.TradeService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if err := r.ParseForm(); err != nil {
@@ -288,6 +384,8 @@ func DeleteSellHandler(tradeService *tradeservice.TradeService) http.HandlerFunc
 		}).Infof("Cancelling sell order.")
 
 		switch trade.State.Status {
+		case types.TradeStatusArmed:
+			fallthrough
 		case types.TradeStatusNew:
 			fallthrough
 		case types.TradeStatusPendingBuy:
@@ -333,10 +431,16 @@ func limitSellByPercentHandler(tradeService *tradeservice.TradeService) http.Han
 		}
 
 		switch trade.State.Status {
+		case types.TradeStatusArmed:
+			fallthrough
 		case types.TradeStatusNew:
 			fallthrough
 		case types.TradeStatusPendingBuy:
 			trade.SetLimitSellByPercent(percent)
+			trade.AddHistoryEntry(types.HistoryTypeLimitSellUpdate, map[string]interface{}{
+				"type":    types.LimitSellTypePercent,
+				"percent": percent,
+			})
 			db.DbUpdateTrade(trade)
 			tradeService.BroadcastTradeUpdate(trade)
 			log.WithFields(log.Fields{
@@ -353,11 +457,16 @@ func limitSellByPercentHandler(tradeService *tradeservice.TradeService) http.Han
 			log.Printf("Cancelling existing sell order.")
 			tradeService.CancelSell(trade)
 		}
+		tradeService.CancelStopOrder(trade)
 
 		err = tradeService.LimitSellByPercent(trade, percent)
 		if err != nil {
 			log.WithError(err).Error("Limit sell order failed.")
-			WriteJsonResponse(w, http.StatusBadRequest, err.Error())
+			if orderErr, ok := err.(*exchange.OrderError); ok {
+				WriteOrderError(w, orderErr)
+			} else {
+				WriteJsonResponse(w, http.StatusBadRequest, err.Error())
+			}
 		}
 
 		duration := time.Since(startTime)
@@ -401,10 +510,16 @@ func limitSellByPriceHandler(tradeService *tradeservice.TradeService) http.Handl
 		}
 
 		switch trade.State.Status {
+		case types.TradeStatusArmed:
+			fallthrough
 		case types.TradeStatusNew:
 			fallthrough
 		case types.TradeStatusPendingBuy:
 			trade.SetLimitSellByPrice(price)
+			trade.AddHistoryEntry(types.HistoryTypeLimitSellUpdate, map[string]interface{}{
+				"type":  types.LimitSellTypePrice,
+				"price": price,
+			})
 			db.DbUpdateTrade(trade)
 			tradeService.BroadcastTradeUpdate(trade)
 			log.WithFields(log.Fields{
@@ -421,11 +536,16 @@ func limitSellByPriceHandler(tradeService *tradeservice.TradeService) http.Handl
 			log.Printf("Cancelling existing sell order.")
 			tradeService.CancelSell(trade)
 		}
+		tradeService.CancelStopOrder(trade)
 
 		err = tradeService.LimitSellByPrice(trade, price)
 		if err != nil {
 			log.WithError(err).Error("Limit sell order failed.")
-			WriteJsonResponse(w, http.StatusBadRequest, err.Error())
+			if orderErr, ok := err.(*exchange.OrderError); ok {
+				WriteOrderError(w, orderErr)
+			} else {
+				WriteJsonResponse(w, http.StatusBadRequest, err.Error())
+			}
 		}
 
 		duration := time.Since(startTime)
@@ -436,6 +556,76 @@ func limitSellByPriceHandler(tradeService *tradeservice.TradeService) http.Handl
 	}
 }
 
+// Replace the take profit targets of a trade. Targets can only be changed
+// before any have been placed. If the buy has already filled the targets
+// are placed immediately.
+//
+// The request body is an object with a "targets" list of quantityPercent and
+// profitPercent pairs.
+func updateTakeProfitHandler(tradeService *tradeservice.TradeService) http.HandlerFunc {
+	type TakeProfitRequest struct {
+		Targets []types.TakeProfitSetting `json:"targets"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		tradeId := mux.Vars(r)["tradeId"]
+		if tradeId == "" {
+			WriteBadRequestError(w)
+			return
+		}
+
+		var request TakeProfitRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			WriteBadRequestError(w)
+			return
+		}
+
+		trade := tradeService.FindTradeByLocalID(tradeId)
+		if trade == nil {
+			WriteJsonError(w, http.StatusNotFound, "")
+			return
+		}
+
+		switch trade.State.Status {
+		case types.TradeStatusArmed:
+		case types.TradeStatusNew:
+		case types.TradeStatusPendingBuy:
+		case types.TradeStatusWatching:
+		default:
+			WriteJsonError(w, http.StatusBadRequest,
+				fmt.Sprintf("take profit can't be changed on %s trade", trade.State.Status))
+			return
+		}
+		for _, target := range trade.State.TakeProfit {
+			if target.ClientOrderID != "" {
+				WriteJsonError(w, http.StatusBadRequest,
+					"take profit orders have already been placed")
+				return
+			}
+		}
+
+		if err := trade.SetTakeProfit(request.Targets); err != nil {
+			WriteJsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		trade.AddHistoryEntry(types.HistoryTypeTakeProfitUpdate, map[string]interface{}{
+			"targets": request.Targets,
+		})
+		log.WithFields(log.Fields{
+			"symbol":  trade.State.Symbol,
+			"tradeId": trade.State.TradeID,
+			"targets": len(request.Targets),
+		}).Info("Updated take profit.")
+
+		if trade.State.Status == types.TradeStatusWatching {
+			tradeService.TriggerTakeProfit(trade)
+		} else {
+			db.DbUpdateTrade(trade)
+			tradeService.BroadcastTradeUpdate(trade)
+		}
+	}
+}
+
 func marketSellHandler(tradeService *tradeservice.TradeService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
@@ -452,13 +642,20 @@ func marketSellHandler(tradeService *tradeservice.TradeService) http.HandlerFunc
 			return
 		}
 
+		// Refused before the exit orders of the trade are cancelled.
+		if err := tradeService.ValidateMarketSell(trade); err != nil {
+			WriteOrderError(w, err)
+			return
+		}
+
 		if trade.State.Status == types.TradeStatusPendingSell {
 			log.Printf("Cancelling existing sell order.")
 			tradeService.CancelSell(trade)
 		}
+		tradeService.CancelTakeProfit(trade)
+		tradeService.CancelStopOrder(trade)
 
-		err := tradeService.MarketSell(trade, false)
-		if err != nil {
+		if err := tradeService.MarketSell(trade, false); err != nil {
 			WriteJsonError(w, http.StatusInternalServerError, err.Error())
 		}
 	}
@@ -477,7 +674,7 @@ func configHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	jconf := yaml2json(yconf)
+	jconf := redactConfig(yaml2json(yconf).(map[string]interface{}))
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -487,6 +684,41 @@ func configHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Configuration keys never returned to the client. The Binance API secret is
+// only used server side to sign requests.
+var secretConfigKeys = []string{
+	"binance.api.secret",
+	"password",
+}
+
+// redactConfig removes secrets from the configuration, whether stored with
+// flat or nested keys, and adds a flag indicating if the Binance API
+// credentials are set.
+func redactConfig(conf map[string]interface{}) map[string]interface{} {
+	for _, key := range secretConfigKeys {
+		delete(conf, key)
+		parts := strings.Split(key, ".")
+		parent := conf
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := parent[part].(map[string]interface{})
+			if !ok {
+				parent = nil
+				break
+			}
+			parent = child
+		}
+		if parent != nil {
+			delete(parent, parts[len(parts)-1])
+		}
+	}
+	if key := config.GetString("binance.api.key"); key != "" {
+		conf["binance.api.key"] = key
+	}
+	conf["binance.api.configured"] = config.GetString("binance.api.key") != "" &&
+		config.GetString("binance.api.secret") != ""
+	return conf
+}
+
 func yaml2json(i interface{}) interface{} {
 	switch x := i.(type) {
 	case map[interface{}]interface{}:
@@ -542,8 +774,110 @@ func getTradeHandler(w http.ResponseWriter, r *http.Request) {
 	WriteJsonResponse(w, http.StatusOK, trade)
 }
 
-func PostBuyHandler(tradeService *tradeservice.TradeService,
-	binancePriceService *binanceex.BinancePriceService) http.HandlerFunc {
+// Adopt a buy order placed, or a balance bought, outside of Maker as a trade.
+//
+// The request body is a types.Adoption with the order ID, or the quantity
+// and price of a balance, along with the exit settings.
+func adoptTradeHandler(tradeService *tradeservice.TradeService) http.HandlerFunc {
+	type AdoptResponse struct {
+		TradeID string `json:"trade_id"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var adoption types.Adoption
+		if err := json.NewDecoder(r.Body).Decode(&adoption); err != nil {
+			log.WithError(err).Errorf("Failed to decode adopt request body.")
+			WriteBadRequestError(w)
+			return
+		}
+		if adoption.Symbol == "" {
+			WriteJsonError(w, http.StatusBadRequest, "missing required parameter: symbol")
+			return
+		}
+
+		// Set from the exchange.
+		adoption.OrderStatus = ""
+		adoption.Fills = nil
+
+		trade, err := tradeService.AdoptTrade(adoption)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"symbol":  adoption.Symbol,
+				"orderId": adoption.OrderID,
+			}).Errorf("Failed to adopt trade.")
+			WriteJsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		WriteJsonResponse(w, http.StatusOK, AdoptResponse{
+			TradeID: trade.State.TradeID,
+		})
+	}
+}
+
+// Rebuild a trade from its execution reports and return it along with the
+// differences from the stored state. On POST the rebuilt state replaces the
+// stored state.
+func replayTradeHandler(tradeService *tradeservice.TradeService, ex exchange.Exchange) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tradeId := mux.Vars(r)["tradeId"]
+		logFields := log.Fields{
+			"tradeId": tradeId,
+		}
+
+		// Replay the live state of open trades, the database copy may lag.
+		live, err := tradeService.CopyTradeState(tradeId)
+		if err != nil {
+			log.WithError(err).WithFields(logFields).Error("Failed to copy trade state.")
+			WriteJsonError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		var tradeState types.TradeState
+		if live != nil {
+			tradeState = *live
+		} else {
+			stored, err := db.DbGetTradeByID(tradeId)
+			if err != nil {
+				log.WithError(err).WithFields(logFields).
+					Warn("Failed to find trade by ID.")
+				WriteJsonError(w, http.StatusNotFound, "trade not found")
+				return
+			}
+			tradeState = *stored
+		}
+
+		stepSize := float64(0)
+		symbolInfo, err := ex.GetSymbolInfo(tradeState.Symbol)
+		if err != nil {
+			log.WithError(err).WithFields(logFields).
+				Warn("Failed to get symbol info, sellable quantity will not be replayed.")
+		} else {
+			stepSize = symbolInfo.StepSize
+		}
+
+		result, err := replay.ReplayTrade(tradeState, stepSize)
+		if err != nil {
+			log.WithError(err).WithFields(logFields).Error("Failed to replay trade.")
+			WriteJsonError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if r.Method == http.MethodPost && len(result.Differences) > 0 {
+			log.WithFields(logFields).WithFields(log.Fields{
+				"differences": len(result.Differences),
+			}).Infof("Repairing trade from replay.")
+			if err := tradeService.RepairTrade(result.Repaired()); err != nil {
+				log.WithError(err).WithFields(logFields).Error("Failed to repair trade.")
+				WriteJsonError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+
+		WriteJsonResponse(w, http.StatusOK, result)
+	}
+}
+
+func PostBuyHandler(tradeService *tradeservice.TradeService, ex exchange.Exchange) http.HandlerFunc {
 	type BuyOrderRequest struct {
 		Symbol                  string              `json:"symbol"`
 		Quantity                float64             `json:"quantity"`
@@ -554,11 +888,51 @@ func PostBuyHandler(tradeService *tradeservice.TradeService,
 		LimitSellPrice          float64             `json:"limitSellPrice"`
 		StopLossEnabled         bool                `json:"stopLossEnabled"`
 		StopLossPercent         float64             `json:"stopLossPercent"`
+		StopLossTrailing        bool                `json:"stopLossTrailing,omitempty"`
+		StopLossTicks           int64               `json:"stopLossTicks,omitempty"`
+		StopLossBreakEven       float64             `json:"stopLossBreakEven,omitempty"`
+		StopLossBreakEvenBuffer float64             `json:"stopLossBreakEvenBuffer,omitempty"`
+		StopLossOnExchange      bool                `json:"stopLossOnExchange,omitempty"`
 		TrailingProfitEnabled   bool                `json:"trailingProfitEnabled"`
 		TrailingProfitPercent   float64             `json:"trailingProfitPercent"`
 		TrailingProfitDeviation float64             `json:"trailingProfitDeviation"`
 		Price                   float64             `json:"price"`
 		OffsetTicks             int64               `json:"offsetTicks"`
+
+		// Instead of a quantity, spend this amount of the quote asset, or
+		// this percent of the free quote asset balance. The quantity is
+		// worked out on the final buy price.
+		QuoteAmount    float64 `json:"quoteAmount,omitempty"`
+		BalancePercent float64 `json:"balancePercent,omitempty"`
+
+		TakeProfit []types.TakeProfitSetting `json:"takeProfit,omitempty"`
+
+		// A conditional entry, the buy is placed once the last price meets
+		// the condition, or the trade cancelled after EntryHours if set.
+		EntryCondition types.EntryConditionType `json:"entryCondition,omitempty"`
+		EntryPrice     float64                  `json:"entryPrice,omitempty"`
+		EntryHours     float64                  `json:"entryHours,omitempty"`
+
+		// A trailing buy, once the entry condition is met, or straight away
+		// without one, the buy is placed on a rebound of deviation percent
+		// from the low.
+		TrailingBuyEnabled   bool    `json:"trailingBuyEnabled,omitempty"`
+		TrailingBuyDeviation float64 `json:"trailingBuyDeviation,omitempty"`
+
+		// Re-price an unfilled buy to the best bid, up to the max price,
+		// and cancel what has not filled after the timeout in seconds.
+		BuyChaseEnabled  bool    `json:"buyChaseEnabled,omitempty"`
+		BuyChaseInterval int64   `json:"buyChaseInterval,omitempty"`
+		BuyChaseTicks    int64   `json:"buyChaseTicks,omitempty"`
+		BuyChaseMaxPrice float64 `json:"buyChaseMaxPrice,omitempty"`
+		BuyTimeout       int64   `json:"buyTimeout,omitempty"`
+
+		// Re-price the limit sell down to the best ask, not below the
+		// minimum profit percent.
+		SellChaseEnabled   bool    `json:"sellChaseEnabled,omitempty"`
+		SellChaseInterval  int64   `json:"sellChaseInterval,omitempty"`
+		SellChaseTicks     int64   `json:"sellChaseTicks,omitempty"`
+		SellChaseMinProfit float64 `json:"sellChaseMinProfit,omitempty"`
 	}
 
 	type BuyOrderResponse struct {
@@ -566,10 +940,10 @@ func PostBuyHandler(tradeService *tradeservice.TradeService,
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		params := binanceapi.OrderParameters{
-			Side:        binanceapi.OrderSideBuy,
-			Type:        binanceapi.OrderTypeLimit,
-			TimeInForce: binanceapi.TimeInForceGTC,
+		params := exchange.OrderParameters{
+			Side:        exchange.OrderSideBuy,
+			Type:        exchange.OrderTypeLimit,
+			TimeInForce: exchange.TimeInForceGTC,
 		}
 
 		var requestBody BuyOrderRequest
@@ -613,31 +987,83 @@ func PostBuyHandler(tradeService *tradeservice.TradeService,
 			}
 		}
 
-		params.Symbol = requestBody.Symbol
-		params.Quantity = requestBody.Quantity
-
-		orderId, err := tradeService.MakeOrderID()
-		if err != nil {
-			log.WithFields(commonLogFields).WithError(err).Errorf("Failed to create order ID.")
-			WriteJsonError(w, http.StatusInternalServerError, err.Error())
+		// Validate the amount, only one of quantity, quote amount or balance
+		// percent can be set.
+		amounts := 0
+		for _, amount := range []float64{requestBody.Quantity,
+			requestBody.QuoteAmount, requestBody.BalancePercent} {
+			if amount < 0 {
+				WriteJsonError(w, http.StatusBadRequest, "negative quantity or amount")
+				return
+			} else if amount > 0 {
+				amounts++
+			}
+		}
+		if amounts != 1 {
+			WriteJsonError(w, http.StatusBadRequest,
+				"one of quantity, quoteAmount or balancePercent required")
 			return
 		}
-		params.NewClientOrderId = orderId
+		if requestBody.BalancePercent > 100 {
+			WriteJsonError(w, http.StatusBadRequest,
+				fmt.Sprintf("invalid value for balancePercent: %v", requestBody.BalancePercent))
+			return
+		}
+
+		params.Symbol = requestBody.Symbol
+		params.Quantity = requestBody.Quantity
 
+		now := time.Now()
 		trade := types.NewTrade()
 		trade.AddHistory(types.HistoryEntry{
-			Timestamp: time.Now(),
+			Timestamp: now,
 			Type:      types.HistoryTypeCreated,
 			Fields:    requestBody,
 		})
 		trade.State.Symbol = params.Symbol
-		trade.AddClientOrderID(params.NewClientOrderId)
 
-		switch requestBody.PriceSource {
-		case types.PriceSourceManual:
-			params.Price = requestBody.Price
-		default:
-			params.Price, err = binancePriceService.GetPrice(params.Symbol, requestBody.PriceSource)
+		var entry *types.EntryCondition
+		if requestBody.EntryCondition != "" || requestBody.TrailingBuyEnabled {
+			entry = types.NewEntryCondition(now, requestBody.EntryCondition,
+				requestBody.EntryPrice, requestBody.EntryHours)
+			entry.Quantity = requestBody.Quantity
+			entry.QuoteAmount = requestBody.QuoteAmount
+			entry.BalancePercent = requestBody.BalancePercent
+			entry.PriceSource = requestBody.PriceSource
+			entry.BuyPrice = requestBody.Price
+			entry.OffsetTicks = requestBody.OffsetTicks
+			if !entry.Valid() || requestBody.EntryHours < 0 {
+				WriteJsonError(w, http.StatusBadRequest, "invalid entry condition")
+				return
+			}
+			if requestBody.TrailingBuyEnabled && requestBody.TrailingBuyDeviation <= 0 {
+				WriteJsonError(w, http.StatusBadRequest, "invalid trailing buy deviation")
+				return
+			}
+			lastPrice, err := ex.GetPrice(params.Symbol, types.PriceSourceLast)
+			if err != nil {
+				WriteJsonError(w, http.StatusInternalServerError,
+					fmt.Sprintf("Failed to get price: %v", err))
+				return
+			}
+			// A trailing buy just starts following the price.
+			if !requestBody.TrailingBuyEnabled && entry.Met(lastPrice) {
+				WriteJsonError(w, http.StatusBadRequest,
+					fmt.Sprintf("entry condition already met at last price %.8f", lastPrice))
+				return
+			}
+		} else {
+			orderId, err := tradeService.MakeOrderID()
+			if err != nil {
+				log.WithFields(commonLogFields).WithError(err).Errorf("Failed to create order ID.")
+				WriteJsonError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			params.ClientOrderID = orderId
+			trade.AddClientOrderID(params.ClientOrderID)
+
+			params.Price, err = exchange.BuyPrice(ex, params.Symbol, requestBody.PriceSource,
+				requestBody.Price, requestBody.OffsetTicks)
 			if err != nil {
 				log.WithError(err).WithFields(commonLogFields).WithFields(log.Fields{
 					"priceSource": requestBody.PriceSource,
@@ -646,21 +1072,30 @@ func PostBuyHandler(tradeService *tradeservice.TradeService,
 					fmt.Sprintf("Failed to get price: %v", err))
 				return
 			}
-			if requestBody.OffsetTicks != 0 {
-				newPrice := binancePriceService.AdjustPriceByTicks(requestBody.Symbol,
-					params.Price, requestBody.OffsetTicks)
-				log.WithFields(log.Fields{
-					"offsetTicks": requestBody.OffsetTicks,
-					"price":       fmt.Sprintf("%.8f", params.Price),
-					"newPrice":    fmt.Sprintf("%.8f", newPrice),
-				}).Infof("Price adjusted by ticks")
-				params.Price = newPrice
+
+			if params.Quantity == 0 {
+				params.Quantity, err = exchange.BuyQuantity(ex, params.Symbol, params.Price,
+					requestBody.QuoteAmount, requestBody.BalancePercent)
+				if err != nil {
+					log.WithError(err).WithFields(commonLogFields).WithFields(log.Fields{
+						"quoteAmount":    requestBody.QuoteAmount,
+						"balancePercent": requestBody.BalancePercent,
+					}).Error("Failed to get buy quantity.")
+					WriteJsonError(w, http.StatusBadRequest,
+						fmt.Sprintf("Failed to get quantity: %v", err))
+					return
+				}
 			}
 		}
 
 		if requestBody.StopLossEnabled {
 			trade.SetStopLoss(requestBody.StopLossEnabled,
 				requestBody.StopLossPercent)
+			trade.SetStopLossTrailing(requestBody.StopLossTrailing,
+				requestBody.StopLossTicks)
+			trade.SetStopLossBreakEven(requestBody.StopLossBreakEven,
+				requestBody.StopLossBreakEvenBuffer)
+			trade.SetStopLossOnExchange(requestBody.StopLossOnExchange)
 		}
 
 		if requestBody.TrailingProfitEnabled {
@@ -669,8 +1104,32 @@ func PostBuyHandler(tradeService *tradeservice.TradeService,
 				requestBody.TrailingProfitDeviation)
 		}
 
-		tradeId := tradeService.AddNewTrade(trade)
-		commonLogFields["tradeId"] = tradeId
+		if err := trade.SetTakeProfit(requestBody.TakeProfit); err != nil {
+			WriteJsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if requestBody.BuyChaseInterval < 0 || requestBody.BuyChaseTicks < 0 ||
+			requestBody.BuyChaseMaxPrice < 0 || requestBody.BuyTimeout < 0 {
+			WriteJsonError(w, http.StatusBadRequest, "invalid buy chase or timeout")
+			return
+		}
+		trade.SetBuyChase(requestBody.BuyChaseEnabled, requestBody.BuyChaseInterval,
+			requestBody.BuyChaseTicks, requestBody.BuyChaseMaxPrice)
+		trade.State.BuyTimeout = requestBody.BuyTimeout
+		if requestBody.SellChaseEnabled {
+			if requestBody.SellChaseInterval < 0 || requestBody.SellChaseTicks < 0 {
+				WriteJsonError(w, http.StatusBadRequest, "invalid sell chase")
+				return
+			}
+			trade.ApplySellChaseSettings(types.SellChaseSettings{
+				Enabled:   true,
+				Interval:  requestBody.SellChaseInterval,
+				Ticks:     requestBody.SellChaseTicks,
+				MinProfit: requestBody.SellChaseMinProfit,
+			})
+		}
+
 		if requestBody.LimitSellEnabled {
 			if requestBody.LimitSellType == types.LimitSellTypePercent {
 				log.WithFields(commonLogFields).Infof("Setting limit sell at %f percent.",
@@ -683,11 +1142,46 @@ func PostBuyHandler(tradeService *tradeservice.TradeService,
 			}
 		}
 
+		if entry != nil {
+			trade.Arm(*entry)
+			trade.SetTrailingBuy(requestBody.TrailingBuyEnabled,
+				requestBody.TrailingBuyDeviation)
+			tradeId := tradeService.ArmTrade(trade)
+			log.WithFields(commonLogFields).WithFields(log.Fields{
+				"tradeId":        tradeId,
+				"entryCondition": entry.Type,
+				"entryPrice":     entry.Price,
+				"entryExpires":   entry.Expires,
+				"quantity":       entry.Quantity,
+				"quoteAmount":    entry.QuoteAmount,
+				"balancePercent": entry.BalancePercent,
+				"priceSource":    entry.PriceSource,
+				"offsetTicks":    entry.OffsetTicks,
+				"trailingBuy":    requestBody.TrailingBuyEnabled,
+				"deviation":      requestBody.TrailingBuyDeviation,
+			}).Infof("Armed conditional BUY for %s", params.Symbol)
+			WriteJsonResponse(w, http.StatusOK, BuyOrderResponse{
+				TradeID: tradeId,
+			})
+			return
+		}
+
+		if err := exchange.ValidateOrder(ex, params); err != nil {
+			log.WithError(err).WithFields(commonLogFields).Warn("Buy order failed validation.")
+			WriteOrderError(w, err)
+			return
+		}
+
+		tradeId := tradeService.AddNewTrade(trade)
+		commonLogFields["tradeId"] = tradeId
+
 		log.WithFields(commonLogFields).WithFields(log.Fields{
 			"type":                    params.Type,
 			"price":                   params.Price,
 			"quantity":                params.Quantity,
-			"clientOrderId":           params.NewClientOrderId,
+			"quoteAmount":             requestBody.QuoteAmount,
+			"balancePercent":          requestBody.BalancePercent,
+			"clientOrderId":           params.ClientOrderID,
 			"priceSource":             requestBody.PriceSource,
 			"limitSellEnabled":        requestBody.LimitSellEnabled,
 			"limitSellType":           requestBody.LimitSellType,
@@ -695,20 +1189,33 @@ func PostBuyHandler(tradeService *tradeservice.TradeService,
 			"limitSellPrice":          requestBody.LimitSellPrice,
 			"stopLossEnabled":         requestBody.StopLossEnabled,
 			"stopLossPercent":         requestBody.StopLossPercent,
+			"stopLossTrailing":        requestBody.StopLossTrailing,
+			"stopLossTicks":           requestBody.StopLossTicks,
+			"stopLossBreakEven":       requestBody.StopLossBreakEven,
+			"stopLossBreakEvenBuffer": requestBody.StopLossBreakEvenBuffer,
+			"stopLossOnExchange":      requestBody.StopLossOnExchange,
 			"trailingProfitEnabled":   requestBody.TrailingProfitEnabled,
 			"trailingProfitPercent":   requestBody.TrailingProfitPercent,
 			"trailingProfitDeviation": requestBody.TrailingProfitDeviation,
 			"offsetTicks":             requestBody.OffsetTicks,
+			"buyChaseEnabled":         requestBody.BuyChaseEnabled,
+			"buyChaseMaxPrice":        requestBody.BuyChaseMaxPrice,
+			"buyTimeout":              requestBody.BuyTimeout,
 		}).Infof("Posting BUY order for %s", params.Symbol)
 
-		response, err := binanceex.GetBinanceRestClient().PostOrder(params)
-		if err != nil {
+		buyResponse, err := ex.PostOrder(params)
+		if exchange.OrderPending(err) {
+			// The trade fails if the journal finds the order was never
+			// placed.
+			log.WithError(err).WithFields(commonLogFields).
+				Warnf("Buy order outcome unknown, waiting for it to be resolved.")
+		} else if err != nil {
 			log.WithError(err).
 				Errorf("Failed to post buy order.")
 			switch err := err.(type) {
-			case *binanceapi.RestApiError:
+			case *exchange.ApiError:
 				log.Debugf("Forwarding Binance error repsonse.")
-				w.WriteHeader(response.StatusCode)
+				w.WriteHeader(err.StatusCode)
 				w.Write(err.Body)
 			default:
 				WriteJsonResponse(w, http.StatusInternalServerError,
@@ -720,11 +1227,6 @@ func PostBuyHandler(tradeService *tradeservice.TradeService,
 			return
 		}
 
-		data, err := ioutil.ReadAll(response.Body)
-		var buyResponse binanceapi.PostOrderResponse
-		if err := json.Unmarshal(data, &buyResponse); err != nil {
-			log.Printf("error: failed to decode buy order response: %v", err)
-		}
 		log.WithFields(log.Fields{
 			"tradeId": tradeId,
 		}).Debugf("Decoded BUY response: %s", log.ToJson(buyResponse))
@@ -18,6 +18,7 @@ package server
 import (
 	"encoding/json"
 	"fmt"
+	"gitlab.com/crankykernel/maker/go/exchange"
 	"gitlab.com/crankykernel/maker/go/log"
 	"net/http"
 )
@@ -45,6 +46,23 @@ func WriteJsonError(w http.ResponseWriter, statusCode int, message string) {
 	WriteJsonResponse(w, statusCode, body)
 }
 
+// WriteOrderError writes an order that failed validation against the symbol
+// filters of the exchange as a bad request naming the field at fault.
+func WriteOrderError(w http.ResponseWriter, err error) {
+	orderErr, ok := err.(*exchange.OrderError)
+	if !ok {
+		WriteJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	WriteJsonResponse(w, http.StatusBadRequest, map[string]interface{}{
+		"error":      true,
+		"statusCode": http.StatusBadRequest,
+		"field":      orderErr.Field,
+		"filter":     orderErr.Filter,
+		"message":    orderErr.Error(),
+	})
+}
+
 func RequireFormValue(w http.ResponseWriter, r *http.Request, field string) bool {
 	if r.FormValue(field) == "" {
 		WriteJsonError(w, http.StatusBadRequest, fmt.Sprintf("%s is required", field))
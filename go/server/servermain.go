@@ -18,16 +18,17 @@ package server
 import (
 	"encoding/json"
 	"fmt"
-	"github.com/crankykernel/binanceapi-go"
 	"github.com/gorilla/mux"
-	_ "github.com/mattn/go-sqlite3"
 	"gitlab.com/crankykernel/maker/go/binanceex"
 	"gitlab.com/crankykernel/maker/go/clientnotificationservice"
 	"gitlab.com/crankykernel/maker/go/context"
+	"gitlab.com/crankykernel/maker/go/credentials"
 	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/exchange"
 	"gitlab.com/crankykernel/maker/go/gencert"
 	"gitlab.com/crankykernel/maker/go/healthservice"
 	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/recorder"
 	"gitlab.com/crankykernel/maker/go/tradeservice"
 	"gitlab.com/crankykernel/maker/go/version"
 	"math"
@@ -37,6 +38,8 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -51,6 +54,35 @@ var ServerFlags struct {
 	TLS            bool
 	ItsAllMyFault  bool
 	EnableAuth     bool
+	Paper          bool
+
+	// Simulated balances for paper trading as ASSET=AMOUNT.
+	PaperBalances []string
+
+	// Key file for the credential store passphrase.
+	CredentialsKeyFile string
+
+	// Market data recording.
+	Record           []string
+	RecordBookTicker bool
+	RecordMaxAge     time.Duration
+	RecordMaxSize    int64
+
+	// Interval to reconcile open trades with the exchange, 0 to disable.
+	ReconcileInterval time.Duration
+}
+
+// parsePaperBalance parses a simulated paper balance given as ASSET=AMOUNT.
+func parsePaperBalance(value string) (string, float64, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", 0, fmt.Errorf("expected ASSET=AMOUNT")
+	}
+	balance, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil || balance < 0 {
+		return "", 0, fmt.Errorf("invalid amount %q", parts[1])
+	}
+	return strings.ToUpper(parts[0]), balance, nil
 }
 
 func initBinanceExchangeInfoService() *binanceex.ExchangeInfoService {
@@ -87,6 +119,10 @@ func ServerMain() {
 	}
 	ServerFlags.ConfigFilename = path.Join(ServerFlags.DataDirectory, "maker.yaml")
 
+	credentialStore := credentials.NewStore(
+		path.Join(ServerFlags.DataDirectory, "credentials.json"))
+	unlockCredentialStore(credentialStore)
+
 	if ServerFlags.Host != "127.0.0.1" {
 		if !ServerFlags.EnableAuth {
 			log.Fatalf("Authentication must be enabled to listen on anything other than 127.0.0.1")
@@ -110,32 +146,91 @@ func ServerMain() {
 		}
 	}
 
+	clientNotificationService := clientnotificationservice.New()
+	healthService := healthservice.New()
+
 	applicationContext := &context.ApplicationContext{}
 	applicationContext.BinanceTradeStreamManager = binanceex.NewXTradeStreamManager()
+	applicationContext.BinanceUserDataStream = binanceex.NewBinanceUserDataStream(
+		clientNotificationService, healthService)
 
-	db.DbOpen(ServerFlags.DataDirectory)
+	binanceex.EnableRateLimiter()
+	binanceExchangeInfoService := initBinanceExchangeInfoService()
+	binancePriceService := binanceex.NewBinancePriceService()
+
+	applicationContext.Exchange = exchange.NewBinanceExchange(
+		binanceExchangeInfoService,
+		binancePriceService,
+		applicationContext.BinanceTradeStreamManager,
+		applicationContext.BinanceUserDataStream)
+
+	if ServerFlags.Paper {
+		// Orders go to a simulated exchange and are stored in their own
+		// database so they never mix with real trades.
+		log.WithField("paper", true).Warnf("Paper trading mode enabled, orders will not be sent to Binance")
+		paperExchange := exchange.NewPaperExchange(applicationContext.Exchange)
+		for _, paperBalance := range ServerFlags.PaperBalances {
+			asset, balance, err := parsePaperBalance(paperBalance)
+			if err != nil {
+				log.Fatalf("Invalid --paper-balance %q: %v", paperBalance, err)
+			}
+			paperExchange.SetBalance(asset, balance)
+		}
+		go paperExchange.RunLiveFeed()
+		applicationContext.Exchange = paperExchange
+		db.DbOpenFile(path.Join(ServerFlags.DataDirectory, "maker-paper.db"))
+	} else {
+		db.DbOpen(ServerFlags.DataDirectory)
+	}
 
-	tradeService := tradeservice.NewTradeService(applicationContext.BinanceTradeStreamManager)
-	applicationContext.TradeService = tradeService
+	// Resolving pending orders and restoring trades may place orders, so
+	// subscribe to the user stream first. The reports are held by the stream
+	// until they are read below, once the trades are restored.
+	userStreamChannel := applicationContext.Exchange.SubscribeUserStream()
+	if !ServerFlags.Paper {
+		go applicationContext.BinanceUserDataStream.Run()
+	}
 
-	restoreTrades(tradeService)
+	// Orders are journalled so an order whose response was lost can be
+	// resolved by its client order ID, including any lost before the last
+	// shutdown once the trades are restored.
+	journalExchange := exchange.NewJournalExchange(applicationContext.Exchange)
+	applicationContext.Exchange = journalExchange
+
+	if len(ServerFlags.Record) > 0 {
+		marketDataRecorder := recorder.New(recorder.Options{
+			Directory:  path.Join(ServerFlags.DataDirectory, "marketdata"),
+			Symbols:    ServerFlags.Record,
+			BookTicker: ServerFlags.RecordBookTicker,
+			MaxAge:     ServerFlags.RecordMaxAge,
+			MaxSize:    ServerFlags.RecordMaxSize * 1024 * 1024,
+		})
+		applicationContext.BinanceTradeStreamManager.SetRecorder(marketDataRecorder)
+		for _, symbol := range marketDataRecorder.Symbols() {
+			applicationContext.BinanceTradeStreamManager.AddSymbol(symbol)
+		}
+		go marketDataRecorder.Run()
+	}
 
-	binanceExchangeInfoService := initBinanceExchangeInfoService()
-	binancePriceService := binanceex.NewBinancePriceService(binanceExchangeInfoService)
+	tradeService := tradeservice.NewTradeService(applicationContext.Exchange)
+	applicationContext.TradeService = tradeService
+	journalExchange.OrderFailed = tradeService.OrderFailed
 
-	clientNotificationService := clientnotificationservice.New()
-	healthService := healthservice.New()
+	reconciler := tradeservice.NewReconciler(tradeService,
+		clientNotificationService, ServerFlags.ReconcileInterval)
+	restoreTrades(tradeService, reconciler)
+	if err := journalExchange.ResolvePending(); err != nil {
+		log.WithError(err).Errorf("Failed to resolve pending orders.")
+	}
 
-	applicationContext.BinanceUserDataStream = binanceex.NewBinanceUserDataStream(
-		clientNotificationService, healthService)
-	userStreamChannel := applicationContext.BinanceUserDataStream.Subscribe()
-	go applicationContext.BinanceUserDataStream.Run()
+	if ServerFlags.ReconcileInterval > 0 {
+		go reconciler.Run()
+	}
 
 	go func() {
 		for {
-			client := binanceapi.NewRestClient()
 			requestStart := time.Now()
-			response, err := client.GetTime()
+			serverTime, err := binanceex.GetServerTime()
 			if err != nil {
 				log.WithError(err).Errorf("Failed to get from Binance API")
 				time.Sleep(1 * time.Minute)
@@ -144,7 +239,7 @@ func ServerMain() {
 
 			roundTripTime := time.Now().Sub(requestStart)
 			now := time.Now().UnixNano() / int64(time.Millisecond)
-			diff := math.Abs(float64(now - response.ServerTime))
+			diff := math.Abs(float64(now - serverTime))
 			if diff > 999 {
 				log.WithFields(log.Fields{
 					"roundTripTime":          roundTripTime,
@@ -166,17 +261,21 @@ func ServerMain() {
 		for {
 			select {
 			case event := <-userStreamChannel:
-				switch event.EventType {
-				case binanceex.EventTypeExecutionReport:
-					if err := db.DbSaveBinanceRawExecutionReport(event.EventTime, event.Raw); err != nil {
+				switch event.Type {
+				case exchange.UserStreamEventExecutionReport:
+					if err := db.DbSaveBinanceRawExecutionReport(event.Time, event.Raw); err != nil {
 						log.Println(err)
 					}
 					tradeService.OnExecutionReport(event)
+				case exchange.UserStreamEventListStatus:
+					tradeService.OnListStatus(event)
 				}
 			}
 		}
 	}()
 
+	reconciler.RestoreStopLosses()
+
 	router := mux.NewRouter()
 
 	var authenticator *Authenticator = nil
@@ -217,9 +316,10 @@ func ServerMain() {
 		})
 	})
 
-	router.HandleFunc("/api/binance/buy", PostBuyHandler(tradeService, binancePriceService)).Methods("POST")
+	router.HandleFunc("/api/binance/buy", PostBuyHandler(tradeService, applicationContext.Exchange)).Methods("POST")
 	router.HandleFunc("/api/binance/buy", deleteBuyHandler(tradeService)).Methods("DELETE")
 	router.HandleFunc("/api/binance/sell", DeleteSellHandler(tradeService)).Methods("DELETE")
+	router.HandleFunc("/api/binance/adopt", adoptTradeHandler(tradeService)).Methods("POST")
 
 	// Set/change stop-loss on a trade.
 	router.HandleFunc("/api/binance/trade/{tradeId}/stopLoss",
@@ -228,6 +328,9 @@ func ServerMain() {
 	router.HandleFunc("/api/binance/trade/{tradeId}/trailingProfit",
 		updateTradeTrailingProfitSettingsHandler(tradeService)).Methods("POST")
 
+	router.HandleFunc("/api/binance/trade/{tradeId}/sellChase",
+		updateTradeSellChaseSettingsHandler(tradeService)).Methods("POST")
+
 	// Limit sell at percent.
 	router.HandleFunc("/api/binance/trade/{tradeId}/limitSellByPercent",
 		limitSellByPercentHandler(tradeService)).Methods("POST")
@@ -236,6 +339,8 @@ func ServerMain() {
 	router.HandleFunc("/api/binance/trade/{tradeId}/limitSellByPrice",
 		limitSellByPriceHandler(tradeService)).Methods("POST")
 
+	router.HandleFunc("/api/binance/trade/{tradeId}/takeProfit",
+		updateTakeProfitHandler(tradeService)).Methods("POST")
 	router.HandleFunc("/api/binance/trade/{tradeId}/marketSell",
 		marketSellHandler(tradeService)).Methods("POST")
 	router.HandleFunc("/api/binance/trade/{tradeId}/archive",
@@ -247,16 +352,18 @@ func ServerMain() {
 		Methods("GET")
 	router.HandleFunc("/api/trade/{tradeId}",
 		getTradeHandler).Methods("GET")
+	router.HandleFunc("/api/trade/{tradeId}/replay",
+		replayTradeHandler(tradeService, applicationContext.Exchange)).Methods("GET", "POST")
 
 	router.HandleFunc("/api/binance/account/test",
 		BinanceTestHandler).Methods("GET")
 	router.HandleFunc("/api/binance/config",
-		SaveBinanceConfigHandler).Methods("POST")
+		SaveBinanceConfigHandler(credentialStore)).Methods("POST")
 	router.HandleFunc("/api/config/preferences",
 		SavePreferencesHandler).Methods("POST")
 
 	binanceApiProxyHandler := http.StripPrefix("/proxy/binance",
-		binanceapi.NewBinanceApiProxyHandler())
+		binanceex.NewProxyHandler())
 	router.PathPrefix("/proxy/binance").Handler(binanceApiProxyHandler)
 
 	router.PathPrefix("/ws").Handler(NewUserWebSocketHandler(applicationContext,
@@ -19,15 +19,16 @@ import (
 	"encoding/json"
 	"github.com/crankykernel/binanceapi-go"
 	"github.com/gorilla/websocket"
-	"gitlab.com/crankykernel/maker/go/binanceex"
 	"gitlab.com/crankykernel/maker/go/clientnotificationservice"
 	"gitlab.com/crankykernel/maker/go/context"
+	"gitlab.com/crankykernel/maker/go/exchange"
 	"gitlab.com/crankykernel/maker/go/healthservice"
 	"gitlab.com/crankykernel/maker/go/log"
 	"gitlab.com/crankykernel/maker/go/tradeservice"
 	"gitlab.com/crankykernel/maker/go/types"
 	"gitlab.com/crankykernel/maker/go/version"
 	"net/http"
+	"time"
 )
 
 // This handler implements the read-only websocket that all clients connect
@@ -109,11 +110,11 @@ func (h *UserWebSocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	tradeChannel := h.appContext.TradeService.Subscribe()
 	defer h.appContext.TradeService.Unsubscribe(tradeChannel)
 
-	binanceTradeStreamChannel := h.appContext.BinanceTradeStreamManager.Subscribe()
-	defer h.appContext.BinanceTradeStreamManager.Unsubscribe(binanceTradeStreamChannel)
+	binanceTradeStreamChannel := h.appContext.Exchange.SubscribeTrades()
+	defer h.appContext.Exchange.UnsubscribeTrades(binanceTradeStreamChannel)
 
-	binanceUserStreamChannel := h.appContext.BinanceUserDataStream.Subscribe()
-	defer h.appContext.BinanceUserDataStream.Unsubscribe(binanceUserStreamChannel)
+	binanceUserStreamChannel := h.appContext.Exchange.SubscribeUserStream()
+	defer h.appContext.Exchange.UnsubscribeUserStream(binanceUserStreamChannel)
 
 	writeChannel := make(chan *MakerMessage)
 
@@ -146,24 +147,35 @@ Loop:
 		case <-doneChannel:
 			break Loop
 		case binanceUserEvent := <-binanceUserStreamChannel:
-			switch binanceUserEvent.EventType {
-			case binanceex.EventTypeExecutionReport:
+			switch binanceUserEvent.Type {
+			case exchange.UserStreamEventExecutionReport:
 				// Do nothing.
-			case binanceex.EventTypeOutboundAccountInfo:
+			case exchange.UserStreamEventListStatus:
+				// Do nothing.
+			case exchange.UserStreamEventAccount:
 				message := MakerMessage{
 					Type:                       MakerMessageTypeBinanceAccountInfo,
-					BinanceOutboundAccountInfo: &binanceUserEvent.OutboundAccountInfo,
+					BinanceOutboundAccountInfo: newAccountInfoMessage(binanceUserEvent),
 				}
 				writeChannel <- &message
 			default:
 				log.WithFields(log.Fields{
-					"eventType": binanceUserEvent.EventType,
+					"eventType": binanceUserEvent.Type,
 				}).Info("Ignoring binance user stream event.")
 			}
 		case trade := <-binanceTradeStreamChannel:
 			message := MakerMessage{
-				Type:            MakerMessageTypeBinanceAggTrade,
-				BinanceAggTrade: trade,
+				Type: MakerMessageTypeBinanceAggTrade,
+				BinanceAggTrade: &binanceapi.StreamAggTrade{
+					EventType:  "aggTrade",
+					EventTime:  trade.Time.UnixNano() / int64(time.Millisecond),
+					Symbol:     trade.Symbol,
+					TradeID:    trade.TradeID,
+					Price:      trade.Price,
+					Quantity:   trade.Quantity,
+					TradeTime:  trade.Time.UnixNano() / int64(time.Millisecond),
+					BuyerMaker: trade.BuyerMaker,
+				},
 			}
 			writeChannel <- &message
 		case trade := <-tradeChannel:
@@ -207,13 +219,43 @@ Loop:
 }
 
 type MakerMessage struct {
-	Type                       MakerMessageType                      `json:"messageType"`
-	Trade                      *types.TradeState                     `json:"trade,omitempty"`
-	TradeID                    string                                `json:"tradeId,omitempty"`
-	BinanceAggTrade            *binanceapi.StreamAggTrade            `json:"binanceAggTrade,omitempty"`
-	BinanceOutboundAccountInfo *binanceapi.StreamOutboundAccountInfo `json:"binanceOutboundAccountInfo,omitempty"`
-	Notice                     *clientnotificationservice.Notice     `json:"notice,omitempty"`
-	Health                     *healthservice.State                  `json:"health,omitempty"`
+	Type                       MakerMessageType                  `json:"messageType"`
+	Trade                      *types.TradeState                 `json:"trade,omitempty"`
+	TradeID                    string                            `json:"tradeId,omitempty"`
+	BinanceAggTrade            *binanceapi.StreamAggTrade        `json:"binanceAggTrade,omitempty"`
+	BinanceOutboundAccountInfo *accountInfoMessage               `json:"binanceOutboundAccountInfo,omitempty"`
+	Notice                     *clientnotificationservice.Notice `json:"notice,omitempty"`
+	Health                     *healthservice.State              `json:"health,omitempty"`
+}
+
+// accountInfoMessage is a balance update in the format of the Binance
+// outboundAccountInfo event the web app expects.
+type accountInfoMessage struct {
+	EventType       string                      `json:"e"`
+	EventTimeMillis int64                       `json:"E"`
+	Balances        []accountInfoMessageBalance `json:"B"`
+}
+
+type accountInfoMessageBalance struct {
+	Asset  string  `json:"a"`
+	Free   float64 `json:"f,string"`
+	Locked float64 `json:"l,string"`
+}
+
+func newAccountInfoMessage(event *exchange.UserStreamEvent) *accountInfoMessage {
+	message := &accountInfoMessage{
+		EventType:       "outboundAccountInfo",
+		EventTimeMillis: event.Time.UnixNano() / int64(time.Millisecond),
+		Balances:        []accountInfoMessageBalance{},
+	}
+	for _, balance := range event.Balances {
+		message.Balances = append(message.Balances, accountInfoMessageBalance{
+			Asset:  balance.Asset,
+			Free:   balance.Free,
+			Locked: balance.Locked,
+		})
+	}
+	return message
 }
 
 type MakerMessageType string
@@ -0,0 +1,159 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tradeservice
+
+import (
+	"fmt"
+	"github.com/crankykernel/binanceapi-go"
+	"gitlab.com/crankykernel/maker/go/exchange"
+	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/types"
+	"time"
+)
+
+// AdoptTrade creates a trade from a buy order placed outside of Maker, or
+// from a balance if no order ID is given, so it can be managed by stop loss,
+// trailing profit and limit sell. An adopted balance with no quantity is all
+// of the balance not held by other trades, and with no price is bought at
+// the last price.
+func (s *TradeService) AdoptTrade(adoption types.Adoption) (*types.Trade, error) {
+	s.executionLock.Lock()
+	defer s.executionLock.Unlock()
+
+	symbolInfo, err := s.exchange.GetSymbolInfo(adoption.Symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	trade := types.NewTrade()
+
+	if adoption.OrderID != 0 {
+		order, err := s.exchange.GetOrderByOrderId(adoption.Symbol, adoption.OrderID)
+		if err != nil {
+			return nil, err
+		}
+		if order.Side != exchange.OrderSideBuy {
+			return nil, fmt.Errorf("order %d is not a buy order", order.OrderID)
+		}
+		if existing := s.findTradeForOrder(order.Symbol, order.OrderID, order.ClientOrderID); existing != nil {
+			return nil, fmt.Errorf("order %d already belongs to trade %s",
+				order.OrderID, existing.State.TradeID)
+		}
+		fills, err := s.exchange.GetOrderFills(adoption.Symbol, order.OrderID)
+		if err != nil {
+			return nil, err
+		}
+		adoption.Fills = []types.OrderFill{}
+		for _, fill := range fills {
+			adoption.Fills = append(adoption.Fills, fill.ToOrderFill())
+		}
+		if !order.Status.IsOpen() && len(adoption.Fills) == 0 {
+			return nil, fmt.Errorf("order %d is %s without fills", order.OrderID, order.Status)
+		}
+		adoption.OrderStatus = binanceapi.OrderStatus(order.Status)
+		adoption.Quantity = order.Quantity
+		adoption.Price = order.Price
+		trade.State.OpenTime = time.Unix(0, order.TimeMillis*int64(time.Millisecond))
+		if order.ClientOrderID != "" {
+			trade.AddClientOrderID(order.ClientOrderID)
+		}
+	} else {
+		if symbolInfo.BaseAsset == "" {
+			return nil, fmt.Errorf("base asset of %s not known", adoption.Symbol)
+		}
+		balance, err := s.exchange.GetBalance(symbolInfo.BaseAsset)
+		if err != nil {
+			return nil, err
+		}
+		available := balance - s.heldByOpenTrades(symbolInfo.BaseAsset)
+		if adoption.Quantity == 0 {
+			adoption.Quantity = available
+		}
+		if adoption.Quantity <= 0 || adoption.Quantity > available+quantityTolerance {
+			return nil, fmt.Errorf("%.8f %s available to adopt, not held by other trades",
+				available, symbolInfo.BaseAsset)
+		}
+		if adoption.Price == 0 {
+			adoption.Price, err = s.exchange.GetPrice(adoption.Symbol, types.PriceSourceLast)
+			if err != nil {
+				return nil, err
+			}
+		}
+		adoption.OrderStatus = ""
+		adoption.Fills = []types.OrderFill{
+			{
+				Price:    adoption.Price,
+				Quantity: adoption.Quantity,
+			},
+		}
+	}
+
+	if err := trade.ApplyAdoption(adoption, symbolInfo.StepSize); err != nil {
+		return nil, err
+	}
+	trade.AddHistoryEntry(types.HistoryTypeAdopted, adoption)
+	s.addTrade(trade)
+
+	log.WithFields(log.Fields{
+		"tradeId":  trade.State.TradeID,
+		"symbol":   trade.State.Symbol,
+		"orderId":  adoption.OrderID,
+		"quantity": trade.State.BuyFillQuantity,
+		"status":   trade.State.Status,
+	}).Infof("Adopted trade.")
+
+	if trade.State.Status == types.TradeStatusWatching {
+		s.TriggerSells(trade)
+	}
+
+	return trade, nil
+}
+
+// Returns the trade an exchange order belongs to, if any.
+func (s *TradeService) findTradeForOrder(symbol string, orderId int64, clientOrderId string) *types.Trade {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if trade, ok := s.TradesByClientID[clientOrderId]; ok && clientOrderId != "" {
+		return trade
+	}
+	for _, trade := range s.TradesByLocalID {
+		if trade.State.Symbol != symbol {
+			continue
+		}
+		if trade.State.BuyOrderId == orderId || trade.State.SellOrderId == orderId {
+			return trade
+		}
+	}
+	return nil
+}
+
+// The quantity of an asset held by open trades.
+func (s *TradeService) heldByOpenTrades(asset string) float64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	held := float64(0)
+	for _, trade := range s.TradesByLocalID {
+		if trade.IsDone() {
+			continue
+		}
+		symbolInfo, err := s.exchange.GetSymbolInfo(trade.State.Symbol)
+		if err != nil || symbolInfo.BaseAsset != asset {
+			continue
+		}
+		held += heldQuantity(trade)
+	}
+	return held
+}
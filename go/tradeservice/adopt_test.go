@@ -0,0 +1,92 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tradeservice
+
+import (
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/exchange"
+	"gitlab.com/crankykernel/maker/go/replay"
+	"gitlab.com/crankykernel/maker/go/types"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestAdoptTrade(t *testing.T) {
+	directory, err := ioutil.TempDir("", "maker-adopt")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+	db.DbOpenFile(path.Join(directory, "maker.db"))
+	defer db.DbClose()
+
+	paper := exchange.NewSteppedPaperExchange(&testMarket{price: 0.0010})
+	ex := &balanceExchange{PaperExchange: paper, balances: map[string]float64{}}
+	service := NewTradeService(ex)
+
+	// A buy placed from the Binance app.
+	order, err := paper.PostOrder(exchange.OrderParameters{
+		Symbol:        "ETHBTC",
+		Side:          exchange.OrderSideBuy,
+		Type:          exchange.OrderTypeLimit,
+		Quantity:      10,
+		Price:         0.0009,
+		ClientOrderID: "web_1",
+	})
+	assert.Nil(t, err)
+	paper.OnTrade(&exchange.MarketTrade{Symbol: "ETHBTC", Price: 0.0008, Quantity: 4})
+	for _, event := range paper.PendingEvents() {
+		service.OnExecutionReport(event)
+	}
+
+	trade, err := service.AdoptTrade(types.Adoption{
+		Symbol:          "ETHBTC",
+		OrderID:         order.OrderID,
+		StopLossEnabled: true,
+		StopLossPercent: 5,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, types.TradeStatusPendingBuy, trade.State.Status)
+	assert.InDelta(t, 3.996, trade.State.BuyFillQuantity, 0.00000001)
+	assert.True(t, trade.State.StopLoss.Enabled)
+
+	// Later reports for the order are applied to the adopted trade.
+	paper.OnTrade(&exchange.MarketTrade{Symbol: "ETHBTC", Price: 0.0008, Quantity: 100})
+	for _, event := range paper.PendingEvents() {
+		service.OnExecutionReport(event)
+	}
+	assert.Equal(t, types.TradeStatusWatching, trade.State.Status)
+	assert.InDelta(t, 9.99, trade.State.BuyFillQuantity, 0.00000001)
+	assert.Equal(t, float64(9), trade.State.SellableQuantity)
+
+	_, err = service.AdoptTrade(types.Adoption{Symbol: "ETHBTC", OrderID: order.OrderID})
+	assert.NotNil(t, err)
+
+	// A balance, less what the adopted order holds.
+	ex.balances["ETH"] = 15
+	_, err = service.AdoptTrade(types.Adoption{Symbol: "ETHBTC", Quantity: 7})
+	assert.NotNil(t, err)
+	balanceTrade, err := service.AdoptTrade(types.Adoption{Symbol: "ETHBTC"})
+	assert.Nil(t, err)
+	assert.Equal(t, types.TradeStatusWatching, balanceTrade.State.Status)
+	assert.Equal(t, float64(6), balanceTrade.State.SellableQuantity)
+	assert.Equal(t, 0.0010, balanceTrade.State.AverageBuyPrice)
+
+	result, err := replay.Replay(balanceTrade.State, nil, 1)
+	assert.Nil(t, err)
+	assert.Len(t, result.Differences, 0)
+}
@@ -0,0 +1,230 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package tradeservice
+
+import (
+	"fmt"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/exchange"
+	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/types"
+	"gitlab.com/crankykernel/maker/go/util"
+	"time"
+)
+
+// Checks the pending buys for chasing and timeouts, and the pending sells
+// for chasing, every second. They aren't checked on the trade stream as the
+// best bid or ask is looked up.
+func (s *TradeService) orderWatcher() {
+	ticker := time.NewTicker(time.Second)
+	for now := range ticker.C {
+		s.checkBuys(now)
+		s.checkSells(now)
+	}
+}
+
+func (s *TradeService) checkBuys(now time.Time) {
+	trades := []*types.Trade{}
+	s.lock.RLock()
+	for _, trade := range s.TradesByLocalID {
+		if trade.State.Status != types.TradeStatusPendingBuy {
+			continue
+		}
+		if trade.State.BuyChase.Enabled || trade.State.BuyTimeout > 0 {
+			trades = append(trades, trade)
+		}
+	}
+	s.lock.RUnlock()
+
+	for _, trade := range trades {
+		s.checkBuy(trade, now)
+	}
+}
+
+func (s *TradeService) checkBuy(trade *types.Trade, now time.Time) {
+	s.executionLock.Lock()
+	defer s.executionLock.Unlock()
+
+	state := &trade.State
+	if state.Status != types.TradeStatusPendingBuy || state.BuyChase.Replacing {
+		return
+	}
+
+	if state.BuyTimeout > 0 &&
+		now.Sub(state.OpenTime) >= time.Duration(state.BuyTimeout)*time.Second {
+		log.WithFields(log.Fields{
+			"tradeId": state.TradeID,
+			"symbol":  state.Symbol,
+			"timeout": state.BuyTimeout,
+		}).Infof("Buy timed out, cancelling.")
+		trade.AddHistoryEntry(types.HistoryTypeBuyTimeout, map[string]interface{}{
+			"timeout": state.BuyTimeout,
+		})
+		if err := s.cancelBuy(trade); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"tradeId": state.TradeID,
+			}).Errorf("Failed to cancel timed out buy.")
+		}
+		return
+	}
+
+	if !state.BuyChase.Enabled {
+		return
+	}
+	last := state.OpenTime
+	if state.BuyChase.Time != nil {
+		last = *state.BuyChase.Time
+	}
+	if now.Sub(last) < time.Duration(state.BuyChase.Interval)*time.Second {
+		return
+	}
+	s.chaseBuy(trade, now)
+}
+
+// Cancels the buy of a trade to place it again at the best bid, if the best
+// bid has moved up by enough ticks. The replacement is placed once the
+// cancel is reported, see replaceBuy.
+func (s *TradeService) chaseBuy(trade *types.Trade, now time.Time) {
+	state := &trade.State
+	logFields := log.Fields{
+		"tradeId": state.TradeID,
+		"symbol":  state.Symbol,
+	}
+
+	symbolInfo, err := s.exchange.GetSymbolInfo(state.Symbol)
+	if err != nil {
+		log.WithError(err).WithFields(logFields).Errorf("Failed to get symbol info to chase buy.")
+		return
+	}
+	bestBid, err := s.exchange.GetPrice(state.Symbol, types.PriceSourceBestBid)
+	if err != nil {
+		log.WithError(err).WithFields(logFields).Errorf("Failed to get best bid to chase buy.")
+		return
+	}
+
+	price := bestBid
+	if state.BuyChase.MaxPrice > 0 && price > state.BuyChase.MaxPrice {
+		price = state.BuyChase.MaxPrice
+	}
+	price = util.Round8(price)
+	ticks := state.BuyChase.Ticks
+	if ticks < 1 {
+		ticks = 1
+	}
+	if price-state.BuyOrder.Price < (float64(ticks)-0.5)*symbolInfo.TickSize {
+		return
+	}
+
+	logFields["price"] = fmt.Sprintf("%.8f", state.BuyOrder.Price)
+	logFields["newPrice"] = fmt.Sprintf("%.8f", price)
+	logFields["bestBid"] = fmt.Sprintf("%.8f", bestBid)
+	log.WithFields(logFields).Infof("Chasing buy, cancelling to re-price.")
+
+	trade.AddHistory(types.HistoryEntry{
+		Timestamp: now,
+		Type:      types.HistoryTypeBuyChase,
+		Fields: map[string]interface{}{
+			"price":    state.BuyOrder.Price,
+			"newPrice": price,
+			"bestBid":  bestBid,
+		},
+	})
+	if err := s.cancelBuy(trade); err != nil {
+		log.WithError(err).WithFields(logFields).Errorf("Failed to cancel buy to chase.")
+		return
+	}
+
+	// The cancel report waits on the execution lock so can't be missed.
+	state.BuyChase.Replacing = true
+	state.BuyChase.Count++
+	state.BuyChase.Time = &now
+	state.BuyChase.Price = price
+	db.DbUpdateTrade(trade)
+	s.BroadcastTradeUpdate(trade)
+}
+
+// Places the replacement of a chased buy once the cancel of the previous buy
+// is known, for what the previous buy did not fill. If that is too little to
+// buy the trade goes on with what was filled. Called with the execution lock
+// held.
+func (s *TradeService) replaceBuy(trade *types.Trade) {
+	state := &trade.State
+	price := state.BuyChase.Price
+	quantity := state.BuyOrder.Quantity -
+		orderFillQuantity(state.BuySideFills, state.BuyOrderId, false)
+
+	var clientOrderId string
+	symbolInfo, err := s.exchange.GetSymbolInfo(state.Symbol)
+	if err == nil {
+		quantity = util.FixQuantityToStepSize(quantity, symbolInfo.StepSize)
+		if quantity <= 0 || quantity*price < symbolInfo.MinNotional {
+			err = fmt.Errorf("remaining quantity %.8f too small to buy", quantity)
+		}
+	}
+	if err == nil {
+		clientOrderId, err = s.MakeOrderID()
+	}
+	if err == nil {
+		s.AddClientOrderId(trade, clientOrderId, false)
+		log.WithFields(log.Fields{
+			"tradeId":       state.TradeID,
+			"symbol":        state.Symbol,
+			"price":         fmt.Sprintf("%.8f", price),
+			"quantity":      quantity,
+			"clientOrderId": clientOrderId,
+		}).Infof("Posting chased BUY order.")
+		_, err = s.exchange.PostOrder(exchange.OrderParameters{
+			Symbol:        state.Symbol,
+			Side:          exchange.OrderSideBuy,
+			Type:          exchange.OrderTypeLimit,
+			TimeInForce:   exchange.TimeInForceGTC,
+			Quantity:      quantity,
+			Price:         price,
+			ClientOrderID: clientOrderId,
+		})
+	}
+
+	historyFields := map[string]interface{}{
+		"clientOrderId": clientOrderId,
+		"price":         price,
+		"quantity":      quantity,
+		"success":       err == nil,
+	}
+	state.BuyChase.Replacing = false
+	if exchange.OrderPending(err) {
+		// Its reports update the trade if it is placed.
+		historyFields["pending"] = true
+		historyFields["error"] = err.Error()
+	}
+	if err == nil || exchange.OrderPending(err) {
+		trade.AddHistoryEntry(types.HistoryTypeBuyReplace, historyFields)
+		return
+	}
+
+	log.WithError(err).WithFields(log.Fields{
+		"tradeId": state.TradeID,
+		"symbol":  state.Symbol,
+	}).Warnf("Not replacing chased buy.")
+	historyFields["error"] = err.Error()
+	trade.AddHistoryEntry(types.HistoryTypeBuyReplace, historyFields)
+	trade.EndBuy()
+	if state.Status == types.TradeStatusCanceled {
+		// Saved and the symbol removed by the caller.
+		closeTime := time.Now()
+		state.CloseTime = &closeTime
+	} else {
+		s.TriggerSells(trade)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package tradeservice
+
+import (
+	"github.com/crankykernel/binanceapi-go"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/exchange"
+	"gitlab.com/crankykernel/maker/go/replay"
+	"gitlab.com/crankykernel/maker/go/types"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestBuyChase(t *testing.T) {
+	directory, err := ioutil.TempDir("", "maker-buychase")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+	db.DbOpenFile(path.Join(directory, "maker.db"))
+	defer db.DbClose()
+
+	market := &testMarket{price: 0.0010}
+	paper := exchange.NewSteppedPaperExchange(market)
+	service := NewTradeService(paper)
+	reports := [][]byte{}
+	deliver := func() {
+		for _, event := range paper.PendingEvents() {
+			if event.Type == exchange.UserStreamEventExecutionReport {
+				reports = append(reports, event.Raw)
+				service.OnExecutionReport(event)
+			}
+		}
+	}
+
+	trade := types.NewTrade()
+	trade.AddHistory(types.HistoryEntry{
+		Timestamp: time.Now(),
+		Type:      types.HistoryTypeCreated,
+		Fields: map[string]interface{}{
+			"buyChaseEnabled":  true,
+			"buyChaseTicks":    1,
+			"buyChaseMaxPrice": 0.00098,
+		},
+	})
+	trade.State.Symbol = "ETHBTC"
+	trade.SetBuyChase(true, 0, 1, 0.00098)
+	clientOrderId, err := service.MakeOrderID()
+	assert.Nil(t, err)
+	trade.AddClientOrderID(clientOrderId)
+	service.AddNewTrade(trade)
+	_, err = paper.PostOrder(exchange.OrderParameters{
+		Symbol:        "ETHBTC",
+		Side:          exchange.OrderSideBuy,
+		Type:          exchange.OrderTypeLimit,
+		Quantity:      1000,
+		Price:         0.00095,
+		ClientOrderID: clientOrderId,
+	})
+	assert.Nil(t, err)
+	paper.OnTrade(&exchange.MarketTrade{Symbol: "ETHBTC", Price: 0.00095, Quantity: 400})
+	paper.OnTrade(&exchange.MarketTrade{Symbol: "ETHBTC", Price: 0.0010})
+	deliver()
+	assert.Equal(t, types.TradeStatusPendingBuy, trade.State.Status)
+	assert.Equal(t, 399.6, trade.State.BuyFillQuantity)
+
+	// The best bid moves up, the rest of the buy is placed again at it.
+	market.price = 0.00097
+	service.checkBuys(time.Now())
+	deliver()
+	deliver()
+	assert.Equal(t, types.TradeStatusPendingBuy, trade.State.Status)
+	assert.Equal(t, float64(600), trade.State.BuyOrder.Quantity)
+	assert.Equal(t, 0.00097, trade.State.BuyOrder.Price)
+	assert.Equal(t, binanceapi.OrderStatusNew, trade.State.LastBuyStatus)
+	assert.Len(t, trade.State.ClientOrderIDs, 2)
+
+	// No further than the max price.
+	market.price = 0.0011
+	service.checkBuys(time.Now())
+	deliver()
+	deliver()
+	assert.Equal(t, 0.00098, trade.State.BuyOrder.Price)
+	service.checkBuys(time.Now())
+	deliver()
+	assert.Equal(t, 2, trade.State.BuyChase.Count)
+	assert.Len(t, trade.State.ClientOrderIDs, 3)
+
+	// On timeout the trade goes on with what was filled.
+	trade.State.BuyTimeout = 60
+	service.checkBuys(time.Now().Add(time.Minute))
+	deliver()
+	assert.Equal(t, types.TradeStatusWatching, trade.State.Status)
+	assert.Equal(t, float64(399), trade.State.SellableQuantity)
+
+	trade.State.BuyTimeout = 0
+	result, err := replay.Replay(trade.State, reports, 1)
+	assert.Nil(t, err)
+	for _, difference := range result.Differences {
+		assert.Contains(t, []string{"OpenTime", "CloseTime"}, difference.Field)
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package tradeservice
+
+import (
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/exchange"
+	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/types"
+	"time"
+)
+
+// ArmTrade adds a trade that waits for its entry condition before its buy
+// is placed.
+func (s *TradeService) ArmTrade(trade *types.Trade) string {
+	trade.State.Status = types.TradeStatusArmed
+	s.addTrade(trade)
+	return trade.State.TradeID
+}
+
+// Triggers or expires the entry of an armed trade on a last price. Called
+// with the execution lock held.
+func (s *TradeService) checkEntry(trade *types.Trade, price float64) {
+	entry := trade.State.Entry
+	if entry == nil {
+		return
+	}
+	if entry.Expired(time.Now()) {
+		s.expireEntry(trade)
+		return
+	}
+	if trade.State.TrailingBuy.Enabled {
+		if !trade.State.TrailingBuy.Activated && !entry.Met(price) {
+			return
+		}
+		if s.checkTrailingBuy(trade, price) {
+			s.triggerEntry(trade, price)
+		}
+	} else if entry.Met(price) {
+		s.triggerEntry(trade, price)
+	}
+}
+
+// Follows the low price of an armed trade with a trailing buy, returning true
+// once the price has rebounded from it by the deviation.
+func (s *TradeService) checkTrailingBuy(trade *types.Trade, price float64) bool {
+	trailingBuy := &trade.State.TrailingBuy
+	if !trailingBuy.Activated {
+		log.WithFields(log.Fields{
+			"tradeId":   trade.State.TradeID,
+			"symbol":    trade.State.Symbol,
+			"price":     price,
+			"deviation": trailingBuy.Deviation,
+		}).Infof("Activating trailing buy")
+		trailingBuy.Activated = true
+		trailingBuy.Price = price
+		s.BroadcastTradeUpdate(trade)
+		return false
+	}
+
+	if price < trailingBuy.Price {
+		trailingBuy.Price = price
+		log.WithFields(log.Fields{
+			"symbol":   trade.State.Symbol,
+			"price-lo": price,
+		}).Info("Trailing Buy: Decreasing low price.")
+		return false
+	}
+
+	rebound := (price - trailingBuy.Price) / trailingBuy.Price * 100
+	if rebound < trailingBuy.Deviation {
+		return false
+	}
+	log.WithFields(log.Fields{
+		"symbol":    trade.State.Symbol,
+		"price-lo":  trailingBuy.Price,
+		"price":     price,
+		"rebound":   rebound,
+		"deviation": trailingBuy.Deviation,
+	}).Infof("Executing trailing buy")
+	return true
+}
+
+// Places the buy order of an armed trade whose entry condition has been
+// met. If the buy price can't be determined the trade is left armed to try
+// again on the next trade. A quantity that can't be worked out from a quote
+// amount or balance percent fails the trade instead, as retrying would fetch
+// the account balance on every trade.
+func (s *TradeService) triggerEntry(trade *types.Trade, price float64) {
+	entry := trade.State.Entry
+	logFields := log.Fields{
+		"tradeId":        trade.State.TradeID,
+		"symbol":         trade.State.Symbol,
+		"entryCondition": entry.Type,
+		"entryPrice":     entry.Price,
+		"lastPrice":      price,
+	}
+
+	buyPrice, err := exchange.BuyPrice(s.exchange, trade.State.Symbol, entry.PriceSource,
+		entry.BuyPrice, entry.OffsetTicks)
+	if err != nil {
+		log.WithError(err).WithFields(logFields).Errorf("Failed to get buy price for entry.")
+		return
+	}
+	quantity := entry.Quantity
+	if entry.QuoteAmount > 0 || entry.BalancePercent > 0 {
+		quantity, err = exchange.BuyQuantity(s.exchange, trade.State.Symbol, buyPrice,
+			entry.QuoteAmount, entry.BalancePercent)
+		if err != nil {
+			log.WithError(err).WithFields(logFields).WithFields(log.Fields{
+				"quoteAmount":    entry.QuoteAmount,
+				"balancePercent": entry.BalancePercent,
+			}).Errorf("Failed to get buy quantity for entry.")
+			s.FailTrade(trade)
+			return
+		}
+	}
+	order := exchange.OrderParameters{
+		Symbol:      trade.State.Symbol,
+		Side:        exchange.OrderSideBuy,
+		Type:        exchange.OrderTypeLimit,
+		TimeInForce: exchange.TimeInForceGTC,
+		Quantity:    quantity,
+		Price:       buyPrice,
+	}
+	if err := exchange.ValidateOrder(s.exchange, order); err != nil {
+		log.WithError(err).WithFields(logFields).Errorf("Entry buy order failed validation.")
+		s.FailTrade(trade)
+		return
+	}
+	clientOrderId, err := s.MakeOrderID()
+	if err != nil {
+		log.WithError(err).WithFields(logFields).Errorf("Failed to create order ID.")
+		return
+	}
+
+	entry.TriggerPrice = price
+	entry.Quantity = quantity
+	trade.State.Status = types.TradeStatusNew
+	if trade.State.TrailingBuy.Enabled {
+		trade.State.TrailingBuy.Triggered = true
+	}
+	s.AddClientOrderId(trade, clientOrderId, false)
+	historyFields := map[string]interface{}{
+		"price":         price,
+		"buyPrice":      buyPrice,
+		"quantity":      quantity,
+		"clientOrderId": clientOrderId,
+	}
+	if trade.State.TrailingBuy.Enabled {
+		historyFields["lowPrice"] = trade.State.TrailingBuy.Price
+	}
+	trade.AddHistoryEntry(types.HistoryTypeEntryTriggered, historyFields)
+
+	logFields["price"] = buyPrice
+	logFields["quantity"] = quantity
+	logFields["clientOrderId"] = clientOrderId
+	log.WithFields(logFields).Infof("Entry condition met, posting BUY order.")
+
+	order.ClientOrderID = clientOrderId
+	_, err = s.exchange.PostOrder(order)
+	if exchange.OrderPending(err) {
+		// The trade fails if the journal finds the order was never placed.
+		log.WithError(err).WithFields(logFields).
+			Warnf("Entry buy order outcome unknown, waiting for it to be resolved.")
+	} else if err != nil {
+		log.WithError(err).WithFields(logFields).Errorf("Failed to post entry buy order.")
+		s.FailTrade(trade)
+		return
+	}
+	db.DbUpdateTrade(trade)
+	s.BroadcastTradeUpdate(trade)
+}
+
+// Cancels an armed trade whose entry condition was not met in time.
+func (s *TradeService) expireEntry(trade *types.Trade) {
+	log.WithFields(log.Fields{
+		"tradeId": trade.State.TradeID,
+		"symbol":  trade.State.Symbol,
+		"expires": trade.State.Entry.Expires,
+	}).Infof("Entry condition expired, cancelling trade.")
+	trade.AddHistoryEntry(types.HistoryTypeEntryExpired, nil)
+	s.CloseTrade(trade, types.TradeStatusCanceled, time.Now())
+	s.BroadcastTradeUpdate(trade)
+}
+
+// Expires armed trades past their expiry time even if no trades are seen
+// for their symbol.
+func (s *TradeService) expireEntries() {
+	now := time.Now()
+	trades := []*types.Trade{}
+	s.lock.RLock()
+	for _, trade := range s.TradesByLocalID {
+		if trade.State.Status == types.TradeStatusArmed && trade.State.Entry != nil {
+			trades = append(trades, trade)
+		}
+	}
+	s.lock.RUnlock()
+
+	s.executionLock.Lock()
+	defer s.executionLock.Unlock()
+	for _, trade := range trades {
+		if trade.State.Status == types.TradeStatusArmed && trade.State.Entry.Expired(now) {
+			s.expireEntry(trade)
+		}
+	}
+}
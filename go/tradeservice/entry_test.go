@@ -0,0 +1,137 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package tradeservice
+
+import (
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/exchange"
+	"gitlab.com/crankykernel/maker/go/replay"
+	"gitlab.com/crankykernel/maker/go/types"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestEntry(t *testing.T) {
+	directory, err := ioutil.TempDir("", "maker-entry")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+	db.DbOpenFile(path.Join(directory, "maker.db"))
+	defer db.DbClose()
+
+	market := &testMarket{price: 0.0010}
+	paper := exchange.NewSteppedPaperExchange(market)
+	service := NewTradeService(paper)
+	reports := [][]byte{}
+	deliver := func() {
+		for _, event := range paper.PendingEvents() {
+			if event.Type == exchange.UserStreamEventExecutionReport {
+				reports = append(reports, event.Raw)
+				service.OnExecutionReport(event)
+			}
+		}
+	}
+	arm := func(conditionType types.EntryConditionType, price float64, hours float64,
+		trailingBuyDeviation float64) *types.Trade {
+		now := time.Now()
+		trade := types.NewTrade()
+		trade.AddHistory(types.HistoryEntry{
+			Timestamp: now,
+			Type:      types.HistoryTypeCreated,
+			Fields: map[string]interface{}{
+				"symbol":         "ETHBTC",
+				"quantity":       1000,
+				"priceSource":    types.PriceSourceLast,
+				"entryCondition": conditionType,
+				"entryPrice":     price,
+				"entryHours":     hours,
+
+				"trailingBuyEnabled":   trailingBuyDeviation > 0,
+				"trailingBuyDeviation": trailingBuyDeviation,
+			},
+		})
+		trade.State.Symbol = "ETHBTC"
+		entry := types.NewEntryCondition(now, conditionType, price, hours)
+		entry.Quantity = 1000
+		entry.PriceSource = types.PriceSourceLast
+		trade.Arm(*entry)
+		trade.SetTrailingBuy(trailingBuyDeviation > 0, trailingBuyDeviation)
+		service.ArmTrade(trade)
+		return trade
+	}
+
+	// Nothing is placed until the price rises to the entry price.
+	trade := arm(types.EntryConditionPriceAbove, 0.0011, 0, 0)
+	service.OnLastTrade(&exchange.MarketTrade{Symbol: "ETHBTC", Price: 0.00105})
+	assert.Equal(t, types.TradeStatusArmed, trade.State.Status)
+	assert.Empty(t, trade.State.ClientOrderIDs)
+
+	market.price = 0.0011
+	service.OnLastTrade(&exchange.MarketTrade{Symbol: "ETHBTC", Price: 0.0011})
+	deliver()
+	assert.Equal(t, types.TradeStatusWatching, trade.State.Status)
+	assert.Equal(t, 0.0011, trade.State.Entry.TriggerPrice)
+	assert.Equal(t, float64(999), trade.State.SellableQuantity)
+
+	result, err := replay.Replay(trade.State, reports, 1)
+	assert.Nil(t, err)
+	for _, difference := range result.Differences {
+		assert.Contains(t, []string{"OpenTime", "CloseTime"}, difference.Field)
+	}
+
+	// A trailing buy follows the price down and buys on a rebound of 5%.
+	reports = [][]byte{}
+	market.price = 0.0010
+	trade = arm(types.EntryConditionNone, 0, 0, 5)
+	for _, price := range []float64{0.0010, 0.0009, 0.00094} {
+		service.OnLastTrade(&exchange.MarketTrade{Symbol: "ETHBTC", Price: price})
+	}
+	assert.Equal(t, types.TradeStatusArmed, trade.State.Status)
+	assert.Equal(t, 0.0009, trade.State.TrailingBuy.Price)
+
+	market.price = 0.000945
+	service.OnLastTrade(&exchange.MarketTrade{Symbol: "ETHBTC", Price: 0.000945})
+	deliver()
+	assert.Equal(t, types.TradeStatusWatching, trade.State.Status)
+	assert.True(t, trade.State.TrailingBuy.Triggered)
+	assert.Equal(t, 0.000945, trade.State.BuyOrder.Price)
+
+	result, err = replay.Replay(trade.State, reports, 1)
+	assert.Nil(t, err)
+	for _, difference := range result.Differences {
+		assert.Contains(t, []string{"OpenTime", "CloseTime"}, difference.Field)
+	}
+
+	// An entry not met in time is cancelled.
+	trade = arm(types.EntryConditionPriceBelow, 0.0009, 0.0001, 0)
+	time.Sleep(time.Second)
+	service.expireEntries()
+	assert.Equal(t, types.TradeStatusCanceled, trade.State.Status)
+	assert.Empty(t, trade.State.ClientOrderIDs)
+
+	// An armed trade is cancelled without going to the exchange.
+	trade = arm(types.EntryConditionPriceBelow, 0.0009, 0, 0)
+	assert.Nil(t, service.CancelBuy(trade))
+	assert.Equal(t, types.TradeStatusCanceled, trade.State.Status)
+	assert.NotNil(t, trade.State.CloseTime)
+	assert.Equal(t, types.HistoryTypeBuyCanceled,
+		trade.State.History[len(trade.State.History)-1].Type)
+	service.OnLastTrade(&exchange.MarketTrade{Symbol: "ETHBTC", Price: 0.0008})
+	assert.Equal(t, types.TradeStatusCanceled, trade.State.Status)
+	assert.Empty(t, trade.State.ClientOrderIDs)
+}
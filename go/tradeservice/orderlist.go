@@ -0,0 +1,225 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package tradeservice
+
+import (
+	"fmt"
+	"github.com/crankykernel/binanceapi-go"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/exchange"
+	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/types"
+	"time"
+)
+
+// Returns true if the limit sell of a trade should be placed as an OCO with
+// its stop order.
+func wantOrderList(trade *types.Trade) bool {
+	stopLoss := trade.State.StopLoss
+	return stopLoss.OnExchange && stopLoss.Enabled && !stopLoss.Triggered &&
+		trade.State.LimitSell.Enabled
+}
+
+// Posts the limit sell of a trade. If the stop loss is on the exchange the
+// limit sell is placed as an OCO with the stop order, falling back to a
+// plain limit sell with the stop left to Maker if the OCO is refused. There
+// is no fallback while the outcome of the OCO is pending.
+func (s *TradeService) postLimitSell(trade *types.Trade, price float64, quantity float64,
+	clientOrderId string, locked bool) error {
+	if wantOrderList(trade) {
+		err := s.postOrderList(trade, price, quantity, clientOrderId, locked)
+		if err == nil || exchange.OrderPending(err) {
+			return err
+		}
+		log.WithError(err).WithFields(log.Fields{
+			"tradeId": trade.State.TradeID,
+			"symbol":  trade.State.Symbol,
+		}).Warnf("Failed to post OCO order, posting limit sell only.")
+	}
+	_, err := s.exchange.PostOrder(exchange.OrderParameters{
+		Symbol:        trade.State.Symbol,
+		Side:          exchange.OrderSideSell,
+		Type:          exchange.OrderTypeLimit,
+		TimeInForce:   exchange.TimeInForceGTC,
+		Quantity:      quantity,
+		Price:         price,
+		ClientOrderID: clientOrderId,
+	})
+	return err
+}
+
+// Posts an OCO of a limit sell at price and the stop order of a trade. The
+// limit sell goes through the trade like any other sell order, the stop
+// order is added to the stop loss orders.
+func (s *TradeService) postOrderList(trade *types.Trade, price float64, quantity float64,
+	limitClientOrderId string, locked bool) error {
+	symbolInfo, err := s.exchange.GetSymbolInfo(trade.State.Symbol)
+	if err != nil {
+		return err
+	}
+	stopPrice, stopLimitPrice := stopOrderPrices(trade, symbolInfo.TickSize)
+	if stopLimitPrice <= 0 {
+		return fmt.Errorf("stop price not known")
+	}
+
+	stopClientOrderId, err := s.MakeOrderID()
+	if err != nil {
+		return err
+	}
+	listClientOrderId, err := s.MakeOrderID()
+	if err != nil {
+		return err
+	}
+	s.AddClientOrderId(trade, stopClientOrderId, locked)
+	trade.State.StopLoss.Orders = append(trade.State.StopLoss.Orders, types.StopOrder{
+		ClientOrderID: stopClientOrderId,
+		Quantity:      quantity,
+		StopPrice:     stopPrice,
+		Price:         stopLimitPrice,
+	})
+	stopOrder := &trade.State.StopLoss.Orders[len(trade.State.StopLoss.Orders)-1]
+	trade.State.OrderList = &types.OrderList{
+		ListClientOrderID:  listClientOrderId,
+		LimitClientOrderID: limitClientOrderId,
+		StopClientOrderID:  stopClientOrderId,
+	}
+
+	logFields := log.Fields{
+		"tradeId":   trade.State.TradeID,
+		"symbol":    trade.State.Symbol,
+		"quantity":  quantity,
+		"price":     fmt.Sprintf("%.8f", price),
+		"stopPrice": fmt.Sprintf("%.8f", stopPrice),
+	}
+	log.WithFields(logFields).Info("Posting OCO order.")
+
+	orderList, err := s.exchange.PostOcoOrder(exchange.OcoOrderParameters{
+		Symbol:             trade.State.Symbol,
+		Quantity:           quantity,
+		Price:              price,
+		StopPrice:          stopPrice,
+		StopLimitPrice:     stopLimitPrice,
+		ListClientOrderID:  listClientOrderId,
+		LimitClientOrderID: limitClientOrderId,
+		StopClientOrderID:  stopClientOrderId,
+	})
+	historyFields := map[string]interface{}{
+		"sellOrderType":      "stopLoss",
+		"stopPrice":          stopPrice,
+		"price":              stopLimitPrice,
+		"quantity":           quantity,
+		"clientOrderId":      stopClientOrderId,
+		"orderList":          listClientOrderId,
+		"limitClientOrderId": limitClientOrderId,
+		"success":            err == nil,
+	}
+	if exchange.OrderPending(err) {
+		// Kept until the journal has resolved it.
+		historyFields["pending"] = true
+		historyFields["error"] = err.Error()
+	} else if err != nil {
+		stopOrder.Status = orderStatusRejected
+		trade.State.OrderList = nil
+		historyFields["error"] = err.Error()
+	} else {
+		trade.State.OrderList.OrderListID = orderList.OrderListID
+		historyFields["orderListId"] = orderList.OrderListID
+		for _, order := range orderList.Orders {
+			if order.ClientOrderID == stopClientOrderId && stopOrder.OrderID == 0 {
+				stopOrder.OrderID = order.OrderID
+			}
+		}
+	}
+	trade.AddHistoryEntry(types.HistoryTypeSellOrder, historyFields)
+	return err
+}
+
+// Keeps the stop order of an OCO in line with the stop loss. As an order of
+// an OCO can't be changed on its own, the OCO is cancelled and the limit sell
+// placed again when the stop moves or is no longer wanted on the exchange.
+func (s *TradeService) syncOrderList(trade *types.Trade, current *types.StopOrder, locked bool) {
+	if current.FillQuantity > 0 || trade.State.Status != types.TradeStatusPendingSell ||
+		trade.State.SellOrder.Status != binanceapi.OrderStatusNew {
+		// Not confirmed yet, or one of the orders has executed.
+		return
+	}
+
+	if wantOrderList(trade) {
+		symbolInfo, err := s.exchange.GetSymbolInfo(trade.State.Symbol)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"symbol": trade.State.Symbol,
+			}).Error("Failed to get symbol info, not updating OCO order.")
+			return
+		}
+		stopPrice, _ := stopOrderPrices(trade, symbolInfo.TickSize)
+		if !stopPriceMoved(current, stopPrice) {
+			return
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"tradeId":   trade.State.TradeID,
+		"symbol":    trade.State.Symbol,
+		"stopPrice": fmt.Sprintf("%.8f", current.StopPrice),
+	}).Info("Replacing OCO order.")
+	if err := s.CancelStopOrder(trade); err != nil {
+		return
+	}
+	s.triggerLimitSell(trade, locked)
+}
+
+// OnListStatus records the status of the OCO order list of a trade. The
+// fills and cancels of its orders come in their own execution reports.
+func (s *TradeService) OnListStatus(event *exchange.UserStreamEvent) {
+	s.executionLock.Lock()
+	defer s.executionLock.Unlock()
+
+	listStatus := event.ListStatus
+
+	var trade *types.Trade
+	s.lock.RLock()
+	for _, order := range listStatus.Orders {
+		if found, ok := s.TradesByClientID[order.ClientOrderID]; ok {
+			trade = found
+			break
+		}
+	}
+	s.lock.RUnlock()
+	if trade == nil {
+		log.WithFields(log.Fields{
+			"listClientOrderId": listStatus.ListClientOrderID,
+		}).Debugf("Failed to find trade for list status")
+		return
+	}
+
+	trade.AddHistory(types.HistoryEntry{
+		Timestamp: time.Now(),
+		Type:      types.HistoryTypeListStatus,
+		Fields:    exchange.ToBinanceListStatus(listStatus),
+	})
+	if trade.ApplyListStatus(listStatus.ListClientOrderID, listStatus.OrderListID,
+		listStatus.ListStatusType, listStatus.ListOrderStatus) {
+		log.WithFields(log.Fields{
+			"tradeId":         trade.State.TradeID,
+			"symbol":          trade.State.Symbol,
+			"orderListId":     listStatus.OrderListID,
+			"listOrderStatus": listStatus.ListOrderStatus,
+		}).Info("OCO order list status updated.")
+	}
+
+	db.DbUpdateTrade(trade)
+	s.BroadcastTradeUpdate(trade)
+}
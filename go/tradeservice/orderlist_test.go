@@ -0,0 +1,129 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package tradeservice
+
+import (
+	"github.com/crankykernel/binanceapi-go"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/exchange"
+	"gitlab.com/crankykernel/maker/go/replay"
+	"gitlab.com/crankykernel/maker/go/types"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestOrderList(t *testing.T) {
+	directory, err := ioutil.TempDir("", "maker-orderlist")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+	db.DbOpenFile(path.Join(directory, "maker.db"))
+	defer db.DbClose()
+
+	market := &testMarket{price: 0.0010}
+	paper := exchange.NewSteppedPaperExchange(market)
+	service := NewTradeService(paper)
+	reports := [][]byte{}
+	deliver := func() {
+		for _, event := range paper.PendingEvents() {
+			switch event.Type {
+			case exchange.UserStreamEventExecutionReport:
+				reports = append(reports, event.Raw)
+				service.OnExecutionReport(event)
+			case exchange.UserStreamEventListStatus:
+				service.OnListStatus(event)
+			}
+		}
+	}
+	buy := func(trade *types.Trade) {
+		trade.State.Symbol = "ETHBTC"
+		trade.SetStopLoss(true, 5)
+		trade.SetStopLossOnExchange(true)
+		trade.SetLimitSellByPercent(10)
+		clientOrderId, err := service.MakeOrderID()
+		assert.Nil(t, err)
+		trade.AddClientOrderID(clientOrderId)
+		service.AddNewTrade(trade)
+		_, err = paper.PostOrder(exchange.OrderParameters{
+			Symbol:        "ETHBTC",
+			Side:          exchange.OrderSideBuy,
+			Type:          exchange.OrderTypeLimit,
+			Quantity:      1000,
+			Price:         0.001,
+			ClientOrderID: clientOrderId,
+		})
+		assert.Nil(t, err)
+		deliver()
+		deliver()
+	}
+
+	// The limit sell and the stop are placed as an OCO.
+	trade := types.NewTrade()
+	buy(trade)
+	assert.Equal(t, types.TradeStatusPendingSell, trade.State.Status)
+	assert.Equal(t, string(exchange.OrderTypeLimitMaker), trade.State.SellOrder.Type)
+	assert.Equal(t, float64(999), trade.State.SellOrder.Quantity)
+	assert.NotNil(t, trade.State.OrderList)
+	assert.Equal(t, "EXECUTING", trade.State.OrderList.ListOrderStatus)
+	stopOrder := trade.OpenStopOrder()
+	assert.NotNil(t, stopOrder)
+	assert.Equal(t, float64(999), stopOrder.Quantity)
+	assert.Equal(t, 0.0009519, stopOrder.StopPrice)
+
+	// Moving the stop replaces the OCO.
+	service.UpdateStopLoss(trade, types.StopLossSettings{
+		Enabled:    true,
+		Percent:    4,
+		OnExchange: true,
+	})
+	deliver()
+	assert.Len(t, trade.State.StopLoss.Orders, 2)
+	assert.Equal(t, binanceapi.OrderStatusCanceled, trade.State.StopLoss.Orders[0].Status)
+	assert.Equal(t, 0.00096192, trade.OpenStopOrder().StopPrice)
+	assert.Equal(t, types.TradeStatusPendingSell, trade.State.Status)
+	assert.Equal(t, trade.State.StopLoss.Orders[1].ClientOrderID,
+		trade.State.OrderList.StopClientOrderID)
+
+	// The stop triggers, the limit sell expires.
+	paper.OnTrade(&exchange.MarketTrade{Symbol: "ETHBTC", Price: 0.00096, Quantity: 10000})
+	market.price = 0.00096
+	service.OnLastTrade(&exchange.MarketTrade{Symbol: "ETHBTC", Price: 0.00096})
+	deliver()
+	assert.Equal(t, types.TradeStatusDone, trade.State.Status)
+	assert.Equal(t, binanceapi.OrderStatus("EXPIRED"), trade.State.SellOrder.Status)
+	assert.Equal(t, float64(999), trade.State.SellFillQuantity)
+	assert.Equal(t, "ALL_DONE", trade.State.OrderList.ListOrderStatus)
+
+	result, err := replay.Replay(trade.State, reports, 1)
+	assert.Nil(t, err)
+	for _, difference := range result.Differences {
+		assert.Contains(t, []string{"OpenTime", "CloseTime"}, difference.Field)
+	}
+
+	// The limit sell fills, the stop expires.
+	market.price = 0.0010
+	paper.OnTrade(&exchange.MarketTrade{Symbol: "ETHBTC", Price: 0.0010, Quantity: 1})
+	trade = types.NewTrade()
+	buy(trade)
+	paper.OnTrade(&exchange.MarketTrade{Symbol: "ETHBTC", Price: 0.0012, Quantity: 10000})
+	deliver()
+	assert.Equal(t, types.TradeStatusDone, trade.State.Status)
+	assert.Equal(t, float64(999), trade.State.SellFillQuantity)
+	assert.False(t, trade.State.StopLoss.Triggered)
+	assert.Equal(t, binanceapi.OrderStatus("EXPIRED"), trade.State.StopLoss.Orders[0].Status)
+	assert.Nil(t, trade.OpenStopOrder())
+}
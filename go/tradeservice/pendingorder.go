@@ -0,0 +1,90 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package tradeservice
+
+import (
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/types"
+)
+
+// OrderFailed updates the trade of an order whose outcome was pending once
+// the journal finds it was never placed, as no report will ever arrive for
+// it. A failed buy fails the trade, or ends the buy with what was filled. A
+// failed sell order is marked rejected so the trade can go on without it.
+func (s *TradeService) OrderFailed(clientOrderId string, reason string) {
+	s.lock.RLock()
+	trade := s.TradesByClientID[clientOrderId]
+	s.lock.RUnlock()
+	if trade == nil {
+		log.WithField("clientOrderId", clientOrderId).
+			Debugf("No trade for failed pending order.")
+		return
+	}
+
+	s.executionLock.Lock()
+	defer s.executionLock.Unlock()
+	if trade.IsDone() {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"tradeId":       trade.State.TradeID,
+		"symbol":        trade.State.Symbol,
+		"clientOrderId": clientOrderId,
+		"reason":        reason,
+	}).Warnf("Pending order was never placed.")
+	historyFields := map[string]interface{}{
+		"clientOrderId": clientOrderId,
+		"success":       false,
+		"error":         reason,
+	}
+
+	if trade.State.Status == types.TradeStatusNew {
+		if trade.State.BuyFillQuantity == 0 {
+			s.FailTrade(trade)
+			return
+		}
+		trade.AddHistoryEntry(types.HistoryTypeBuyReplace, historyFields)
+		trade.EndBuy()
+		s.TriggerSells(trade)
+		db.DbUpdateTrade(trade)
+		s.BroadcastTradeUpdate(trade)
+		return
+	}
+
+	orderList := trade.State.OrderList
+	if orderList != nil && (orderList.LimitClientOrderID == clientOrderId ||
+		orderList.StopClientOrderID == clientOrderId) {
+		// Neither order of the OCO was placed, the stop order is placed on
+		// its own instead.
+		if stopOrder := trade.StopOrderForClientOrderId(orderList.StopClientOrderID); stopOrder != nil {
+			stopOrder.Status = orderStatusRejected
+		}
+		trade.State.OrderList = nil
+		trade.State.LimitSell.Enabled = false
+	} else if stopOrder := trade.StopOrderForClientOrderId(clientOrderId); stopOrder != nil {
+		stopOrder.Status = orderStatusRejected
+	} else if target := trade.TakeProfitTargetForClientOrderId(clientOrderId); target != nil {
+		target.Status = orderStatusRejected
+	} else if trade.State.Status == types.TradeStatusWatching {
+		// A limit sell never placed.
+		trade.State.LimitSell.Enabled = false
+	}
+	trade.AddHistoryEntry(types.HistoryTypeSellOrder, historyFields)
+	db.DbUpdateTrade(trade)
+	s.BroadcastTradeUpdate(trade)
+	s.SyncStopOrder(trade, false)
+}
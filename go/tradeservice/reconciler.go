@@ -0,0 +1,668 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tradeservice
+
+import (
+	"errors"
+	"fmt"
+	"github.com/crankykernel/binanceapi-go"
+	"gitlab.com/crankykernel/maker/go/clientnotificationservice"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/exchange"
+	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/types"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Order statuses that may not be defined by the Binance API package.
+const (
+	orderStatusRejected binanceapi.OrderStatus = "REJECTED"
+	orderStatusExpired  binanceapi.OrderStatus = "EXPIRED"
+)
+
+// Quantities closer than this are considered equal.
+const quantityTolerance = 0.00000001
+
+// Reconciler periodically compares the buy and sell orders of open trades
+// with the open orders and fills on the exchange, and repairs fills and
+// cancels missed from the user stream, for example while its websocket was
+// reconnecting.
+//
+// A difference must be seen on two consecutive runs before it is repaired,
+// so execution reports that were only delayed are not applied twice.
+type Reconciler struct {
+	tradeService *TradeService
+	notices      *clientnotificationservice.Service
+	interval     time.Duration
+
+	lock     sync.Mutex
+	suspects map[string]string
+}
+
+func NewReconciler(tradeService *TradeService,
+	notices *clientnotificationservice.Service, interval time.Duration) *Reconciler {
+	return &Reconciler{
+		tradeService: tradeService,
+		notices:      notices,
+		interval:     interval,
+		suspects:     make(map[string]string),
+	}
+}
+
+// Run reconciles all open trades every interval. It does not return.
+func (r *Reconciler) Run() {
+	for {
+		time.Sleep(r.interval)
+		r.Reconcile()
+	}
+}
+
+// Reconcile checks all open trades against the exchange once.
+func (r *Reconciler) Reconcile() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	suspects := map[string]string{}
+	for symbol, trades := range r.openTradesBySymbol() {
+		snapshot, err := newExchangeSnapshot(r.tradeService.exchange, symbol)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"symbol": symbol,
+			}).Warn("Reconciler: failed to get open orders.")
+			continue
+		}
+		r.prefetch(trades, snapshot)
+		for _, trade := range trades {
+			if key := r.reconcileTrade(trade, snapshot, false); key != "" {
+				suspects[trade.State.TradeID] = key
+			}
+		}
+	}
+	r.suspects = suspects
+}
+
+func (r *Reconciler) openTradesBySymbol() map[string][]*types.Trade {
+	bySymbol := map[string][]*types.Trade{}
+	r.tradeService.lock.RLock()
+	defer r.tradeService.lock.RUnlock()
+	for _, trade := range r.tradeService.TradesByLocalID {
+		if trade.State.Status == types.TradeStatusArmed {
+			// Nothing on the exchange until the entry is triggered.
+			continue
+		}
+		if !trade.IsDone() {
+			bySymbol[trade.State.Symbol] = append(bySymbol[trade.State.Symbol], trade)
+		}
+	}
+	return bySymbol
+}
+
+// Returns a key describing the difference found if it was not repaired on
+// this run. On restore differences are repaired immediately as there are no
+// execution reports in flight.
+func (r *Reconciler) reconcileTrade(trade *types.Trade, snapshot *exchangeSnapshot,
+	restore bool) string {
+	s := r.tradeService
+	s.executionLock.Lock()
+	defer s.executionLock.Unlock()
+
+	logFields := log.Fields{
+		"tradeId": trade.State.TradeID,
+		"symbol":  trade.State.Symbol,
+	}
+
+	if trade.IsDone() {
+		return ""
+	}
+
+	d, err := checkTrade(trade, snapshot)
+	if err == errNotFetched {
+		// The trade changed since the exchange state was fetched, keep
+		// any difference already found for the next run.
+		log.WithFields(logFields).Debugf("Reconciler: trade changed while fetching orders, will check on next run.")
+		return r.suspects[trade.State.TradeID]
+	}
+	if err != nil {
+		log.WithError(err).WithFields(logFields).Warn("Reconciler: failed to check trade.")
+		return ""
+	}
+	if len(d.corrections) == 0 {
+		return ""
+	}
+
+	key := strings.Join(d.corrections, "; ")
+	if !restore && r.suspects[trade.State.TradeID] != key {
+		log.WithFields(logFields).Infof("Reconciler: difference found, will repair if still present on next run: %s", key)
+		return key
+	}
+
+	log.WithFields(logFields).Warnf("Reconciler: repairing trade: %s", key)
+	triggerLimitSell := applyDiscrepancy(s, trade, d)
+	if trade.State.BuyChase.Replacing && isFinalOrderStatus(trade.State.LastBuyStatus) {
+		// The cancel of a chased buy was missed.
+		s.replaceBuy(trade)
+	}
+
+	r.recordCorrections(trade, d.corrections, restore)
+
+	if triggerLimitSell {
+		s.TriggerSells(trade)
+	}
+
+	return ""
+}
+
+// Fetches the exchange state the checks of the trades need without holding
+// the execution lock, so order placement is never blocked on the requests.
+// What a check needs can depend on what was already fetched, such as the
+// fills of an order found by its client order ID, so the trades are checked
+// until nothing more is requested.
+func (r *Reconciler) prefetch(trades []*types.Trade, snapshot *exchangeSnapshot) {
+	s := r.tradeService
+	for pass := 0; pass < maxPrefetchPasses; pass++ {
+		for _, trade := range trades {
+			s.executionLock.Lock()
+			if !trade.IsDone() {
+				checkTrade(trade, snapshot)
+			}
+			s.executionLock.Unlock()
+		}
+		if !snapshot.fetch() {
+			return
+		}
+	}
+}
+
+// Records the corrections made to a trade in its history, saves it and
+// notifies clients.
+func (r *Reconciler) recordCorrections(trade *types.Trade, corrections []string, restore bool) {
+	s := r.tradeService
+	data := map[string]interface{}{
+		"corrections": corrections,
+	}
+	if restore {
+		data["restore"] = true
+	}
+	trade.AddHistoryEntry(types.HistoryTypeReconciled, data)
+	if trade.IsDone() {
+		if trade.State.CloseTime == nil {
+			closeTime := time.Now()
+			trade.State.CloseTime = &closeTime
+		}
+		s.exchange.RemoveSymbol(trade.State.Symbol)
+	}
+	db.DbUpdateTrade(trade)
+	s.BroadcastTradeUpdate(trade)
+
+	if r.notices != nil {
+		r.notices.Broadcast(clientnotificationservice.NewNotice(clientnotificationservice.LevelWarning,
+			fmt.Sprintf("Reconciled %s trade with exchange: %s", trade.State.Symbol,
+				strings.Join(corrections, "; "))).
+			WithData(map[string]interface{}{
+				"tradeId":     trade.State.TradeID,
+				"corrections": corrections,
+			}))
+	}
+}
+
+// The differences between a trade and the exchange.
+type discrepancy struct {
+	// The order whose status is to be applied to the trade.
+	buyOrder  *exchange.Order
+	sellOrder *exchange.Order
+
+	// The exchange's view of the open stop order.
+	stopOrder *exchange.Order
+
+	// Replacement fills, nil if unchanged.
+	buyFills  []types.OrderFill
+	sellFills []types.OrderFill
+
+	corrections []string
+}
+
+func checkTrade(trade *types.Trade, snapshot *exchangeSnapshot) (*discrepancy, error) {
+	state := &trade.State
+	d := &discrepancy{}
+
+	buyOrderId := state.BuyOrderId
+	if state.Status == types.TradeStatusNew && buyOrderId == 0 {
+		// The NEW report for the buy was missed. The buy is the first
+		// order, it may not have been placed yet.
+		orders, err := snapshot.tradeOrders(state)
+		if err != nil {
+			return nil, err
+		}
+		if len(orders) == 0 {
+			return d, nil
+		}
+		order := orders[0]
+		buyOrderId = order.OrderID
+		d.buyOrder = order
+		d.corrections = append(d.corrections,
+			fmt.Sprintf("buy order %d %s", order.OrderID, order.Status))
+	}
+
+	if buyOrderId != 0 && !isFinalOrderStatus(state.LastBuyStatus) {
+		order := d.buyOrder
+		if order == nil {
+			var err error
+			if order, err = snapshot.getOrder(buyOrderId); err != nil {
+				return nil, err
+			}
+		}
+		fills, err := checkFills(snapshot, order, state.BuySideFills, true)
+		if err != nil {
+			return nil, err
+		}
+		if fills != nil {
+			d.buyFills = fills
+			d.corrections = append(d.corrections, fmt.Sprintf("buy order %d fills %.8f -> %.8f",
+				order.OrderID, orderFillQuantity(state.BuySideFills, order.OrderID, true),
+				orderFillQuantity(fills, order.OrderID, true)))
+		}
+		if d.buyOrder == nil && binanceapi.OrderStatus(order.Status) != state.LastBuyStatus {
+			switch order.Status {
+			case exchange.OrderStatusNew:
+			case exchange.OrderStatusPartiallyFilled:
+				// Only of interest if the fills differ.
+				if fills != nil {
+					d.buyOrder = order
+				}
+			default:
+				d.buyOrder = order
+				d.corrections = append(d.corrections,
+					fmt.Sprintf("buy order %d %s", order.OrderID, order.Status))
+			}
+		}
+	}
+
+	switch state.Status {
+	case types.TradeStatusWatching:
+	case types.TradeStatusPendingSell:
+	default:
+		return d, nil
+	}
+
+	// A stop order on the exchange may have triggered and filled while
+	// Maker was not running.
+	if stopOrder := trade.OpenStopOrder(); stopOrder != nil {
+		order, err := snapshot.getOrderByClientId(stopOrder.ClientOrderID)
+		if err == errNotFetched {
+			return nil, err
+		}
+		if err == nil && binanceapi.OrderStatus(order.Status) != stopOrder.Status &&
+			!(stopOrder.Status == "" && order.Status == exchange.OrderStatusNew) {
+			fills, err := checkFills(snapshot, order, state.SellSideFills, false)
+			if err != nil {
+				return nil, err
+			}
+			if fills != nil {
+				d.sellFills = fills
+				d.corrections = append(d.corrections, fmt.Sprintf("stop order %d fills %.8f -> %.8f",
+					order.OrderID, orderFillQuantity(state.SellSideFills, order.OrderID, false),
+					orderFillQuantity(fills, order.OrderID, false)))
+			}
+			d.corrections = append(d.corrections,
+				fmt.Sprintf("stop order %d %s", order.OrderID, order.Status))
+			d.stopOrder = order
+			return d, nil
+		}
+	}
+
+	// The most recent order is the sell order, unless there have been no
+	// sells. Its NEW report may have been missed.
+	var order *exchange.Order
+	if len(state.ClientOrderIDs) > 1 {
+		orders, err := snapshot.tradeOrders(state)
+		if err != nil {
+			return nil, err
+		}
+		if len(orders) > 0 && orders[len(orders)-1].OrderID != buyOrderId {
+			order = orders[len(orders)-1]
+		}
+	}
+	if order == nil {
+		if state.Status != types.TradeStatusPendingSell || state.SellOrderId == 0 {
+			return d, nil
+		}
+		var err error
+		if order, err = snapshot.getOrder(state.SellOrderId); err != nil {
+			return nil, err
+		}
+	}
+
+	// The final report for the order was already received.
+	if order.OrderID == state.SellOrderId &&
+		binanceapi.OrderStatus(order.Status) == state.SellOrder.Status &&
+		isFinalOrderStatus(state.SellOrder.Status) {
+		return d, nil
+	}
+
+	// Fills recorded without an order ID can only belong to the current sell
+	// order.
+	legacy := order.OrderID == state.SellOrderId
+	fills, err := checkFills(snapshot, order, state.SellSideFills, legacy)
+	if err != nil {
+		return nil, err
+	}
+	if fills != nil {
+		d.sellFills = fills
+		d.corrections = append(d.corrections, fmt.Sprintf("sell order %d fills %.8f -> %.8f",
+			order.OrderID, orderFillQuantity(state.SellSideFills, order.OrderID, legacy),
+			orderFillQuantity(fills, order.OrderID, legacy)))
+	}
+
+	var status types.TradeStatus
+	switch order.Status {
+	case exchange.OrderStatusNew:
+		status = types.TradeStatusPendingSell
+	case exchange.OrderStatusPartiallyFilled:
+		status = types.TradeStatusPendingSell
+	case exchange.OrderStatusFilled:
+		status = types.TradeStatusDone
+	default:
+		status = types.TradeStatusWatching
+	}
+	if order.OrderID != state.SellOrderId || status != state.Status {
+		d.sellOrder = order
+		d.corrections = append(d.corrections,
+			fmt.Sprintf("sell order %d %s", order.OrderID, order.Status))
+	}
+
+	return d, nil
+}
+
+// Returns the trade's fills with those of the order replaced by the
+// exchange's, or nil if the exchange doesn't have more.
+func checkFills(snapshot *exchangeSnapshot, order *exchange.Order,
+	fills []types.OrderFill, legacy bool) ([]types.OrderFill, error) {
+	recorded := orderFillQuantity(fills, order.OrderID, legacy)
+	if order.Status.IsOpen() && order.ExecutedQuantity <= recorded+quantityTolerance {
+		return nil, nil
+	}
+	exchangeFills, err := snapshot.getFills(order.OrderID)
+	if err != nil {
+		return nil, err
+	}
+	if orderFillQuantity(exchangeFills, order.OrderID, false) <= recorded+quantityTolerance {
+		return nil, nil
+	}
+	replaced := []types.OrderFill{}
+	for _, fill := range fills {
+		if fill.OrderID == order.OrderID || (legacy && fill.OrderID == 0) {
+			continue
+		}
+		replaced = append(replaced, fill)
+	}
+	return append(replaced, exchangeFills...), nil
+}
+
+// Returns true if the limit sell should be triggered.
+func applyDiscrepancy(s *TradeService, trade *types.Trade, d *discrepancy) bool {
+	state := &trade.State
+	triggerLimitSell := false
+
+	if d.buyFills != nil {
+		state.BuySideFills = d.buyFills
+		trade.UpdateBuyState()
+		s.UpdateSellableQuantity(trade)
+	}
+
+	if order := d.buyOrder; order != nil {
+		state.BuyOrderId = order.OrderID
+		pending := state.Status == types.TradeStatusNew ||
+			state.Status == types.TradeStatusPendingBuy
+		switch order.Status {
+		case exchange.OrderStatusNew:
+			fallthrough
+		case exchange.OrderStatusPartiallyFilled:
+			if state.Status == types.TradeStatusNew {
+				state.Status = types.TradeStatusPendingBuy
+			}
+		case exchange.OrderStatusFilled:
+			if pending {
+				state.Status = types.TradeStatusWatching
+				triggerLimitSell = true
+			}
+		default:
+			if state.BuyChase.Replacing {
+				// The replacement is placed once repaired.
+			} else if state.BuyFillQuantity == 0 {
+				state.Status = types.TradeStatusCanceled
+			} else if pending {
+				state.Status = types.TradeStatusWatching
+			}
+		}
+		state.LastBuyStatus = binanceapi.OrderStatus(order.Status)
+	}
+
+	if d.sellFills != nil {
+		state.SellSideFills = d.sellFills
+		trade.UpdateSellState()
+	}
+
+	if order := d.stopOrder; order != nil {
+		trade.SetStopOrderStatus(order.OrderID, binanceapi.OrderStatus(order.Status),
+			orderFillQuantity(state.SellSideFills, order.OrderID, false))
+	}
+
+	if order := d.sellOrder; order != nil {
+		state.SellOrderId = order.OrderID
+		state.SellOrder.Status = binanceapi.OrderStatus(order.Status)
+		switch order.Status {
+		case exchange.OrderStatusNew:
+			fallthrough
+		case exchange.OrderStatusPartiallyFilled:
+			state.Status = types.TradeStatusPendingSell
+		case exchange.OrderStatusFilled:
+			state.Status = types.TradeStatusDone
+		default:
+			state.Status = types.TradeStatusWatching
+		}
+	}
+
+	return triggerLimitSell
+}
+
+// errNotFetched is returned by a snapshot for exchange state it has not
+// fetched yet. The state is fetched by the next call to fetch.
+var errNotFetched = errors.New("not fetched from exchange")
+
+// The most passes prefetch makes over the trades of a symbol, enough for the
+// longest chain of requests a check makes.
+const maxPrefetchPasses = 8
+
+// The orders and fills of a symbol on the exchange. Trades are checked
+// against a snapshot with the execution lock held, so it never calls the
+// exchange itself. Orders that are not open, and fills, are requested by the
+// checks that need them and fetched by fetch without the lock.
+type exchangeSnapshot struct {
+	exchange   exchange.Exchange
+	symbol     string
+	openOrders []exchange.Order
+
+	// Requested but not yet fetched entries are nil.
+	orders       map[int64]*fetchedOrder
+	clientOrders map[string]*fetchedOrder
+	fills        map[int64]*fetchedFills
+}
+
+type fetchedOrder struct {
+	order *exchange.Order
+	err   error
+}
+
+type fetchedFills struct {
+	fills []types.OrderFill
+	err   error
+}
+
+func newExchangeSnapshot(ex exchange.Exchange, symbol string) (*exchangeSnapshot, error) {
+	openOrders, err := ex.GetOpenOrders(symbol)
+	if err != nil {
+		return nil, err
+	}
+	return &exchangeSnapshot{
+		exchange:     ex,
+		symbol:       symbol,
+		openOrders:   openOrders,
+		orders:       make(map[int64]*fetchedOrder),
+		clientOrders: make(map[string]*fetchedOrder),
+		fills:        make(map[int64]*fetchedFills),
+	}, nil
+}
+
+// Fetches the requested orders and fills. Returns false if nothing was
+// requested.
+func (s *exchangeSnapshot) fetch() bool {
+	fetched := false
+	for orderId, result := range s.orders {
+		if result == nil {
+			order, err := s.exchange.GetOrderByOrderId(s.symbol, orderId)
+			s.orders[orderId] = &fetchedOrder{order: order, err: err}
+			fetched = true
+		}
+	}
+	for clientOrderId, result := range s.clientOrders {
+		if result == nil {
+			order, err := s.exchange.GetOrderByClientId(s.symbol, clientOrderId)
+			s.clientOrders[clientOrderId] = &fetchedOrder{order: order, err: err}
+			fetched = true
+		}
+	}
+	for orderId, result := range s.fills {
+		if result == nil {
+			fills, err := s.exchange.GetOrderFills(s.symbol, orderId)
+			orderFills := []types.OrderFill{}
+			for _, fill := range fills {
+				orderFills = append(orderFills, fill.ToOrderFill())
+			}
+			s.fills[orderId] = &fetchedFills{fills: orderFills, err: err}
+			fetched = true
+		}
+	}
+	return fetched
+}
+
+func (s *exchangeSnapshot) getOrder(orderId int64) (*exchange.Order, error) {
+	for i := range s.openOrders {
+		if s.openOrders[i].OrderID == orderId {
+			return &s.openOrders[i], nil
+		}
+	}
+	result := s.orders[orderId]
+	if result == nil {
+		s.orders[orderId] = nil
+		return nil, errNotFetched
+	}
+	return result.order, result.err
+}
+
+func (s *exchangeSnapshot) getOrderByClientId(clientOrderId string) (*exchange.Order, error) {
+	for i := range s.openOrders {
+		if s.openOrders[i].ClientOrderID == clientOrderId {
+			return &s.openOrders[i], nil
+		}
+	}
+	result := s.clientOrders[clientOrderId]
+	if result == nil {
+		s.clientOrders[clientOrderId] = nil
+		return nil, errNotFetched
+	}
+	return result.order, result.err
+}
+
+func (s *exchangeSnapshot) getFills(orderId int64) ([]types.OrderFill, error) {
+	result := s.fills[orderId]
+	if result == nil {
+		s.fills[orderId] = nil
+		return nil, errNotFetched
+	}
+	return result.fills, result.err
+}
+
+// The quantity filled for an order, including fills without an order ID if
+// legacy is set.
+func orderFillQuantity(fills []types.OrderFill, orderId int64, legacy bool) float64 {
+	quantity := float64(0)
+	for _, fill := range fills {
+		if fill.OrderID == orderId || (legacy && fill.OrderID == 0) {
+			quantity += fill.Quantity
+		}
+	}
+	return quantity
+}
+
+// The orders of a trade found on the exchange, not counting take profit and
+// stop orders, in the order they were placed. Client order IDs can't be used
+// for this as only those generated by Maker sort by time; exchange order IDs
+// always increase.
+func (s *exchangeSnapshot) tradeOrders(state *types.TradeState) ([]*exchange.Order, error) {
+	orders := []*exchange.Order{}
+	notFetched := false
+	for clientOrderId := range state.ClientOrderIDs {
+		if isTargetOrStopClientOrderId(state, clientOrderId) {
+			continue
+		}
+		order, err := s.getOrderByClientId(clientOrderId)
+		if err == errNotFetched {
+			// Request all of the orders before returning.
+			notFetched = true
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		orders = append(orders, order)
+	}
+	if notFetched {
+		return nil, errNotFetched
+	}
+	sort.Slice(orders, func(i, j int) bool {
+		return orders[i].OrderID < orders[j].OrderID
+	})
+	return orders, nil
+}
+
+func isTargetOrStopClientOrderId(state *types.TradeState, clientOrderId string) bool {
+	for _, target := range state.TakeProfit {
+		if target.ClientOrderID == clientOrderId {
+			return true
+		}
+	}
+	for _, order := range state.StopLoss.Orders {
+		if order.ClientOrderID == clientOrderId {
+			return true
+		}
+	}
+	return false
+}
+
+func isFinalOrderStatus(status binanceapi.OrderStatus) bool {
+	switch status {
+	case binanceapi.OrderStatusFilled:
+	case binanceapi.OrderStatusCanceled:
+	case orderStatusRejected:
+	case orderStatusExpired:
+	default:
+		return false
+	}
+	return true
+}
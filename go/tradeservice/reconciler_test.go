@@ -0,0 +1,254 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tradeservice
+
+import (
+	"github.com/crankykernel/binanceapi-go"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/exchange"
+	"gitlab.com/crankykernel/maker/go/types"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+type testMarket struct {
+	exchange.Exchange
+	price float64
+}
+
+func (m *testMarket) GetPrice(symbol string, priceSource types.PriceSource) (float64, error) {
+	return m.price, nil
+}
+
+func (m *testMarket) GetSymbolInfo(symbol string) (exchange.SymbolInfo, error) {
+	return exchange.SymbolInfo{BaseAsset: "ETH", QuoteAsset: "BTC",
+		TickSize: 0.00000001, StepSize: 1}, nil
+}
+
+func (m *testMarket) AddSymbol(symbol string) {
+}
+
+func (m *testMarket) RemoveSymbol(symbol string) {
+}
+
+func (m *testMarket) SubscribeTrades() exchange.TradeChannel {
+	return make(exchange.TradeChannel)
+}
+
+// lockCheckingExchange fails the test if orders or fills are requested while
+// the execution lock is held.
+type lockCheckingExchange struct {
+	*exchange.PaperExchange
+	t       *testing.T
+	service *TradeService
+}
+
+func (e *lockCheckingExchange) checkUnlocked() {
+	acquired := make(chan bool)
+	go func() {
+		e.service.executionLock.Lock()
+		e.service.executionLock.Unlock()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		e.t.Error("exchange called with the execution lock held")
+	}
+}
+
+func (e *lockCheckingExchange) GetOrderByOrderId(symbol string, orderId int64) (*exchange.Order, error) {
+	e.checkUnlocked()
+	return e.PaperExchange.GetOrderByOrderId(symbol, orderId)
+}
+
+func (e *lockCheckingExchange) GetOrderByClientId(symbol string, clientOrderId string) (*exchange.Order, error) {
+	e.checkUnlocked()
+	return e.PaperExchange.GetOrderByClientId(symbol, clientOrderId)
+}
+
+func (e *lockCheckingExchange) GetOrderFills(symbol string, orderId int64) ([]exchange.Fill, error) {
+	e.checkUnlocked()
+	return e.PaperExchange.GetOrderFills(symbol, orderId)
+}
+
+// Fills and cancels whose execution reports were missed are repaired on the
+// second reconcile run.
+func TestReconcileMissedReports(t *testing.T) {
+	directory, err := ioutil.TempDir("", "maker-reconcile")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+	db.DbOpenFile(path.Join(directory, "maker.db"))
+	defer db.DbClose()
+
+	paper := exchange.NewSteppedPaperExchange(&testMarket{price: 0.0010})
+	checking := &lockCheckingExchange{PaperExchange: paper, t: t}
+	service := NewTradeService(checking)
+	checking.service = service
+	reconciler := NewReconciler(service, nil, time.Minute)
+
+	trade := types.NewTrade()
+	trade.State.Symbol = "ETHBTC"
+	clientOrderId, err := service.MakeOrderID()
+	assert.Nil(t, err)
+	trade.AddClientOrderID(clientOrderId)
+	service.AddNewTrade(trade)
+
+	_, err = paper.PostOrder(exchange.OrderParameters{
+		Symbol:        "ETHBTC",
+		Side:          exchange.OrderSideBuy,
+		Type:          exchange.OrderTypeLimit,
+		Quantity:      10,
+		Price:         0.0009,
+		ClientOrderID: clientOrderId,
+	})
+	assert.Nil(t, err)
+
+	// Nothing to repair while the reports are delivered.
+	for _, event := range paper.PendingEvents() {
+		service.OnExecutionReport(event)
+	}
+	assert.Equal(t, types.TradeStatusPendingBuy, trade.State.Status)
+	reconciler.Reconcile()
+	reconciler.Reconcile()
+	assert.Equal(t, types.TradeStatusPendingBuy, trade.State.Status)
+
+	// Fill the buy, dropping the reports.
+	paper.OnTrade(&exchange.MarketTrade{Symbol: "ETHBTC", Price: 0.0008, Quantity: 100})
+	assert.Len(t, paper.PendingEvents(), 1)
+
+	reconciler.Reconcile()
+	assert.Equal(t, types.TradeStatusPendingBuy, trade.State.Status)
+	reconciler.Reconcile()
+	assert.Equal(t, types.TradeStatusWatching, trade.State.Status)
+	assert.Equal(t, binanceapi.OrderStatusFilled, trade.State.LastBuyStatus)
+	assert.InDelta(t, 9.99, trade.State.BuyFillQuantity, 0.00000001)
+	assert.Equal(t, float64(9), trade.State.SellableQuantity)
+	history := trade.State.History[len(trade.State.History)-1]
+	assert.Equal(t, types.HistoryTypeReconciled, history.Type)
+
+	// Market sell, dropping the reports.
+	assert.Nil(t, service.MarketSell(trade, false))
+	assert.Len(t, paper.PendingEvents(), 2)
+
+	reconciler.Reconcile()
+	assert.Equal(t, types.TradeStatusWatching, trade.State.Status)
+	reconciler.Reconcile()
+	assert.Equal(t, types.TradeStatusDone, trade.State.Status)
+	assert.Equal(t, float64(9), trade.State.SellFillQuantity)
+	assert.NotNil(t, trade.State.CloseTime)
+}
+
+func TestReconcileStopOrder(t *testing.T) {
+	directory, err := ioutil.TempDir("", "maker-reconcile")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+	db.DbOpenFile(path.Join(directory, "maker.db"))
+	defer db.DbClose()
+
+	paper := exchange.NewSteppedPaperExchange(&testMarket{price: 0.0010})
+	checking := &lockCheckingExchange{PaperExchange: paper, t: t}
+	service := NewTradeService(checking)
+	checking.service = service
+	reconciler := NewReconciler(service, nil, time.Minute)
+	deliver := func() {
+		for _, event := range paper.PendingEvents() {
+			service.OnExecutionReport(event)
+		}
+	}
+
+	trade := types.NewTrade()
+	trade.State.Symbol = "ETHBTC"
+	trade.SetStopLoss(true, 5)
+	trade.SetStopLossOnExchange(true)
+	clientOrderId, err := service.MakeOrderID()
+	assert.Nil(t, err)
+	trade.AddClientOrderID(clientOrderId)
+	service.AddNewTrade(trade)
+
+	_, err = paper.PostOrder(exchange.OrderParameters{
+		Symbol:        "ETHBTC",
+		Side:          exchange.OrderSideBuy,
+		Type:          exchange.OrderTypeLimit,
+		Quantity:      1000,
+		Price:         0.001,
+		ClientOrderID: clientOrderId,
+	})
+	assert.Nil(t, err)
+	deliver()
+	deliver()
+	assert.Equal(t, binanceapi.OrderStatusNew, trade.OpenStopOrder().Status)
+
+	// The stop fills while Maker is not receiving reports.
+	paper.OnTrade(&exchange.MarketTrade{Symbol: "ETHBTC", Price: 0.00095, Quantity: 10000})
+	assert.NotEmpty(t, paper.PendingEvents())
+
+	reconciler.Reconcile()
+	assert.Equal(t, types.TradeStatusWatching, trade.State.Status)
+	reconciler.Reconcile()
+	assert.Equal(t, types.TradeStatusDone, trade.State.Status)
+	assert.True(t, trade.State.StopLoss.Triggered)
+	assert.Equal(t, float64(999), trade.State.SellFillQuantity)
+	assert.Equal(t, binanceapi.OrderStatusFilled, trade.State.StopLoss.Orders[0].Status)
+	assert.Nil(t, trade.OpenStopOrder())
+}
+
+// A missed sell is found for a trade whose buy has a client order ID not
+// generated by Maker, which sorts after the client order ID of the sell.
+func TestReconcileAdoptedClientOrderId(t *testing.T) {
+	directory, err := ioutil.TempDir("", "maker-reconcile")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+	db.DbOpenFile(path.Join(directory, "maker.db"))
+	defer db.DbClose()
+
+	paper := exchange.NewSteppedPaperExchange(&testMarket{price: 0.0010})
+	service := NewTradeService(paper)
+	reconciler := NewReconciler(service, nil, time.Minute)
+
+	trade := types.NewTrade()
+	trade.State.Symbol = "ETHBTC"
+	trade.AddClientOrderID("web_f3c1a9")
+	service.AddNewTrade(trade)
+
+	_, err = paper.PostOrder(exchange.OrderParameters{
+		Symbol:        "ETHBTC",
+		Side:          exchange.OrderSideBuy,
+		Type:          exchange.OrderTypeLimit,
+		Quantity:      10,
+		Price:         0.0009,
+		ClientOrderID: "web_f3c1a9",
+	})
+	assert.Nil(t, err)
+	paper.OnTrade(&exchange.MarketTrade{Symbol: "ETHBTC", Price: 0.0008, Quantity: 100})
+	for _, event := range paper.PendingEvents() {
+		service.OnExecutionReport(event)
+	}
+	assert.Equal(t, types.TradeStatusWatching, trade.State.Status)
+
+	// Market sell, dropping the reports.
+	assert.Nil(t, service.MarketSell(trade, false))
+	assert.Len(t, paper.PendingEvents(), 2)
+
+	reconciler.Reconcile()
+	reconciler.Reconcile()
+	assert.Equal(t, types.TradeStatusDone, trade.State.Status)
+	assert.Equal(t, float64(9), trade.State.SellFillQuantity)
+}
@@ -0,0 +1,194 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tradeservice
+
+import (
+	"fmt"
+	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/types"
+	"math"
+	"sort"
+)
+
+// Restore brings restored trades up to date with the exchange after Maker
+// was not running. Missed fills, cancels and sells are repaired immediately
+// and watching trades whose asset is no longer held are closed as abandoned.
+// Each change is recorded in the history of the trade.
+func (r *Reconciler) Restore() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for symbol, trades := range r.openTradesBySymbol() {
+		snapshot, err := newExchangeSnapshot(r.tradeService.exchange, symbol)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"symbol": symbol,
+			}).Warn("Restore: failed to get open orders.")
+			continue
+		}
+		r.prefetch(trades, snapshot)
+		for _, trade := range trades {
+			r.reconcileTrade(trade, snapshot, true)
+		}
+	}
+
+	r.restoreBalances()
+}
+
+// RestoreStopLosses triggers the stop loss of trades whose price passed it
+// while Maker was not running, instead of waiting for the next trade of the
+// symbol. To be called once the user stream is being processed so the
+// reports of the market sells are not missed.
+func (r *Reconciler) RestoreStopLosses() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, trades := range r.openTradesBySymbol() {
+		for _, trade := range trades {
+			r.restoreStopLoss(trade)
+		}
+	}
+}
+
+// The quantity of the base asset a trade still holds.
+func heldQuantity(trade *types.Trade) float64 {
+	switch trade.State.Status {
+	case types.TradeStatusPendingBuy:
+		return trade.State.BuyFillQuantity
+	case types.TradeStatusWatching:
+	case types.TradeStatusPendingSell:
+	default:
+		return 0
+	}
+	return trade.State.SellableQuantity - trade.State.SellFillQuantity
+}
+
+// Closes watching trades whose base asset is not covered by the account
+// balance, most likely because it was sold by hand. The balance is allocated
+// to trades with a sell order first as their quantity is locked in the
+// order, then to the remaining trades oldest first.
+func (r *Reconciler) restoreBalances() {
+	s := r.tradeService
+
+	byAsset := map[string][]*types.Trade{}
+	for symbol, trades := range r.openTradesBySymbol() {
+		symbolInfo, err := s.exchange.GetSymbolInfo(symbol)
+		if err != nil || symbolInfo.BaseAsset == "" {
+			continue
+		}
+		byAsset[symbolInfo.BaseAsset] = append(byAsset[symbolInfo.BaseAsset], trades...)
+	}
+
+	for asset, trades := range byAsset {
+		balance, err := s.exchange.GetBalance(asset)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"asset": asset,
+			}).Debugf("Restore: failed to get balance, not checking for assets sold outside of Maker.")
+			continue
+		}
+
+		sort.Slice(trades, func(i, j int) bool {
+			iSell := trades[i].State.Status == types.TradeStatusPendingSell
+			jSell := trades[j].State.Status == types.TradeStatusPendingSell
+			if iSell != jSell {
+				return iSell
+			}
+			return trades[i].State.TradeID < trades[j].State.TradeID
+		})
+
+		available := balance
+		for _, trade := range trades {
+			held := heldQuantity(trade)
+			if held <= available+quantityTolerance {
+				available = math.Max(available-held, 0)
+				continue
+			}
+			if trade.State.Status != types.TradeStatusWatching {
+				continue
+			}
+			r.abandonSoldTrade(trade, asset, balance, held)
+		}
+	}
+}
+
+func (r *Reconciler) abandonSoldTrade(trade *types.Trade, asset string, balance float64, held float64) {
+	s := r.tradeService
+	s.executionLock.Lock()
+	defer s.executionLock.Unlock()
+
+	if trade.State.Status != types.TradeStatusWatching {
+		return
+	}
+
+	correction := fmt.Sprintf("balance of %.8f %s does not cover %.8f held by trade, assumed sold outside of Maker",
+		balance, asset, held)
+	log.WithFields(log.Fields{
+		"tradeId": trade.State.TradeID,
+		"symbol":  trade.State.Symbol,
+	}).Warnf("Restore: abandoning trade: %s", correction)
+
+	trade.AddHistoryEntry(types.HistoryTypeAbandoned, nil)
+	trade.State.Status = types.TradeStatusAbandoned
+	r.recordCorrections(trade, []string{correction}, true)
+}
+
+func (r *Reconciler) restoreStopLoss(trade *types.Trade) {
+	s := r.tradeService
+	s.executionLock.Lock()
+	defer s.executionLock.Unlock()
+
+	switch trade.State.Status {
+	case types.TradeStatusWatching:
+	case types.TradeStatusPendingSell:
+	default:
+		return
+	}
+	if !trade.State.StopLoss.Enabled || trade.State.StopLoss.Triggered {
+		return
+	}
+
+	price, err := s.exchange.GetPrice(trade.State.Symbol, types.PriceSourceLast)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"symbol": trade.State.Symbol,
+		}).Warn("Restore: failed to get price, not checking stop loss.")
+		return
+	}
+
+	trade.State.LastPrice = price
+	trade.State.ProfitPercent = s.CalculateProfit(trade, price)
+	s.checkBreakEven(trade)
+	if trade.State.StopLoss.Trailing {
+		// The highs while not running are unknown, the stop level can
+		// only be ratcheted up from the current price.
+		s.updateTrailingStop(trade)
+	}
+	if !s.stopLossPassed(trade) {
+		return
+	}
+
+	var correction string
+	if trade.StopPriceActive() {
+		correction = fmt.Sprintf("stop loss at %.8f passed while Maker was not running, price %.8f",
+			trade.State.StopLoss.Price, price)
+	} else {
+		correction = fmt.Sprintf("stop loss of %.2f%% passed while Maker was not running, price %.8f, loss %.2f%%",
+			math.Abs(trade.State.StopLoss.Percent), price, trade.State.ProfitPercent)
+	}
+	r.recordCorrections(trade, []string{correction}, true)
+	s.checkStopLoss(trade)
+}
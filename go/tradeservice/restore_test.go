@@ -0,0 +1,126 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tradeservice
+
+import (
+	"github.com/crankykernel/binanceapi-go"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/exchange"
+	"gitlab.com/crankykernel/maker/go/types"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+type balanceExchange struct {
+	*exchange.PaperExchange
+	balances map[string]float64
+}
+
+func (e *balanceExchange) GetBalance(asset string) (float64, error) {
+	return e.balances[asset], nil
+}
+
+func postTestBuy(t *testing.T, service *TradeService, paper *exchange.PaperExchange,
+	price float64) *types.Trade {
+	trade := types.NewTrade()
+	trade.State.Symbol = "ETHBTC"
+	clientOrderId, err := service.MakeOrderID()
+	assert.Nil(t, err)
+	trade.AddClientOrderID(clientOrderId)
+	service.AddNewTrade(trade)
+	_, err = paper.PostOrder(exchange.OrderParameters{
+		Symbol:        "ETHBTC",
+		Side:          exchange.OrderSideBuy,
+		Type:          exchange.OrderTypeLimit,
+		Quantity:      10,
+		Price:         price,
+		ClientOrderID: clientOrderId,
+	})
+	assert.Nil(t, err)
+	for _, event := range paper.PendingEvents() {
+		service.OnExecutionReport(event)
+	}
+	return trade
+}
+
+func lastHistoryEntry(trade *types.Trade) types.HistoryEntry {
+	return trade.State.History[len(trade.State.History)-1]
+}
+
+func TestRestore(t *testing.T) {
+	directory, err := ioutil.TempDir("", "maker-restore")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+	db.DbOpenFile(path.Join(directory, "maker.db"))
+	defer db.DbClose()
+
+	market := &testMarket{price: 0.0010}
+	paper := exchange.NewSteppedPaperExchange(market)
+	ex := &balanceExchange{PaperExchange: paper, balances: map[string]float64{}}
+	service := NewTradeService(ex)
+
+	// A filled buy whose asset is then sold by hand.
+	sold := postTestBuy(t, service, paper, 0.0009)
+	paper.OnTrade(&exchange.MarketTrade{Symbol: "ETHBTC", Price: 0.0008, Quantity: 100})
+	for _, event := range paper.PendingEvents() {
+		service.OnExecutionReport(event)
+	}
+	assert.Equal(t, types.TradeStatusWatching, sold.State.Status)
+
+	// A partially filled buy, cancelled while not running.
+	partial := postTestBuy(t, service, paper, 0.0007)
+	partial.State.StopLoss.Enabled = true
+	partial.State.StopLoss.Percent = 5
+	db.DbUpdateTrade(partial)
+	paper.OnTrade(&exchange.MarketTrade{Symbol: "ETHBTC", Price: 0.0007, Quantity: 4})
+	assert.Nil(t, paper.CancelOrder("ETHBTC", partial.State.BuyOrderId))
+	assert.Len(t, paper.PendingEvents(), 2)
+
+	// Restart.
+	ex.balances["ETH"] = 3
+	market.price = 0.0006
+	service = NewTradeService(ex)
+	states, err := db.DbRestoreTradeState()
+	assert.Nil(t, err)
+	for _, state := range states {
+		service.RestoreTrade(types.NewTradeWithState(state))
+	}
+	reconciler := NewReconciler(service, nil, time.Minute)
+	reconciler.Restore()
+
+	partial = service.FindTradeByLocalID(partial.State.TradeID)
+	assert.Equal(t, types.TradeStatusWatching, partial.State.Status)
+	assert.Equal(t, binanceapi.OrderStatusCanceled, partial.State.LastBuyStatus)
+	assert.InDelta(t, 3.996, partial.State.BuyFillQuantity, 0.00000001)
+	assert.Equal(t, float64(3), partial.State.SellableQuantity)
+	assert.Equal(t, types.HistoryTypeReconciled, lastHistoryEntry(partial).Type)
+	assert.Equal(t, true, lastHistoryEntry(partial).Fields.(map[string]interface{})["restore"])
+
+	sold = service.FindTradeByLocalID(sold.State.TradeID)
+	assert.Equal(t, types.TradeStatusAbandoned, sold.State.Status)
+	assert.NotNil(t, sold.State.CloseTime)
+	assert.Equal(t, types.HistoryTypeReconciled, lastHistoryEntry(sold).Type)
+
+	// The stop loss was passed while not running.
+	reconciler.RestoreStopLosses()
+	assert.True(t, partial.State.StopLoss.Triggered)
+	assert.Equal(t, types.HistoryTypeReconciled, lastHistoryEntry(partial).Type)
+	assert.Len(t, partial.State.ClientOrderIDs, 2)
+}
@@ -0,0 +1,178 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package tradeservice
+
+import (
+	"fmt"
+	"github.com/crankykernel/binanceapi-go"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/exchange"
+	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/types"
+	"gitlab.com/crankykernel/maker/go/util"
+	"math"
+	"time"
+)
+
+// When the limit sell of a trade was last checked for chasing and the last
+// price then.
+type sellCheck struct {
+	time  time.Time
+	price float64
+}
+
+func (s *TradeService) UpdateSellChase(trade *types.Trade, settings types.SellChaseSettings) {
+	trade.ApplySellChaseSettings(settings)
+	log.WithFields(log.Fields{
+		"symbol":    trade.State.Symbol,
+		"tradeId":   trade.State.TradeID,
+		"enable":    settings.Enabled,
+		"interval":  settings.Interval,
+		"ticks":     settings.Ticks,
+		"minProfit": settings.MinProfit,
+	}).Infof("Sell chase settings updated")
+	trade.AddHistoryEntry(types.HistoryTypeSellChaseUpdate, settings)
+	db.DbUpdateTrade(trade)
+	s.BroadcastTradeUpdate(trade)
+}
+
+func (s *TradeService) checkSells(now time.Time) {
+	trades := []*types.Trade{}
+	s.lock.RLock()
+	for _, trade := range s.TradesByLocalID {
+		if trade.State.Status == types.TradeStatusPendingSell && trade.State.SellChase.Enabled {
+			trades = append(trades, trade)
+		}
+	}
+	s.lock.RUnlock()
+
+	for _, trade := range trades {
+		s.checkSell(trade, now)
+	}
+
+	// Forget sells no longer chased.
+	s.executionLock.Lock()
+	for tradeId := range s.sellChecks {
+		chased := false
+		for _, trade := range trades {
+			chased = chased || trade.State.TradeID == tradeId
+		}
+		if !chased {
+			delete(s.sellChecks, tradeId)
+		}
+	}
+	s.executionLock.Unlock()
+}
+
+func (s *TradeService) checkSell(trade *types.Trade, now time.Time) {
+	s.executionLock.Lock()
+	defer s.executionLock.Unlock()
+
+	state := &trade.State
+	if state.Status != types.TradeStatusPendingSell || !state.SellChase.Enabled ||
+		state.StopLoss.Triggered || state.TrailingProfit.Triggered {
+		return
+	}
+	switch state.SellOrder.Type {
+	case string(binanceapi.OrderTypeLimit):
+	case string(exchange.OrderTypeLimitMaker):
+	default:
+		// Market sells.
+		return
+	}
+
+	last, ok := s.sellChecks[state.TradeID]
+	if ok {
+		if state.SellChase.Interval > 0 {
+			if now.Sub(last.time) < time.Duration(state.SellChase.Interval)*time.Second {
+				return
+			}
+		} else if state.LastPrice == last.price {
+			return
+		}
+	}
+	s.sellChecks[state.TradeID] = sellCheck{time: now, price: state.LastPrice}
+	if !ok {
+		// The first check of a sell only starts the interval.
+		return
+	}
+	s.chaseSell(trade, now)
+}
+
+// The lowest price a sell may be chased down to, the price for the minimum
+// profit.
+func sellChaseFloor(trade *types.Trade, tickSize float64) float64 {
+	return limitSellPrice(trade, trade.State.SellChase.MinProfit, tickSize)
+}
+
+// Cancels the limit sell of a trade and places it again at the best ask, if
+// the best ask has moved down by enough ticks, but not below the minimum
+// profit.
+func (s *TradeService) chaseSell(trade *types.Trade, now time.Time) {
+	state := &trade.State
+	logFields := log.Fields{
+		"tradeId": state.TradeID,
+		"symbol":  state.Symbol,
+	}
+
+	symbolInfo, err := s.exchange.GetSymbolInfo(state.Symbol)
+	if err != nil {
+		log.WithError(err).WithFields(logFields).Errorf("Failed to get symbol info to chase sell.")
+		return
+	}
+	bestAsk, err := s.exchange.GetPrice(state.Symbol, types.PriceSourceBestAsk)
+	if err != nil {
+		log.WithError(err).WithFields(logFields).Errorf("Failed to get best ask to chase sell.")
+		return
+	}
+
+	floor := sellChaseFloor(trade, symbolInfo.TickSize)
+	price := util.Round8(math.Max(bestAsk, floor))
+	ticks := state.SellChase.Ticks
+	if ticks < 1 {
+		ticks = 1
+	}
+	if state.SellOrder.Price-price < (float64(ticks)-0.5)*symbolInfo.TickSize {
+		return
+	}
+
+	logFields["price"] = fmt.Sprintf("%.8f", state.SellOrder.Price)
+	logFields["newPrice"] = fmt.Sprintf("%.8f", price)
+	logFields["bestAsk"] = fmt.Sprintf("%.8f", bestAsk)
+	logFields["floor"] = fmt.Sprintf("%.8f", floor)
+	log.WithFields(logFields).Infof("Chasing sell, re-pricing.")
+
+	state.SellChase.Count++
+	trade.AddHistory(types.HistoryEntry{
+		Timestamp: now,
+		Type:      types.HistoryTypeSellChase,
+		Fields: map[string]interface{}{
+			"price":    state.SellOrder.Price,
+			"newPrice": price,
+			"bestAsk":  bestAsk,
+			"floor":    floor,
+		},
+	})
+
+	if err := s.CancelSell(trade); err != nil {
+		log.WithError(err).WithFields(logFields).Errorf("Failed to cancel sell to chase.")
+		return
+	}
+	s.CancelStopOrder(trade)
+	if err := s.LimitSellByPrice(trade, price); err != nil {
+		log.WithError(err).WithFields(logFields).Errorf("Failed to post chased sell.")
+	}
+	s.BroadcastTradeUpdate(trade)
+}
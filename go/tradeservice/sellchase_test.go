@@ -0,0 +1,112 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package tradeservice
+
+import (
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/exchange"
+	"gitlab.com/crankykernel/maker/go/replay"
+	"gitlab.com/crankykernel/maker/go/types"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestSellChase(t *testing.T) {
+	directory, err := ioutil.TempDir("", "maker-sellchase")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+	db.DbOpenFile(path.Join(directory, "maker.db"))
+	defer db.DbClose()
+
+	market := &testMarket{price: 0.0010}
+	paper := exchange.NewSteppedPaperExchange(market)
+	service := NewTradeService(paper)
+	reports := [][]byte{}
+	deliver := func() {
+		for _, event := range paper.PendingEvents() {
+			if event.Type == exchange.UserStreamEventExecutionReport {
+				reports = append(reports, event.Raw)
+				service.OnExecutionReport(event)
+			}
+		}
+	}
+	// Sets the best ask, with the last trade a tick below it.
+	setPrice := func(price float64) {
+		market.price = price
+		last := &exchange.MarketTrade{Symbol: "ETHBTC", Price: price - 0.00000001}
+		paper.OnTrade(last)
+		service.OnLastTrade(last)
+	}
+
+	trade := types.NewTrade()
+	trade.State.Symbol = "ETHBTC"
+	trade.SetLimitSellByPercent(10)
+	clientOrderId, err := service.MakeOrderID()
+	assert.Nil(t, err)
+	trade.AddClientOrderID(clientOrderId)
+	service.AddNewTrade(trade)
+	service.UpdateSellChase(trade, types.SellChaseSettings{
+		Enabled:   true,
+		Ticks:     1,
+		MinProfit: 2,
+	})
+	_, err = paper.PostOrder(exchange.OrderParameters{
+		Symbol:        "ETHBTC",
+		Side:          exchange.OrderSideBuy,
+		Type:          exchange.OrderTypeLimit,
+		Quantity:      1000,
+		Price:         0.001,
+		ClientOrderID: clientOrderId,
+	})
+	assert.Nil(t, err)
+	deliver()
+	deliver()
+	assert.Equal(t, types.TradeStatusPendingSell, trade.State.Status)
+	sellPrice := trade.State.SellOrder.Price
+
+	// Nothing is chased until the last price changes.
+	service.checkSells(time.Now())
+	service.checkSells(time.Now())
+	assert.Equal(t, sellPrice, trade.State.SellOrder.Price)
+
+	setPrice(0.00105)
+	service.checkSells(time.Now())
+	deliver()
+	assert.Equal(t, types.TradeStatusPendingSell, trade.State.Status)
+	assert.Equal(t, 0.00105, trade.State.SellOrder.Price)
+	assert.Equal(t, float64(999), trade.State.SellOrder.Quantity)
+	assert.Equal(t, 0.00105, trade.State.LimitSell.Price)
+	assert.Equal(t, 1, trade.State.SellChase.Count)
+
+	// Not below the minimum profit.
+	setPrice(0.0009)
+	service.checkSells(time.Now())
+	deliver()
+	assert.Equal(t, limitSellPrice(trade, 2, 0.00000001), trade.State.SellOrder.Price)
+	setPrice(0.00089)
+	service.checkSells(time.Now())
+	deliver()
+	assert.Equal(t, 2, trade.State.SellChase.Count)
+
+	result, err := replay.Replay(trade.State, reports, 1)
+	assert.Nil(t, err)
+	for _, difference := range result.Differences {
+		assert.Contains(t, []string{"OpenTime", "CloseTime"}, difference.Field)
+	}
+}
@@ -0,0 +1,463 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package tradeservice
+
+import (
+	"github.com/crankykernel/binanceapi-go"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/exchange"
+	"gitlab.com/crankykernel/maker/go/replay"
+	"gitlab.com/crankykernel/maker/go/types"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestTrailingStopLoss(t *testing.T) {
+	directory, err := ioutil.TempDir("", "maker-stoploss")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+	db.DbOpenFile(path.Join(directory, "maker.db"))
+	defer db.DbClose()
+
+	market := &testMarket{price: 0.0010}
+	paper := exchange.NewSteppedPaperExchange(market)
+	service := NewTradeService(paper)
+	deliver := func() {
+		for _, event := range paper.PendingEvents() {
+			service.OnExecutionReport(event)
+		}
+	}
+	lastTrade := func(price float64) {
+		market.price = price
+		service.OnLastTrade(&exchange.MarketTrade{Symbol: "ETHBTC", Price: price})
+	}
+
+	trade := types.NewTrade()
+	trade.State.Symbol = "ETHBTC"
+	trade.SetStopLoss(true, 5)
+	trade.SetStopLossTrailing(true, 0)
+	clientOrderId, err := service.MakeOrderID()
+	assert.Nil(t, err)
+	trade.AddClientOrderID(clientOrderId)
+	service.AddNewTrade(trade)
+
+	_, err = paper.PostOrder(exchange.OrderParameters{
+		Symbol:        "ETHBTC",
+		Side:          exchange.OrderSideBuy,
+		Type:          exchange.OrderTypeLimit,
+		Quantity:      10,
+		Price:         0.001,
+		ClientOrderID: clientOrderId,
+	})
+	assert.Nil(t, err)
+	deliver()
+	assert.Equal(t, types.TradeStatusWatching, trade.State.Status)
+
+	// The stop starts below the buy price, including the commission, and
+	// only moves up.
+	lastTrade(0.00099)
+	assert.Equal(t, 0.001001, trade.State.StopLoss.HighPrice)
+	assert.Equal(t, 0.00095095, trade.State.StopLoss.Price)
+	lastTrade(0.0012)
+	assert.Equal(t, 0.00114, trade.State.StopLoss.Price)
+	lastTrade(0.00115)
+	assert.Equal(t, 0.00114, trade.State.StopLoss.Price)
+	assert.False(t, trade.State.StopLoss.Triggered)
+
+	// The level is saved as it moves.
+	stored, err := db.DbGetTradeByID(trade.State.TradeID)
+	assert.Nil(t, err)
+	assert.Equal(t, 0.0012, stored.StopLoss.HighPrice)
+	assert.Equal(t, 0.00114, stored.StopLoss.Price)
+
+	// Switching to ticks recalculates the level from the same high.
+	service.UpdateStopLoss(trade, types.StopLossSettings{
+		Enabled:  true,
+		Percent:  5,
+		Trailing: true,
+		Ticks:    1000,
+	})
+	assert.Equal(t, 0.00119, trade.State.StopLoss.Price)
+
+	// A profitable trade is still sold when the price falls to the stop.
+	lastTrade(0.00119)
+	assert.True(t, trade.State.StopLoss.Triggered)
+	deliver()
+	assert.Equal(t, types.TradeStatusDone, trade.State.Status)
+}
+
+func TestBreakEvenStop(t *testing.T) {
+	directory, err := ioutil.TempDir("", "maker-stoploss")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+	db.DbOpenFile(path.Join(directory, "maker.db"))
+	defer db.DbClose()
+
+	market := &testMarket{price: 0.0010}
+	paper := exchange.NewSteppedPaperExchange(market)
+	service := NewTradeService(paper)
+	lastTrade := func(price float64) {
+		market.price = price
+		service.OnLastTrade(&exchange.MarketTrade{Symbol: "ETHBTC", Price: price})
+	}
+
+	trade := types.NewTrade()
+	trade.State.Symbol = "ETHBTC"
+	trade.SetStopLoss(true, 5)
+	trade.SetStopLossBreakEven(10, 1)
+	clientOrderId, err := service.MakeOrderID()
+	assert.Nil(t, err)
+	trade.AddClientOrderID(clientOrderId)
+	service.AddNewTrade(trade)
+
+	_, err = paper.PostOrder(exchange.OrderParameters{
+		Symbol:        "ETHBTC",
+		Side:          exchange.OrderSideBuy,
+		Type:          exchange.OrderTypeLimit,
+		Quantity:      10,
+		Price:         0.001,
+		ClientOrderID: clientOrderId,
+	})
+	assert.Nil(t, err)
+	for _, event := range paper.PendingEvents() {
+		service.OnExecutionReport(event)
+	}
+
+	lastTrade(0.0012)
+	assert.False(t, trade.State.StopLoss.BreakEvenActivated)
+
+	// Above 10% profit the stop moves to break even plus 1%.
+	lastTrade(0.0013)
+	assert.True(t, trade.State.StopLoss.BreakEvenActivated)
+	assert.Equal(t, 0.00112335, trade.State.StopLoss.Price)
+	assert.Equal(t, types.HistoryTypeStopLossBreakEven,
+		trade.State.History[len(trade.State.History)-1].Type)
+
+	// Still a profit when the stop is hit.
+	lastTrade(0.00112)
+	assert.True(t, trade.State.StopLoss.Triggered)
+	for _, event := range paper.PendingEvents() {
+		service.OnExecutionReport(event)
+	}
+	assert.Equal(t, types.TradeStatusDone, trade.State.Status)
+	assert.True(t, trade.State.ProfitPercent > 0)
+}
+
+func TestStopOrder(t *testing.T) {
+	directory, err := ioutil.TempDir("", "maker-stoploss")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+	db.DbOpenFile(path.Join(directory, "maker.db"))
+	defer db.DbClose()
+
+	market := &testMarket{price: 0.0010}
+	paper := exchange.NewSteppedPaperExchange(market)
+	service := NewTradeService(paper)
+	reports := [][]byte{}
+	deliver := func() {
+		for _, event := range paper.PendingEvents() {
+			reports = append(reports, event.Raw)
+			service.OnExecutionReport(event)
+		}
+	}
+
+	trade := types.NewTrade()
+	trade.State.Symbol = "ETHBTC"
+	trade.SetStopLoss(true, 5)
+	trade.SetStopLossOnExchange(true)
+	clientOrderId, err := service.MakeOrderID()
+	assert.Nil(t, err)
+	trade.AddClientOrderID(clientOrderId)
+	service.AddNewTrade(trade)
+
+	_, err = paper.PostOrder(exchange.OrderParameters{
+		Symbol:        "ETHBTC",
+		Side:          exchange.OrderSideBuy,
+		Type:          exchange.OrderTypeLimit,
+		Quantity:      1000,
+		Price:         0.001,
+		ClientOrderID: clientOrderId,
+	})
+	assert.Nil(t, err)
+	deliver()
+
+	// The stop order sells everything at 5% loss including fees.
+	stopOrder := trade.OpenStopOrder()
+	assert.NotNil(t, stopOrder)
+	assert.Equal(t, float64(999), stopOrder.Quantity)
+	assert.Equal(t, 0.0009519, stopOrder.StopPrice)
+	assert.Equal(t, float64(0), trade.RemainingQuantity())
+	deliver()
+	assert.Equal(t, binanceapi.OrderStatusNew, stopOrder.Status)
+	assert.Equal(t, types.TradeStatusWatching, trade.State.Status)
+
+	// A settings change replaces the order.
+	service.UpdateStopLoss(trade, types.StopLossSettings{
+		Enabled:    true,
+		Percent:    4,
+		OnExchange: true,
+	})
+	deliver()
+	assert.Len(t, trade.State.StopLoss.Orders, 2)
+	assert.Equal(t, binanceapi.OrderStatusCanceled, trade.State.StopLoss.Orders[0].Status)
+	assert.Equal(t, 0.00096192, trade.OpenStopOrder().StopPrice)
+	assert.Equal(t, types.TradeStatusWatching, trade.State.Status)
+
+	// The exchange fills the stop, Maker does not sell itself.
+	paper.OnTrade(&exchange.MarketTrade{Symbol: "ETHBTC", Price: 0.00096, Quantity: 10000})
+	market.price = 0.00096
+	service.OnLastTrade(&exchange.MarketTrade{Symbol: "ETHBTC", Price: 0.00096})
+	deliver()
+	assert.Equal(t, types.TradeStatusDone, trade.State.Status)
+	assert.True(t, trade.State.StopLoss.Triggered)
+	assert.Equal(t, float64(999), trade.State.SellFillQuantity)
+
+	// Only the times differ as the reports are in milliseconds.
+	result, err := replay.Replay(trade.State, reports, 1)
+	assert.Nil(t, err)
+	for _, difference := range result.Differences {
+		assert.Contains(t, []string{"OpenTime", "CloseTime"}, difference.Field)
+	}
+}
+
+// A trailing stop order is only replaced once the stop has moved enough.
+func TestTrailingStopOrder(t *testing.T) {
+	directory, err := ioutil.TempDir("", "maker-stoploss")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+	db.DbOpenFile(path.Join(directory, "maker.db"))
+	defer db.DbClose()
+
+	market := &testMarket{price: 0.0010}
+	paper := exchange.NewSteppedPaperExchange(market)
+	service := NewTradeService(paper)
+	deliver := func() {
+		for _, event := range paper.PendingEvents() {
+			service.OnExecutionReport(event)
+		}
+	}
+	lastTrade := func(price float64) {
+		market.price = price
+		service.OnLastTrade(&exchange.MarketTrade{Symbol: "ETHBTC", Price: price})
+		deliver()
+	}
+
+	trade := types.NewTrade()
+	trade.State.Symbol = "ETHBTC"
+	trade.SetStopLoss(true, 5)
+	trade.SetStopLossTrailing(true, 0)
+	trade.SetStopLossOnExchange(true)
+	clientOrderId, err := service.MakeOrderID()
+	assert.Nil(t, err)
+	trade.AddClientOrderID(clientOrderId)
+	service.AddNewTrade(trade)
+
+	_, err = paper.PostOrder(exchange.OrderParameters{
+		Symbol:        "ETHBTC",
+		Side:          exchange.OrderSideBuy,
+		Type:          exchange.OrderTypeLimit,
+		Quantity:      1000,
+		Price:         0.001,
+		ClientOrderID: clientOrderId,
+	})
+	assert.Nil(t, err)
+	deliver()
+	deliver()
+	lastTrade(0.001)
+	assert.Len(t, trade.State.StopLoss.Orders, 1)
+	assert.Equal(t, 0.00095095, trade.OpenStopOrder().StopPrice)
+
+	// Less than 0.2% higher.
+	lastTrade(0.001002)
+	assert.Equal(t, 0.0009519, trade.State.StopLoss.Price)
+	assert.Len(t, trade.State.StopLoss.Orders, 1)
+
+	lastTrade(0.00101)
+	assert.Len(t, trade.State.StopLoss.Orders, 2)
+	assert.Equal(t, binanceapi.OrderStatusCanceled, trade.State.StopLoss.Orders[0].Status)
+	assert.Equal(t, 0.0009595, trade.OpenStopOrder().StopPrice)
+}
+
+// failingStopExchange fails stop orders with err while it is set.
+type failingStopExchange struct {
+	*exchange.PaperExchange
+	err   error
+	posts int
+}
+
+func (e *failingStopExchange) PostStopOrder(params exchange.StopOrderParameters) (*exchange.Order, error) {
+	e.posts++
+	if e.err != nil {
+		return nil, e.err
+	}
+	return e.PaperExchange.PostStopOrder(params)
+}
+
+// A stop order that fails to post is retried with a backoff, and not at all
+// once the exchange refuses it.
+func TestStopOrderRetry(t *testing.T) {
+	directory, err := ioutil.TempDir("", "maker-stoploss")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+	db.DbOpenFile(path.Join(directory, "maker.db"))
+	defer db.DbClose()
+
+	market := &testMarket{price: 0.0010}
+	paper := exchange.NewSteppedPaperExchange(market)
+	failing := &failingStopExchange{
+		PaperExchange: paper,
+		err: &exchange.ApiError{StatusCode: 429,
+			Body: []byte(`{"code":-1003,"msg":"Too many requests."}`)},
+	}
+	service := NewTradeService(failing)
+	deliver := func() {
+		for _, event := range paper.PendingEvents() {
+			service.OnExecutionReport(event)
+		}
+	}
+	lastTrade := func() {
+		service.OnLastTrade(&exchange.MarketTrade{Symbol: "ETHBTC", Price: 0.001})
+		deliver()
+	}
+	trade := types.NewTrade()
+	trade.State.Symbol = "ETHBTC"
+	trade.SetStopLoss(true, 5)
+	trade.SetStopLossOnExchange(true)
+	clientOrderId, err := service.MakeOrderID()
+	assert.Nil(t, err)
+	trade.AddClientOrderID(clientOrderId)
+	service.AddNewTrade(trade)
+	expireBackoff := func() {
+		retry := service.stopOrderRetries[trade.State.TradeID]
+		retry.next = time.Time{}
+		service.stopOrderRetries[trade.State.TradeID] = retry
+	}
+	stopOrderHistory := func() []types.HistoryEntry {
+		entries := []types.HistoryEntry{}
+		for _, entry := range trade.State.History {
+			if entry.Type == types.HistoryTypeSellOrder {
+				entries = append(entries, entry)
+			}
+		}
+		return entries
+	}
+
+	_, err = paper.PostOrder(exchange.OrderParameters{
+		Symbol:        "ETHBTC",
+		Side:          exchange.OrderSideBuy,
+		Type:          exchange.OrderTypeLimit,
+		Quantity:      1000,
+		Price:         0.001,
+		ClientOrderID: clientOrderId,
+	})
+	assert.Nil(t, err)
+	deliver()
+	assert.Equal(t, 1, failing.posts)
+	assert.Nil(t, trade.OpenStopOrder())
+
+	// Not retried until the backoff has passed.
+	lastTrade()
+	assert.Equal(t, 1, failing.posts)
+	expireBackoff()
+	lastTrade()
+	assert.Equal(t, 2, failing.posts)
+	assert.Empty(t, stopOrderHistory())
+
+	// Refused by the exchange, recorded once and not retried.
+	failing.err = &exchange.ApiError{StatusCode: 400,
+		Body: []byte(`{"code":-2010,"msg":"Order would trigger immediately."}`)}
+	expireBackoff()
+	lastTrade()
+	assert.Equal(t, 3, failing.posts)
+	expireBackoff()
+	lastTrade()
+	assert.Equal(t, 3, failing.posts)
+	history := stopOrderHistory()
+	assert.Len(t, history, 1)
+	assert.Equal(t, false, history[0].Fields.(map[string]interface{})["success"])
+	assert.Equal(t, 3, history[0].Fields.(map[string]interface{})["attempts"])
+
+	// New settings get another try.
+	failing.err = nil
+	service.UpdateStopLoss(trade, types.StopLossSettings{
+		Enabled:    true,
+		Percent:    4,
+		OnExchange: true,
+	})
+	assert.Equal(t, 4, failing.posts)
+	assert.NotNil(t, trade.OpenStopOrder())
+}
+
+// A stop order whose outcome is pending is kept open, and no other is placed
+// until the journal finds it was never placed.
+func TestStopOrderPending(t *testing.T) {
+	directory, err := ioutil.TempDir("", "maker-stoploss")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+	db.DbOpenFile(path.Join(directory, "maker.db"))
+	defer db.DbClose()
+
+	market := &testMarket{price: 0.0010}
+	paper := exchange.NewSteppedPaperExchange(market)
+	failing := &failingStopExchange{
+		PaperExchange: paper,
+		err:           &exchange.OrderPendingError{Err: exchange.ErrOrderTimeout},
+	}
+	service := NewTradeService(failing)
+	deliver := func() {
+		for _, event := range paper.PendingEvents() {
+			service.OnExecutionReport(event)
+		}
+	}
+	trade := types.NewTrade()
+	trade.State.Symbol = "ETHBTC"
+	trade.SetStopLoss(true, 5)
+	trade.SetStopLossOnExchange(true)
+	clientOrderId, err := service.MakeOrderID()
+	assert.Nil(t, err)
+	trade.AddClientOrderID(clientOrderId)
+	service.AddNewTrade(trade)
+
+	_, err = paper.PostOrder(exchange.OrderParameters{
+		Symbol:        "ETHBTC",
+		Side:          exchange.OrderSideBuy,
+		Type:          exchange.OrderTypeLimit,
+		Quantity:      1000,
+		Price:         0.001,
+		ClientOrderID: clientOrderId,
+	})
+	assert.Nil(t, err)
+	deliver()
+	assert.Equal(t, 1, failing.posts)
+	pending := trade.OpenStopOrder()
+	assert.NotNil(t, pending)
+	stopClientOrderId := pending.ClientOrderID
+
+	service.OnLastTrade(&exchange.MarketTrade{Symbol: "ETHBTC", Price: 0.001})
+	deliver()
+	assert.Equal(t, 1, failing.posts)
+
+	// Never placed, so a new stop order is.
+	failing.err = nil
+	service.OrderFailed(stopClientOrderId, "not found on exchange")
+	assert.Equal(t, 2, failing.posts)
+	assert.Equal(t, orderStatusRejected, trade.StopOrderForClientOrderId(stopClientOrderId).Status)
+	assert.NotNil(t, trade.OpenStopOrder())
+	assert.NotEqual(t, stopClientOrderId, trade.OpenStopOrder().ClientOrderID)
+}
@@ -0,0 +1,279 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package tradeservice
+
+import (
+	"fmt"
+	"github.com/crankykernel/binanceapi-go"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/exchange"
+	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/types"
+	"gitlab.com/crankykernel/maker/go/util"
+	"time"
+)
+
+// The limit price of a stop order is this percent below its stop price so
+// it still fills when the market moves through the stop quickly.
+const stopOrderLimitPercent = 0.5
+
+// A trailing stop moves up with every new high. The stop order is only
+// replaced once the stop has moved up this percent, so it isn't cancelled
+// and placed again on every trade.
+const stopOrderReplacePercent = 0.2
+
+// A stop order that failed to post is retried after an interval that doubles
+// with each attempt, up to a number of attempts. It is not retried if the
+// exchange refused it, the stop loss is then left to Maker.
+const (
+	stopOrderRetryInterval = 10 * time.Second
+	stopOrderMaxAttempts   = 5
+)
+
+// The failed attempts to post the stop order of a trade.
+type stopOrderRetry struct {
+	attempts int
+	next     time.Time
+	stopped  bool
+}
+
+// Returns true if a trade should have a stop order of its own on the
+// exchange. A limit sell order holds the same quantity, so while one is
+// enabled the stop order is placed with it as an OCO instead.
+func wantStopOrder(trade *types.Trade) bool {
+	stopLoss := trade.State.StopLoss
+	if !stopLoss.OnExchange || !stopLoss.Enabled || stopLoss.Triggered {
+		return false
+	}
+	return trade.State.Status == types.TradeStatusWatching && !trade.State.LimitSell.Enabled
+}
+
+// SyncStopOrder keeps the stop order of a trade on the exchange in line with
+// its stop loss. The order is placed for the quantity left by other sell
+// orders, replaced when the stop price moves and cancelled when it is no
+// longer wanted. Called with the execution lock held, set locked if the
+// caller holds the trade service lock too.
+func (s *TradeService) SyncStopOrder(trade *types.Trade, locked bool) {
+	current := trade.OpenStopOrder()
+	if current != nil && trade.IsOrderListOrder(current.ClientOrderID) {
+		s.syncOrderList(trade, current, locked)
+		return
+	}
+	if current == nil && !wantStopOrder(trade) {
+		delete(s.stopOrderRetries, trade.State.TradeID)
+		return
+	}
+	if retry, ok := s.stopOrderRetries[trade.State.TradeID]; ok && current == nil &&
+		(retry.stopped || time.Now().Before(retry.next)) {
+		return
+	}
+	if current != nil && current.FillQuantity > 0 {
+		// Triggered and filling.
+		return
+	}
+	if current != nil && current.OrderID == 0 {
+		// Not confirmed yet, its outcome may be pending.
+		return
+	}
+
+	symbolInfo, err := s.exchange.GetSymbolInfo(trade.State.Symbol)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"symbol": trade.State.Symbol,
+		}).Error("Failed to get symbol info, not updating stop order.")
+		return
+	}
+
+	var params exchange.StopOrderParameters
+	if wantStopOrder(trade) {
+		quantity := trade.RemainingQuantity()
+		if current != nil {
+			quantity += current.Quantity
+		}
+		params = exchange.StopOrderParameters{
+			Symbol:   trade.State.Symbol,
+			Quantity: util.Round8(util.FixQuantityToStepSize(quantity, symbolInfo.StepSize)),
+		}
+		params.StopPrice, params.Price = stopOrderPrices(trade, symbolInfo.TickSize)
+	}
+
+	if current != nil {
+		if current.Quantity == params.Quantity && !stopPriceMoved(current, params.StopPrice) {
+			return
+		}
+		if err := s.CancelStopOrder(trade); err != nil {
+			return
+		}
+	}
+
+	if params.Quantity <= 0 || params.Price <= 0 {
+		db.DbUpdateTrade(trade)
+		s.BroadcastTradeUpdate(trade)
+		return
+	}
+
+	params.ClientOrderID, err = s.MakeOrderID()
+	if err != nil {
+		log.WithError(err).Errorf("Failed to generate clientOrderId")
+		return
+	}
+	s.AddClientOrderId(trade, params.ClientOrderID, locked)
+	trade.State.StopLoss.Orders = append(trade.State.StopLoss.Orders, types.StopOrder{
+		ClientOrderID: params.ClientOrderID,
+		Quantity:      params.Quantity,
+		StopPrice:     params.StopPrice,
+		Price:         params.Price,
+	})
+	order := &trade.State.StopLoss.Orders[len(trade.State.StopLoss.Orders)-1]
+
+	logFields := log.Fields{
+		"tradeId":   trade.State.TradeID,
+		"symbol":    trade.State.Symbol,
+		"quantity":  params.Quantity,
+		"stopPrice": fmt.Sprintf("%.8f", params.StopPrice),
+		"price":     fmt.Sprintf("%.8f", params.Price),
+	}
+	if err := exchange.ValidateExitOrder(s.exchange, exchange.OrderParameters{
+		Symbol:    params.Symbol,
+		Side:      exchange.OrderSideSell,
+		Type:      exchange.OrderTypeStopLossLimit,
+		Quantity:  params.Quantity,
+		Price:     params.Price,
+		StopPrice: params.StopPrice,
+	}); err != nil {
+		// Still sent, an exit is left to the exchange to refuse.
+		log.WithError(err).WithFields(logFields).Warn("Stop order failed validation.")
+	}
+	log.WithFields(logFields).Info("Posting stop order.")
+
+	posted, err := s.exchange.PostStopOrder(params)
+	historyFields := map[string]interface{}{
+		"sellOrderType": "stopLoss",
+		"stopPrice":     params.StopPrice,
+		"price":         params.Price,
+		"quantity":      params.Quantity,
+		"clientOrderId": params.ClientOrderID,
+		"success":       err == nil,
+	}
+	if exchange.OrderPending(err) {
+		// Left open, no other stop order is placed until the journal has
+		// resolved it.
+		log.WithError(err).WithFields(logFields).
+			Warn("Stop order outcome unknown, waiting for it to be resolved.")
+		historyFields["pending"] = true
+		historyFields["error"] = err.Error()
+	} else if err != nil {
+		order.Status = orderStatusRejected
+		retry := s.stopOrderFailed(trade, err)
+		if !retry.stopped {
+			log.WithError(err).WithFields(logFields).WithField("attempt", retry.attempts).
+				Warn("Failed to post stop order, will retry.")
+			db.DbUpdateTrade(trade)
+			s.BroadcastTradeUpdate(trade)
+			return
+		}
+		// Most likely the price is already past the stop, which is left to
+		// the stop loss check of Maker.
+		log.WithError(err).WithFields(logFields).WithField("attempt", retry.attempts).
+			Error("Failed to post stop order, leaving the stop loss to Maker.")
+		historyFields["error"] = err.Error()
+		historyFields["attempts"] = retry.attempts
+	} else {
+		delete(s.stopOrderRetries, trade.State.TradeID)
+		if order.OrderID == 0 {
+			order.OrderID = posted.OrderID
+		}
+	}
+	trade.AddHistoryEntry(types.HistoryTypeSellOrder, historyFields)
+
+	db.DbUpdateTrade(trade)
+	s.BroadcastTradeUpdate(trade)
+}
+
+// Records a failed attempt to post the stop order of a trade. Retries stop
+// once the exchange refuses the order or the attempts run out.
+func (s *TradeService) stopOrderFailed(trade *types.Trade, err error) stopOrderRetry {
+	retry := s.stopOrderRetries[trade.State.TradeID]
+	retry.attempts++
+	if exchange.OrderRejected(err) || retry.attempts >= stopOrderMaxAttempts {
+		retry.stopped = true
+	} else {
+		retry.next = time.Now().Add(stopOrderRetryInterval * time.Duration(1<<uint(retry.attempts-1)))
+	}
+	s.stopOrderRetries[trade.State.TradeID] = retry
+	return retry
+}
+
+// Returns true if the stop of a trade at stopPrice has moved enough from the
+// current stop order to replace it. A stop that moves down, after a settings
+// change, is always replaced.
+func stopPriceMoved(current *types.StopOrder, stopPrice float64) bool {
+	if stopPrice < current.StopPrice {
+		return true
+	}
+	return stopPrice >= current.StopPrice*(1+stopOrderReplacePercent/100)
+}
+
+// The stop price and limit price of the stop order of a trade.
+func stopOrderPrices(trade *types.Trade, tickSize float64) (float64, float64) {
+	stopPrice := util.Round8(util.FixQuantityToStepSize(trade.StopLossPrice(), tickSize))
+	price := util.Round8(util.FixQuantityToStepSize(
+		stopPrice*(1-stopOrderLimitPercent/100), tickSize))
+	return stopPrice, price
+}
+
+// CancelStopOrder cancels the open stop order of a trade, if any. For the
+// stop order of an OCO this cancels the limit sell too.
+func (s *TradeService) CancelStopOrder(trade *types.Trade) error {
+	order := trade.OpenStopOrder()
+	if order == nil {
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"tradeId": trade.State.TradeID,
+		"symbol":  trade.State.Symbol,
+		"orderId": order.OrderID,
+	}).Info("Cancelling stop order.")
+	err := s.exchange.CancelOrder(trade.State.Symbol, order.OrderID)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"tradeId": trade.State.TradeID,
+			"orderId": order.OrderID,
+		}).Error("Failed to cancel stop order.")
+	}
+	recordStopOrderCancel(trade, err)
+	db.DbUpdateTrade(trade)
+	s.BroadcastTradeUpdate(trade)
+	return err
+}
+
+// Records the cancel of the open stop order of a trade in its history. If
+// successful the order is set cancelled, freeing its quantity for the order
+// that follows. The report will confirm.
+func recordStopOrderCancel(trade *types.Trade, err error) {
+	order := trade.OpenStopOrder()
+	historyFields := map[string]interface{}{
+		"sellOrderId": order.OrderID,
+		"stopOrder":   len(trade.State.StopLoss.Orders) - 1,
+		"success":     err == nil,
+	}
+	if err != nil {
+		historyFields["error"] = err.Error()
+	} else {
+		order.Status = binanceapi.OrderStatusCanceled
+	}
+	trade.AddHistoryEntry(types.HistoryTypeSellCanceled, historyFields)
+}
@@ -0,0 +1,162 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tradeservice
+
+import (
+	"fmt"
+	"github.com/crankykernel/binanceapi-go"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/exchange"
+	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/types"
+	"gitlab.com/crankykernel/maker/go/util"
+)
+
+// TriggerTakeProfit places a limit sell order for each take profit target
+// not yet placed. The quantity of a target is its portion of the sellable
+// quantity rounded down to the step size.
+func (s *TradeService) TriggerTakeProfit(trade *types.Trade) {
+	if len(trade.State.TakeProfit) == 0 {
+		return
+	}
+
+	logFields := log.Fields{
+		"tradeId": trade.State.TradeID,
+		"symbol":  trade.State.Symbol,
+	}
+
+	symbolInfo, err := s.exchange.GetSymbolInfo(trade.State.Symbol)
+	if err != nil {
+		log.WithError(err).WithFields(logFields).
+			Error("Failed to get symbol info, not placing take profit orders.")
+		return
+	}
+
+	for i := range trade.State.TakeProfit {
+		target := &trade.State.TakeProfit[i]
+		if target.ClientOrderID != "" {
+			continue
+		}
+
+		quantity := util.FixQuantityToStepSize(
+			trade.State.SellableQuantity*target.QuantityPercent/100, symbolInfo.StepSize)
+		quantity = util.Round8(quantity)
+		if quantity > trade.RemainingQuantity() {
+			quantity = util.FixQuantityToStepSize(trade.RemainingQuantity(), symbolInfo.StepSize)
+		}
+		if quantity <= 0 {
+			log.WithFields(logFields).Warnf("Take profit target %d has no quantity to sell.", i)
+			continue
+		}
+		price := limitSellPrice(trade, target.ProfitPercent, symbolInfo.TickSize)
+
+		order := exchange.OrderParameters{
+			Symbol:      trade.State.Symbol,
+			Side:        exchange.OrderSideSell,
+			Type:        exchange.OrderTypeLimit,
+			TimeInForce: exchange.TimeInForceGTC,
+			Quantity:    quantity,
+			Price:       price,
+		}
+		if err := exchange.ValidateExitOrder(s.exchange, order); err != nil {
+			// Still sent, an exit is left to the exchange to refuse.
+			log.WithError(err).WithFields(logFields).WithFields(log.Fields{
+				"target": i,
+			}).Warn("Take profit sell order failed validation.")
+		}
+
+		clientOrderId, err := s.MakeOrderID()
+		if err != nil {
+			log.WithError(err).Errorf("Failed to generate clientOrderId")
+			return
+		}
+		s.AddClientOrderId(trade, clientOrderId, false)
+		target.ClientOrderID = clientOrderId
+		target.Quantity = quantity
+		target.Price = price
+
+		log.WithFields(logFields).WithFields(log.Fields{
+			"target":   i,
+			"quantity": quantity,
+			"price":    fmt.Sprintf("%.8f", price),
+		}).Info("Posting take profit sell order.")
+
+		order.ClientOrderID = clientOrderId
+		_, err = s.exchange.PostOrder(order)
+		historyFields := map[string]interface{}{
+			"sellOrderType": "takeProfit",
+			"target":        i,
+			"percent":       target.ProfitPercent,
+			"price":         price,
+			"quantity":      quantity,
+			"clientOrderId": clientOrderId,
+			"success":       err == nil,
+		}
+		if exchange.OrderPending(err) {
+			// Left open until the journal has resolved it.
+			log.WithError(err).WithFields(logFields).
+				Warn("Take profit sell order outcome unknown, waiting for it to be resolved.")
+			historyFields["pending"] = true
+			historyFields["error"] = err.Error()
+		} else if err != nil {
+			log.WithError(err).WithFields(logFields).Error("Failed to post take profit sell order.")
+			target.Status = orderStatusRejected
+			historyFields["error"] = err.Error()
+		}
+		trade.AddHistoryEntry(types.HistoryTypeSellOrder, historyFields)
+	}
+
+	db.DbUpdateTrade(trade)
+	s.BroadcastTradeUpdate(trade)
+}
+
+// CancelTakeProfit cancels the open take profit orders of a trade.
+func (s *TradeService) CancelTakeProfit(trade *types.Trade) {
+	if trade.OpenTakeProfitQuantity() == 0 {
+		return
+	}
+	for i := range trade.State.TakeProfit {
+		target := &trade.State.TakeProfit[i]
+		if !target.IsOpen() || target.OrderID == 0 {
+			continue
+		}
+		log.WithFields(log.Fields{
+			"tradeId": trade.State.TradeID,
+			"symbol":  trade.State.Symbol,
+			"orderId": target.OrderID,
+		}).Info("Cancelling take profit sell order.")
+		err := s.exchange.CancelOrder(trade.State.Symbol, target.OrderID)
+		historyFields := map[string]interface{}{
+			"sellOrderId": target.OrderID,
+			"target":      i,
+			"success":     err == nil,
+		}
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"tradeId": trade.State.TradeID,
+				"orderId": target.OrderID,
+			}).Error("Failed to cancel take profit sell order.")
+			historyFields["error"] = err.Error()
+		} else {
+			// Free the quantity for the sell that follows, the report will
+			// confirm.
+			target.Status = binanceapi.OrderStatusCanceled
+		}
+		trade.AddHistoryEntry(types.HistoryTypeSellCanceled, historyFields)
+	}
+	db.DbUpdateTrade(trade)
+	s.BroadcastTradeUpdate(trade)
+}
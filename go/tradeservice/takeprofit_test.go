@@ -0,0 +1,101 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tradeservice
+
+import (
+	"github.com/crankykernel/binanceapi-go"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/exchange"
+	"gitlab.com/crankykernel/maker/go/types"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestTakeProfit(t *testing.T) {
+	directory, err := ioutil.TempDir("", "maker-takeprofit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+	db.DbOpenFile(path.Join(directory, "maker.db"))
+	defer db.DbClose()
+
+	paper := exchange.NewSteppedPaperExchange(&testMarket{price: 0.0010})
+	service := NewTradeService(paper)
+	deliver := func() {
+		for _, event := range paper.PendingEvents() {
+			service.OnExecutionReport(event)
+		}
+	}
+
+	trade := types.NewTrade()
+	trade.State.Symbol = "ETHBTC"
+	trade.SetLimitSellByPercent(10)
+	assert.NotNil(t, trade.SetTakeProfit([]types.TakeProfitSetting{
+		{QuantityPercent: 60, ProfitPercent: 2},
+		{QuantityPercent: 60, ProfitPercent: 4},
+	}))
+	assert.Nil(t, trade.SetTakeProfit([]types.TakeProfitSetting{
+		{QuantityPercent: 30, ProfitPercent: 2},
+		{QuantityPercent: 30, ProfitPercent: 4},
+	}))
+	clientOrderId, err := service.MakeOrderID()
+	assert.Nil(t, err)
+	trade.AddClientOrderID(clientOrderId)
+	service.AddNewTrade(trade)
+
+	_, err = paper.PostOrder(exchange.OrderParameters{
+		Symbol:        "ETHBTC",
+		Side:          exchange.OrderSideBuy,
+		Type:          exchange.OrderTypeLimit,
+		Quantity:      10,
+		Price:         0.0009,
+		ClientOrderID: clientOrderId,
+	})
+	assert.Nil(t, err)
+	paper.OnTrade(&exchange.MarketTrade{Symbol: "ETHBTC", Price: 0.0009, Quantity: 100})
+	deliver()
+
+	// Each target sells its portion of the 9 sellable rounded down to the
+	// step size, the limit sell the rest.
+	assert.Equal(t, float64(9), trade.State.SellableQuantity)
+	deliver()
+	assert.Equal(t, types.TradeStatusPendingSell, trade.State.Status)
+	assert.Equal(t, float64(2), trade.State.TakeProfit[0].Quantity)
+	assert.Equal(t, 0.00102102, trade.State.TakeProfit[0].Price)
+	assert.Equal(t, float64(2), trade.State.TakeProfit[1].Quantity)
+	assert.Equal(t, 0.00104104, trade.State.TakeProfit[1].Price)
+	assert.Equal(t, binanceapi.OrderStatusNew, trade.State.TakeProfit[1].Status)
+	assert.Equal(t, float64(4), trade.OpenTakeProfitQuantity())
+	// The limit sell does not reserve its quantity as a later sell replaces it.
+	assert.Equal(t, float64(5), trade.RemainingQuantity())
+
+	// First target fills.
+	paper.OnTrade(&exchange.MarketTrade{Symbol: "ETHBTC", Price: 0.00103, Quantity: 100})
+	deliver()
+	assert.Equal(t, binanceapi.OrderStatusFilled, trade.State.TakeProfit[0].Status)
+	assert.Equal(t, float64(2), trade.State.SellFillQuantity)
+	assert.Equal(t, types.TradeStatusPendingSell, trade.State.Status)
+
+	// The rest fills.
+	paper.OnTrade(&exchange.MarketTrade{Symbol: "ETHBTC", Price: 0.0012, Quantity: 100})
+	deliver()
+	assert.Equal(t, binanceapi.OrderStatusFilled, trade.State.TakeProfit[1].Status)
+	assert.Equal(t, float64(9), trade.State.SellFillQuantity)
+	assert.Equal(t, types.TradeStatusDone, trade.State.Status)
+	assert.NotNil(t, trade.State.CloseTime)
+}
@@ -16,10 +16,10 @@
 package tradeservice
 
 import (
+	"encoding/json"
 	"fmt"
-	"github.com/crankykernel/binanceapi-go"
-	"gitlab.com/crankykernel/maker/go/binanceex"
 	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/exchange"
 	"gitlab.com/crankykernel/maker/go/idgenerator"
 	"gitlab.com/crankykernel/maker/go/log"
 	"gitlab.com/crankykernel/maker/go/types"
@@ -56,39 +56,48 @@ type TradeService struct {
 	subscribers map[chan TradeEvent]bool
 	lock        sync.RWMutex
 
-	tradeStreamManager *binanceex.TradeStreamManager
-	tradeStreamChannel binanceex.TradeStreamChannel
+	// Serializes trade updates from execution reports and the reconciler.
+	executionLock sync.Mutex
 
-	binanceExchangeInfo *binanceex.ExchangeInfoService
+	// The last checks of chased sells by trade ID, under the execution
+	// lock.
+	sellChecks map[string]sellCheck
+
+	// The failed attempts to post stop orders by trade ID, under the
+	// execution lock.
+	stopOrderRetries map[string]stopOrderRetry
+
+	exchange           exchange.Exchange
+	tradeStreamChannel exchange.TradeChannel
 }
 
-func NewTradeService(binanceStreamManager *binanceex.TradeStreamManager) *TradeService {
+func NewTradeService(exchange exchange.Exchange) *TradeService {
 	tradeService := &TradeService{
-		TradesByLocalID:     make(map[string]*types.Trade),
-		TradesByClientID:    make(map[string]*types.Trade),
-		idGenerator:         idgenerator.NewIdGenerator(),
-		subscribers:         make(map[chan TradeEvent]bool),
-		tradeStreamManager:  binanceStreamManager,
-		binanceExchangeInfo: binanceex.NewExchangeInfoService(),
-	}
-
-	if err := tradeService.binanceExchangeInfo.Update(); err != nil {
-		log.WithError(err).
-			Errorf("Failed to update Binance exchange info")
+		TradesByLocalID:  make(map[string]*types.Trade),
+		TradesByClientID: make(map[string]*types.Trade),
+		idGenerator:      idgenerator.NewIdGenerator(),
+		subscribers:      make(map[chan TradeEvent]bool),
+		sellChecks:       make(map[string]sellCheck),
+		stopOrderRetries: make(map[string]stopOrderRetry),
+		exchange:         exchange,
 	}
 
-	tradeService.tradeStreamChannel = tradeService.tradeStreamManager.Subscribe()
+	tradeService.tradeStreamChannel = tradeService.exchange.SubscribeTrades()
 
 	go tradeService.tradeStreamListener()
+	go tradeService.orderWatcher()
 
 	return tradeService
 }
 
 func (s *TradeService) tradeStreamListener() {
+	entryTicker := time.NewTicker(time.Minute)
 	for {
 		select {
 		case xlastTrade := <-s.tradeStreamChannel:
-			s.onLastTrade(xlastTrade)
+			s.OnLastTrade(xlastTrade)
+		case <-entryTicker.C:
+			s.expireEntries()
 		}
 	}
 }
@@ -102,34 +111,117 @@ func (s *TradeService) CalculateProfit(trade *types.Trade, price float64) float6
 	return profit
 }
 
-func (s *TradeService) onLastTrade(lastTrade *binanceapi.StreamAggTrade) {
+// Returns true if the last price of the trade has passed its stop loss.
+func (s *TradeService) stopLossPassed(trade *types.Trade) bool {
+	if trade.StopPriceActive() {
+		return trade.StopPricePassed(trade.State.LastPrice)
+	}
+	return trade.State.ProfitPercent < math.Abs(trade.State.StopLoss.Percent)*-1
+}
+
+// Ratchets the stop level of a trailing stop loss up with the last price.
+// The trade is saved whenever the level moves so it survives a restart.
+func (s *TradeService) updateTrailingStop(trade *types.Trade) {
+	switch trade.State.Status {
+	case types.TradeStatusPendingSell:
+	case types.TradeStatusWatching:
+	default:
+		return
+	}
+	symbolInfo, err := s.exchange.GetSymbolInfo(trade.State.Symbol)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"symbol": trade.State.Symbol,
+		}).Errorf("Failed to get symbol info, not updating trailing stop loss.")
+		return
+	}
+	if !trade.UpdateTrailingStop(trade.State.LastPrice, symbolInfo.TickSize) {
+		return
+	}
+	log.WithFields(log.Fields{
+		"symbol":    trade.State.Symbol,
+		"tradeId":   trade.State.TradeID,
+		"highPrice": trade.State.StopLoss.HighPrice,
+		"stopPrice": trade.State.StopLoss.Price,
+	}).Debugf("Trailing stop loss level updated.")
+	db.DbUpdateTrade(trade)
+	s.BroadcastTradeUpdate(trade)
+}
+
+// Moves the stop to break even once the profit reaches the break even
+// percent.
+func (s *TradeService) checkBreakEven(trade *types.Trade) {
+	switch trade.State.Status {
+	case types.TradeStatusPendingSell:
+	case types.TradeStatusWatching:
+	default:
+		return
+	}
+	if trade.State.StopLoss.Triggered || !trade.ActivateBreakEven() {
+		return
+	}
+	log.WithFields(log.Fields{
+		"symbol":    trade.State.Symbol,
+		"tradeId":   trade.State.TradeID,
+		"profit":    trade.State.ProfitPercent,
+		"stopPrice": trade.State.StopLoss.Price,
+	}).Infof("Stop Loss: Moved stop to break even.")
+	trade.AddHistoryEntry(types.HistoryTypeStopLossBreakEven, map[string]interface{}{
+		"profitPercent": trade.State.ProfitPercent,
+		"price":         trade.State.StopLoss.Price,
+	})
+	db.DbUpdateTrade(trade)
+	s.BroadcastTradeUpdate(trade)
+}
+
+// OnLastTrade updates open trades for the symbol of the trade and runs the
+// stop loss and trailing profit checks, and the entry check of armed trades.
+func (s *TradeService) OnLastTrade(lastTrade *exchange.MarketTrade) {
+	trades := []*types.Trade{}
 	s.lock.RLock()
-	defer s.lock.RUnlock()
 	for _, trade := range s.TradesByLocalID {
-
-		if trade.IsDone() {
-			continue
+		if !trade.IsDone() && trade.State.Symbol == lastTrade.Symbol {
+			trades = append(trades, trade)
 		}
+	}
+	s.lock.RUnlock()
+
+	// The checks save, broadcast and place orders so are run without the
+	// lock, serialized with the execution reports.
+	for _, trade := range trades {
+		s.checkLastTrade(trade, lastTrade.Price)
+	}
+}
 
-		if trade.State.Symbol == lastTrade.Symbol {
+func (s *TradeService) checkLastTrade(trade *types.Trade, price float64) {
+	s.executionLock.Lock()
+	defer s.executionLock.Unlock()
 
-			switch trade.State.Status {
-			case types.TradeStatusPendingSell:
-			case types.TradeStatusWatching:
-			default:
-				continue
-			}
+	if trade.State.Status == types.TradeStatusArmed {
+		trade.State.LastPrice = price
+		s.checkEntry(trade, price)
+		return
+	}
 
-			trade.State.LastPrice = lastTrade.Price
-			trade.State.ProfitPercent = s.CalculateProfit(trade, lastTrade.Price)
+	switch trade.State.Status {
+	case types.TradeStatusPendingSell:
+	case types.TradeStatusWatching:
+	default:
+		return
+	}
 
-			if trade.State.StopLoss.Enabled {
-				s.checkStopLoss(trade)
-			}
-			if trade.State.TrailingProfit.Enabled {
-				s.checkTrailingProfit(trade, lastTrade.Price)
-			}
-		}
+	trade.State.LastPrice = price
+	trade.State.ProfitPercent = s.CalculateProfit(trade, price)
+
+	if trade.State.StopLoss.Enabled {
+		s.checkBreakEven(trade)
+		s.checkStopLoss(trade)
+	}
+	if trade.State.TrailingProfit.Enabled {
+		s.checkTrailingProfit(trade, price)
+	}
+	if trade.State.StopLoss.OnExchange || trade.OpenStopOrder() != nil {
+		s.SyncStopOrder(trade, false)
 	}
 }
 
@@ -143,16 +235,28 @@ func (s *TradeService) checkStopLoss(trade *types.Trade) {
 	if trade.State.StopLoss.Triggered {
 		return
 	}
-	if trade.State.ProfitPercent < math.Abs(trade.State.StopLoss.Percent)*-1 {
+	if trade.State.StopLoss.Trailing {
+		s.updateTrailingStop(trade)
+	}
+	if stopOrder := trade.OpenStopOrder(); stopOrder != nil &&
+		trade.State.LastPrice >= stopOrder.Price {
+		// Left to the stop order unless the market is past its limit.
+		return
+	}
+	if s.stopLossPassed(trade) {
 		log.WithFields(log.Fields{
-			"symbol": trade.State.Symbol,
-			"loss":   trade.State.ProfitPercent,
+			"symbol":    trade.State.Symbol,
+			"loss":      trade.State.ProfitPercent,
+			"price":     trade.State.LastPrice,
+			"stopPrice": trade.State.StopLoss.Price,
 		}).Infof("Stop Loss: Triggering market sell.")
 		if trade.State.Status == types.TradeStatusPendingSell {
 			s.CancelSell(trade)
 		}
+		s.CancelTakeProfit(trade)
+		s.CancelStopOrder(trade)
 		trade.State.StopLoss.Triggered = true
-		s.MarketSell(trade, true)
+		s.MarketSell(trade, false)
 	}
 }
 
@@ -191,7 +295,8 @@ func (s *TradeService) checkTrailingProfit(trade *types.Trade, price float64) {
 					"percent": trade.State.ProfitPercent,
 				}).Infof("Executing trailing profit sell")
 				trade.State.TrailingProfit.Triggered = true
-				s.MarketSell(trade, true)
+				s.CancelStopOrder(trade)
+				s.MarketSell(trade, false)
 			}
 		}
 	} else {
@@ -264,8 +369,34 @@ func (s *TradeService) FindTradeByLocalID(localId string) *types.Trade {
 	return s.TradesByLocalID[localId]
 }
 
+// CopyTradeState returns a copy of the state of a loaded trade, or nil if the
+// trade is not loaded. The copy is taken under the execution lock so it is never read while a report is
+// being applied to the trade.
+func (s *TradeService) CopyTradeState(localId string) (*types.TradeState, error) {
+	s.executionLock.Lock()
+	defer s.executionLock.Unlock()
+
+	trade := s.FindTradeByLocalID(localId)
+	if trade == nil {
+		return nil, nil
+	}
+
+	// A round trip through JSON, as the state is saved, copies the maps and
+	// slices the state shares with the trade.
+	buf, err := json.Marshal(trade.State)
+	if err != nil {
+		return nil, err
+	}
+	var state types.TradeState
+	if err := json.Unmarshal(buf, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
 func (s *TradeService) AbandonTrade(trade *types.Trade) {
 	if !trade.IsDone() {
+		trade.AddHistoryEntry(types.HistoryTypeAbandoned, nil)
 		s.CloseTrade(trade, types.TradeStatusAbandoned, time.Now())
 		s.BroadcastTradeUpdate(trade)
 	}
@@ -300,18 +431,17 @@ func (s *TradeService) AddClientOrderId(trade *types.Trade, orderId string, lock
 }
 
 func (s *TradeService) UpdateSellableQuantity(trade *types.Trade) {
-	feeAsset := trade.FeeAsset()
-	if feeAsset == "BNB" {
-		trade.State.SellableQuantity = trade.State.BuyFillQuantity
-	} else if feeAsset != "" {
-		stepSize, err := s.binanceExchangeInfo.GetStepSize(trade.State.Symbol)
+	stepSize := float64(0)
+	if feeAsset := trade.FeeAsset(); feeAsset != "" && feeAsset != "BNB" {
+		symbolInfo, err := s.exchange.GetSymbolInfo(trade.State.Symbol)
 		if err != nil {
 			log.WithError(err).WithField("symbol", trade.State.Symbol).
 				Error("Failed to get symbol step size.")
-		} else {
-			trade.State.SellableQuantity = s.FixQuantityToStepSize(trade.State.BuyFillQuantity, stepSize)
+			return
 		}
+		stepSize = symbolInfo.StepSize
 	}
+	trade.UpdateSellableQuantity(stepSize)
 }
 
 func (s *TradeService) RestoreTrade(trade *types.Trade) {
@@ -321,11 +451,19 @@ func (s *TradeService) RestoreTrade(trade *types.Trade) {
 	}
 	s.UpdateSellableQuantity(trade)
 	if !trade.IsDone() {
-		s.tradeStreamManager.AddSymbol(trade.State.Symbol)
+		s.exchange.AddSymbol(trade.State.Symbol)
 	}
 }
 
 func (s *TradeService) AddNewTrade(trade *types.Trade) string {
+	trade.State.Status = types.TradeStatusNew
+	s.addTrade(trade)
+	return trade.State.TradeID
+}
+
+// Registers, saves and broadcasts a trade, assigning it an ID if it doesn't
+// have one.
+func (s *TradeService) addTrade(trade *types.Trade) {
 	if trade.State.TradeID == "" {
 		localId, err := s.idGenerator.GetID(nil)
 		if err != nil {
@@ -333,7 +471,6 @@ func (s *TradeService) AddNewTrade(trade *types.Trade) string {
 		}
 		trade.State.TradeID = localId.String()
 	}
-	trade.State.Status = types.TradeStatusNew
 
 	s.lock.Lock()
 	s.TradesByLocalID[trade.State.TradeID] = trade
@@ -350,22 +487,20 @@ func (s *TradeService) AddNewTrade(trade *types.Trade) string {
 		log.WithError(err).Errorf("Failed to save trade to database")
 	}
 
-	s.tradeStreamManager.AddSymbol(trade.State.Symbol)
+	s.exchange.AddSymbol(trade.State.Symbol)
 	s.BroadcastTradeUpdate(trade)
 
-	lastPrice, err := binanceapi.NewRestClient().GetPriceTicker(trade.State.Symbol)
+	lastPrice, err := s.exchange.GetPrice(trade.State.Symbol, types.PriceSourceLast)
 	if err != nil {
 		log.WithError(err).WithFields(log.Fields{
 			"symbol": trade.State.Symbol,
 		}).Errorf("Failed to get last price for new trade")
 	} else {
 		if trade.State.LastPrice == 0 {
-			trade.State.LastPrice = lastPrice.Price
+			trade.State.LastPrice = lastPrice
 			s.BroadcastTradeUpdate(trade)
 		}
 	}
-
-	return trade.State.TradeID
 }
 
 func (s *TradeService) RemoveTrade(trade *types.Trade) {
@@ -381,12 +516,50 @@ func (s *TradeService) RemoveTrade(trade *types.Trade) {
 	}
 }
 
+// RepairTrade replaces the state of a trade, for example with the state
+// rebuilt by a replay, and saves it. Trades not currently loaded, such as
+// archived trades, are only updated in the database.
+func (s *TradeService) RepairTrade(state types.TradeState) error {
+	s.executionLock.Lock()
+	defer s.executionLock.Unlock()
+
+	s.lock.Lock()
+	trade := s.TradesByLocalID[state.TradeID]
+	wasDone := false
+	if trade != nil {
+		wasDone = trade.IsDone()
+		trade.State = state
+		for clientOrderId := range state.ClientOrderIDs {
+			s.TradesByClientID[clientOrderId] = trade
+		}
+	}
+	s.lock.Unlock()
+
+	if trade == nil {
+		return db.DbUpdateTrade(types.NewTradeWithState(state))
+	}
+
+	// Only a repair that closes or reopens the trade changes its interest
+	// in the symbol's trade stream.
+	if !wasDone && trade.IsDone() {
+		s.exchange.RemoveSymbol(trade.State.Symbol)
+	} else if wasDone && !trade.IsDone() {
+		s.exchange.AddSymbol(trade.State.Symbol)
+	}
+	if err := db.DbUpdateTrade(trade); err != nil {
+		return err
+	}
+	s.BroadcastTradeUpdate(trade)
+	return nil
+}
+
 func (s *TradeService) FailTrade(trade *types.Trade) {
+	trade.AddHistoryEntry(types.HistoryTypeFailed, nil)
 	s.CloseTrade(trade, types.TradeStatusFailed, time.Now())
 	s.BroadcastTradeUpdate(trade)
 }
 
-func (s *TradeService) FindTradeForReport(report binanceapi.StreamExecutionReport) *types.Trade {
+func (s *TradeService) FindTradeForReport(report exchange.ExecutionReport) *types.Trade {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 
@@ -408,7 +581,10 @@ func (s *TradeService) FindTradeForReport(report binanceapi.StreamExecutionRepor
 
 // Note: Be sure to process reports even after a fill, as sometimes partial
 //       fills will be received after the fill report.
-func (s *TradeService) OnExecutionReport(event *binanceex.UserStreamEvent) {
+func (s *TradeService) OnExecutionReport(event *exchange.UserStreamEvent) {
+	s.executionLock.Lock()
+	defer s.executionLock.Unlock()
+
 	report := event.ExecutionReport
 
 	trade := s.FindTradeForReport(report)
@@ -422,104 +598,40 @@ func (s *TradeService) OnExecutionReport(event *binanceex.UserStreamEvent) {
 		"symbol":  trade.State.Symbol,
 	}).Debugf("Received execution report: %s", log.ToJson(report))
 
+	// Trades keep execution reports in the Binance format.
+	binanceReport := exchange.ToBinanceExecutionReport(report)
+
 	trade.AddHistory(types.HistoryEntry{
 		Timestamp: time.Now(),
 		Type:      types.HistoryTypeExecutionReport,
-		Fields:    report,
+		Fields:    binanceReport,
 	})
 
-	_, err := s.binanceExchangeInfo.GetStepSize(trade.State.Symbol)
+	stepSize := float64(0)
+	symbolInfo, err := s.exchange.GetSymbolInfo(trade.State.Symbol)
 	if err != nil {
 		log.WithError(err).WithFields(log.Fields{
 			"symbol": trade.State.Symbol,
 		}).Error("Failed to get Binance symbol information.")
+	} else {
+		stepSize = symbolInfo.StepSize
 	}
 
-	switch report.Side {
-	case binanceapi.OrderSideBuy:
-		switch report.CurrentOrderStatus {
-		case binanceapi.OrderStatusNew:
-			trade.State.OpenTime = event.EventTime
-			trade.State.BuyOrder.Quantity = report.Quantity
-			trade.State.BuyOrder.Price = report.Price
-			trade.State.BuyOrderId = report.OrderID
-			if trade.State.Status == types.TradeStatusNew {
-				trade.State.Status = types.TradeStatusPendingBuy
-			}
-			if trade.State.LastBuyStatus == "" {
-				trade.State.LastBuyStatus = report.CurrentOrderStatus
-			}
-		case binanceapi.OrderStatusCanceled:
-			if trade.State.BuyFillQuantity == 0 {
-				trade.State.Status = types.TradeStatusCanceled
-			} else {
-				trade.State.Status = types.TradeStatusWatching
-			}
-			trade.State.LastBuyStatus = report.CurrentOrderStatus
-		case binanceapi.OrderStatusPartiallyFilled:
-			if trade.State.LastBuyStatus != binanceapi.OrderStatusFilled {
-				trade.State.LastBuyStatus = report.CurrentOrderStatus
-			}
-			trade.AddBuyFill(report)
-			s.UpdateSellableQuantity(trade)
-		case binanceapi.OrderStatusFilled:
-			trade.AddBuyFill(report)
-			s.UpdateSellableQuantity(trade)
-			trade.State.Status = types.TradeStatusWatching
-			trade.State.LastBuyStatus = report.CurrentOrderStatus
-			s.TriggerLimitSell(trade)
-		}
-
-	case binanceapi.OrderSideSell:
-		switch report.CurrentOrderStatus {
-		case binanceapi.OrderStatusNew:
-			if trade.State.Status == types.TradeStatusDone {
-				// Sometimes we get the fill before the new.
-				break
-			}
-			trade.State.SellOrderId = report.OrderID
-			trade.State.Status = types.TradeStatusPendingSell
-			switch trade.State.SellOrder.Status {
-			case binanceapi.OrderStatusPartiallyFilled:
-			case binanceapi.OrderStatusFilled:
-			default:
-				trade.State.SellOrder.Status = report.CurrentOrderStatus
-			}
-			trade.State.SellOrder.Type = report.OrderType
-			trade.State.SellOrder.Quantity = report.Quantity
-			trade.State.SellOrder.Price = report.Price
-		case binanceapi.OrderStatusPartiallyFilled:
-			fill := types.OrderFill{
-				Price:            report.LastExecutedPrice,
-				Quantity:         report.LastExecutedQuantity,
-				CommissionAsset:  report.CommissionAsset,
-				CommissionAmount: report.CommissionAmount,
-			}
-			trade.DoAddSellFill(fill)
-			if trade.State.SellOrder.Status != binanceapi.OrderStatusFilled {
-				trade.State.SellOrder.Status = report.CurrentOrderStatus
-			}
-		case binanceapi.OrderStatusFilled:
-			fill := types.OrderFill{
-				Price:            report.LastExecutedPrice,
-				Quantity:         report.LastExecutedQuantity,
-				CommissionAsset:  report.CommissionAsset,
-				CommissionAmount: report.CommissionAmount,
-			}
-			trade.DoAddSellFill(fill)
-			trade.State.Status = types.TradeStatusDone
-			trade.State.SellOrder.Status = report.CurrentOrderStatus
-		case binanceapi.OrderStatusCanceled:
-			trade.State.Status = types.TradeStatusWatching
-			trade.State.SellOrder.Status = report.CurrentOrderStatus
-		default:
-			log.WithFields(log.Fields{
-				"symbol":             trade.State.Symbol,
-				"currentOrderStatus": report.CurrentOrderStatus,
-				"side":               "sell",
-			}).Errorf("Unknown current order status in execution report")
-			trade.State.SellOrder.Status = report.CurrentOrderStatus
+	trade.ApplyExecutionReport(binanceReport, event.Time, stepSize)
+
+	if report.Side == exchange.OrderSideBuy &&
+		report.Status == exchange.OrderStatusFilled {
+		s.TriggerSells(trade)
+	} else if report.Side == exchange.OrderSideBuy &&
+		report.Status == exchange.OrderStatusCanceled {
+		if trade.State.BuyChase.Replacing {
+			s.replaceBuy(trade)
+		} else if trade.State.Status == types.TradeStatusWatching {
+			// What was filled before the cancel.
+			s.TriggerSells(trade)
 		}
+	} else if report.Side == exchange.OrderSideSell {
+		s.SyncStopOrder(trade, false)
 	}
 
 	switch trade.State.Status {
@@ -528,15 +640,29 @@ func (s *TradeService) OnExecutionReport(event *binanceex.UserStreamEvent) {
 	case types.TradeStatusCanceled:
 		fallthrough
 	case types.TradeStatusFailed:
-		trade.State.CloseTime = &event.EventTime
-		s.tradeStreamManager.RemoveSymbol(trade.State.Symbol)
+		s.exchange.RemoveSymbol(trade.State.Symbol)
 	}
 
 	db.DbUpdateTrade(trade)
 	s.BroadcastTradeUpdate(trade)
 }
 
+// TriggerSells places the take profit, limit sell and stop orders of a trade
+// whose buy has filled.
+func (s *TradeService) TriggerSells(trade *types.Trade) {
+	s.TriggerTakeProfit(trade)
+	if trade.RemainingQuantity() > 0 {
+		s.TriggerLimitSell(trade)
+	}
+	s.SyncStopOrder(trade, false)
+}
+
 func (s *TradeService) TriggerLimitSell(trade *types.Trade) {
+	s.triggerLimitSell(trade, false)
+}
+
+// Set locked if the caller holds the trade service lock.
+func (s *TradeService) triggerLimitSell(trade *types.Trade, locked bool) {
 	if trade.State.LimitSell.Enabled {
 		if trade.State.LimitSell.Type == types.LimitSellTypePercent {
 			log.WithFields(log.Fields{
@@ -544,14 +670,14 @@ func (s *TradeService) TriggerLimitSell(trade *types.Trade) {
 				"symbol":  trade.State.Symbol,
 			}).Infof("Triggering limit sell at %f percent.",
 				trade.State.LimitSell.Percent)
-			s.LimitSellByPercent(trade, trade.State.LimitSell.Percent)
+			s.limitSellByPercent(trade, trade.State.LimitSell.Percent, locked)
 		} else if trade.State.LimitSell.Type == types.LimitSellTypePrice {
 			log.WithFields(log.Fields{
 				"tradeId": trade.State.TradeID,
 				"symbol":  trade.State.Symbol,
 			}).Infof("Triggering limit sell at price %f.",
 				trade.State.LimitSell.Price)
-			s.LimitSellByPrice(trade, trade.State.LimitSell.Price)
+			s.limitSellByPrice(trade, trade.State.LimitSell.Price, locked)
 		} else {
 			log.WithFields(log.Fields{
 				"tradeId": trade.State.TradeID,
@@ -572,21 +698,58 @@ func (s *TradeService) CloseTrade(trade *types.Trade, status types.TradeStatus,
 	}
 	trade.State.Status = status
 	trade.State.CloseTime = &closeTime
-	s.tradeStreamManager.RemoveSymbol(trade.State.Symbol)
+	s.exchange.RemoveSymbol(trade.State.Symbol)
 	db.DbUpdateTrade(trade)
 }
 
 // Return the sellable quantity adjusted for lot size.
 func (s *TradeService) FixQuantityToStepSize(quantity float64, stepSize float64) float64 {
-	fixedQuantity := util.Roundx(quantity, 1/stepSize)
-	if fixedQuantity > quantity {
-		fixedQuantity = util.Roundx(fixedQuantity-stepSize, 1/stepSize)
+	return util.FixQuantityToStepSize(quantity, stepSize)
+}
+
+// ValidateMarketSell checks a market sell of all a trade holds, once its
+// sell orders are cancelled, against the symbol filters. Returns an
+// *exchange.OrderError if it fails. For market sells requested by the user,
+// so a sell that would be refused is reported before any order is cancelled.
+func (s *TradeService) ValidateMarketSell(trade *types.Trade) error {
+	err := exchange.ValidateExitOrder(s.exchange, exchange.OrderParameters{
+		Symbol:   trade.State.Symbol,
+		Side:     exchange.OrderSideSell,
+		Type:     exchange.OrderTypeMarket,
+		Quantity: util.Round8(trade.State.SellableQuantity - trade.State.SellFillQuantity),
+	})
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"symbol":  trade.State.Symbol,
+			"tradeId": trade.State.TradeID,
+		}).Warn("Market sell order failed validation.")
 	}
-	return fixedQuantity
+	return err
 }
 
+// MarketSell sells what is left of a trade at market. An order failing
+// validation is still sent, as an automatic exit is left to the exchange to
+// refuse. Validate market sells requested by the user with
+// ValidateMarketSell first.
 func (s *TradeService) MarketSell(trade *types.Trade, locked bool) error {
-	quantity := trade.State.SellableQuantity - trade.State.SellFillQuantity
+	quantity := trade.RemainingQuantity()
+	if quantity <= 0 {
+		return fmt.Errorf("nothing left to sell")
+	}
+
+	order := exchange.OrderParameters{
+		Symbol:   trade.State.Symbol,
+		Side:     exchange.OrderSideSell,
+		Type:     exchange.OrderTypeMarket,
+		Quantity: quantity,
+	}
+	if err := exchange.ValidateExitOrder(s.exchange, order); err != nil {
+		// Still sent, an exit is left to the exchange to refuse.
+		log.WithError(err).WithFields(log.Fields{
+			"symbol":  trade.State.Symbol,
+			"tradeId": trade.State.TradeID,
+		}).Warn("Market sell order failed validation.")
+	}
 
 	clientOrderId, err := s.MakeOrderID()
 	if err != nil {
@@ -602,32 +765,40 @@ func (s *TradeService) MarketSell(trade *types.Trade, locked bool) error {
 		"tradeId":  trade.State.TradeID,
 	}).Info("Posting market sell order.")
 
-	order := binanceapi.OrderParameters{
-		Symbol:           trade.State.Symbol,
-		Side:             binanceapi.OrderSideSell,
-		Type:             binanceapi.OrderTypeMarket,
-		Quantity:         quantity,
-		NewClientOrderId: clientOrderId,
-	}
-	_, err = binanceex.GetBinanceRestClient().PostOrder(order)
+	order.ClientOrderID = clientOrderId
+	_, err = s.exchange.PostOrder(order)
 	return err
 }
 
-func (s *TradeService) LimitSellByPercent(trade *types.Trade, percent float64) error {
-	symbolInfo, err := s.binanceExchangeInfo.GetSymbol(trade.State.Symbol)
+// Validates a limit sell of a trade against the symbol filters before any
+// order ID is created for it.
+func (s *TradeService) validateLimitSell(trade *types.Trade, price float64, quantity float64) error {
+	err := exchange.ValidateOrder(s.exchange, exchange.OrderParameters{
+		Symbol:      trade.State.Symbol,
+		Side:        exchange.OrderSideSell,
+		Type:        exchange.OrderTypeLimit,
+		TimeInForce: exchange.TimeInForceGTC,
+		Quantity:    quantity,
+		Price:       price,
+	})
 	if err != nil {
 		log.WithError(err).WithFields(log.Fields{
-			"symbol": trade.State.Symbol,
-		}).Error("Failed to get info for symbol.")
-		return err
+			"symbol":   trade.State.Symbol,
+			"tradeId":  trade.State.TradeID,
+			"price":    fmt.Sprintf("%.8f", price),
+			"quantity": quantity,
+		}).Warn("Limit sell order failed validation.")
 	}
+	return err
+}
 
+// The price to sell at for a profit percent, above the effective buy price.
+func limitSellPrice(trade *types.Trade, percent float64, tickSize float64) float64 {
 	price := trade.State.BuyCost *
 		(1 + trade.State.Fee) * (1 + (percent / 100)) /
 		trade.State.SellableQuantity
-	price = util.Roundx(price, 1/symbolInfo.TickSize)
+	price = util.Roundx(price, 1/tickSize)
 
-	tickSize := symbolInfo.TickSize
 	if price <= trade.State.EffectiveBuyPrice {
 		fixedPrice := price + tickSize
 		log.WithFields(log.Fields{
@@ -639,15 +810,34 @@ func (s *TradeService) LimitSellByPercent(trade *types.Trade, percent float64) e
 		}).Warnf("Sell price <= effective buy price, incrementing by tick size.")
 		price = fixedPrice
 	}
+	return price
+}
+
+func (s *TradeService) LimitSellByPercent(trade *types.Trade, percent float64) error {
+	return s.limitSellByPercent(trade, percent, false)
+}
+
+func (s *TradeService) limitSellByPercent(trade *types.Trade, percent float64, locked bool) error {
+	symbolInfo, err := s.exchange.GetSymbolInfo(trade.State.Symbol)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"symbol": trade.State.Symbol,
+		}).Error("Failed to get info for symbol.")
+		return err
+	}
+
+	price := limitSellPrice(trade, percent, symbolInfo.TickSize)
+	quantity := trade.RemainingQuantity()
+	if err := s.validateLimitSell(trade, price, quantity); err != nil {
+		return err
+	}
 
 	clientOrderId, err := s.MakeOrderID()
 	if err != nil {
 		log.WithError(err).Errorf("Failed to generate clientOrderId")
 		return err
 	}
-	s.AddClientOrderId(trade, clientOrderId, false)
-
-	quantity := trade.State.SellableQuantity - trade.State.SellFillQuantity
+	s.AddClientOrderId(trade, clientOrderId, locked)
 
 	log.WithFields(log.Fields{
 		"price":    fmt.Sprintf("%.8f", price),
@@ -656,19 +846,10 @@ func (s *TradeService) LimitSellByPercent(trade *types.Trade, percent float64) e
 		"quantity": quantity,
 	}).Debugf("Posting limit sell order at percent.")
 
-	order := binanceapi.OrderParameters{
-		Symbol:           trade.State.Symbol,
-		Side:             binanceapi.OrderSideSell,
-		Type:             binanceapi.OrderTypeLimit,
-		TimeInForce:      binanceapi.TimeInForceGTC,
-		Quantity:         quantity,
-		Price:            price,
-		NewClientOrderId: clientOrderId,
-	}
 	s0 := time.Now()
-	_, err = binanceex.GetBinanceRestClient().PostOrder(order)
+	err = s.postLimitSell(trade, price, quantity, clientOrderId, locked)
 	d := time.Now().Sub(s0)
-	if err != nil {
+	if err != nil && !exchange.OrderPending(err) {
 		log.WithFields(log.Fields{
 			"requestDuration": d,
 		}).WithError(err).Error("Failed to send sell order.")
@@ -701,31 +882,31 @@ func (s *TradeService) LimitSellByPercent(trade *types.Trade, percent float64) e
 }
 
 func (s *TradeService) LimitSellByPrice(trade *types.Trade, price float64) error {
+	return s.limitSellByPrice(trade, price, false)
+}
+
+func (s *TradeService) limitSellByPrice(trade *types.Trade, price float64, locked bool) error {
+	quantity := trade.RemainingQuantity()
+	if err := s.validateLimitSell(trade, price, quantity); err != nil {
+		return err
+	}
+
 	clientOrderId, err := s.MakeOrderID()
 	if err != nil {
 		log.WithError(err).Errorf("Failed to generate clientOrderId")
 		return err
 	}
-	s.AddClientOrderId(trade, clientOrderId, false)
+	s.AddClientOrderId(trade, clientOrderId, locked)
 
 	log.WithFields(log.Fields{
 		"price":    fmt.Sprintf("%.8f", price),
 		"symbol":   trade.State.Symbol,
 		"tradeId":  trade.State.TradeID,
-		"quantity": trade.State.SellableQuantity,
+		"quantity": quantity,
 	}).Debugf("Posting limit sell order at price.")
 
-	order := binanceapi.OrderParameters{
-		Symbol:           trade.State.Symbol,
-		Side:             binanceapi.OrderSideSell,
-		Type:             binanceapi.OrderTypeLimit,
-		TimeInForce:      binanceapi.TimeInForceGTC,
-		Quantity:         trade.State.SellableQuantity,
-		Price:            price,
-		NewClientOrderId: clientOrderId,
-	}
-	_, err = binanceex.GetBinanceRestClient().PostOrder(order)
-	if err != nil {
+	err = s.postLimitSell(trade, price, quantity, clientOrderId, locked)
+	if err != nil && !exchange.OrderPending(err) {
 		log.WithFields(log.Fields{}).WithError(err).Error("Failed to send sell order.")
 		return err
 	}
@@ -734,22 +915,44 @@ func (s *TradeService) LimitSellByPrice(trade *types.Trade, price float64) error
 		"symbol":  trade.State.Symbol,
 		"tradeId": trade.State.TradeID,
 	}).Info("Sell order posted.")
+
+	trade.AddHistoryEntry(types.HistoryTypeSellOrder, map[string]interface{}{
+		"sellOrderType": "limitSellByPrice",
+		"price":         price,
+		"quantity":      quantity,
+		"clientOrderId": clientOrderId,
+	})
+
+	trade.SetLimitSellByPrice(price)
+
 	db.DbUpdateTrade(trade)
+	s.BroadcastTradeUpdate(trade)
 	return nil
 }
 
-func (s *TradeService) UpdateStopLoss(trade *types.Trade, enable bool, percent float64) {
-	trade.SetStopLoss(enable, percent)
+func (s *TradeService) UpdateStopLoss(trade *types.Trade, settings types.StopLossSettings) {
+	s.executionLock.Lock()
+	defer s.executionLock.Unlock()
+
+	trade.ApplyStopLossSettings(settings)
 	log.WithFields(log.Fields{
-		"symbol":  trade.State.Symbol,
-		"tradeId": trade.State.TradeID,
-		"enable":  enable,
-		"percent": percent,
+		"symbol":           trade.State.Symbol,
+		"tradeId":          trade.State.TradeID,
+		"enable":           settings.Enabled,
+		"percent":          settings.Percent,
+		"trailing":         settings.Trailing,
+		"ticks":            settings.Ticks,
+		"breakEvenPercent": settings.BreakEvenPercent,
+		"breakEvenBuffer":  settings.BreakEvenBuffer,
+		"onExchange":       settings.OnExchange,
 	}).Infof("Stop loss settings updated")
-	trade.AddHistoryEntry(types.HistoryTypeStopLossUpdate, map[string]interface{}{
-		"enable":  enable,
-		"percent": percent,
-	})
+	trade.AddHistoryEntry(types.HistoryTypeStopLossUpdate, settings)
+	// New settings get a stop order that failed to post another try.
+	delete(s.stopOrderRetries, trade.State.TradeID)
+	if settings.Trailing && trade.State.LastPrice > 0 {
+		s.updateTrailingStop(trade)
+	}
+	s.SyncStopOrder(trade, false)
 	db.DbUpdateTrade(trade)
 	s.BroadcastTradeUpdate(trade)
 }
@@ -788,14 +991,18 @@ func (s *TradeService) CancelSell(trade *types.Trade) error {
 		"tradeId": trade.State.TradeID,
 		"orderId": trade.State.SellOrderId,
 	}).Info("Cancelling sell order.")
-	_, err := binanceex.GetBinanceRestClient().CancelOrderById(
-		trade.State.Symbol, trade.State.SellOrderId)
+	err := s.exchange.CancelOrder(trade.State.Symbol, trade.State.SellOrderId)
 	if err == nil {
 		trade.AddHistoryEntry(types.HistoryTypeSellCanceled, map[string]interface{}{
 			"sellOrderId": trade.State.SellOrderId,
 			"success":     true,
 		})
 		trade.State.LimitSell.Enabled = false
+		if stopOrder := trade.OpenStopOrder(); stopOrder != nil &&
+			trade.IsOrderListOrder(stopOrder.ClientOrderID) {
+			// Cancelling the limit sell of an OCO cancels its stop order.
+			recordStopOrderCancel(trade, nil)
+		}
 	} else {
 		log.WithError(err).WithFields(log.Fields{
 			"symbol":  trade.State.Symbol,
@@ -813,9 +1020,31 @@ func (s *TradeService) CancelSell(trade *types.Trade) error {
 	return err
 }
 
+// CancelBuy cancels the buy order of a trade, or an armed trade whose buy
+// has not been placed yet.
 func (s *TradeService) CancelBuy(trade *types.Trade) error {
-	_, err := binanceex.GetBinanceRestClient().CancelOrderById(
-		trade.State.Symbol, trade.State.BuyOrderId)
+	// Taken to keep the entry from being triggered while cancelling.
+	s.executionLock.Lock()
+	defer s.executionLock.Unlock()
+	if trade.State.Status == types.TradeStatusArmed {
+		// Nothing on the exchange yet.
+		trade.AddHistoryEntry(types.HistoryTypeBuyCanceled, map[string]interface{}{
+			"success": true,
+			"armed":   true,
+		})
+		s.CloseTrade(trade, types.TradeStatusCanceled, time.Now())
+		s.BroadcastTradeUpdate(trade)
+		return nil
+	}
+	return s.cancelBuy(trade)
+}
+
+// Cancels the buy order of a trade. Called with the execution lock held.
+func (s *TradeService) cancelBuy(trade *types.Trade) error {
+	if trade.State.BuyChase.Replacing {
+		return fmt.Errorf("buy is being re-priced")
+	}
+	err := s.exchange.CancelOrder(trade.State.Symbol, trade.State.BuyOrderId)
 	if err != nil {
 		trade.AddHistoryEntry(types.HistoryTypeBuyCanceled, map[string]interface{}{
 			"success": false,
@@ -0,0 +1,125 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tradeservice
+
+import (
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/exchange"
+	"gitlab.com/crankykernel/maker/go/types"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+type symbolCountingMarket struct {
+	testMarket
+	symbols map[string]int
+}
+
+func (m *symbolCountingMarket) AddSymbol(symbol string) {
+	m.symbols[symbol]++
+}
+
+func (m *symbolCountingMarket) RemoveSymbol(symbol string) {
+	m.symbols[symbol]--
+}
+
+// A repair only changes the trade stream subscription when it closes or
+// reopens the trade.
+func TestRepairTradeSubscriptions(t *testing.T) {
+	directory, err := ioutil.TempDir("", "maker-repair")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+	db.DbOpenFile(path.Join(directory, "maker.db"))
+	defer db.DbClose()
+
+	market := &symbolCountingMarket{symbols: map[string]int{}}
+	service := NewTradeService(market)
+
+	trade := types.NewTrade()
+	trade.State.Symbol = "ETHBTC"
+	service.AddNewTrade(trade)
+	assert.Equal(t, 1, market.symbols["ETHBTC"])
+
+	repair := func(status types.TradeStatus) {
+		state, err := service.CopyTradeState(trade.State.TradeID)
+		assert.Nil(t, err)
+		state.Status = status
+		assert.Nil(t, service.RepairTrade(*state))
+	}
+
+	repair(types.TradeStatusWatching)
+	assert.Equal(t, 1, market.symbols["ETHBTC"])
+
+	repair(types.TradeStatusDone)
+	assert.Equal(t, 0, market.symbols["ETHBTC"])
+	repair(types.TradeStatusDone)
+	assert.Equal(t, 0, market.symbols["ETHBTC"])
+
+	repair(types.TradeStatusWatching)
+	assert.Equal(t, 1, market.symbols["ETHBTC"])
+}
+
+// The copied state doesn't share maps with the trade.
+func TestCopyTradeState(t *testing.T) {
+	directory, err := ioutil.TempDir("", "maker-repair")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+	db.DbOpenFile(path.Join(directory, "maker.db"))
+	defer db.DbClose()
+
+	service := NewTradeService(&testMarket{})
+	trade := types.NewTrade()
+	trade.State.Symbol = "ETHBTC"
+	trade.AddClientOrderID("buy")
+	service.AddNewTrade(trade)
+
+	state, err := service.CopyTradeState(trade.State.TradeID)
+	assert.Nil(t, err)
+	state.ClientOrderIDs["other"] = true
+	assert.Equal(t, 1, len(trade.State.ClientOrderIDs))
+
+	state, err = service.CopyTradeState("missing")
+	assert.Nil(t, err)
+	assert.Nil(t, state)
+}
+
+type haltedMarket struct {
+	testMarket
+}
+
+func (m *haltedMarket) GetSymbolInfo(symbol string) (exchange.SymbolInfo, error) {
+	return exchange.SymbolInfo{BaseAsset: "ETH", QuoteAsset: "BTC", Status: "BREAK",
+		TickSize: 0.00000001, StepSize: 1}, nil
+}
+
+// A market sell the exchange would refuse is reported to the user.
+func TestValidateMarketSell(t *testing.T) {
+	service := NewTradeService(&haltedMarket{})
+	trade := types.NewTrade()
+	trade.State.Symbol = "ETHBTC"
+	trade.State.SellableQuantity = 10
+
+	err := service.ValidateMarketSell(trade)
+	orderErr, ok := err.(*exchange.OrderError)
+	assert.True(t, ok)
+	assert.Equal(t, "symbol", orderErr.Field)
+
+	service = NewTradeService(&testMarket{})
+	assert.Nil(t, service.ValidateMarketSell(trade))
+}
@@ -0,0 +1,113 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package types
+
+import (
+	"github.com/crankykernel/binanceapi-go"
+	"gitlab.com/crankykernel/maker/go/util"
+)
+
+// Adoption describes an order or balance from outside Maker that is taken
+// over as a trade. It is recorded as the fields of the ADOPTED history entry
+// so the trade can be replayed.
+type Adoption struct {
+	Symbol string `json:"symbol"`
+
+	// The adopted buy order, 0 if a balance was adopted.
+	OrderID     int64                  `json:"orderId,omitempty"`
+	OrderStatus binanceapi.OrderStatus `json:"orderStatus,omitempty"`
+
+	// The quantity and price of the buy order, or the adopted balance and
+	// the price it was bought at.
+	Quantity float64 `json:"quantity"`
+	Price    float64 `json:"price"`
+
+	// The fills of the buy order at the time of adoption.
+	Fills []OrderFill `json:"fills"`
+
+	LimitSellEnabled        bool          `json:"limitSellEnabled"`
+	LimitSellType           LimitSellType `json:"limitSellType"`
+	LimitSellPercent        float64       `json:"limitSellPercent"`
+	LimitSellPrice          float64       `json:"limitSellPrice"`
+	StopLossEnabled         bool          `json:"stopLossEnabled"`
+	StopLossPercent         float64       `json:"stopLossPercent"`
+	StopLossTrailing        bool          `json:"stopLossTrailing,omitempty"`
+	StopLossTicks           int64         `json:"stopLossTicks,omitempty"`
+	StopLossBreakEven       float64       `json:"stopLossBreakEven,omitempty"`
+	StopLossBreakEvenBuffer float64       `json:"stopLossBreakEvenBuffer,omitempty"`
+	StopLossOnExchange      bool          `json:"stopLossOnExchange,omitempty"`
+	TrailingProfitEnabled   bool          `json:"trailingProfitEnabled"`
+	TrailingProfitPercent   float64       `json:"trailingProfitPercent"`
+	TrailingProfitDeviation float64       `json:"trailingProfitDeviation"`
+
+	TakeProfit []TakeProfitSetting `json:"takeProfit,omitempty"`
+}
+
+// ApplyAdoption sets the buy side and exit settings of a trade from an
+// adoption. The trade is pending buy while the adopted order is open,
+// otherwise it is watching.
+func (t *Trade) ApplyAdoption(adoption Adoption, stepSize float64) error {
+	t.State.Symbol = adoption.Symbol
+	t.State.BuyOrderId = adoption.OrderID
+	t.State.LastBuyStatus = adoption.OrderStatus
+	t.State.BuyOrder.Quantity = adoption.Quantity
+	t.State.BuyOrder.Price = adoption.Price
+	t.State.BuySideFills = append([]OrderFill{}, adoption.Fills...)
+	t.UpdateBuyState()
+
+	if t.FeeAsset() == "" {
+		// An adopted balance has no commission to round for.
+		t.State.SellableQuantity = t.State.BuyFillQuantity
+		if stepSize > 0 {
+			t.State.SellableQuantity = util.FixQuantityToStepSize(
+				t.State.BuyFillQuantity, stepSize)
+		}
+	} else {
+		t.UpdateSellableQuantity(stepSize)
+	}
+
+	switch adoption.OrderStatus {
+	case binanceapi.OrderStatusNew:
+		fallthrough
+	case binanceapi.OrderStatusPartiallyFilled:
+		t.State.Status = TradeStatusPendingBuy
+	default:
+		t.State.Status = TradeStatusWatching
+	}
+
+	if adoption.StopLossEnabled {
+		t.SetStopLoss(true, adoption.StopLossPercent)
+		t.SetStopLossTrailing(adoption.StopLossTrailing, adoption.StopLossTicks)
+		t.SetStopLossBreakEven(adoption.StopLossBreakEven, adoption.StopLossBreakEvenBuffer)
+		t.SetStopLossOnExchange(adoption.StopLossOnExchange)
+	}
+	if adoption.TrailingProfitEnabled {
+		t.SetTrailingProfit(true, adoption.TrailingProfitPercent,
+			adoption.TrailingProfitDeviation)
+	}
+	if adoption.LimitSellEnabled {
+		switch adoption.LimitSellType {
+		case LimitSellTypePercent:
+			t.SetLimitSellByPercent(adoption.LimitSellPercent)
+		case LimitSellTypePrice:
+			t.SetLimitSellByPrice(adoption.LimitSellPrice)
+		}
+	}
+	if len(adoption.TakeProfit) > 0 {
+		return t.SetTakeProfit(adoption.TakeProfit)
+	}
+	return nil
+}
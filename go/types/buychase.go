@@ -0,0 +1,36 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package types
+
+// SetBuyChase sets a trade to re-price its buy to the best bid, checking
+// every interval seconds, when the best bid is ticks or more above the buy,
+// up to maxPrice.
+func (t *Trade) SetBuyChase(enable bool, interval int64, ticks int64, maxPrice float64) {
+	t.State.BuyChase.Enabled = enable
+	t.State.BuyChase.Interval = interval
+	t.State.BuyChase.Ticks = ticks
+	t.State.BuyChase.MaxPrice = maxPrice
+}
+
+// EndBuy ends the buy of a trade whose buy order is no longer open. The
+// trade goes on to watching with what was filled, or is canceled if nothing
+// was.
+func (t *Trade) EndBuy() {
+	if t.State.BuyFillQuantity == 0 {
+		t.State.Status = TradeStatusCanceled
+	} else {
+		t.State.Status = TradeStatusWatching
+	}
+}
@@ -34,6 +34,7 @@ const (
 type TradeStatus string
 
 const (
+	TradeStatusArmed       TradeStatus = "ARMED"
 	TradeStatusNew         TradeStatus = "NEW"
 	TradeStatusFailed      TradeStatus = "FAILED"
 	TradeStatusPendingBuy  TradeStatus = "PENDING_BUY"
@@ -0,0 +1,118 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package types
+
+import (
+	"time"
+)
+
+type EntryConditionType string
+
+const (
+	// Buy once the last price rises to or above the entry price, such as
+	// for a breakout.
+	EntryConditionPriceAbove EntryConditionType = "PRICE_ABOVE"
+
+	// Buy once the last price drops to or below the entry price.
+	EntryConditionPriceBelow EntryConditionType = "PRICE_BELOW"
+
+	// No price condition, only used with a trailing buy which then starts
+	// following the price as soon as the trade is armed.
+	EntryConditionNone EntryConditionType = ""
+)
+
+// EntryCondition holds back the buy of an armed trade until the last price
+// meets it. The buy is then placed like an immediate buy, at the manual buy
+// price or the price from the price source offset by ticks.
+type EntryCondition struct {
+	Type  EntryConditionType
+	Price float64
+
+	// The trade is cancelled if the condition has not been met by then.
+	Expires *time.Time `json:",omitempty"`
+
+	Quantity    float64
+	PriceSource PriceSource
+	BuyPrice    float64 `json:",omitempty"`
+	OffsetTicks int64   `json:",omitempty"`
+
+	// If set the quantity is worked out from the buy price when the
+	// condition is met, spending this amount of the quote asset, or this
+	// percent of the free quote asset balance.
+	QuoteAmount    float64 `json:",omitempty"`
+	BalancePercent float64 `json:",omitempty"`
+
+	// The last price the condition was met at.
+	TriggerPrice float64 `json:",omitempty"`
+}
+
+// NewEntryCondition returns an entry condition for a trade created at
+// created that expires after hours, or never if hours is 0.
+func NewEntryCondition(created time.Time, conditionType EntryConditionType,
+	price float64, hours float64) *EntryCondition {
+	condition := &EntryCondition{
+		Type:  conditionType,
+		Price: price,
+	}
+	if hours > 0 {
+		expires := created.Add(time.Duration(hours * float64(time.Hour)))
+		condition.Expires = &expires
+	}
+	return condition
+}
+
+// Valid returns false if the type or price of the condition is not valid.
+func (c *EntryCondition) Valid() bool {
+	switch c.Type {
+	case EntryConditionNone:
+		return true
+	case EntryConditionPriceAbove:
+	case EntryConditionPriceBelow:
+	default:
+		return false
+	}
+	return c.Price > 0
+}
+
+// Met returns true if the last price meets the condition.
+func (c *EntryCondition) Met(price float64) bool {
+	switch c.Type {
+	case EntryConditionNone:
+		return true
+	case EntryConditionPriceAbove:
+		return price >= c.Price
+	case EntryConditionPriceBelow:
+		return price <= c.Price
+	}
+	return false
+}
+
+// Expired returns true if the condition expires before now.
+func (c *EntryCondition) Expired(now time.Time) bool {
+	return c.Expires != nil && now.After(*c.Expires)
+}
+
+// SetTrailingBuy sets an armed trade to follow the price down once its entry
+// is met and buy on a rebound of deviation percent.
+func (t *Trade) SetTrailingBuy(enable bool, deviation float64) {
+	t.State.TrailingBuy.Enabled = enable
+	t.State.TrailingBuy.Deviation = deviation
+}
+
+// Arm sets a trade to wait for its entry condition before buying.
+func (t *Trade) Arm(condition EntryCondition) {
+	t.State.Status = TradeStatusArmed
+	t.State.Entry = &condition
+}
@@ -0,0 +1,60 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package types
+
+import (
+	"github.com/crankykernel/binanceapi-go"
+)
+
+// The status of an order of an OCO that expired as the other order executed.
+const orderStatusExpired = binanceapi.OrderStatus("EXPIRED")
+
+// OrderList is an OCO order list pairing the limit sell of a trade with its
+// stop order, cancelling one cancels the other. The list status is as last
+// reported by the exchange.
+type OrderList struct {
+	ListClientOrderID  string
+	OrderListID        int64 `json:",omitempty"`
+	LimitClientOrderID string
+	StopClientOrderID  string
+
+	ListStatusType  string `json:",omitempty"`
+	ListOrderStatus string `json:",omitempty"`
+}
+
+// IsOrderListOrder returns true if the client order ID is of an order in the
+// current order list of the trade.
+func (t *Trade) IsOrderListOrder(clientOrderId string) bool {
+	orderList := t.State.OrderList
+	if orderList == nil || clientOrderId == "" {
+		return false
+	}
+	return clientOrderId == orderList.LimitClientOrderID ||
+		clientOrderId == orderList.StopClientOrderID
+}
+
+// ApplyListStatus records the status of an order list. Returns false if it
+// is not the current order list of the trade.
+func (t *Trade) ApplyListStatus(listClientOrderId string, orderListId int64,
+	listStatusType string, listOrderStatus string) bool {
+	orderList := t.State.OrderList
+	if orderList == nil || orderList.ListClientOrderID != listClientOrderId {
+		return false
+	}
+	orderList.OrderListID = orderListId
+	orderList.ListStatusType = listStatusType
+	orderList.ListOrderStatus = listOrderStatus
+	return true
+}
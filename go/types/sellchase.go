@@ -0,0 +1,33 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package types
+
+// SellChaseSettings are the sell chasing options as set from the API and
+// recorded in the history.
+type SellChaseSettings struct {
+	Enabled   bool    `json:"enable"`
+	Interval  int64   `json:"interval"`
+	Ticks     int64   `json:"ticks"`
+	MinProfit float64 `json:"minProfit"`
+}
+
+// ApplySellChaseSettings sets a trade to re-price its limit sell down to the
+// best ask, not below the price for the minimum profit percent.
+func (t *Trade) ApplySellChaseSettings(settings SellChaseSettings) {
+	t.State.SellChase.Enabled = settings.Enabled
+	t.State.SellChase.Interval = settings.Interval
+	t.State.SellChase.Ticks = settings.Ticks
+	t.State.SellChase.MinProfit = settings.MinProfit
+}
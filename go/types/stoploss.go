@@ -0,0 +1,258 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package types
+
+import (
+	"github.com/crankykernel/binanceapi-go"
+	"gitlab.com/crankykernel/maker/go/util"
+	"math"
+)
+
+// StopLossSettings are the stop loss options of a trade as given when
+// updating its stop loss.
+type StopLossSettings struct {
+	Enabled          bool    `json:"enable"`
+	Percent          float64 `json:"percent"`
+	Trailing         bool    `json:"trailing"`
+	Ticks            int64   `json:"ticks"`
+	BreakEvenPercent float64 `json:"breakEvenPercent"`
+	BreakEvenBuffer  float64 `json:"breakEvenBuffer"`
+	OnExchange       bool    `json:"onExchange"`
+}
+
+// ApplyStopLossSettings sets all the stop loss options of a trade.
+func (t *Trade) ApplyStopLossSettings(settings StopLossSettings) {
+	t.SetStopLoss(settings.Enabled, settings.Percent)
+	t.SetStopLossTrailing(settings.Trailing, settings.Ticks)
+	t.SetStopLossBreakEven(settings.BreakEvenPercent, settings.BreakEvenBuffer)
+	t.SetStopLossOnExchange(settings.OnExchange)
+}
+
+// StopOrder is a stop loss limit sell order placed on the exchange.
+type StopOrder struct {
+	ClientOrderID string
+	OrderID       int64 `json:",omitempty"`
+	Quantity      float64
+	StopPrice     float64
+	Price         float64
+
+	Status       binanceapi.OrderStatus `json:",omitempty"`
+	FillQuantity float64                `json:",omitempty"`
+}
+
+// IsOpen returns true if the stop order may still fill.
+func (o *StopOrder) IsOpen() bool {
+	return isOpenSellOrder(o.ClientOrderID, o.Status)
+}
+
+// SetStopLossTrailing switches the stop loss between a fixed stop below the
+// buy price and a stop that trails the highest price since the buy filled.
+// The trailing distance is the stop loss percent, or ticks price ticks if
+// ticks is greater than 0.
+func (t *Trade) SetStopLossTrailing(trailing bool, ticks int64) {
+	t.State.StopLoss.Trailing = trailing
+	t.State.StopLoss.Ticks = ticks
+	if !trailing {
+		t.State.StopLoss.HighPrice = 0
+		t.State.StopLoss.Price = 0
+		if t.State.StopLoss.BreakEvenActivated {
+			t.State.StopLoss.Price = t.BreakEvenStopPrice()
+		}
+	}
+}
+
+// SetStopLossBreakEven sets the profit percent at which the stop is moved to
+// break even, and the buffer in percent kept above break even. A percent of
+// 0 disables the move.
+func (t *Trade) SetStopLossBreakEven(percent float64, buffer float64) {
+	stopLoss := &t.State.StopLoss
+	stopLoss.BreakEvenPercent = percent
+	stopLoss.BreakEvenBuffer = buffer
+	if !stopLoss.BreakEvenActivated {
+		return
+	}
+	if percent <= 0 {
+		stopLoss.BreakEvenActivated = false
+	}
+	// A trailing stop picks up the change on its next update.
+	if !stopLoss.Trailing {
+		stopLoss.Price = 0
+		if stopLoss.BreakEvenActivated {
+			stopLoss.Price = t.BreakEvenStopPrice()
+		}
+	}
+}
+
+// The price selling the sellable quantity covers the buy cost and the sell
+// fee at.
+func (t *Trade) breakEvenPrice() float64 {
+	if t.State.SellableQuantity <= 0 {
+		return 0
+	}
+	return t.State.BuyCost / (t.State.SellableQuantity * (1 - t.State.Fee))
+}
+
+// BreakEvenStopPrice returns the break even price plus the break even
+// buffer.
+func (t *Trade) BreakEvenStopPrice() float64 {
+	return util.Round8(t.breakEvenPrice() *
+		(1 + math.Abs(t.State.StopLoss.BreakEvenBuffer)/100))
+}
+
+// StopLossPrice returns the price the stop loss triggers at, the stop level
+// if it has one, otherwise the price the loss reaches the stop loss percent
+// at. 0 if not known yet.
+func (t *Trade) StopLossPrice() float64 {
+	if t.StopPriceActive() {
+		return t.State.StopLoss.Price
+	}
+	return util.Round8(t.breakEvenPrice() * (1 - math.Abs(t.State.StopLoss.Percent)/100))
+}
+
+// ActivateBreakEven moves the stop up to the break even stop price if the
+// profit has reached the break even percent. Returns true if it was moved.
+func (t *Trade) ActivateBreakEven() bool {
+	stopLoss := &t.State.StopLoss
+	if stopLoss.BreakEvenPercent <= 0 || stopLoss.BreakEvenActivated {
+		return false
+	}
+	if t.State.ProfitPercent < stopLoss.BreakEvenPercent {
+		return false
+	}
+	stopLoss.BreakEvenActivated = true
+	stopLoss.Price = math.Max(stopLoss.Price, t.BreakEvenStopPrice())
+	return true
+}
+
+// UpdateTrailingStop ratchets the high price of a trailing stop loss up to
+// price and recalculates the stop level from it. The high starts at the buy
+// price so the stop never starts below where a fixed stop would be. Returns
+// true if the high or the stop level changed.
+func (t *Trade) UpdateTrailingStop(price float64, tickSize float64) bool {
+	stopLoss := &t.State.StopLoss
+	if !stopLoss.Trailing {
+		return false
+	}
+
+	high := math.Max(stopLoss.HighPrice, math.Max(price, t.State.AverageBuyPrice))
+
+	var stop float64
+	if stopLoss.Ticks > 0 {
+		stop = util.Round8(high - tickSize*float64(stopLoss.Ticks))
+	} else {
+		stop = util.Round8(high * (1 - math.Abs(stopLoss.Percent)/100))
+	}
+	if stopLoss.BreakEvenActivated {
+		stop = math.Max(stop, t.BreakEvenStopPrice())
+	}
+
+	if high == stopLoss.HighPrice && stop == stopLoss.Price {
+		return false
+	}
+	stopLoss.HighPrice = high
+	stopLoss.Price = stop
+	return true
+}
+
+// StopPriceActive returns true if the stop loss is at a price level, from
+// trailing or a break even move, instead of a percent below the buy.
+func (t *Trade) StopPriceActive() bool {
+	return t.State.StopLoss.Trailing || t.State.StopLoss.BreakEvenActivated
+}
+
+// StopPricePassed returns true if the stop level has been reached by price.
+func (t *Trade) StopPricePassed(price float64) bool {
+	return t.StopPriceActive() && t.State.StopLoss.Price > 0 &&
+		price <= t.State.StopLoss.Price
+}
+
+// SetStopLossOnExchange sets if the stop loss is kept as a stop order on the
+// exchange.
+func (t *Trade) SetStopLossOnExchange(onExchange bool) {
+	t.State.StopLoss.OnExchange = onExchange
+}
+
+// OpenStopOrder returns the current stop order if it is open, or nil.
+func (t *Trade) OpenStopOrder() *StopOrder {
+	orders := t.State.StopLoss.Orders
+	if len(orders) == 0 || !orders[len(orders)-1].IsOpen() {
+		return nil
+	}
+	return &orders[len(orders)-1]
+}
+
+// OpenStopOrderQuantity returns the quantity reserved by open stop orders.
+func (t *Trade) OpenStopOrderQuantity() float64 {
+	quantity := float64(0)
+	for i := range t.State.StopLoss.Orders {
+		order := &t.State.StopLoss.Orders[i]
+		if order.IsOpen() {
+			quantity += order.Quantity - order.FillQuantity
+		}
+	}
+	return round8(quantity)
+}
+
+// StopOrderForClientOrderId returns the stop order with the client order ID,
+// or nil.
+func (t *Trade) StopOrderForClientOrderId(clientOrderId string) *StopOrder {
+	if clientOrderId == "" {
+		return nil
+	}
+	for i := range t.State.StopLoss.Orders {
+		if t.State.StopLoss.Orders[i].ClientOrderID == clientOrderId {
+			return &t.State.StopLoss.Orders[i]
+		}
+	}
+	return nil
+}
+
+// SetStopOrderStatus sets the status and fill quantity of the open stop order
+// from the exchange, for when its reports were missed.
+func (t *Trade) SetStopOrderStatus(orderId int64, status binanceapi.OrderStatus, fillQuantity float64) {
+	order := t.OpenStopOrder()
+	if order == nil {
+		return
+	}
+	order.OrderID = orderId
+	order.Status = status
+	order.FillQuantity = round8(fillQuantity)
+	if fillQuantity > 0 {
+		t.State.StopLoss.Triggered = true
+	}
+	t.updateSellStatus()
+}
+
+func (t *Trade) applyStopOrderReport(order *StopOrder, report binanceapi.StreamExecutionReport) {
+	order.OrderID = report.OrderID
+	switch report.CurrentOrderStatus {
+	case binanceapi.OrderStatusNew:
+		if order.Status == "" {
+			order.Status = report.CurrentOrderStatus
+		}
+	case binanceapi.OrderStatusPartiallyFilled:
+		fallthrough
+	case binanceapi.OrderStatusFilled:
+		t.AddSellFill(report)
+		order.FillQuantity = round8(order.FillQuantity + report.LastExecutedQuantity)
+		if order.Status != binanceapi.OrderStatusFilled {
+			order.Status = report.CurrentOrderStatus
+		}
+		t.State.StopLoss.Triggered = true
+	default:
+		order.Status = report.CurrentOrderStatus
+	}
+	t.updateSellStatus()
+}
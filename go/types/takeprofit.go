@@ -0,0 +1,165 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package types
+
+import (
+	"fmt"
+	"github.com/crankykernel/binanceapi-go"
+)
+
+// TakeProfitTarget sells a portion of a trade with a limit sell order placed
+// when the buy is filled.
+type TakeProfitTarget struct {
+	// The portion of the sellable quantity to sell (0-100).
+	QuantityPercent float64
+
+	// The profit to sell at as a percentage (0-100).
+	ProfitPercent float64
+
+	// Set when the sell order is placed.
+	ClientOrderID string  `json:",omitempty"`
+	OrderID       int64   `json:",omitempty"`
+	Quantity      float64 `json:",omitempty"`
+	Price         float64 `json:",omitempty"`
+
+	Status       binanceapi.OrderStatus `json:",omitempty"`
+	FillQuantity float64                `json:",omitempty"`
+}
+
+// IsOpen returns true if the sell order of the target has been placed and
+// may still fill.
+func (t *TakeProfitTarget) IsOpen() bool {
+	return isOpenSellOrder(t.ClientOrderID, t.Status)
+}
+
+// A placed sell order is open until a report closes it. No status means the
+// order was placed but its first report has not been received.
+func isOpenSellOrder(clientOrderId string, status binanceapi.OrderStatus) bool {
+	if clientOrderId == "" {
+		return false
+	}
+	switch status {
+	case "":
+	case binanceapi.OrderStatusNew:
+	case binanceapi.OrderStatusPartiallyFilled:
+	default:
+		return false
+	}
+	return true
+}
+
+// TakeProfitSetting is a take profit target as given when opening a trade or
+// updating its targets.
+type TakeProfitSetting struct {
+	QuantityPercent float64 `json:"quantityPercent"`
+	ProfitPercent   float64 `json:"profitPercent"`
+}
+
+// SetTakeProfit replaces the take profit targets of a trade. The targets may
+// not sell more than the whole trade.
+func (t *Trade) SetTakeProfit(settings []TakeProfitSetting) error {
+	total := float64(0)
+	for _, setting := range settings {
+		if setting.QuantityPercent <= 0 {
+			return fmt.Errorf("take profit quantity must be more than 0%%")
+		}
+		if setting.ProfitPercent <= 0 {
+			return fmt.Errorf("take profit must be more than 0%%")
+		}
+		total += setting.QuantityPercent
+	}
+	if total > 100 {
+		return fmt.Errorf("take profit targets sell %.2f%% of the trade", total)
+	}
+	t.State.TakeProfit = nil
+	for _, setting := range settings {
+		t.State.TakeProfit = append(t.State.TakeProfit, TakeProfitTarget{
+			QuantityPercent: setting.QuantityPercent,
+			ProfitPercent:   setting.ProfitPercent,
+		})
+	}
+	return nil
+}
+
+// OpenTakeProfitQuantity returns the quantity reserved by open take profit
+// orders.
+func (t *Trade) OpenTakeProfitQuantity() float64 {
+	quantity := float64(0)
+	for i := range t.State.TakeProfit {
+		target := &t.State.TakeProfit[i]
+		if target.IsOpen() {
+			quantity += target.Quantity - target.FillQuantity
+		}
+	}
+	return round8(quantity)
+}
+
+// RemainingQuantity returns the quantity that is neither sold nor reserved by
+// an open take profit or stop order.
+func (t *Trade) RemainingQuantity() float64 {
+	return round8(t.State.SellableQuantity - t.State.SellFillQuantity -
+		t.OpenTakeProfitQuantity() - t.OpenStopOrderQuantity())
+}
+
+// TakeProfitTargetForClientOrderId returns the take profit target whose sell
+// order has the client order ID, or nil.
+func (t *Trade) TakeProfitTargetForClientOrderId(clientOrderId string) *TakeProfitTarget {
+	if clientOrderId == "" {
+		return nil
+	}
+	for i := range t.State.TakeProfit {
+		if t.State.TakeProfit[i].ClientOrderID == clientOrderId {
+			return &t.State.TakeProfit[i]
+		}
+	}
+	return nil
+}
+
+func (t *Trade) applyTakeProfitReport(target *TakeProfitTarget, report binanceapi.StreamExecutionReport) {
+	target.OrderID = report.OrderID
+	switch report.CurrentOrderStatus {
+	case binanceapi.OrderStatusNew:
+		if target.Status == "" {
+			target.Status = report.CurrentOrderStatus
+		}
+	case binanceapi.OrderStatusPartiallyFilled:
+		fallthrough
+	case binanceapi.OrderStatusFilled:
+		t.AddSellFill(report)
+		target.FillQuantity = round8(target.FillQuantity + report.LastExecutedQuantity)
+		if target.Status != binanceapi.OrderStatusFilled {
+			target.Status = report.CurrentOrderStatus
+		}
+	default:
+		target.Status = report.CurrentOrderStatus
+	}
+	t.updateSellStatus()
+}
+
+// With take profit targets or stop orders a trade is only done once
+// everything is sold and none of them is open.
+func (t *Trade) updateSellStatus() {
+	sold := t.State.SellFillQuantity >= t.State.SellableQuantity-0.00000001
+	if sold && t.OpenTakeProfitQuantity() == 0 && t.OpenStopOrderQuantity() == 0 {
+		if t.State.Status == TradeStatusWatching || t.State.Status == TradeStatusPendingSell {
+			t.State.Status = TradeStatusDone
+		}
+	} else if t.State.Status == TradeStatusDone {
+		// The remainder was sold, the targets are still open or did not
+		// sell their quantity.
+		t.State.Status = TradeStatusWatching
+	}
+}
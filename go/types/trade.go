@@ -17,6 +17,8 @@ package types
 
 import (
 	"github.com/crankykernel/binanceapi-go"
+	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/util"
 	"math"
 	"time"
 )
@@ -116,6 +118,7 @@ func (t *Trade) AddBuyFill(report binanceapi.StreamExecutionReport) {
 		Quantity:         report.LastExecutedQuantity,
 		CommissionAmount: report.CommissionAmount,
 		CommissionAsset:  report.CommissionAsset,
+		OrderID:          report.OrderID,
 	}
 	t.DoAddBuyFill(fill)
 }
@@ -130,6 +133,145 @@ func (t *Trade) DoAddSellFill(fill OrderFill) {
 	t.UpdateSellState()
 }
 
+// UpdateSellableQuantity sets the quantity that can be sold. If the
+// commission was taken from the bought asset the quantity is rounded down to
+// the step size, which is left unchanged if the step size is not known.
+func (t *Trade) UpdateSellableQuantity(stepSize float64) {
+	feeAsset := t.FeeAsset()
+	if feeAsset == "BNB" {
+		t.State.SellableQuantity = t.State.BuyFillQuantity
+	} else if feeAsset != "" && stepSize > 0 {
+		t.State.SellableQuantity = util.FixQuantityToStepSize(t.State.BuyFillQuantity, stepSize)
+	}
+}
+
+// ApplyExecutionReport updates the trade state from an execution report for
+// one of its orders. It only modifies the state, so is shared by the trade
+// service and trade replay.
+func (t *Trade) ApplyExecutionReport(report binanceapi.StreamExecutionReport, eventTime time.Time, stepSize float64) {
+	switch report.Side {
+	case binanceapi.OrderSideBuy:
+		switch report.CurrentOrderStatus {
+		case binanceapi.OrderStatusNew:
+			if t.State.BuyOrderId == 0 {
+				// Not for the replacements of a chased buy.
+				t.State.OpenTime = eventTime
+			}
+			if t.State.LastBuyStatus == "" ||
+				(t.State.BuyOrderId != 0 && t.State.BuyOrderId != report.OrderID) {
+				// The first buy, or the replacement of a chased buy.
+				t.State.LastBuyStatus = report.CurrentOrderStatus
+			}
+			t.State.BuyOrder.Quantity = report.Quantity
+			t.State.BuyOrder.Price = report.Price
+			t.State.BuyOrderId = report.OrderID
+			if t.State.Status == TradeStatusNew {
+				t.State.Status = TradeStatusPendingBuy
+			}
+		case binanceapi.OrderStatusCanceled:
+			t.State.LastBuyStatus = report.CurrentOrderStatus
+			if !t.State.BuyChase.Replacing {
+				t.EndBuy()
+			}
+		case binanceapi.OrderStatusPartiallyFilled:
+			if t.State.LastBuyStatus != binanceapi.OrderStatusFilled {
+				t.State.LastBuyStatus = report.CurrentOrderStatus
+			}
+			t.AddBuyFill(report)
+			t.UpdateSellableQuantity(stepSize)
+		case binanceapi.OrderStatusFilled:
+			t.AddBuyFill(report)
+			t.UpdateSellableQuantity(stepSize)
+			t.State.Status = TradeStatusWatching
+			t.State.LastBuyStatus = report.CurrentOrderStatus
+		}
+
+	case binanceapi.OrderSideSell:
+		target := t.TakeProfitTargetForClientOrderId(report.ClientOrderID)
+		if target == nil {
+			target = t.TakeProfitTargetForClientOrderId(report.OriginalClientOrderID)
+		}
+		if target != nil {
+			t.applyTakeProfitReport(target, report)
+			break
+		}
+		stopOrder := t.StopOrderForClientOrderId(report.ClientOrderID)
+		if stopOrder == nil {
+			stopOrder = t.StopOrderForClientOrderId(report.OriginalClientOrderID)
+		}
+		if stopOrder != nil {
+			t.applyStopOrderReport(stopOrder, report)
+			break
+		}
+
+		switch report.CurrentOrderStatus {
+		case binanceapi.OrderStatusNew:
+			if t.State.Status == TradeStatusDone {
+				// Sometimes we get the fill before the new.
+				break
+			}
+			t.State.SellOrderId = report.OrderID
+			t.State.Status = TradeStatusPendingSell
+			switch t.State.SellOrder.Status {
+			case binanceapi.OrderStatusPartiallyFilled:
+			case binanceapi.OrderStatusFilled:
+			default:
+				t.State.SellOrder.Status = report.CurrentOrderStatus
+			}
+			t.State.SellOrder.Type = report.OrderType
+			t.State.SellOrder.Quantity = report.Quantity
+			t.State.SellOrder.Price = report.Price
+		case binanceapi.OrderStatusPartiallyFilled:
+			t.AddSellFill(report)
+			if t.State.SellOrder.Status != binanceapi.OrderStatusFilled {
+				t.State.SellOrder.Status = report.CurrentOrderStatus
+			}
+		case binanceapi.OrderStatusFilled:
+			t.AddSellFill(report)
+			t.State.Status = TradeStatusDone
+			t.State.SellOrder.Status = report.CurrentOrderStatus
+		case binanceapi.OrderStatusCanceled:
+			fallthrough
+		case orderStatusExpired:
+			// The limit sell of an OCO expires when the stop triggers.
+			t.State.Status = TradeStatusWatching
+			t.State.SellOrder.Status = report.CurrentOrderStatus
+		default:
+			log.WithFields(log.Fields{
+				"symbol":             t.State.Symbol,
+				"currentOrderStatus": report.CurrentOrderStatus,
+				"side":               "sell",
+			}).Errorf("Unknown current order status in execution report")
+			t.State.SellOrder.Status = report.CurrentOrderStatus
+		}
+		if len(t.State.TakeProfit) > 0 || len(t.State.StopLoss.Orders) > 0 {
+			if t.State.Status != TradeStatusPendingSell {
+				t.updateSellStatus()
+			}
+		}
+	}
+
+	switch t.State.Status {
+	case TradeStatusDone:
+		fallthrough
+	case TradeStatusCanceled:
+		fallthrough
+	case TradeStatusFailed:
+		t.State.CloseTime = &eventTime
+	}
+}
+
+func (t *Trade) AddSellFill(report binanceapi.StreamExecutionReport) {
+	fill := OrderFill{
+		Price:            report.LastExecutedPrice,
+		Quantity:         report.LastExecutedQuantity,
+		CommissionAsset:  report.CommissionAsset,
+		CommissionAmount: report.CommissionAmount,
+		OrderID:          report.OrderID,
+	}
+	t.DoAddSellFill(fill)
+}
+
 func (t *Trade) AddClientOrderID(clientOrderID string) {
 	t.State.ClientOrderIDs[clientOrderID] = true
 }
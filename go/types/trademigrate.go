@@ -37,7 +37,9 @@ func TradeStateV0ToTradeStateV1(old TradeStateV0) TradeState {
 	state.SellFillQuantity = old.SellFillQuantity
 	state.AverageSellPrice = old.AverageSellPrice
 	state.SellCost = old.SellCost
-	state.StopLoss = old.StopLoss
+	state.StopLoss.Enabled = old.StopLoss.Enabled
+	state.StopLoss.Percent = old.StopLoss.Percent
+	state.StopLoss.Triggered = old.StopLoss.Triggered
 	state.LimitSell.Enabled = old.LimitSell.Enabled
 	state.LimitSell.Type = LimitSellTypePercent
 	state.LimitSell.Percent = old.LimitSell.Percent
@@ -25,6 +25,10 @@ type OrderFill struct {
 	Quantity         float64
 	CommissionAsset  string
 	CommissionAmount float64
+
+	// The exchange order ID of the fill. Not set on fills recorded by older
+	// versions.
+	OrderID int64 `json:",omitempty"`
 }
 
 type HistoryType string
@@ -37,6 +41,22 @@ const (
 	HistoryTypeSellCanceled         HistoryType = "SELL_CANCELED"
 	HistoryTypeTrailingProfitUpdate HistoryType = "TRAILING_PROFIT_UPDATE"
 	HistoryTypeStopLossUpdate       HistoryType = "STOP_LOSS_UPDATE"
+	HistoryTypeLimitSellUpdate      HistoryType = "LIMIT_SELL_UPDATE"
+	HistoryTypeAbandoned            HistoryType = "ABANDONED"
+	HistoryTypeFailed               HistoryType = "FAILED"
+	HistoryTypeReplayRepair         HistoryType = "REPLAY_REPAIR"
+	HistoryTypeReconciled           HistoryType = "RECONCILED"
+	HistoryTypeAdopted              HistoryType = "ADOPTED"
+	HistoryTypeTakeProfitUpdate     HistoryType = "TAKE_PROFIT_UPDATE"
+	HistoryTypeStopLossBreakEven    HistoryType = "STOP_LOSS_BREAK_EVEN"
+	HistoryTypeListStatus           HistoryType = "LIST_STATUS"
+	HistoryTypeEntryTriggered       HistoryType = "ENTRY_TRIGGERED"
+	HistoryTypeEntryExpired         HistoryType = "ENTRY_EXPIRED"
+	HistoryTypeBuyChase             HistoryType = "BUY_CHASE"
+	HistoryTypeBuyReplace           HistoryType = "BUY_REPLACE"
+	HistoryTypeBuyTimeout           HistoryType = "BUY_TIMEOUT"
+	HistoryTypeSellChase            HistoryType = "SELL_CHASE"
+	HistoryTypeSellChaseUpdate      HistoryType = "SELL_CHASE_UPDATE"
 )
 
 type HistoryEntry struct {
@@ -59,6 +79,41 @@ type TradeState struct {
 	Status    TradeStatus
 	Fee       float64
 
+	// The condition an ARMED trade waits for before placing its buy.
+	Entry *EntryCondition `json:",omitempty"`
+
+	// A trailing buy follows the lowest price once the entry is met and
+	// places the buy when the price rebounds from it by Deviation percent.
+	TrailingBuy struct {
+		Enabled   bool
+		Deviation float64
+		Activated bool
+		Price     float64
+		Triggered bool
+	}
+
+	// Chasing re-prices an unfilled buy to follow the best bid, up to
+	// MaxPrice. Every Interval seconds the buy is cancelled and placed
+	// again at the best bid if it is Ticks or more ticks above the buy.
+	BuyChase struct {
+		Enabled  bool
+		Interval int64
+		Ticks    int64
+		MaxPrice float64
+
+		// The number of times re-priced, the last time and the price of
+		// the replacement. Replacing is set from the cancel of a buy until
+		// its replacement is posted.
+		Count     int        `json:",omitempty"`
+		Time      *time.Time `json:",omitempty"`
+		Price     float64    `json:",omitempty"`
+		Replacing bool       `json:",omitempty"`
+	}
+
+	// Seconds after the buy is placed to cancel what has not filled, 0 for
+	// no timeout.
+	BuyTimeout int64 `json:",omitempty"`
+
 	BuyOrderId int64
 
 	ClientOrderIDs map[string]bool
@@ -95,6 +150,29 @@ type TradeState struct {
 		Enabled   bool
 		Percent   float64
 		Triggered bool
+
+		// A trailing stop loss follows the highest price seen since the
+		// buy filled, by Percent or by Ticks price ticks when set.
+		Trailing bool  `json:",omitempty"`
+		Ticks    int64 `json:",omitempty"`
+
+		// The highest price seen and the resulting stop level of a
+		// trailing stop loss.
+		HighPrice float64 `json:",omitempty"`
+		Price     float64 `json:",omitempty"`
+
+		// Once the profit reaches BreakEvenPercent the stop is moved up to
+		// break even plus BreakEvenBuffer percent. 0 disables the move.
+		BreakEvenPercent   float64 `json:",omitempty"`
+		BreakEvenBuffer    float64 `json:",omitempty"`
+		BreakEvenActivated bool    `json:",omitempty"`
+
+		// Keep a stop loss limit order on the exchange at the stop price
+		// for the quantity other sell orders leave, so the stop holds while
+		// Maker is not running. Orders is every stop order placed, the
+		// last being the current one.
+		OnExchange bool        `json:",omitempty"`
+		Orders     []StopOrder `json:",omitempty"`
 	}
 
 	LimitSell struct {
@@ -104,6 +182,15 @@ type TradeState struct {
 		Price   float64
 	}
 
+	// The OCO order list of the limit sell and the stop order, when the
+	// stop loss is on the exchange with a limit sell. The limit sell is the
+	// sell order and the stop the last of the stop loss orders.
+	OrderList *OrderList `json:",omitempty"`
+
+	// Portions of the trade sold by their own limit sell orders. Other sells
+	// only sell what the targets leave.
+	TakeProfit []TakeProfitTarget `json:",omitempty"`
+
 	TrailingProfit struct {
 		Enabled   bool
 		Percent   float64
@@ -113,6 +200,18 @@ type TradeState struct {
 		Triggered bool
 	}
 
+	// Chasing re-prices an unfilled limit sell down to the best ask, never
+	// below the price for MinProfit percent profit. Every Interval seconds,
+	// or on each change of the last price if 0, the sell is cancelled and
+	// placed again at the best ask if it is Ticks or more ticks below it.
+	SellChase struct {
+		Enabled   bool
+		Interval  int64
+		Ticks     int64
+		MinProfit float64
+		Count     int `json:",omitempty"`
+	}
+
 	// The profit in units of the quote asset.
 	Profit float64
 
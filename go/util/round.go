@@ -9,3 +9,12 @@ func Roundx(val float64, x float64) float64 {
 func Round8(val float64) float64 {
 	return Roundx(val, 1/0.00000001)
 }
+
+// FixQuantityToStepSize rounds quantity down to a multiple of stepSize.
+func FixQuantityToStepSize(quantity float64, stepSize float64) float64 {
+	fixedQuantity := Roundx(quantity, 1/stepSize)
+	if fixedQuantity > quantity {
+		fixedQuantity = Roundx(fixedQuantity-stepSize, 1/stepSize)
+	}
+	return fixedQuantity
+}
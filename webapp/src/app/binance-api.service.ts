@@ -15,12 +15,10 @@
 
 import {Injectable} from "@angular/core";
 import {HttpHeaders, HttpParams} from "@angular/common/http";
-import * as hmacSHA256 from "crypto-js/hmac-sha256";
-import * as hex from "crypto-js/enc-hex";
 import {catchError, map} from "rxjs/operators";
 import {Observable} from "rxjs";
 import {throwError} from "rxjs/internal/observable/throwError";
-import {OpenTradeOptions} from "./binance.service";
+import {AdoptTradeOptions, OpenTradeOptions} from "./binance.service";
 import {Observer} from "rxjs/Observer";
 import {MakerApiService} from "./maker-api.service";
 
@@ -30,21 +28,9 @@ const STREAM_ROOT = "wss://stream.binance.com:9443";
 @Injectable()
 export class BinanceApiService {
 
-    private _apiKey: string = null;
-
-    private _apiSecret: string = null;
-
     constructor(private makerApi: MakerApiService) {
     }
 
-    set apiKey(key: string) {
-        this._apiKey = key;
-    }
-
-    set apiSecret(secret: string) {
-        this._apiSecret = secret;
-    }
-
     private get(path: string, params: HttpParams = null): Observable<Object> {
         const url = `${API_ROOT}${path}`;
 
@@ -57,27 +43,12 @@ export class BinanceApiService {
         });
     }
 
+    /**
+     * GET a signed endpoint. The Maker server adds the API key, timestamp
+     * and signature when proxying the request.
+     */
     private authenticateGet(path: string, params: HttpParams = null): Observable<Object> {
-        const url = `${API_ROOT}${path}`;
-
-        if (params == null) {
-            params = new HttpParams();
-        }
-
-        let headers = new HttpHeaders();
-
-        const timestamp = new Date().getTime();
-        params = params.set("timestamp", `${timestamp}`);
-
-        const hmacDigest = hmacSHA256(params.toString(), this._apiSecret);
-        params = params.set("signature", hex.stringify(hmacDigest));
-
-        headers = headers.append("X-MBX-APIKEY", this._apiKey);
-
-        return this.makerApi.get(url, {
-            headers: headers,
-            params: params,
-        });
+        return this.get(path, params);
     }
 
     private post(path: string, options?: {
@@ -126,6 +97,11 @@ export class BinanceApiService {
         return <Observable<BuyOrderResponse>>this.post(endpoint, null, body);
     }
 
+    adoptTrade(body: AdoptTradeOptions): Observable<BuyOrderResponse> {
+        const endpoint = "/api/binance/adopt";
+        return <Observable<BuyOrderResponse>>this.post(endpoint, null, body);
+    }
+
     cancelSellOrder(tradeId: string): Observable<CancelOrderResponse> {
         const endpoint = "/api/binance/sell";
         const params = new HttpParams().set("trade_id", tradeId);
@@ -29,7 +29,7 @@ import {map, multicast, refCount, take, tap} from "rxjs/operators";
 import {Observable, Subject} from "rxjs";
 import {ReplaySubject} from "rxjs/ReplaySubject";
 import {Logger, LoggerService} from "./logger.service";
-import {MakerService} from "./maker.service";
+import {EntryCondition, MakerService} from "./maker.service";
 import {MakerApiService} from "./maker-api.service";
 import {ToastrService} from "./toastr.service";
 import {LoginService} from "./login.service";
@@ -98,9 +98,7 @@ export class BinanceService {
     private init() {
         console.log("BinanceServer.init()");
         // Get config then do initialization that depends on config.
-        this.makerApi.getConfig().subscribe((config) => {
-            this.api.apiKey = config["binance.api.key"];
-            this.api.apiSecret = config["binance.api.secret"];
+        this.makerApi.getConfig().subscribe(() => {
             this.updateExchangeInfo().subscribe(() => {
                 this.isReadySubject.next(true);
             });
@@ -111,6 +109,10 @@ export class BinanceService {
         return this.api.postBuyOrder(body);
     }
 
+    adoptTrade(body: AdoptTradeOptions) {
+        return this.api.adoptTrade(body);
+    }
+
     subscribeAggTradeStream(symbol: string): Observable<AggTrade> {
         const stream = `${symbol.toLowerCase()}@aggTrade`;
         if (!this.streams$[stream]) {
@@ -183,7 +185,13 @@ export class BinanceService {
 
 export interface OpenTradeOptions {
     symbol: string;
-    quantity: number;
+
+    // One of the quantity, the amount of the quote asset to spend, or the
+    // percent of the free quote asset balance to spend. The server works
+    // out the quantity for the last two on the final buy price.
+    quantity?: number;
+    quoteAmount?: number;
+    balancePercent?: number;
 
     priceSource: PriceSource;
     priceAdjustment: number;
@@ -191,6 +199,11 @@ export interface OpenTradeOptions {
 
     stopLossEnabled?: boolean;
     stopLossPercent?: number;
+    stopLossTrailing?: boolean;
+    stopLossTicks?: number;
+    stopLossBreakEven?: number;
+    stopLossBreakEvenBuffer?: number;
+    stopLossOnExchange?: boolean;
 
     limitSellEnabled?: boolean;
     limitSellType?: LimitSellType;
@@ -202,4 +215,57 @@ export interface OpenTradeOptions {
     trailingProfitDeviation?: number;
 
     offsetTicks?: number,
+
+    // Hold the buy back until the last price meets the condition.
+    entryCondition?: EntryCondition;
+    entryPrice?: number;
+    entryHours?: number;
+
+    // Buy on a rebound of deviation percent from the low once the entry
+    // condition is met, or from when the trade is made without one.
+    trailingBuyEnabled?: boolean;
+    trailingBuyDeviation?: number;
+
+    // Re-price the buy to the best bid every interval seconds, when it has
+    // moved up by ticks, up to the max price. Cancel what has not filled
+    // after the timeout in seconds.
+    buyChaseEnabled?: boolean;
+    buyChaseInterval?: number;
+    buyChaseTicks?: number;
+    buyChaseMaxPrice?: number;
+    buyTimeout?: number;
+    sellChaseEnabled?: boolean;
+    sellChaseInterval?: number;
+    sellChaseTicks?: number;
+    sellChaseMinProfit?: number;
+}
+
+/**
+ * Options to adopt an order, or a balance if no order ID is set, placed
+ * outside of Maker as a trade.
+ */
+export interface AdoptTradeOptions {
+    symbol: string;
+    orderId?: number;
+
+    // For a balance, all of the balance and the last price if not set.
+    quantity?: number;
+    price?: number;
+
+    stopLossEnabled?: boolean;
+    stopLossPercent?: number;
+    stopLossTrailing?: boolean;
+    stopLossTicks?: number;
+    stopLossBreakEven?: number;
+    stopLossBreakEvenBuffer?: number;
+    stopLossOnExchange?: boolean;
+
+    limitSellEnabled?: boolean;
+    limitSellType?: LimitSellType;
+    limitSellPercent?: number;
+    limitSellPrice?: number;
+
+    trailingProfitEnabled?: boolean;
+    trailingProfitPercent?: number;
+    trailingProfitDeviation?: number;
 }
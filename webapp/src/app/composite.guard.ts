@@ -45,7 +45,7 @@ export class CompositeGuard implements CanActivate {
                     console.log("Login is OK, checking configuration.");
                     return this.makerApi.getConfig()
                         .pipe(map((config) => {
-                            if (!(config["binance.api.key"] && config["binance.api.secret"])) {
+                            if (!config["binance.api.configured"]) {
                                 this.toastr.error("Incomplete Binance configuration. Redirecting to configuration page.");
                                 this.router.navigate(["/config"]);
                                 return false;
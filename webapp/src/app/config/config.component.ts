@@ -60,8 +60,10 @@ export class ConfigComponent implements OnInit {
         this.form = this.fb.group({
             binanceApiKey: [this.config["binance.api.key"],
                 Validators.required],
-            binanceApiSecret: [this.config["binance.api.secret"],
-                Validators.required],
+            // The secret is never sent to the browser, leaving it empty
+            // keeps the saved secret.
+            binanceApiSecret: ["",
+                this.config["binance.api.configured"] ? [] : Validators.required],
         });
     }
 
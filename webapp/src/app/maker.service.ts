@@ -163,10 +163,18 @@ export class MakerService {
         this.trade$.next(trade);
     }
 
-    public updateStopLoss(trade: TradeState, enable: boolean, percent: number) {
+    public updateStopLoss(trade: TradeState, enable: boolean, percent: number,
+                          trailing: boolean = false, ticks: number = 0,
+                          breakEvenPercent: number = 0, breakEvenBuffer: number = 0,
+                          onExchange: boolean = false) {
         const params = new HttpParams()
             .set("enable", String(enable))
-            .set("percent", percent.toFixed(8));
+            .set("percent", percent.toFixed(8))
+            .set("trailing", String(trailing))
+            .set("ticks", String(ticks || 0))
+            .set("breakEvenPercent", String(breakEvenPercent || 0))
+            .set("breakEvenBuffer", String(breakEvenBuffer || 0))
+            .set("onExchange", String(onExchange));
         this.makerApi.post(`/api/binance/trade/${trade.TradeID}/stopLoss`, null, {
             params: params,
         }).subscribe((response) => {
@@ -186,6 +194,19 @@ export class MakerService {
         });
     }
 
+    public updateSellChase(trade: TradeState, enable: boolean,
+                           interval: number, ticks: number, minProfit: number) {
+        const params = new HttpParams()
+            .set("enable", String(enable))
+            .set("interval", String(interval))
+            .set("ticks", String(ticks))
+            .set("minProfit", minProfit.toFixed(8));
+        this.makerApi.post(`/api/binance/trade/${trade.TradeID}/sellChase`, null, {
+            params: params,
+        }).subscribe((response) => {
+        });
+    }
+
     cancelBuy(trade: TradeState) {
         this.binanceApi.cancelBuy(trade.TradeID).subscribe((response) => {
         }, (error) => {
@@ -261,6 +282,7 @@ export class MakerService {
 }
 
 export enum TradeStatus {
+    ARMED = "ARMED",
     NEW = "NEW",
     FAILED = "FAILED",
     PENDING_BUY = "PENDING_BUY",
@@ -271,6 +293,12 @@ export enum TradeStatus {
     ABANDONED = "ABANDONED",
 }
 
+export enum EntryCondition {
+    NONE = "",
+    PRICE_ABOVE = "PRICE_ABOVE",
+    PRICE_BELOW = "PRICE_BELOW",
+}
+
 export interface TradeState {
     TradeID: string;
     Symbol: string;
@@ -292,6 +320,23 @@ export interface TradeState {
         Enabled: boolean;
         Percent: number;
         Triggered: boolean;
+        Trailing?: boolean;
+        Ticks?: number;
+        HighPrice?: number;
+        Price?: number;
+        BreakEvenPercent?: number;
+        BreakEvenBuffer?: number;
+        BreakEvenActivated?: boolean;
+        OnExchange?: boolean;
+        Orders?: {
+            ClientOrderID: string;
+            OrderID?: number;
+            Quantity: number;
+            StopPrice: number;
+            Price: number;
+            Status?: string;
+            FillQuantity?: number;
+        }[];
     };
     TrailingProfit: {
         Enabled: boolean;
@@ -300,6 +345,44 @@ export interface TradeState {
         Activated: boolean;
         Triggered: boolean;
     };
+    SellChase?: {
+        Enabled: boolean;
+        Interval: number;
+        Ticks: number;
+        MinProfit: number;
+        Count?: number;
+    };
+    OrderList?: {
+        ListClientOrderID: string;
+        OrderListID?: number;
+        LimitClientOrderID: string;
+        StopClientOrderID: string;
+        ListStatusType?: string;
+        ListOrderStatus?: string;
+    };
+    Entry?: {
+        Type: EntryCondition;
+        Price: number;
+        Expires?: string; // ISO format.
+        Quantity: number;
+        TriggerPrice?: number;
+    };
+    TrailingBuy: {
+        Enabled: boolean;
+        Deviation: number;
+        Activated: boolean;
+        Price: number;
+        Triggered: boolean;
+    };
+    BuyChase: {
+        Enabled: boolean;
+        Interval: number;
+        Ticks: number;
+        MaxPrice: number;
+        Count?: number;
+        Replacing?: boolean;
+    };
+    BuyTimeout?: number;
     EffectiveBuyPrice: number;
     Profit: number;
     ProfitPercent: number;
@@ -42,13 +42,21 @@ export class StopLossFormComponent implements OnInit {
         this.form = this.fb.group({
             enabled: [this.trade.StopLoss.Enabled,],
             percent: [this.trade.StopLoss.Percent,],
+            trailing: [this.trade.StopLoss.Trailing || false,],
+            ticks: [this.trade.StopLoss.Ticks || 0,],
+            breakEvenPercent: [this.trade.StopLoss.BreakEvenPercent || 0,],
+            breakEvenBuffer: [this.trade.StopLoss.BreakEvenBuffer || 0,],
+            onExchange: [this.trade.StopLoss.OnExchange || false,],
         });
     }
 
     onSubmit() {
         const formModel: FormModel = this.form.value;
         this.maker.updateStopLoss(this.trade,
-                formModel.enabled, +formModel.percent);
+                formModel.enabled, +formModel.percent,
+                formModel.trailing, +formModel.ticks,
+                +formModel.breakEvenPercent, +formModel.breakEvenBuffer,
+                formModel.onExchange);
     }
 
     reset() {
@@ -59,4 +67,9 @@ export class StopLossFormComponent implements OnInit {
 interface FormModel {
     enabled: boolean;
     percent: number;
+    trailing: boolean;
+    ticks: number;
+    breakEvenPercent: number;
+    breakEvenBuffer: number;
+    onExchange: boolean;
 }
\ No newline at end of file
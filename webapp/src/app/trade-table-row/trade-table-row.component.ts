@@ -163,6 +163,23 @@ export class TradeTableRowComponent implements OnInit, OnDestroy, AfterViewInit
         this.maker.limitSellByPrice(this.trade, +this.sellAtPriceModel.price);
     }
 
+    /**
+     * Toggle sell chasing keeping the trade's current settings, or the
+     * defaults of every 10 seconds by 1 tick at 0% profit.
+     */
+    toggleSellChase() {
+        const chase = this.trade.SellChase;
+        if (chase && chase.Enabled) {
+            this.maker.updateSellChase(this.trade, false, chase.Interval,
+                    chase.Ticks, chase.MinProfit);
+        } else if (chase && chase.Ticks > 0) {
+            this.maker.updateSellChase(this.trade, true, chase.Interval,
+                    chase.Ticks, chase.MinProfit);
+        } else {
+            this.maker.updateSellChase(this.trade, true, 10, 1, 0);
+        }
+    }
+
     onMarketSellClick($event: any) {
         if (this.marketSellState == MARKET_SELL_STATE.INITIAL) {
             this.marketSellState = MARKET_SELL_STATE.CONFIRM;
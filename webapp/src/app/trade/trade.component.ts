@@ -16,14 +16,14 @@
 import {AfterViewInit, Component, OnDestroy, OnInit, ViewChild} from "@angular/core";
 import {AccountInfo, AggTrade, Balance, BinanceApiService} from "../binance-api.service";
 import {Observable} from "rxjs";
-import {BinanceService, LimitSellType, OpenTradeOptions, PriceSource} from "../binance.service";
+import {AdoptTradeOptions, BinanceService, LimitSellType, OpenTradeOptions, PriceSource} from "../binance.service";
 import {switchMap, tap} from "rxjs/operators";
 import {Subscription} from "rxjs/Subscription";
 import * as Mousetrap from "mousetrap";
 import * as $ from "jquery";
 import {round8, roundx} from "../utils";
 import {ConfigService} from "../config.service";
-import {MakerService, TradeMap} from "../maker.service";
+import {EntryCondition, MakerService, TradeMap} from "../maker.service";
 import {Logger, LoggerService} from "../logger.service";
 import {FormBuilder, FormGroup} from "@angular/forms";
 import {ToastrService} from "../toastr.service";
@@ -44,6 +44,8 @@ interface OrderFormSettingsModel {
     balancePercent: number;
     stopLossEnabled: boolean;
     stopLossPercent: number;
+    stopLossTrailing: boolean;
+    stopLossOnExchange: boolean;
     trailingProfitEnabled: boolean;
     trailingProfitPercent: number;
     trailingProfitDeviation: number;
@@ -84,6 +86,8 @@ export class TradeComponent implements OnInit, OnDestroy, AfterViewInit {
         balancePercent: null,
         stopLossEnabled: false,
         stopLossPercent: 1,
+        stopLossTrailing: false,
+        stopLossOnExchange: false,
         trailingProfitEnabled: false,
         trailingProfitPercent: 1,
         trailingProfitDeviation: 0.25,
@@ -102,6 +106,23 @@ export class TradeComponent implements OnInit, OnDestroy, AfterViewInit {
 
         offsetType: string;
         offsetTicks: number;
+
+        entryCondition: string;
+        entryPrice: string;
+        entryHours: number;
+        trailingBuyEnabled: boolean;
+        trailingBuyDeviation: number;
+        buyChaseEnabled: boolean;
+        buyChaseInterval: number;
+        buyChaseTicks: number;
+        buyChaseMaxPrice: string;
+        buyTimeout: number;
+        sellChaseEnabled: boolean;
+        sellChaseInterval: number;
+        sellChaseTicks: number;
+        sellChaseMinProfit: number;
+
+        adoptOrderId: string;
     } = {
         amount: null,
         quoteAmount: null,
@@ -111,6 +132,23 @@ export class TradeComponent implements OnInit, OnDestroy, AfterViewInit {
 
         offsetType: this.OFFSET_TYPE_NONE,
         offsetTicks: 0,
+
+        entryCondition: "",
+        entryPrice: null,
+        entryHours: null,
+        trailingBuyEnabled: false,
+        trailingBuyDeviation: 1,
+        buyChaseEnabled: false,
+        buyChaseInterval: 10,
+        buyChaseTicks: 1,
+        buyChaseMaxPrice: null,
+        buyTimeout: null,
+        sellChaseEnabled: false,
+        sellChaseInterval: 10,
+        sellChaseTicks: 1,
+        sellChaseMinProfit: 0,
+
+        adoptOrderId: null,
     };
 
     balances: { [key: string]: Balance } = {};
@@ -417,14 +455,9 @@ export class TradeComponent implements OnInit, OnDestroy, AfterViewInit {
     makeOrder() {
         const options: OpenTradeOptions = {
             symbol: this.orderFormSettings.symbol,
-            quantity: this.orderForm.amount,
+            balancePercent: +this.orderFormSettings.balancePercent,
             priceSource: this.orderFormSettings.priceSource,
             priceAdjustment: this.orderForm.buyLimitPercent,
-            stopLossEnabled: this.orderFormSettings.stopLossEnabled,
-            stopLossPercent: this.orderFormSettings.stopLossPercent,
-            trailingProfitEnabled: this.orderFormSettings.trailingProfitEnabled,
-            trailingProfitPercent: this.orderFormSettings.trailingProfitPercent,
-            trailingProfitDeviation: this.orderFormSettings.trailingProfitDeviation,
             price: +this.orderForm.manualPrice,
 
             offsetTicks: 0,
@@ -438,6 +471,76 @@ export class TradeComponent implements OnInit, OnDestroy, AfterViewInit {
             }
         }
 
+        if (this.orderForm.entryCondition) {
+            options.entryCondition = <EntryCondition>this.orderForm.entryCondition;
+            options.entryPrice = +this.orderForm.entryPrice;
+        }
+        if (this.orderForm.trailingBuyEnabled) {
+            options.trailingBuyEnabled = true;
+            options.trailingBuyDeviation = +this.orderForm.trailingBuyDeviation;
+        }
+        if (this.orderForm.buyChaseEnabled) {
+            options.buyChaseEnabled = true;
+            options.buyChaseInterval = +this.orderForm.buyChaseInterval;
+            options.buyChaseTicks = +this.orderForm.buyChaseTicks;
+            options.buyChaseMaxPrice = +this.orderForm.buyChaseMaxPrice;
+        }
+        if (this.orderForm.buyTimeout) {
+            options.buyTimeout = +this.orderForm.buyTimeout;
+        }
+        if (this.orderForm.sellChaseEnabled) {
+            options.sellChaseEnabled = true;
+            options.sellChaseInterval = +this.orderForm.sellChaseInterval;
+            options.sellChaseTicks = +this.orderForm.sellChaseTicks;
+            options.sellChaseMinProfit = +this.orderForm.sellChaseMinProfit;
+        }
+        if ((options.entryCondition || options.trailingBuyEnabled) && this.orderForm.entryHours) {
+            options.entryHours = +this.orderForm.entryHours;
+        }
+
+        this.setExitOptions(options);
+
+        this.binance.postBuyOrder(options).subscribe(() => {
+        }, (error) => {
+            console.log("Failed to post order:");
+            console.log(error);
+            this.showError("Failed to Post Order", error);
+        });
+    }
+
+    /**
+     * Adopt the order with the entered order ID, or if none the balance of
+     * the base asset, placed outside of Maker as a trade with the exit
+     * settings of the order form.
+     */
+    adopt() {
+        const options: AdoptTradeOptions = {
+            symbol: this.orderFormSettings.symbol,
+        };
+        if (this.orderForm.adoptOrderId) {
+            options.orderId = +this.orderForm.adoptOrderId;
+        }
+
+        this.setExitOptions(options);
+
+        this.binance.adoptTrade(options).subscribe(() => {
+            this.orderForm.adoptOrderId = null;
+        }, (error) => {
+            console.log("Failed to adopt trade:");
+            console.log(error);
+            this.showError("Failed to Adopt Trade", error);
+        });
+    }
+
+    private setExitOptions(options: OpenTradeOptions | AdoptTradeOptions) {
+        options.stopLossEnabled = this.orderFormSettings.stopLossEnabled;
+        options.stopLossPercent = this.orderFormSettings.stopLossPercent;
+        options.stopLossTrailing = this.orderFormSettings.stopLossTrailing;
+        options.stopLossOnExchange = this.orderFormSettings.stopLossOnExchange;
+        options.trailingProfitEnabled = this.orderFormSettings.trailingProfitEnabled;
+        options.trailingProfitPercent = this.orderFormSettings.trailingProfitPercent;
+        options.trailingProfitDeviation = this.orderFormSettings.trailingProfitDeviation;
+
         if (this.orderFormSettings.limitSellEnabled) {
             options.limitSellEnabled = true;
             options.limitSellType = LimitSellType.PERCENT;
@@ -447,30 +550,29 @@ export class TradeComponent implements OnInit, OnDestroy, AfterViewInit {
             options.limitSellType = LimitSellType.PRICE;
             options.limitSellPrice = +this.orderForm.limitSellPrice;
         }
+    }
 
-        this.binance.postBuyOrder(options).subscribe(() => {
-        }, (error) => {
-            console.log("Failed to post order:");
-            console.log(error);
-            const title = "Failed to Post Order";
-            const options = {
-                closeButton: true,
-            };
-            if (error.error) {
-                console.log(`Failed to post order: ${JSON.stringify(error.error)}`);
-                const inner = error.error;
-                if (inner.code && inner.msg) {
-                    this.toastr.error(`[${inner.code}]: ${inner.msg}`, title, options)
-                } else {
-                    this.toastr.error(JSON.stringify(inner), title, options);
-                }
-                return;
-            } else if (error.message) {
-                this.toastr.error(`${error.message}`, title, options);
+    private showError(title: string, error: any) {
+        const options = {
+            closeButton: true,
+        };
+        if (error.error) {
+            console.log(`${title}: ${JSON.stringify(error.error)}`);
+            const inner = error.error;
+            if (inner.code && inner.msg) {
+                this.toastr.error(`[${inner.code}]: ${inner.msg}`, title, options)
+            } else if (inner.field && inner.message) {
+                // An order that failed the symbol filters.
+                this.toastr.error(inner.message, title, options);
             } else {
-                this.toastr.error("Unknown error. Check server log and browser console.", title, options);
+                this.toastr.error(JSON.stringify(inner), title, options);
             }
-        });
+            return;
+        } else if (error.message) {
+            this.toastr.error(`${error.message}`, title, options);
+        } else {
+            this.toastr.error("Unknown error. Check server log and browser console.", title, options);
+        }
     }
 
     toggleLimitSellType(type: string) {